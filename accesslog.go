@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// streamRecord is one access log entry, written when a proxied stream ends
+type streamRecord struct {
+	User      string    `json:"user"`
+	Remote    string    `json:"remote"`
+	StreamID  uint32    `json:"stream_id"`
+	Dest      string    `json:"dest"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	BytesUp   int64     `json:"bytes_up"`   // Client -> destination
+	BytesDown int64     `json:"bytes_down"` // Destination -> client
+	Reason    string    `json:"close_reason"`
+}
+
+var accessLog *RotatingFile
+
+// initAccessLog opens the stream access log, if configured.
+func initAccessLog() {
+	cfg := currentConfig()
+	if cfg.AccessLog == "" {
+		return
+	}
+	f, err := OpenRotatingFile(cfg.AccessLog, cfg.AccessLogMaxSize, cfg.AccessLogMaxBackups,
+		cfg.AccessLogRotateHours, cfg.AccessLogMaxAge)
+	if err != nil {
+		log.Fatalf("Could not open access log %s: %v", cfg.AccessLog, err)
+	}
+	accessLog = f
+}
+
+// logStream writes a JSON line describing a finished stream to the access log.
+func logStream(rec streamRecord) {
+	if accessLog == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	accessLog.Write(append(line, '\n'))
+}
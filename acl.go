@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minewire-server/internal/core"
+)
+
+// aclRule is a parsed listener_allow or listener_deny entry
+type aclRule struct {
+	Rule   string `json:"rule"`
+	Hits   uint64 `json:"hits"` // Updated atomically
+	prefix netip.Prefix
+}
+
+// listenerACL holds the compiled allow and deny lists of one game server
+type listenerACL struct {
+	Allow []*aclRule `json:"allow"`
+	Deny  []*aclRule `json:"deny"`
+
+	NotAllowed uint64 `json:"not_allowed"` // Connections matching no allow rule, updated atomically
+}
+
+// Listener access control state
+var (
+	listenerACLs = make(map[string]*listenerACL) // By game server name
+	aclLock      sync.RWMutex
+
+	// Networks banned by the ban engine after too many of their addresses were banned
+	bannedNetworks = make(map[netip.Prefix]time.Time)
+	networkBans    = make(map[netip.Prefix]map[netip.Addr]time.Time) // Banned addresses per network, until
+	networkLock    sync.Mutex
+)
+
+// parsePrefix parses a CIDR block or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	return core.ParseNetwork(s)
+}
+
+// compileRules parses a list of rules, skipping invalid ones (reported by config validate).
+func compileRules(list []string) []*aclRule {
+	var rules []*aclRule
+	for _, s := range list {
+		p, err := parsePrefix(s)
+		if err != nil {
+			log.Printf("Ignoring invalid listener rule %q: %v", s, err)
+			continue
+		}
+		rules = append(rules, &aclRule{Rule: s, prefix: p})
+	}
+	return rules
+}
+
+// matchRule returns the first rule containing addr, counting the hit.
+func matchRule(rules []*aclRule, addr netip.Addr) *aclRule {
+	for _, r := range rules {
+		if r.prefix.Contains(addr) {
+			atomic.AddUint64(&r.Hits, 1)
+			return r
+		}
+	}
+	return nil
+}
+
+// initListenerACL compiles the allow and deny lists of every game server.
+func initListenerACL() {
+	acls := make(map[string]*listenerACL)
+	for _, srv := range allServers() {
+		acls[srv.Name] = &listenerACL{Allow: compileRules(srv.ListenerAllow), Deny: compileRules(srv.ListenerDeny)}
+	}
+	aclLock.Lock()
+	listenerACLs = acls
+	aclLock.Unlock()
+}
+
+// admitConnection decides right after Accept whether a source may talk to the named game server:
+// the deny list, then bans (addresses and networks), then the allow list if one is configured.
+func admitConnection(server, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	aclLock.RLock()
+	acl := listenerACLs[server]
+	aclLock.RUnlock()
+
+	if acl != nil && matchRule(acl.Deny, addr) != nil {
+		return false
+	}
+	if isBanned(ip) || isNetworkBanned(addr) {
+		return false
+	}
+	if acl != nil && len(acl.Allow) > 0 && matchRule(acl.Allow, addr) == nil {
+		atomic.AddUint64(&acl.NotAllowed, 1)
+		return false
+	}
+	return true
+}
+
+// networkOf returns the network a ban is grouped by: /24 for IPv4, /64 for IPv6.
+func networkOf(addr netip.Addr) netip.Prefix {
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// recordNetworkBan notes a ban by the ban engine and bans the whole network once
+// ban_network_threshold of its addresses are banned at the same time.
+func recordNetworkBan(ip string, until time.Time) {
+	cfg := currentConfig()
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || cfg.BanNetworkThreshold <= 0 {
+		return
+	}
+	addr = addr.Unmap()
+	network := networkOf(addr)
+	now := time.Now()
+
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	bans := networkBans[network]
+	if bans == nil {
+		bans = make(map[netip.Addr]time.Time)
+		networkBans[network] = bans
+	}
+	bans[addr] = until
+	for a, t := range bans {
+		if now.After(t) {
+			delete(bans, a)
+		}
+	}
+	if len(bans) < cfg.BanNetworkThreshold || now.Before(bannedNetworks[network]) {
+		return
+	}
+	bannedNetworks[network] = until
+	queueFirewallBan(network.String(), until)
+	log.Printf("Banned network %s for %d minutes (%d banned addresses)", network, cfg.BanDuration, len(bans))
+	recordEvent(EventBan, network.String(), "", fmt.Sprintf("network with %d banned addresses", len(bans)))
+}
+
+// isNetworkBanned reports whether the address is in a network banned by the ban engine.
+func isNetworkBanned(addr netip.Addr) bool {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	return time.Now().Before(bannedNetworks[networkOf(addr)])
+}
+
+// pruneNetworkBans drops expired network bans and address records.
+func pruneNetworkBans(now time.Time) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	for network, until := range bannedNetworks {
+		if now.After(until) {
+			delete(bannedNetworks, network)
+		}
+	}
+	for network, bans := range networkBans {
+		for a, t := range bans {
+			if now.After(t) {
+				delete(bans, a)
+			}
+		}
+		if len(bans) == 0 {
+			delete(networkBans, network)
+		}
+	}
+}
+
+// aclResponse is the document served by /api/acl
+type aclResponse struct {
+	Servers        map[string]*listenerACL `json:"servers"`
+	BannedNetworks []bannedNetwork         `json:"banned_networks"`
+}
+
+type bannedNetwork struct {
+	Network string    `json:"network"`
+	Until   time.Time `json:"until"`
+}
+
+// handleAdminACL returns the listener rules with their hit counts and the banned networks.
+func handleAdminACL(w http.ResponseWriter, r *http.Request) {
+	resp := aclResponse{Servers: make(map[string]*listenerACL), BannedNetworks: []bannedNetwork{}}
+	snapshot := func(rules []*aclRule) []*aclRule {
+		list := []*aclRule{}
+		for _, r := range rules {
+			list = append(list, &aclRule{Rule: r.Rule, Hits: atomic.LoadUint64(&r.Hits)})
+		}
+		return list
+	}
+	aclLock.RLock()
+	for name, acl := range listenerACLs {
+		resp.Servers[name] = &listenerACL{Allow: snapshot(acl.Allow), Deny: snapshot(acl.Deny), NotAllowed: atomic.LoadUint64(&acl.NotAllowed)}
+	}
+	aclLock.RUnlock()
+
+	now := time.Now()
+	networkLock.Lock()
+	for network, until := range bannedNetworks {
+		if now.Before(until) {
+			resp.BannedNetworks = append(resp.BannedNetworks, bannedNetwork{network.String(), until})
+		}
+	}
+	networkLock.Unlock()
+	sort.Slice(resp.BannedNetworks, func(i, j int) bool { return resp.BannedNetworks[i].Network < resp.BannedNetworks[j].Network })
+	writeJSON(w, resp)
+}
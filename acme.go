@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACME challenge types
+const (
+	ACMEChallengeHTTP = "http-01" // Token served on acme_http_port
+	ACMEChallengeDNS  = "dns-01"  // TXT record published by acme_dns_hook
+)
+
+// Certificates are renewed this long before they expire
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+var (
+	acmeCert       atomic.Pointer[tls.Certificate]
+	acmeHTTPTokens sync.Map // HTTP-01 token -> key authorization
+	acmeListener   net.Listener
+)
+
+// acmeEnabled reports whether the subscription server is served over HTTPS with ACME certificates.
+func acmeEnabled() bool {
+	cfg := currentConfig()
+	return len(cfg.ACMEDomains) > 0
+}
+
+// initACME loads the cached certificate and keeps it renewed in the background. Until the first
+// certificate is obtained, TLS handshakes on the subscription port fail.
+func initACME() {
+	cfg := currentConfig()
+	if !acmeEnabled() {
+		return
+	}
+	if err := os.MkdirAll(cfg.ACMECacheDir, 0700); err != nil {
+		log.Printf("ACME: %v", err)
+	}
+	if cert, err := loadACMECert(); err == nil {
+		acmeCert.Store(cert)
+		log.Printf("ACME: using cached certificate for %s, valid until %s",
+			strings.Join(cfg.ACMEDomains, ", "), cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	if cfg.ACMEChallenge == ACMEChallengeHTTP {
+		go startACMEChallengeServer()
+	}
+	go startACMERenewal()
+}
+
+// acmeTLSConfig returns the TLS settings of the subscription server.
+func acmeTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := acmeCert.Load(); cert != nil {
+				return cert, nil
+			}
+			return nil, errors.New("no certificate obtained yet")
+		},
+	}
+}
+
+// startACMEChallengeServer answers HTTP-01 challenges on acme_http_port.
+func startACMEChallengeServer() {
+	cfg := currentConfig()
+	ln, err := listenTCP("acme", ":"+cfg.ACMEHTTPPort)
+	if err != nil {
+		log.Printf("ACME challenge server error: %v", err)
+		return
+	}
+	listenersLock.Lock()
+	acmeListener = ln
+	listenersLock.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/acme-challenge/{token}", func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := acmeHTTPTokens.Load(r.PathValue("token"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(auth.(string)))
+	})
+	err = http.Serve(ln, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("ACME challenge server error: %v", err)
+	}
+}
+
+// startACMERenewal obtains a certificate when there is none or it is about to expire,
+// checking twice a day and retrying failures every hour.
+func startACMERenewal() {
+	for {
+		cfg := currentConfig()
+		wait := 12 * time.Hour
+		if cert := acmeCert.Load(); cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			cert, err := obtainACMECert(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("ACME: could not obtain a certificate for %s: %v", strings.Join(cfg.ACMEDomains, ", "), err)
+				wait = time.Hour
+			} else {
+				acmeCert.Store(cert)
+				log.Printf("ACME: obtained certificate for %s, valid until %s",
+					strings.Join(cfg.ACMEDomains, ", "), cert.Leaf.NotAfter.Format(time.DateOnly))
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// obtainACMECert orders a certificate for acme_domains, solves the challenges and stores the
+// certificate with its key in the cache.
+func obtainACMECert(ctx context.Context) (*tls.Certificate, error) {
+	cfg := currentConfig()
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(cfg.ACMEDomains...))
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue // Authorized recently, e.g. by a previous renewal
+		}
+		if err := solveACMEChallenge(ctx, client, z); err != nil {
+			return nil, fmt.Errorf("%s: %w", z.Identifier.Value, err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: cfg.ACMEDomains}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := os.WriteFile(acmeCertPath(), data, 0600); err != nil {
+		log.Printf("ACME: could not cache the certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	return &cert, err
+}
+
+// solveACMEChallenge completes the acme_challenge of one authorization and waits until the CA
+// has validated it.
+func solveACMEChallenge(ctx context.Context, client *acme.Client, z *acme.Authorization) error {
+	cfg := currentConfig()
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == cfg.ACMEChallenge {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("the CA offers no %s challenge", cfg.ACMEChallenge)
+	}
+
+	switch chal.Type {
+	case ACMEChallengeHTTP:
+		auth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		acmeHTTPTokens.Store(chal.Token, auth)
+		defer acmeHTTPTokens.Delete(chal.Token)
+	case ACMEChallengeDNS:
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.")
+		if err := runACMEDNSHook(ctx, "present", name, value); err != nil {
+			return err
+		}
+		defer runACMEDNSHook(context.Background(), "cleanup", name, value)
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err := client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// runACMEDNSHook runs acme_dns_hook with the action (present or cleanup), the record name and
+// its TXT value. The hook should return once the record is published.
+func runACMEDNSHook(ctx context.Context, action, name, value string) error {
+	cfg := currentConfig()
+	out, err := exec.CommandContext(ctx, cfg.ACMEDNSHook, action, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("acme_dns_hook %s %s: %v: %s", action, name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// acmeClient returns a client registered with acme_directory, creating the account key on first use.
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	cfg := currentConfig()
+	key, err := acmeAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: cfg.ACMEDirectory, UserAgent: "minewire-server"}
+	var contact []string
+	if cfg.ACMEEmail != "" {
+		contact = []string{"mailto:" + cfg.ACMEEmail}
+	}
+	_, err = client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	return client, nil
+}
+
+// acmeAccountKey loads the account key from the cache, or generates and stores a new one.
+func acmeAccountKey() (crypto.Signer, error) {
+	cfg := currentConfig()
+	path := filepath.Join(cfg.ACMECacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// acmeCertPath returns the cache file of the certificate, named by its first domain.
+func acmeCertPath() string {
+	cfg := currentConfig()
+	return filepath.Join(cfg.ACMECacheDir, strings.ReplaceAll(cfg.ACMEDomains[0], "*", "_")+".pem")
+}
+
+// loadACMECert loads the cached certificate if it covers exactly acme_domains.
+func loadACMECert() (*tls.Certificate, error) {
+	cfg := currentConfig()
+	data, err := os.ReadFile(acmeCertPath())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	names := slices.Clone(cert.Leaf.DNSNames)
+	want := slices.Clone(cfg.ACMEDomains)
+	slices.Sort(names)
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		return nil, errors.New("cached certificate is for other domains")
+	}
+	return &cert, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+// sessionInfo is the admin API representation of a live session
+type sessionInfo struct {
+	ID        uint64    `json:"id"`
+	Username  string    `json:"username"`
+	Nickname  string    `json:"nickname,omitempty"`
+	Server    string    `json:"server"`
+	Remote    string    `json:"remote"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Streams   int64     `json:"streams"`
+	RTTMillis float64   `json:"rtt_ms,omitempty"` // Keep Alive round trip, if the client answers them
+
+	Goroutines int64 `json:"goroutines"`
+	Conns      int64 `json:"conns"`
+}
+
+// streamInfo is the admin API representation of a live stream
+type streamInfo struct {
+	ID        uint32    `json:"id"`
+	Dest      string    `json:"dest"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// userInfo is the admin API representation of a configured user
+type userInfo struct {
+	Username string `json:"username"`
+	ID       string `json:"id,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	Server   string `json:"server"`
+	Disabled bool   `json:"disabled"`
+	Sessions int    `json:"sessions"`
+}
+
+// startAdminServer serves the admin API and the embedded dashboard.
+func startAdminServer() {
+	cfg := currentConfig()
+	if cfg.AdminToken == "" {
+		log.Printf("Admin Server disabled: admin_token is not set")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	mux.HandleFunc("GET /api/sessions", handleAdminSessions)
+	mux.HandleFunc("GET /api/sessions/{id}/streams", handleAdminStreams)
+	mux.HandleFunc("POST /api/sessions/{id}/kick", handleAdminKick)
+	mux.HandleFunc("GET /api/users", handleAdminUsers)
+	mux.HandleFunc("POST /api/users", handleAdminCreateUser)
+	mux.HandleFunc("POST /api/users/{username}/disable", handleAdminSetDisabled(true))
+	mux.HandleFunc("POST /api/users/{username}/enable", handleAdminSetDisabled(false))
+	mux.HandleFunc("PUT /api/users/{username}/name", handleAdminRenameUser)
+	mux.HandleFunc("POST /api/users/{username}/rotate", handleAdminRotateUser)
+	mux.HandleFunc("GET /api/logins", handleAdminLogins)
+	mux.HandleFunc("GET /api/stats", handleAdminStats)
+	mux.HandleFunc("GET /api/dials", handleAdminDials)
+	mux.HandleFunc("GET /api/upstreams", handleAdminUpstreams)
+	mux.HandleFunc("GET /api/destinations", handleAdminDestinations)
+	mux.HandleFunc("GET /api/events", handleAdminEvents)
+	mux.HandleFunc("GET /api/acl", handleAdminACL)
+	mux.HandleFunc("GET /api/bans", handleAdminBans)
+	mux.HandleFunc("POST /api/subs/{name}/token", handleAdminSubsToken)
+	mux.HandleFunc("POST /api/subs/{name}/once", handleAdminSubsOnce)
+	mux.HandleFunc("GET /api/events.csv", handleAdminEventsCSV)
+	mux.HandleFunc("GET /api/config", handleAdminGetConfig)
+	mux.HandleFunc("PUT /api/config", handleAdminPutConfig)
+	mux.HandleFunc("POST /api/config/reload", handleAdminReloadConfig)
+
+	ln, err := listenTCP("admin", cfg.AdminListen)
+	if err != nil {
+		log.Printf("Admin Server Error: %v", err)
+		return
+	}
+	listenersLock.Lock()
+	adminListener = ln
+	listenersLock.Unlock()
+	log.Printf("Starting Admin Server on %s", ln.Addr())
+	err = http.Serve(ln, adminAuth(mux))
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Admin Server Error: %v", err)
+	}
+}
+
+// adminAuth accepts the admin token as a bearer token (scripts) or basic auth password (browsers).
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, pass, ok := r.BasicAuth(); ok {
+			token = pass
+		}
+		// The token of the current config, so a reload changes it. An emptied token locks the API.
+		want := currentConfig().AdminToken
+		if want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Minewire"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// usernameNicknames maps generated usernames to their configured nicknames
+func usernameNicknames() map[string]string {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	nicks := make(map[string]string)
+	for nick, u := range nicknameMap {
+		nicks[u.Username()] = nick
+	}
+	return nicks
+}
+
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	nicks := usernameNicknames()
+	list := []sessionInfo{}
+	for _, s := range sessions.Live() {
+		list = append(list, sessionInfo{
+			ID:        s.ID,
+			Username:  s.Username,
+			Nickname:  nicks[s.Username],
+			Server:    s.Server,
+			Remote:    s.Remote,
+			Start:     s.Start,
+			BytesUp:   s.BytesUp.Load(),
+			BytesDown: s.BytesDown.Load(),
+			Streams:   s.Streams.Load(),
+			RTTMillis: rttMillis(s.RTT.Load()),
+
+			Goroutines: s.Goroutines.Load(),
+			Conns:      s.Conns.Load(),
+		})
+	}
+	writeJSON(w, list)
+}
+
+// handleAdminStreams lists the live streams of a session.
+func handleAdminStreams(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+	s, ok := sessions.Find(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	list := []streamInfo{}
+	for _, st := range sessions.Streams(s) {
+		list = append(list, streamInfo{
+			ID:        st.ID,
+			Dest:      st.Dest,
+			Start:     st.Start,
+			BytesUp:   st.BytesUp.Load(),
+			BytesDown: st.BytesDown.Load(),
+		})
+	}
+	writeJSON(w, list)
+}
+
+func handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+	s, ok := sessions.Find(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	s.Kick()
+	log.Printf("Admin kicked session %d (%s)", s.ID, logUser(s.Username))
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	nicks := usernameNicknames()
+	counts := make(map[string]int)
+	for _, s := range sessions.Live() {
+		counts[s.Username]++
+	}
+	authLock.RLock()
+	names := make([]string, 0, len(validUsers))
+	for user := range validUsers {
+		names = append(names, user)
+	}
+	ids := make(map[string]string)
+	for _, u := range subsUsers {
+		ids[u.Username()] = u.ID
+	}
+	authLock.RUnlock()
+
+	list := []userInfo{}
+	for _, user := range names {
+		list = append(list, userInfo{
+			Username: user,
+			ID:       ids[user],
+			Nickname: nicks[user],
+			Server:   userServer(user),
+			Disabled: isUserDisabled(user),
+			Sessions: counts[user],
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	writeJSON(w, list)
+}
+
+func handleAdminSetDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if _, _, ok := lookupUser(username); !ok {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		setUserDisabled(username, disabled)
+		log.Printf("Admin set user %s disabled=%v", logUser(username), disabled)
+		writeJSON(w, map[string]bool{"ok": true})
+	}
+}
+
+// handleAdminRenameUser sets the nickname of a user from {"name": "..."}. With ?save=1 the
+// config file is updated too, otherwise the next reload from disk restores the old nickname.
+func handleAdminRenameUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username := r.PathValue("username")
+	if err := renameUser(username, req.Name); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin renamed user %s to %q", logUser(username), req.Name)
+	resp := map[string]interface{}{"ok": true}
+	if r.URL.Query().Get("save") == "1" {
+		err := saveUserEntry(username, func(entry *yaml.Node) { setEntryField(entry, "name", req.Name) })
+		if err != nil {
+			resp["warning"] = "applied but not saved: " + err.Error()
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func handleAdminLogins(w http.ResponseWriter, r *http.Request) {
+	loginsLock.Lock()
+	list := append([]loginEvent{}, recentLogins...)
+	loginsLock.Unlock()
+	// Newest first
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Anomaly kinds recorded against a source address, with their score weights
+const (
+	AnomalyMalformedHandshake = "malformed_handshake"
+	AnomalyRapidStatus        = "rapid_status"
+	AnomalyEmptyConnection    = "empty_connection"
+	AnomalyBadLogin           = "bad_login"
+)
+
+var anomalyWeights = map[string]float64{
+	AnomalyMalformedHandshake: 3,
+	AnomalyRapidStatus:        1,
+	AnomalyEmptyConnection:    1,
+	AnomalyBadLogin:           2,
+}
+
+const (
+	// Scores halve every 10 minutes, so occasional oddities from real players fade away
+	scoreHalfLife = 10 * time.Minute
+
+	// Status queries closer together than this count as rapid
+	rapidStatusWindow = 2 * time.Second
+
+	// Maximum delay applied to responses for tarpitted sources
+	maxTarpitDelay = 5 * time.Second
+)
+
+// sourceScore tracks the suspicion score of a single source IP
+type sourceScore struct {
+	score       float64
+	updated     time.Time
+	lastStatus  time.Time
+	bannedUntil time.Time
+}
+
+// Scanner detection state
+var (
+	scores    = make(map[string]*sourceScore)
+	scoreLock sync.Mutex
+
+	// Counters surfaced in logs and statistics
+	anomalyCounts = make(map[string]uint64)
+	banCount      uint64
+)
+
+// remoteIP returns the IP of the connection's remote address as a string
+func remoteIP(conn net.Conn) string {
+	return addrHost(conn.RemoteAddr())
+}
+
+// getScore returns the decayed score entry for an IP. Must be called with scoreLock held.
+func getScore(ip string, now time.Time) *sourceScore {
+	s, ok := scores[ip]
+	if !ok {
+		s = &sourceScore{updated: now}
+		scores[ip] = s
+		return s
+	}
+	elapsed := now.Sub(s.updated)
+	s.score *= math.Pow(0.5, float64(elapsed)/float64(scoreHalfLife))
+	s.updated = now
+	return s
+}
+
+// recordAnomaly adds the weight of an anomaly to the source's score, banning it when the
+// configured threshold is crossed.
+func recordAnomaly(ip, kind string) {
+	cfg := currentConfig()
+	if kind != AnomalyBadLogin { // Its rejected_login event has a line already
+		logSecurityLine(kind, ip, "")
+	}
+	if !cfg.AnomalyScoring {
+		return
+	}
+	now := time.Now()
+
+	scoreLock.Lock()
+	defer scoreLock.Unlock()
+
+	anomalyCounts[kind]++
+	s := getScore(ip, now)
+	s.score += anomalyWeights[kind]
+	log.Printf("Anomaly from %s: %s (score %.1f)", ip, kind, s.score)
+
+	if s.score >= cfg.BanScore && now.After(s.bannedUntil) {
+		s.bannedUntil = now.Add(time.Duration(cfg.BanDuration) * time.Minute)
+		banCount++
+		log.Printf("Banned %s for %d minutes (score %.1f)", ip, cfg.BanDuration, s.score)
+		recordNetworkBan(ip, s.bannedUntil)
+		queueFirewallBan(ip, s.bannedUntil)
+		recordEvent(EventBan, ip, "", fmt.Sprintf("score %.1f after %s, %d minutes", s.score, kind, cfg.BanDuration))
+	}
+}
+
+// recordStatusQuery notes a status request and flags sources querying too rapidly.
+func recordStatusQuery(ip string) {
+	cfg := currentConfig()
+	if !cfg.AnomalyScoring {
+		return
+	}
+	now := time.Now()
+	scoreLock.Lock()
+	s := getScore(ip, now)
+	rapid := !s.lastStatus.IsZero() && now.Sub(s.lastStatus) < rapidStatusWindow
+	s.lastStatus = now
+	scoreLock.Unlock()
+
+	if rapid {
+		recordAnomaly(ip, AnomalyRapidStatus)
+	}
+}
+
+// isBanned reports whether the source is currently banned.
+func isBanned(ip string) bool {
+	scoreLock.Lock()
+	defer scoreLock.Unlock()
+	s, ok := scores[ip]
+	return ok && time.Now().Before(s.bannedUntil)
+}
+
+// tarpit slows down responses to suspicious sources. The delay grows with the score
+// above the tarpit threshold, up to maxTarpitDelay.
+func tarpit(ip string) {
+	cfg := currentConfig()
+	if !cfg.AnomalyScoring {
+		return
+	}
+	scoreLock.Lock()
+	score := getScore(ip, time.Now()).score
+	scoreLock.Unlock()
+
+	if score < cfg.TarpitScore {
+		return
+	}
+	delay := time.Duration((score - cfg.TarpitScore + 1) * float64(time.Second))
+	if delay > maxTarpitDelay {
+		delay = maxTarpitDelay
+	}
+	recordEvent(EventTarpit, ip, "", fmt.Sprintf("score %.1f, delayed %s", score, delay))
+	time.Sleep(delay)
+}
+
+// startScoreJanitor periodically drops entries that decayed to nothing and expired bans.
+func startScoreJanitor() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		now := time.Now()
+		scoreLock.Lock()
+		for ip, s := range scores {
+			if now.After(s.bannedUntil) && getScore(ip, now).score < 0.1 && now.Sub(s.lastStatus) > rapidStatusWindow {
+				delete(scores, ip)
+			}
+		}
+		scoreLock.Unlock()
+		pruneNetworkBans(now)
+	}
+}
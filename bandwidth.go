@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/heap"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest write scheduled at once: a busy stream waits its turn again after this many bytes
+	bandwidthChunk = 16 << 10
+	// Sending that can be caught up at once after an idle moment
+	bandwidthBurst = 20 * time.Millisecond
+)
+
+// bandwidthRequest is a write waiting for its share of bandwidth_limit
+type bandwidthRequest struct {
+	start float64 // Virtual time the write may start at
+	seq   uint64  // Order of arrival, between equal start tags
+	bytes int
+	ready chan struct{}
+}
+
+// bandwidthFlow is the traffic of a user: its sessions and streams share its weight
+type bandwidthFlow struct {
+	finish float64 // Virtual time the user's last queued write ends at
+}
+
+// bandwidthQueue orders requests by start tag
+type bandwidthQueue []*bandwidthRequest
+
+func (q bandwidthQueue) Len() int { return len(q) }
+func (q bandwidthQueue) Less(i, j int) bool {
+	if q[i].start != q[j].start {
+		return q[i].start < q[j].start
+	}
+	return q[i].seq < q[j].seq
+}
+func (q bandwidthQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *bandwidthQueue) Push(x any)   { *q = append(*q, x.(*bandwidthRequest)) }
+func (q *bandwidthQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+// bandwidthScheduler paces the traffic of all sessions to bandwidth_limit with start-time
+// fair queuing: under contention every user gets a share proportional to its bandwidth_weight,
+// however many streams it has.
+type bandwidthScheduler struct {
+	mu      sync.Mutex
+	queue   bandwidthQueue
+	flows   map[string]*bandwidthFlow // By username
+	virtual float64                   // Start tag of the last write let through
+	seq     uint64
+	wake    chan struct{}
+	started sync.Once
+}
+
+var bandwidth = &bandwidthScheduler{flows: make(map[string]*bandwidthFlow), wake: make(chan struct{}, 1)}
+
+// bandwidthRate returns bandwidth_limit in bytes per second, 0 if unlimited.
+func bandwidthRate() float64 {
+	cfg := currentConfig()
+	return float64(cfg.BandwidthLimit) * 1e6 / 8
+}
+
+// userBandwidthWeight returns the share of a user under contention: its bandwidth_weight limit, or 1.
+func userBandwidthWeight(username string) int {
+	if _, limits, ok := lookupUser(username); ok && limits.BandwidthWeight > 0 {
+		return limits.BandwidthWeight
+	}
+	return 1
+}
+
+// wait blocks until the user may send n bytes. Without bandwidth_limit it returns at once.
+func (s *bandwidthScheduler) wait(username string, weight, n int) {
+	cfg := currentConfig()
+	if cfg.BandwidthLimit <= 0 {
+		return
+	}
+	s.started.Do(func() { go s.run() })
+	r := &bandwidthRequest{bytes: n, ready: make(chan struct{})}
+	s.mu.Lock()
+	flow := s.flows[username]
+	if flow == nil {
+		flow = &bandwidthFlow{}
+		s.flows[username] = flow
+	}
+	r.start = max(s.virtual, flow.finish)
+	flow.finish = r.start + float64(n)/float64(weight)
+	s.seq++
+	r.seq = s.seq
+	heap.Push(&s.queue, r)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	<-r.ready
+}
+
+// run lets the queued writes through one at a time, lowest start tag first, as fast as
+// bandwidth_limit allows.
+func (s *bandwidthScheduler) run() {
+	next := time.Now() // When the rate allows the next write
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			// Nobody is waiting: the users' finish tags no longer matter
+			clear(s.flows)
+			s.virtual = 0
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		s.mu.Unlock()
+
+		rate := bandwidthRate()
+		now := time.Now()
+		if rate > 0 && next.After(now) {
+			// Sleep first and pick after, so writes queued meanwhile compete for the turn
+			time.Sleep(next.Sub(now))
+			continue
+		}
+
+		s.mu.Lock()
+		r := heap.Pop(&s.queue).(*bandwidthRequest)
+		s.virtual = r.start
+		s.mu.Unlock()
+		if rate > 0 {
+			if floor := now.Add(-bandwidthBurst); next.Before(floor) {
+				next = floor
+			}
+			next = next.Add(time.Duration(float64(r.bytes) / rate * float64(time.Second)))
+		}
+		close(r.ready)
+	}
+}
+
+// shapedWriter schedules the writes of a user's stream with bandwidth.
+type shapedWriter struct {
+	w        io.Writer
+	username string
+	weight   int
+}
+
+func (w shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		bandwidth.wait(w.username, w.weight, len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"minewire-server/internal/core"
+
+	"github.com/hashicorp/yamux"
+)
+
+// benchResult is one line of the benchmark report, also the format of -save and -compare
+type benchResult struct {
+	Name     string  `json:"name"`
+	NsPerOp  float64 `json:"ns_per_op"`
+	MBPerSec float64 `json:"mb_per_s,omitempty"`
+}
+
+// runBenchCommand runs an end-to-end tunnel benchmark against an in-process server on loopback,
+// using the framing and frame size of the configuration. The codec benchmarks are Benchmark
+// functions run by go test -bench. Returns the process exit code: 1 if -compare found a
+// regression.
+func runBenchCommand(args []string) int {
+	var filter, save, compare string
+	var threshold float64
+	var payloadMB, pings int
+	parseFlags("bench", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&filter, "run", "", "only run benchmarks matching this regular expression")
+		fs.StringVar(&save, "save", "", "write the results as JSON to this file")
+		fs.StringVar(&compare, "compare", "", "compare with results saved by -save")
+		fs.Float64Var(&threshold, "threshold", 10, "percent slowdown reported as a regression by -compare")
+		fs.IntVar(&payloadMB, "payload", 64, "MiB echoed through the tunnel to measure throughput")
+		fs.IntVar(&pings, "pings", 200, "round trips through the tunnel to measure latency")
+	})
+	loadConfig()
+	cfg := currentConfig()
+	match, err := regexp.Compile(filter)
+	if err != nil {
+		fmt.Printf("FAIL -run: %v\n", err)
+		return 1
+	}
+	if payloadMB < 1 || pings < 1 {
+		fmt.Printf("FAIL -payload and -pings must be at least 1\n")
+		return 1
+	}
+
+	fmt.Printf("framing=%s frame_size=%d crypto_workers=%d\n", cfg.TunnelFraming, cfg.TunnelFrameSize, cfg.TunnelCryptoWorkers)
+	var results []benchResult
+	if slices.ContainsFunc(tunnelBenchNames, match.MatchString) {
+		tunnel, err := benchTunnel(payloadMB<<20, pings)
+		if err != nil {
+			fmt.Printf("FAIL tunnel %v\n", err)
+			return 1
+		}
+		for _, res := range tunnel {
+			if match.MatchString(res.Name) {
+				results = append(results, res)
+				printBenchResult(res)
+			}
+		}
+	}
+
+	if save != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := os.WriteFile(save, append(data, '\n'), 0644); err != nil {
+			fmt.Printf("FAIL -save: %v\n", err)
+			return 1
+		}
+	}
+	if compare != "" {
+		return compareBenchResults(compare, results, threshold)
+	}
+	return 0
+}
+
+func printBenchResult(r benchResult) {
+	line := fmt.Sprintf("%-28s %14.1f ns/op", r.Name, r.NsPerOp)
+	if r.MBPerSec > 0 {
+		line += fmt.Sprintf(" %10.2f MB/s", r.MBPerSec)
+	}
+	fmt.Printf("%s\n", line)
+}
+
+// Results of benchTunnel
+var tunnelBenchNames = []string{"Tunnel/login", "Tunnel/rtt-p50", "Tunnel/rtt-p99", "Tunnel/echo"}
+
+// benchSession is a stream through a loopback tunnel to an echo server, see openBenchSession
+type benchSession struct {
+	stream net.Conn
+	login  time.Duration // Time from dialing to the tunnel
+	close  []func()
+}
+
+// openBenchSession serves the top-level game server on loopback with a temporary user without
+// limits, logs in and opens a stream to a local echo server. Server logs are discarded until
+// Close.
+func openBenchSession() (_ *benchSession, err error) {
+	cfg := currentConfig()
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	password := hex.EncodeToString(secret)
+	test := *cfg
+	test.Passwords = append(slices.Clone(cfg.Passwords), UserConfig{Name: "bench", Password: password})
+	publishConfig(&test)
+	cfg = &test
+
+	// The server logs of the benchmark sessions would only clutter the report
+	log.SetOutput(io.Discard)
+	s := &benchSession{close: []func(){func() { log.SetOutput(os.Stderr) }}}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+	initAuthMap()
+	initListenerACL()
+	initLimits()
+	if cryptoJobs == nil {
+		startCryptoWorkers()
+	}
+
+	addr, stop, err := dryRunServe(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loopback listener: %w", err)
+	}
+	s.close = append(s.close, stop)
+	echo, err := startEchoServer()
+	if err != nil {
+		return nil, fmt.Errorf("echo server: %w", err)
+	}
+	s.close = append(s.close, func() { echo.Close() })
+
+	start := time.Now()
+	conn, tc, err := dialTunnel(addr, password)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	s.close = append(s.close, func() { conn.Close() })
+	s.login = time.Since(start)
+
+	session, err := yamux.Client(tc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: %w", err)
+	}
+	s.close = append(s.close, func() { session.Close() })
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("stream open: %w", err)
+	}
+	s.close = append(s.close, func() { stream.Close() })
+	if err := core.WriteStreamRequest(stream, echo.Addr().String()); err != nil {
+		return nil, fmt.Errorf("stream open: %w", err)
+	}
+	s.stream = stream
+	return s, nil
+}
+
+// Close tears the session and its servers down in reverse order.
+func (s *benchSession) Close() {
+	for i := len(s.close) - 1; i >= 0; i-- {
+		s.close[i]()
+	}
+	s.close = nil
+}
+
+// roundTrip echoes one byte, so the coalescing delay is part of every round trip.
+func (s *benchSession) roundTrip() error {
+	one := []byte{0x42}
+	if _, err := s.stream.Write(one); err != nil {
+		return fmt.Errorf("stream write: %w", err)
+	}
+	if _, err := io.ReadFull(s.stream, one); err != nil {
+		return fmt.Errorf("stream read: %w", err)
+	}
+	return nil
+}
+
+// echo writes payload through the stream while reading it back into received.
+func (s *benchSession) echo(payload, received []byte) error {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := s.stream.Write(payload)
+		writeErr <- err
+	}()
+	if _, err := io.ReadFull(s.stream, received); err != nil {
+		return fmt.Errorf("echo read: %w", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("echo write: %w", err)
+	}
+	return nil
+}
+
+// benchTunnel measures login time, stream round trips and echo throughput through a loopback
+// tunnel.
+func benchTunnel(payloadSize, pings int) ([]benchResult, error) {
+	s, err := openBenchSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	rtts := make([]time.Duration, 0, pings)
+	for i := 0; i < pings; i++ {
+		t := time.Now()
+		if err := s.roundTrip(); err != nil {
+			return nil, err
+		}
+		rtts = append(rtts, time.Since(t))
+	}
+	slices.Sort(rtts)
+	percentile := func(p int) float64 { return float64(rtts[(len(rtts)-1)*p/100].Nanoseconds()) }
+
+	payload := make([]byte, payloadSize)
+	rand.Read(payload)
+	received := make([]byte, payloadSize)
+	t := time.Now()
+	if err := s.echo(payload, received); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(t)
+	if !bytes.Equal(payload, received) {
+		return nil, fmt.Errorf("echo: echoed data does not match")
+	}
+
+	// Echo ns/op is per MiB, comparable between payload sizes
+	return []benchResult{
+		{Name: "Tunnel/login", NsPerOp: float64(s.login.Nanoseconds())},
+		{Name: "Tunnel/rtt-p50", NsPerOp: percentile(50)},
+		{Name: "Tunnel/rtt-p99", NsPerOp: percentile(99)},
+		{Name: "Tunnel/echo", NsPerOp: float64(elapsed.Nanoseconds()) / float64(payloadSize>>20), MBPerSec: float64(payloadSize) / 1e6 / elapsed.Seconds()},
+	}, nil
+}
+
+// compareBenchResults prints the change of every result against the file saved by -save and
+// returns 1 if any got slower by more than threshold percent.
+func compareBenchResults(path string, results []benchResult, threshold float64) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("FAIL -compare: %v\n", err)
+		return 1
+	}
+	var old []benchResult
+	if err := json.Unmarshal(data, &old); err != nil {
+		fmt.Printf("FAIL -compare %s: %v\n", path, err)
+		return 1
+	}
+	baseline := make(map[string]benchResult)
+	for _, r := range old {
+		baseline[r.Name] = r
+	}
+
+	fmt.Printf("Compared with %s\n", path)
+	regressed := false
+	for _, r := range results {
+		b, ok := baseline[r.Name]
+		if !ok || b.NsPerOp == 0 {
+			continue
+		}
+		delta := (r.NsPerOp - b.NsPerOp) / b.NsPerOp * 100
+		status := "OK  "
+		if delta > threshold {
+			status, regressed = "SLOW", true
+		}
+		fmt.Printf("  %s %-28s %+7.1f%% ns/op\n", status, r.Name, delta)
+	}
+	if regressed {
+		fmt.Printf("Regression beyond %.0f%%\n", threshold)
+		return 1
+	}
+	return 0
+}
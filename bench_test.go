@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+)
+
+// benchConfig publishes the default configuration with framing for a benchmark.
+func benchConfig(b *testing.B, framing string) *Config {
+	b.Helper()
+	c, err := parseConfig([]byte("tunnel_framing: " + framing))
+	if err != nil {
+		b.Fatal(err)
+	}
+	publishConfig(&c)
+	return currentConfig()
+}
+
+// BenchmarkFrame measures the server's send path per frame, as in MinecraftConn.writeFrame.
+func BenchmarkFrame(b *testing.B) {
+	for _, framing := range []string{core.FramingRandom, core.FramingSequenced} {
+		b.Run(framing, func(b *testing.B) {
+			cfg := benchConfig(b, framing)
+			var key [32]byte
+			var session mcproto.UUID
+			rand.Read(key[:])
+			rand.Read(session[:])
+			sealer, _ := core.Ciphers(framing, key, session, disguise.ServerToClient, disguise.ClientToServer)
+			frame := make([]byte, cfg.TunnelFrameSize)
+			rand.Read(frame)
+			chunkData := sessionProtocol(cfg, cfg.ProtocolID).ID(mcproto.ChunkData)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for b.Loop() {
+				buf := mcproto.GetBuffer()
+				packet := mcproto.AppendPacketHeader(*buf, chunkData, disguise.ChunkLen(sealer.SealedLen(len(frame))))
+				*buf = disguise.AppendSealedChunk(packet, sealer, 3, -7, frame)
+				mcproto.PutBuffer(buf)
+			}
+		})
+	}
+}
+
+// BenchmarkTunnel measures a stream through a loopback tunnel to an echo server.
+func BenchmarkTunnel(b *testing.B) {
+	for _, framing := range []string{core.FramingRandom, core.FramingSequenced} {
+		benchConfig(b, framing)
+		s, err := openBenchSession()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(framing+"/round-trip", func(b *testing.B) {
+			for b.Loop() {
+				if err := s.roundTrip(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(framing+"/echo", func(b *testing.B) {
+			payload := make([]byte, 1<<20)
+			rand.Read(payload)
+			received := make([]byte, len(payload))
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				if err := s.echo(payload, received); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		s.Close()
+	}
+}
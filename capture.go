@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// captureSample is one server -> client packet observed in a real server session
+type captureSample struct {
+	Gap  time.Duration // Time since the previous packet
+	ID   int           // Packet ID, or -1 if unknown
+	Size int           // Packet body size in bytes
+}
+
+// CaptureTemplate holds the packet sequence of a recorded real server session.
+// Sessions replay it as cover traffic so their packet sizes, types and timings match a real deployment.
+type CaptureTemplate struct {
+	Samples []captureSample
+}
+
+var captureTemplate *CaptureTemplate
+
+// loadCaptureTemplate loads a capture template from a pcap file or a packet log.
+// Packet logs are text files with one "<time_ms> <packet_id> <size>" line per packet.
+func loadCaptureTemplate(path string, serverPort int) (*CaptureTemplate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var t *CaptureTemplate
+	if strings.HasSuffix(path, ".pcap") {
+		t, err = parsePcap(f, serverPort)
+	} else {
+		t, err = parsePacketLog(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Samples) == 0 {
+		return nil, errors.New("capture contains no server packets")
+	}
+	return t, nil
+}
+
+func parsePacketLog(r io.Reader) (*CaptureTemplate, error) {
+	t := &CaptureTemplate{}
+	scanner := bufio.NewScanner(r)
+	var last int64
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected \"<time_ms> <packet_id> <size>\"", line)
+		}
+		ms, err1 := strconv.ParseInt(fields[0], 10, 64)
+		id, err2 := strconv.ParseInt(fields[1], 0, 32)
+		size, err3 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil || ms < last || size < 0 {
+			return nil, fmt.Errorf("line %d: invalid packet entry", line)
+		}
+		t.Samples = append(t.Samples, captureSample{Gap: time.Duration(ms-last) * time.Millisecond, ID: int(id), Size: size})
+		last = ms
+	}
+	return t, scanner.Err()
+}
+
+// parsePcap extracts the timing and size of every TCP segment sent from the server port.
+// Real sessions are compressed and encrypted after login, so segment sizes are all a capture reveals.
+func parsePcap(r io.Reader, serverPort int) (*CaptureTemplate, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	nanos := false
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap file (pcapng is not supported)")
+	}
+	linkType := order.Uint32(hdr[20:])
+
+	t := &CaptureTemplate{}
+	var last time.Time
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if err == io.EOF {
+				return t, nil
+			}
+			return nil, err
+		}
+		sec, frac := int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))
+		if !nanos {
+			frac *= 1000
+		}
+		ts := time.Unix(sec, frac)
+		inclLen := order.Uint32(rec[8:])
+		if inclLen > maxPcapRecord {
+			return nil, fmt.Errorf("pcap record of %d bytes", inclLen)
+		}
+		data := make([]byte, inclLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		srcPort, payload, ok := tcpPayload(data, linkType)
+		if !ok || srcPort != serverPort || payload <= 0 {
+			continue
+		}
+		var gap time.Duration
+		if !last.IsZero() {
+			gap = ts.Sub(last)
+		}
+		last = ts
+		t.Samples = append(t.Samples, captureSample{Gap: gap, ID: -1, Size: payload})
+	}
+}
+
+// maxPcapRecord is the largest captured frame parsePcap reads, the snap length of tcpdump
+const maxPcapRecord = 262144
+
+// tcpPayload decodes a captured frame and returns the TCP source port and payload length.
+// Offloaded (TSO) segments have no IP length, their payload is what was captured.
+func tcpPayload(frame []byte, linkType uint32) (int, int, bool) {
+	var ip []byte
+	switch linkType {
+	case 1: // Ethernet
+		if len(frame) < 14 {
+			return 0, 0, false
+		}
+		ip = frame[14:]
+	case 101: // Raw IP
+		ip = frame
+	case 113: // Linux cooked capture
+		if len(frame) < 16 {
+			return 0, 0, false
+		}
+		ip = frame[16:]
+	default:
+		return 0, 0, false
+	}
+	if len(ip) < 1 {
+		return 0, 0, false
+	}
+
+	var tcp []byte
+	var total int
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 || ip[9] != 6 {
+			return 0, 0, false
+		}
+		ihl := int(ip[0]&0x0F) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return 0, 0, false
+		}
+		total = int(binary.BigEndian.Uint16(ip[2:]))
+		if total == 0 {
+			total = len(ip)
+		}
+		total -= ihl
+		tcp = ip[ihl:]
+	case 6:
+		if len(ip) < 40 || ip[6] != 6 {
+			return 0, 0, false
+		}
+		total = int(binary.BigEndian.Uint16(ip[4:]))
+		if total == 0 {
+			total = len(ip) - 40
+		}
+		tcp = ip[40:]
+	default:
+		return 0, 0, false
+	}
+	if len(tcp) < 20 {
+		return 0, 0, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) || total < dataOffset {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(tcp)), total - dataOffset, true
+}
+
+// replayCoverTraffic replays the capture template as cover packets until the connection fails.
+// Replay starts at a random position and is limited to cfg.CaptureMaxRate bytes per second.
+func (mc *MinecraftConn) replayCoverTraffic(t *CaptureTemplate) {
+	cfg := currentConfig()
+	rate := float64(cfg.CaptureMaxRate)
+	i := getSecureRandomInt(len(t.Samples))
+	budget := rate
+	lastRefill := time.Now()
+
+	for {
+		sample := t.Samples[i]
+		i = (i + 1) % len(t.Samples)
+		time.Sleep(sample.Gap)
+
+		// The budget holds a second of traffic, or the sample if it is larger. Wait for it to
+		// refill rather than skip, so back-to-back samples don't spin.
+		size := float64(sample.Size)
+		now := time.Now()
+		budget = min(budget+now.Sub(lastRefill).Seconds()*rate, max(rate, size))
+		lastRefill = now
+		if budget < size {
+			time.Sleep(time.Duration((size - budget) / rate * float64(time.Second)))
+			budget, lastRefill = size, time.Now()
+		}
+		budget -= size
+
+		payload := make([]byte, sample.Size)
+		rand.Read(payload)
+		if err := mc.writePacket(mc.coverPacketID(sample.ID), payload); err != nil {
+			return
+		}
+	}
+}
+
+// coverPacketID returns the ID to replay a captured packet as. IDs our own frames or the
+// client act on (chunks, keep alives, disconnects, teleports...) and unknown IDs (encrypted pcap
+// captures) become entity movement, the most frequent packet a real server sends.
+func (mc *MinecraftConn) coverPacketID(id int) int {
+	if id < 0 {
+		return mc.proto.ID(mcproto.EntityPosition)
+	}
+	for kind := mcproto.JoinGame; kind < mcproto.EntityPosition; kind++ {
+		if id == mc.proto.ID(kind) {
+			return mc.proto.ID(mcproto.EntityPosition)
+		}
+	}
+	return id
+}
+
+// initCaptureTemplate loads the configured capture template, if any.
+func initCaptureTemplate() {
+	cfg := currentConfig()
+	if cfg.CaptureTemplate == "" {
+		return
+	}
+	if cfg.CaptureMaxRate < 0 {
+		log.Fatalf("capture_max_rate must not be negative")
+	}
+	t, err := loadCaptureTemplate(cfg.CaptureTemplate, cfg.CaptureServerPort)
+	if err != nil {
+		log.Fatalf("Could not load capture template %s: %v", cfg.CaptureTemplate, err)
+	}
+	captureTemplate = t
+	log.Printf("Loaded capture template %s (%d packets)", cfg.CaptureTemplate, len(t.Samples))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// pcapFile returns a raw IP pcap capture of frames
+func pcapFile(frames ...[]byte) []byte {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(hdr[20:], 101)
+	for i, f := range frames {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec, uint32(i))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(f)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(f)))
+		hdr = append(append(hdr, rec...), f...)
+	}
+	return hdr
+}
+
+// ipv4Segment returns an IPv4 TCP segment from srcPort with payload bytes of data, its IP
+// total length set to totalLen and its TCP header dataOffset bytes long
+func ipv4Segment(srcPort, payload, totalLen, dataOffset int) []byte {
+	b := make([]byte, 40+payload)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(totalLen))
+	b[9] = 6
+	binary.BigEndian.PutUint16(b[20:], uint16(srcPort))
+	b[32] = byte(dataOffset/4) << 4
+	return b
+}
+
+func TestParsePcap(t *testing.T) {
+	capture := pcapFile(
+		ipv4Segment(25565, 100, 140, 20),
+		ipv4Segment(25565, 300, 0, 20),      // Offloaded: no IP length
+		ipv4Segment(25565, 0, 40, 20),       // Bare ACK
+		ipv4Segment(25565, 10, 50, 60),      // Data offset past the captured bytes
+		ipv4Segment(25565, 10, 20, 20),      // IP length shorter than its headers
+		ipv4Segment(25565, 10, 50, 20)[:30], // Truncated TCP header
+		ipv4Segment(1234, 100, 140, 20),     // Another port
+	)
+	tmpl, err := parsePcap(bytes.NewReader(capture), 25565)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, s := range tmpl.Samples {
+		sizes = append(sizes, s.Size)
+	}
+	if len(sizes) != 2 || sizes[0] != 100 || sizes[1] != 300 {
+		t.Errorf("sample sizes %v, want [100 300]", sizes)
+	}
+
+	huge := pcapFile()
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[8:], 1<<31)
+	if _, err := parsePcap(bytes.NewReader(append(huge, rec...)), 25565); err == nil {
+		t.Error("record of 2 GiB accepted")
+	}
+}
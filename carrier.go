@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Logs a failure to set tcp_user_timeout once, not for every session
+var carrierWarning sync.Once
+
+// tuneCarrier sets the socket options of the game connection a tunnel session runs over.
+// Options the system rejects are logged once and otherwise ignored: the session works without.
+func tuneCarrier(conn *net.TCPConn, srv *Config) {
+	conn.SetNoDelay(true)
+	if srv.TCPSendBuffer > 0 {
+		conn.SetWriteBuffer(srv.TCPSendBuffer)
+	}
+	if srv.TCPReceiveBuffer > 0 {
+		conn.SetReadBuffer(srv.TCPReceiveBuffer)
+	}
+	if srv.TCPKeepAliveIdle < 0 {
+		conn.SetKeepAlive(false)
+	} else {
+		conn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(srv.TCPKeepAliveIdle) * time.Second,
+			Interval: time.Duration(srv.TCPKeepAliveInterval) * time.Second,
+			Count:    srv.TCPKeepAliveCount,
+		})
+	}
+	if err := setCarrierOptions(conn, srv); err != nil {
+		carrierWarning.Do(func() {
+			log.Printf("Could not set tcp_user_timeout: %v", err)
+		})
+	}
+}
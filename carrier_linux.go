@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCarrierOptions sets TCP_USER_TIMEOUT, which only Linux has.
+func setCarrierOptions(conn *net.TCPConn, srv *Config) error {
+	if srv.TCPUserTimeout <= 0 {
+		return nil
+	}
+	return setTCPOption(conn, unix.TCP_USER_TIMEOUT, srv.TCPUserTimeout*1000)
+}
+
+// setListenerOptions sets TCP_MAXSEG on the game port: the segment size is agreed in the
+// handshake, so it has to be set before connections are accepted, which inherit it.
+func setListenerOptions(ln net.Listener, srv *Config) error {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok || srv.TCPMaxSegment <= 0 {
+		return nil
+	}
+	return setTCPOption(tcpLn, unix.TCP_MAXSEG, srv.TCPMaxSegment)
+}
+
+// setTCPOption sets an IPPROTO_TCP option of a socket.
+func setTCPOption(sock syscall.Conn, opt, value int) error {
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, opt, value)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
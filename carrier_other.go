@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// setCarrierOptions does nothing: tcp_user_timeout is a Linux socket option.
+func setCarrierOptions(conn *net.TCPConn, srv *Config) error { return nil }
+
+// setListenerOptions does nothing: tcp_max_segment is a Linux socket option.
+func setListenerOptions(ln net.Listener, srv *Config) error { return nil }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// defaultChatTemplates are used when chat_templates is not configured.
+// {player} is replaced with a random online simulated player.
+var defaultChatTemplates = []string{
+	"{player} has made the advancement [Stone Age]",
+	"{player} has made the advancement [Getting an Upgrade]",
+	"{player} has made the advancement [Acquire Hardware]",
+	"{player} has made the advancement [Suit Up]",
+	"{player} has made the advancement [Hot Stuff]",
+	"{player} has made the advancement [Isn't It Iron Pick]",
+	"{player} has made the advancement [Diamonds!]",
+	"{player} has made the advancement [We Need to Go Deeper]",
+	"{player} has made the advancement [Sweet Dreams]",
+	"{player} has completed the challenge [Monster Hunter]",
+}
+
+// nextChatDelay returns a randomized delay around the configured chat interval
+func nextChatDelay(srv *Config) time.Duration {
+	base := float64(srv.ChatInterval)
+	return time.Duration(base*(0.5+getRandomFloat())) * time.Second
+}
+
+// randomChatMessage fills a random template with a random online player, or returns "" if nobody is online
+func randomChatMessage(srv *Config) string {
+	players := simFor(srv.Name).PlayerNames()
+	if len(players) == 0 {
+		return ""
+	}
+	templates := srv.ChatTemplates
+	if len(templates) == 0 {
+		templates = defaultChatTemplates
+	}
+	template := templates[getSecureRandomInt(len(templates))]
+	return strings.ReplaceAll(template, "{player}", players[getSecureRandomInt(len(players))])
+}
+
+// sendSystemChat sends a System Chat Message packet. The text may contain legacy § formatting codes.
+func (mc *MinecraftConn) sendSystemChat(text, color string) error {
+	c := ParseLegacyText(text)
+	if c.Color == "" {
+		c.Color = color
+	}
+	pw := mcproto.NewPacketBuffer()
+	c.WriteNBT(pw)
+	pw.Bool(false) // Not an action bar overlay
+	return mc.sendBody(mcproto.SystemChat, pw)
+}
+
+// sendRosterChat announces simulated players joining and leaving, like vanilla join/leave messages.
+func (mc *MinecraftConn) sendRosterChat(change rosterChange) error {
+	for _, p := range change.Left {
+		if err := mc.sendSystemChat(p.Name+" left the game", "yellow"); err != nil {
+			return err
+		}
+	}
+	for _, p := range change.Joined {
+		if err := mc.sendSystemChat(p.Name+" joined the game", "yellow"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
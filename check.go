@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"minewire-server/internal/core"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	checkTimeout     = 30 * time.Second
+	checkPayloadSize = 4 << 20 // Bytes echoed through the tunnel to measure throughput
+)
+
+// dialTunnel performs the disguised handshake and login against addr and returns the
+// raw connection and the client end of the encrypted tunnel.
+func dialTunnel(addr, password string) (net.Conn, *core.ClientConn, error) {
+	cfg := currentConfig()
+	conn, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc, err := core.Login(conn, addr, password, sessionProtocol(cfg, cfg.ProtocolID), cfg.TunnelFraming)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, tc, nil
+}
+
+// checkPassword returns the credential used by the health check: check_password or the first
+// configured password (users configured by key can't be used).
+func checkPassword() string {
+	cfg := currentConfig()
+	if cfg.CheckPassword != "" {
+		return cfg.CheckPassword
+	}
+	for _, u := range cfg.Passwords {
+		if u.Password != "" {
+			return u.Password
+		}
+	}
+	return ""
+}
+
+// runHealthCheck performs a loopback login and stream round-trip against the running server
+// and prints handshake latency and throughput. Returns the process exit code.
+func runHealthCheck() int {
+	cfg := currentConfig()
+	password := checkPassword()
+	if password == "" {
+		fmt.Printf("FAIL config: no check_password or plaintext password configured\n")
+		return 1
+	}
+	addr := cfg.CheckAddress
+	if addr == "" {
+		addr = "127.0.0.1:" + cfg.ListenPort
+	}
+
+	res, err := checkTunnel(addr, password, checkPayloadSize)
+	if err != nil {
+		fmt.Printf("FAIL %v\n", err)
+		return 1
+	}
+	fmt.Printf("OK server=%s login=%s stream_rtt=%s throughput=%.1f Mbit/s (%d bytes echoed)\n",
+		addr, res.login.Round(time.Millisecond), res.roundTrip.Round(time.Millisecond), res.mbps, checkPayloadSize)
+	return 0
+}
+
+// tunnelCheckResult holds the timings of a successful checkTunnel
+type tunnelCheckResult struct {
+	login, roundTrip time.Duration
+	mbps             float64
+}
+
+// startEchoServer listens on a loopback port and echoes every connection back to itself.
+func startEchoServer() (net.Listener, error) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	return echo, nil
+}
+
+// checkTunnel logs in to addr, opens a stream to a local echo server and echoes payloadSize
+// random bytes through it. Errors are prefixed with the failed step.
+func checkTunnel(addr, password string, payloadSize int) (tunnelCheckResult, error) {
+	var res tunnelCheckResult
+	fail := func(step string, err error) (tunnelCheckResult, error) {
+		return res, fmt.Errorf("%s: %w", step, err)
+	}
+
+	// Local echo server as the stream destination
+	echo, err := startEchoServer()
+	if err != nil {
+		return fail("echo server", err)
+	}
+	defer echo.Close()
+
+	start := time.Now()
+	conn, tc, err := dialTunnel(addr, password)
+	if err != nil {
+		return fail("login", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	res.login = time.Since(start)
+
+	session, err := yamux.Client(tc, nil)
+	if err != nil {
+		return fail("tunnel", err)
+	}
+	defer session.Close()
+	stream, err := session.OpenStream()
+	if err != nil {
+		return fail("stream open", err)
+	}
+	defer stream.Close()
+	if err := core.WriteStreamRequest(stream, echo.Addr().String()); err != nil {
+		return fail("stream open", err)
+	}
+
+	// Round trip of a single byte measures stream setup latency through the tunnel
+	rtStart := time.Now()
+	one := []byte{0x42}
+	if _, err := stream.Write(one); err != nil {
+		return fail("stream write", err)
+	}
+	if _, err := io.ReadFull(stream, one); err != nil {
+		return fail("stream read", err)
+	}
+	res.roundTrip = time.Since(rtStart)
+
+	// Throughput: echo a larger payload and verify it byte for byte
+	payload := make([]byte, payloadSize)
+	rand.Read(payload)
+	tpStart := time.Now()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(payload)
+		writeErr <- err
+	}()
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		return fail("throughput read", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fail("throughput write", err)
+	}
+	elapsed := time.Since(tpStart)
+	if !bytes.Equal(payload, received) {
+		return fail("throughput", errors.New("echoed data does not match"))
+	}
+	res.mbps = float64(len(payload)) * 8 / elapsed.Seconds() / 1e6
+	return res, nil
+}
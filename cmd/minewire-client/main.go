@@ -0,0 +1,158 @@
+// Command minewire-client is the reference Minewire client: it serves local proxies, or a TUN
+// interface, whose traffic goes through the disguised tunnel of a pkg/client Dialer.
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/client"
+)
+
+const ClientVersion = "26.1.1"
+
+// linkList collects the values of a repeated -link flag
+type linkList []string
+
+func (l *linkList) String() string     { return strings.Join(*l, ",") }
+func (l *linkList) Set(v string) error { *l = append(*l, v); return nil }
+
+func main() {
+	var (
+		links                   linkList
+		subscription, socksAddr string
+		httpAddr, tunName       string
+		rulesFile               string
+		apiAddr, apiToken       string
+		tunRoutes               bool
+		cfg                     client.Config
+		version                 bool
+	)
+	fs := flag.NewFlagSet("minewire-client", flag.ExitOnError)
+	fs.Var(&links, "link", "mw://password@host:port link of a server (repeat for several)")
+	fs.StringVar(&subscription, "subscription", "", "subscription URL (plain, base64 or ?format=json)")
+	fs.StringVar(&socksAddr, "socks", "127.0.0.1:1080", "listen address of the local SOCKS5 proxy, empty disables")
+	fs.StringVar(&httpAddr, "http", "", "listen address of a local HTTP proxy (CONNECT and http:// requests), e.g. 127.0.0.1:8080")
+	fs.StringVar(&tunName, "tun", "", "name of a TUN interface carrying IP packets through the tunnel (Linux, root), e.g. mw1")
+	fs.BoolVar(&tunRoutes, "tun-routes", false, "route all IPv4 traffic of the device through the -tun interface")
+	fs.StringVar(&apiAddr, "api", "", "listen address of a local JSON API and status page for GUI frontends, e.g. 127.0.0.1:9090")
+	fs.StringVar(&apiToken, "api-token", "", "token the -api requests must carry (bearer token or basic auth password)")
+	fs.StringVar(&rulesFile, "rules", "", "JSON file of routing rules deciding which destinations go direct (overrides the subscription's)")
+	fs.StringVar(&cfg.GeoIP, "geoip", "", "IP to country database (iptoasn.com TSV, optionally .gz) for country rules")
+	fs.StringVar(&cfg.Framing, "framing", core.FramingRandom, "tunnel framing of the server: random or sequenced (tunnel_framing)")
+	fs.StringVar(&cfg.PacketIDs, "packet-ids", core.PacketIDsLegacy, "packet IDs of the server: legacy or version (packet_ids)")
+	fs.IntVar(&cfg.Protocol, "protocol", 773, "protocol version announced to the server")
+	fs.DurationVar(&cfg.ProbeInterval, "probe-interval", time.Minute, "interval of the status pings ranking several endpoints, 0 disables")
+	fs.DurationVar(&cfg.SwitchMargin, "switch-margin", 100*time.Millisecond, "round trip advantage that makes the client move to another endpoint")
+	fs.BoolVar(&version, "version", false, "print the version and exit")
+	fs.Parse(os.Args[1:])
+
+	if version {
+		fmt.Printf("Minewire Client v%s\n", ClientVersion)
+		return
+	}
+	if socksAddr == "" && httpAddr == "" && tunName == "" {
+		log.Fatal("Nothing to serve: -socks, -http and -tun are all empty")
+	}
+	if tunRoutes && tunName == "" {
+		log.Fatal("-tun-routes needs -tun")
+	}
+	if cfg.ProbeInterval == 0 {
+		cfg.ProbeInterval = -1
+	}
+
+	switch {
+	case len(links) > 0:
+		for _, link := range links {
+			ep, err := client.ParseLink(link)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Endpoints = append(cfg.Endpoints, ep)
+		}
+	case subscription != "":
+		sub, err := client.FetchSubscription(subscription)
+		if err != nil {
+			log.Fatalf("Could not load the subscription: %v", err)
+		}
+		cfg.Endpoints, cfg.Routing = sub.Endpoints, sub.Routing
+	}
+	if len(cfg.Endpoints) == 0 {
+		fmt.Fprintln(os.Stderr, "minewire-client: -link or -subscription is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if rulesFile != "" {
+		policy, err := client.LoadRouting(rulesFile)
+		if err != nil {
+			log.Fatalf("Could not load the routing rules: %v", err)
+		}
+		cfg.Routing = &policy
+	}
+
+	d, err := client.NewDialer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Routing != nil && !cfg.Routing.Empty() {
+		log.Printf("Split tunneling: %d routing rules, default %s", len(cfg.Routing.Rules), cmp.Or(cfg.Routing.Default, client.RouteProxy))
+	}
+	if err := d.Connect(); err != nil {
+		log.Fatalf("Could not connect: %v", err)
+	}
+	defer d.Close()
+
+	log.Printf("Minewire Client v%s started", ClientVersion)
+	var listeners []net.Listener
+	for _, srv := range []struct {
+		name, addr string
+		serve      func(net.Listener) error
+	}{
+		{"SOCKS5 proxy", socksAddr, d.ServeSOCKS},
+		{"HTTP proxy", httpAddr, d.ServeHTTPProxy},
+		{"Status API", apiAddr, func(ln net.Listener) error { return http.Serve(ln, d.APIHandler(apiToken)) }},
+	} {
+		if srv.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", srv.addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s on %s", srv.name, ln.Addr())
+		go srv.serve(ln)
+		listeners = append(listeners, ln)
+	}
+	if tunName != "" {
+		t, err := startTUN(tunName, d)
+		if err != nil {
+			log.Fatalf("Could not start TUN mode: %v", err)
+		}
+		defer t.close()
+		if tunRoutes {
+			cleanup, err := t.routeAll(cfg.Endpoints, d.DirectNetworks())
+			if err != nil {
+				t.close()
+				log.Fatalf("Could not route through %s: %v", t.dev.Name(), err)
+			}
+			defer cleanup()
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/internal/tun"
+	"minewire-server/pkg/client"
+)
+
+// tunInterface routes the packets of a TUN interface over an IP packet stream: the server
+// hands them to its own network stack, so every TCP and UDP flow of the device goes through
+// the tunnel without per-application proxy settings.
+type tunInterface struct {
+	dev *tun.Device
+	d   *client.Dialer
+
+	mu     sync.Mutex
+	stream *client.PacketStream // Current packet stream, nil while reconnecting
+	addr   netip.Prefix         // Address configured on dev
+}
+
+// startTUN creates the TUN interface name, configures it with the address the server assigns
+// and starts relaying its packets.
+func startTUN(name string, d *client.Dialer) (*tunInterface, error) {
+	ps, err := d.OpenPacketStream()
+	if err != nil {
+		return nil, err
+	}
+	dev, err := tun.Open(name)
+	if err != nil {
+		ps.Close()
+		return nil, err
+	}
+	t := &tunInterface{dev: dev, d: d}
+	if err := t.attach(ps); err != nil {
+		ps.Close()
+		dev.Close()
+		return nil, err
+	}
+	go t.readLoop()
+	go t.run(ps)
+	return t, nil
+}
+
+// attach makes ps the current packet stream, reconfiguring the interface if the server
+// assigned another address.
+func (t *tunInterface) attach(ps *client.PacketStream) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ps.Addr != t.addr {
+		if err := t.dev.Configure(ps.Addr, ps.MTU); err != nil {
+			return err
+		}
+		log.Printf("TUN interface %s with address %s (MTU %d)", t.dev.Name(), ps.Addr, ps.MTU)
+		t.addr = ps.Addr
+	}
+	t.stream = ps
+	return nil
+}
+
+// run writes the packets of the packet stream to the interface, replacing the stream when it
+// ends or the Dialer moved to another session.
+func (t *tunInterface) run(ps *client.PacketStream) {
+	for {
+		moved := make(chan struct{})
+		go func() {
+			for !ps.Stale() {
+				select {
+				case <-moved:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+			ps.Close()
+		}()
+		t.relayDown(ps)
+		close(moved)
+
+		t.mu.Lock()
+		t.stream = nil
+		t.mu.Unlock()
+		ps.Close()
+		for {
+			var err error
+			if ps, err = t.d.OpenPacketStream(); err == nil {
+				if err = t.attach(ps); err == nil {
+					break
+				}
+				ps.Close()
+			}
+			log.Printf("Could not reopen the packet stream: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// relayDown writes the packets of a packet stream to the interface until the stream ends.
+func (t *tunInterface) relayDown(ps *client.PacketStream) {
+	for {
+		packet, err := ps.ReadPacket()
+		if err != nil {
+			return
+		}
+		t.dev.Write(packet)
+	}
+}
+
+// readLoop sends the packets read from the interface over the current packet stream. Packets
+// read while there is none are dropped; TCP resends them.
+func (t *tunInterface) readLoop() {
+	buf := make([]byte, core.MaxPacket)
+	for {
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		stream := t.stream
+		t.mu.Unlock()
+		if stream != nil {
+			stream.WritePacket(buf[:n])
+		}
+	}
+}
+
+// close removes the interface, and the routes through it with it.
+func (t *tunInterface) close() {
+	t.dev.Close()
+}
+
+// routeAll sends all IPv4 traffic of the device through the TUN interface: two /1 routes take
+// precedence over the default route without replacing it, while the endpoints and the
+// networks of direct routing rules keep their current path. It returns a function removing the
+// routes it added for the latter.
+func (t *tunInterface) routeAll(endpoints []client.Endpoint, direct []netip.Prefix) (func(), error) {
+	var added []string
+	cleanup := func() {
+		for _, p := range added {
+			ipCommand("-4", "route", "del", p)
+		}
+	}
+	// keep pins a network to the route it takes now, e.g. "203.0.113.5 via 192.168.1.1 dev eth0 src ..."
+	keep := func(p netip.Prefix) error {
+		out, err := exec.Command("ip", "-4", "route", "get", p.Addr().String()).Output()
+		if err != nil {
+			return fmt.Errorf("no route to %s", p.Addr())
+		}
+		route := []string{"-4", "route", "add", p.String()}
+		fields := strings.Fields(string(out))
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "via" || fields[i] == "dev" {
+				route = append(route, fields[i], fields[i+1])
+			}
+		}
+		if err := ipCommand(route...); err != nil {
+			if strings.Contains(err.Error(), "File exists") {
+				return nil // Already routed on its own, and not ours to remove
+			}
+			return err
+		}
+		added = append(added, p.String())
+		return nil
+	}
+
+	for _, ep := range endpoints {
+		host, _, _ := net.SplitHostPort(ep.Addr)
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip4", host)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		for _, ip := range ips {
+			if err := keep(netip.PrefixFrom(ip.Unmap(), 32)); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	}
+	for _, p := range direct {
+		if !p.Addr().Is4() {
+			continue
+		}
+		if err := keep(p); err != nil {
+			log.Printf("Direct network %s stays in the tunnel: %v", p, err)
+		}
+	}
+	for _, half := range []string{"0.0.0.0/1", "128.0.0.0/1"} {
+		if err := ipCommand("-4", "route", "replace", half, "dev", t.dev.Name()); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	log.Printf("Routing all IPv4 traffic through %s", t.dev.Name())
+	return cleanup, nil
+}
+
+// ipCommand runs the ip tool of iproute2.
+func ipCommand(args ...string) error {
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
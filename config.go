@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"minewire-server/internal/core"
+
+	"golang.org/x/crypto/acme"
+	"gopkg.in/yaml.v3"
+)
+
+// Path of the config file, set with --config or MINEWIRE_CONFIG
+var configPath = "server.yaml"
+
+// Config overrides from the command line, by yaml key
+var flagOverrides = make(map[string]string)
+
+// overrideFlag records a command line value for a config key
+type overrideFlag string
+
+func (f overrideFlag) String() string { return "" }
+
+func (f overrideFlag) Set(v string) error {
+	flagOverrides[string(f)] = v
+	return nil
+}
+
+// configKeys returns the yaml keys of all Config fields, in declaration order.
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// envName returns the environment variable overriding a config key, e.g. MINEWIRE_LISTEN_PORT.
+func envName(key string) string {
+	return "MINEWIRE_" + strings.ToUpper(key)
+}
+
+// parseFlags parses the command line: --config and one --<key> flag per config key
+// (underscores become dashes, e.g. --listen-port 25566), plus any flags added by extra.
+func parseFlags(name string, args []string, extra ...func(*flag.FlagSet)) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	if env := os.Getenv("MINEWIRE_CONFIG"); env != "" {
+		configPath = env
+	}
+	fs.StringVar(&configPath, "config", configPath, "path of the config file (env MINEWIRE_CONFIG)")
+	fs.BoolVar(&dryRun, "dry-run", false, "check the config, ports and handshakes without serving")
+	for _, key := range configKeys() {
+		fs.Var(overrideFlag(key), strings.ReplaceAll(key, "_", "-"), fmt.Sprintf("override %s (env %s)", key, envName(key)))
+	}
+	for _, f := range extra {
+		f(fs)
+	}
+	fs.Parse(args)
+}
+
+// setConfigValue sets the field tagged key from its string form. Strings are taken verbatim,
+// other types are parsed as YAML, e.g. "true", "[a, b]" or "{k: v}".
+func setConfigValue(c *Config, key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] != key {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			return nil
+		}
+		parsed := reflect.New(field.Type())
+		if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+			return err
+		}
+		field.Set(parsed.Elem())
+		return nil
+	}
+	return fmt.Errorf("unknown config key %s", key)
+}
+
+// applyOverrides applies MINEWIRE_* environment variables, then command line flags.
+func applyOverrides(c *Config) {
+	for _, key := range configKeys() {
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			if err := setConfigValue(c, key, value); err != nil {
+				log.Fatalf("Invalid %s: %v", envName(key), err)
+			}
+		}
+	}
+	for key, value := range flagOverrides {
+		if err := setConfigValue(c, key, value); err != nil {
+			log.Fatalf("Invalid --%s: %v", strings.ReplaceAll(key, "_", "-"), err)
+		}
+	}
+}
+
+// loadConfig reads the config file (YAML, or JSON/TOML by extension) and makes it the running
+// configuration.
+func loadConfig() {
+	data, err := readConfigFile()
+	if err != nil {
+		log.Fatalf("Could not load %s: %v", configPath, err)
+	}
+	c, err := parseConfig(data)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", configPath, err)
+	}
+	publishConfig(&c)
+}
+
+// parseConfig decodes a config document, applying the disguise profile, overrides and defaults.
+// Precedence: command line flags > MINEWIRE_* environment variables > config file > profile > defaults.
+func parseConfig(data []byte) (Config, error) {
+	top := func(c *Config) error {
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return err
+		}
+		applyOverrides(c)
+		return nil
+	}
+	c, err := decodeConfig(top)
+	if err != nil {
+		return c, err
+	}
+	if c.Name == "" {
+		c.Name = "main"
+	}
+
+	// Every servers entry inherits the top-level settings except its name, port and users
+	var doc struct {
+		Servers []yaml.Node `yaml:"servers"`
+	}
+	yaml.Unmarshal(data, &doc)
+	for i := range doc.Servers {
+		node := &doc.Servers[i]
+		s, err := decodeConfig(func(s *Config) error {
+			if err := top(s); err != nil {
+				return err
+			}
+			s.Name, s.ListenPort, s.QueryPort, s.Passwords, s.Servers = "", "", "", nil, nil
+			return node.Decode(s)
+		})
+		if err != nil {
+			return c, fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if s.Name == "" {
+			s.Name = s.ListenPort
+		}
+		s.Servers = nil
+		c.Servers[i] = s
+	}
+	return c, nil
+}
+
+// decodeConfig decodes a config with the given function, applies the disguise profile underneath
+// the decoded settings and fills in the defaults.
+func decodeConfig(decode func(*Config) error) (Config, error) {
+	var c Config
+	if err := decode(&c); err != nil {
+		return c, err
+	}
+
+	// Disguise profile provides defaults, explicit settings take precedence
+	if c.Profile != "" {
+		profile, ok := disguiseProfiles[c.Profile]
+		if !ok {
+			return c, fmt.Errorf("unknown disguise profile: %s", c.Profile)
+		}
+		c = Config{}
+		profile.apply(&c)
+		decode(&c)
+	}
+
+	// Addresses may be written with the brackets of IPv6 literals in URLs
+	c.ListenAddress = strings.Trim(c.ListenAddress, "[]")
+	c.SubsListenAddress = strings.Trim(c.SubsListenAddress, "[]")
+	for i := range c.PublicAddresses {
+		c.PublicAddresses[i] = strings.Trim(c.PublicAddresses[i], "[]")
+	}
+	for i := range c.SubsHosts {
+		c.SubsHosts[i] = strings.Trim(c.SubsHosts[i], "[]")
+	}
+	for i := range c.SubsEndpoints {
+		c.SubsEndpoints[i].Host = strings.Trim(c.SubsEndpoints[i].Host, "[]")
+	}
+
+	// Apply defaults if not specified in config
+	if c.RedactLogs == nil {
+		redact := !c.LogUsernames
+		c.RedactLogs = &redact
+	}
+	if c.ProtocolID == 0 {
+		c.ProtocolID = 773
+	}
+	if c.PacketIDs == "" {
+		c.PacketIDs = core.PacketIDsLegacy
+	}
+	if c.MaxPlayers == 0 {
+		c.MaxPlayers = 20
+	}
+	if c.KeepAliveInterval == 0 {
+		c.KeepAliveInterval = 10
+	}
+	if c.KeepAliveTimeout == 0 {
+		c.KeepAliveTimeout = 30
+	}
+	if c.TunName == "" {
+		c.TunName = "mw0"
+	}
+	if c.TunMTU == 0 {
+		c.TunMTU = 1400
+	}
+	if c.TimeUpdateInterval == 0 {
+		c.TimeUpdateInterval = 1
+	}
+	if c.QueryPort == "" {
+		c.QueryPort = c.ListenPort
+	}
+	if c.ChatInterval == 0 {
+		c.ChatInterval = 300
+	}
+	if c.TarpitScore == 0 {
+		c.TarpitScore = 5
+	}
+	if c.BanScore == 0 {
+		c.BanScore = 10
+	}
+	if c.BanDuration == 0 {
+		c.BanDuration = 60
+	}
+	if c.StatusMode == "" {
+		c.StatusMode = StatusModeNormal
+	}
+	if c.MaintenanceMotd == "" {
+		c.MaintenanceMotd = "§cServer is under maintenance.\\n§7Please come back later."
+	}
+	if c.MaintenanceVersion == "" {
+		c.MaintenanceVersion = "§4Maintenance"
+	}
+	if c.CaptureServerPort == 0 {
+		c.CaptureServerPort = 25565
+	}
+	if c.CaptureMaxRate == 0 {
+		c.CaptureMaxRate = 16384
+	}
+	if c.AccessLogMaxSize == 0 {
+		c.AccessLogMaxSize = 100
+	}
+	if c.AccessLogMaxBackups == 0 {
+		c.AccessLogMaxBackups = 5
+	}
+	if c.Brand == "" {
+		c.Brand = "vanilla"
+	}
+	if c.DestinationStats == "" {
+		c.DestinationStats = DestStatsAggregate
+	}
+	if c.DestinationStatsRetention == 0 {
+		c.DestinationStatsRetention = 24
+	}
+	if c.DestinationStatsTop == 0 {
+		c.DestinationStatsTop = 20
+	}
+	if c.SlowDialThreshold == 0 {
+		c.SlowDialThreshold = 3
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 10
+	}
+	if c.DNSCacheSize == 0 {
+		c.DNSCacheSize = 10000
+	}
+	if c.DNSCacheMaxTTL == 0 {
+		c.DNSCacheMaxTTL = 3600
+	}
+	if c.DNSCacheNegativeTTL == 0 {
+		c.DNSCacheNegativeTTL = 30
+	}
+	if c.EventLogMaxSize == 0 {
+		c.EventLogMaxSize = 10
+	}
+	if c.EventLogMaxBackups == 0 {
+		c.EventLogMaxBackups = 5
+	}
+	if c.WatchdogInterval == 0 {
+		c.WatchdogInterval = 30
+	}
+	if c.SessionMaxGoroutines == 0 {
+		c.SessionMaxGoroutines = 4096
+	}
+	if c.SessionMaxConns == 0 {
+		c.SessionMaxConns = 1024
+	}
+	if c.MaxConnections == 0 {
+		c.MaxConnections = 8192
+	}
+	if c.UserStreamRate == 0 {
+		c.UserStreamRate = 100
+	}
+	if c.UserMaxDials == 0 {
+		c.UserMaxDials = 64
+	}
+	if c.UpstreamCheckInterval == 0 {
+		c.UpstreamCheckInterval = 30
+	}
+	if c.MaxSessionsTotal == 0 {
+		c.MaxSessionsTotal = 2048
+	}
+	if c.MaxStreamsTotal == 0 {
+		c.MaxStreamsTotal = 65536
+	}
+	if c.UpgradeDrainTimeout == 0 {
+		c.UpgradeDrainTimeout = 3600
+	}
+	if c.StreamIdleTimeout == 0 {
+		c.StreamIdleTimeout = 600
+	}
+	if c.DestinationKeepAlive == 0 {
+		c.DestinationKeepAlive = 15
+	}
+	if c.TunnelFraming == "" {
+		c.TunnelFraming = core.FramingRandom
+	}
+	if c.ForeignProtocol == "" {
+		c.ForeignProtocol = ForeignClose
+	}
+	if c.FirewallTable == "" {
+		c.FirewallTable = "inet filter"
+	}
+	if c.FirewallSet == "" {
+		c.FirewallSet = "minewire_banned"
+	}
+	if c.FirewallSet6 == "" {
+		c.FirewallSet6 = "minewire_banned6"
+	}
+	if c.TunnelFrameSize == 0 {
+		c.TunnelFrameSize = 16384
+	}
+	if c.TunnelCoalesceDelay == 0 {
+		c.TunnelCoalesceDelay = 2
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = 10
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 30
+	}
+	if c.SubsTokenTTL == 0 {
+		c.SubsTokenTTL = 720
+	}
+	if c.SubsRateLimit == 0 {
+		c.SubsRateLimit = 30
+	}
+	if c.SubsPath == "" {
+		c.SubsPath = "/subs/"
+	}
+	if c.SubsAddressSelection == "" {
+		c.SubsAddressSelection = SubsAddressesAll
+	}
+	if c.SubsLocalProxy == "" {
+		c.SubsLocalProxy = "127.0.0.1:1080"
+	}
+	if c.ACMEDirectory == "" {
+		c.ACMEDirectory = acme.LetsEncryptURL
+	}
+	if c.ACMECacheDir == "" {
+		c.ACMECacheDir = "acme"
+	}
+	if c.ACMEChallenge == "" {
+		c.ACMEChallenge = ACMEChallengeHTTP
+	}
+	if c.ACMEHTTPPort == "" {
+		c.ACMEHTTPPort = "80"
+	}
+	if c.TracingServiceName == "" {
+		c.TracingServiceName = "minewire-server"
+	}
+	if c.SyslogTag == "" {
+		c.SyslogTag = "minewire-server"
+	}
+	return c, nil
+}
+
+// checkUnknownKeys strictly decodes a config document and returns one error per unknown or
+// mistyped key, with its line number. Such keys are silently ignored by parseConfig.
+func checkUnknownKeys(data []byte) ([]string, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&Config{})
+	if err == nil || err == io.EOF {
+		return nil, nil
+	}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Errors, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
+)
+
+// runConfigCommand handles the "config" subcommands (validate, gen, key, report). Returns the process exit code.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: minewire-server config validate|gen|key|report [flags]")
+		return 2
+	}
+	switch args[0] {
+	case "validate":
+		parseFlags("config validate", args[1:])
+		return runConfigValidate()
+	case "gen":
+		return runConfigGen(args[1:])
+	case "key":
+		return runConfigKey(args[1:])
+	case "report":
+		parseFlags("config report", args[1:])
+		loadConfig()
+		return runConfigReport()
+	}
+	fmt.Fprintf(os.Stderr, "unknown config command: %s\n", args[0])
+	return 2
+}
+
+// runConfigValidate strictly parses the config file and reports every problem found.
+func runConfigValidate() int {
+	data, err := readConfigFile()
+	if err != nil {
+		fmt.Printf("ERROR %v\n", err)
+		return 1
+	}
+
+	// Unknown keys are typos or options from another version, both silently ignored at runtime
+	var problems []string
+	keyErrors, err := checkUnknownKeys(data)
+	if err != nil {
+		fmt.Printf("ERROR %s: %v\n", configPath, err)
+		return 1
+	}
+	for _, e := range keyErrors {
+		problems = append(problems, "ERROR "+e)
+	}
+
+	loadConfig()
+	cfg := currentConfig()
+	problems = append(problems, validateConfig(cfg)...)
+
+	errorCount := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if strings.HasPrefix(p, "ERROR") {
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", configPath, errorCount, len(problems)-errorCount)
+		return 1
+	}
+	fmt.Printf("%s: OK (%d warning(s))\n", configPath, len(problems))
+	return 0
+}
+
+// validateConfig checks the effective configuration for bad values and missing files.
+// Problems are prefixed with ERROR or WARNING.
+func validateConfig(c *Config) []string {
+	var problems []string
+	errorf := func(format string, a ...interface{}) {
+		problems = append(problems, "ERROR "+fmt.Sprintf(format, a...))
+	}
+	warnf := func(format string, a ...interface{}) {
+		problems = append(problems, "WARNING "+fmt.Sprintf(format, a...))
+	}
+	checkPort := func(key, port string) {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errorf("%s: invalid port %q", key, port)
+		}
+	}
+	checkFile := func(key, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			errorf("%s: %v", key, err)
+		}
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errorf("%s: %q is not one of %s", key, value, strings.Join(allowed, ", "))
+	}
+
+	// Network
+	checkPort("listen_port", c.ListenPort)
+	if c.SubsListenPort != "" {
+		checkPort("subs_listen_port", c.SubsListenPort)
+	}
+	if c.DialTimeout < 0 {
+		errorf("dial_timeout must not be negative")
+	}
+	if c.EgressFamily != "" {
+		oneOf("egress_family", c.EgressFamily, FamilyPreferIPv4, FamilyPreferIPv6, FamilyIPv4, FamilyIPv6)
+	}
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		errorf("listen_address: %q is not an IP address", c.ListenAddress)
+	}
+	if c.SubsListenAddress != "" && net.ParseIP(c.SubsListenAddress) == nil {
+		errorf("subs_listen_address: %q is not an IP address", c.SubsListenAddress)
+	}
+	if c.QueryEnabled {
+		checkPort("query_port", c.QueryPort)
+	}
+	if !strings.HasPrefix(c.SubsPath, "/") || !strings.HasSuffix(c.SubsPath, "/") || c.SubsPath == "/" {
+		errorf("subs_path must start and end with / and not be / alone, e.g. /subs/")
+	}
+	if c.SubsDecoyDir != "" {
+		if _, err := os.Stat(filepath.Join(c.SubsDecoyDir, "index.html")); err != nil {
+			warnf("subs_decoy_dir has no index.html, the decoy website shows a directory listing")
+		}
+	}
+	if c.SubsListenPort != "" && c.SubsSecret == "" {
+		warnf("subs_secret is not set, anyone who knows a nickname can fetch its subscription link")
+	} else if c.SubsSecret != "" && len(c.SubsSecret) < 16 {
+		warnf("subs_secret is shorter than 16 characters")
+	}
+	for i, e := range c.SubsEndpoints {
+		if e.Port != "" {
+			checkPort(fmt.Sprintf("subs_endpoints[%d].port", i), e.Port)
+		}
+	}
+	if err := c.SubsRouting.Validate(); err != nil {
+		errorf("subs_routing: %v", err)
+	}
+	if c.SubsListenPort != "" && len(c.SubsHosts) == 0 && len(c.ACMEDomains) == 0 && len(c.PublicAddresses) == 0 {
+		warnf("subs_hosts is not set, links point at whatever Host header a request sends")
+	}
+	for i, h := range c.SubsHosts {
+		if h == "" || strings.ContainsAny(h, ":/[] ") && net.ParseIP(h) == nil {
+			errorf("subs_hosts[%d]: %q is not a hostname or IP address", i, h)
+		}
+	}
+	for i, h := range c.PublicAddresses {
+		if h == "" || strings.ContainsAny(h, ":/[] ") && net.ParseIP(h) == nil {
+			errorf("public_addresses[%d]: %q is not a hostname or IP address", i, h)
+		}
+	}
+	oneOf("subs_address_selection", c.SubsAddressSelection, SubsAddressesAll, SubsAddressesClientFamily)
+	if c.SMTPServer != "" {
+		if _, port, err := net.SplitHostPort(c.SMTPServer); err != nil {
+			errorf("smtp_server: %v", err)
+		} else {
+			checkPort("smtp_server", port)
+		}
+		if c.SMTPFrom == "" {
+			errorf("smtp_server is set but smtp_from is not")
+		}
+	}
+	if c.SubsRotationNotice < 0 {
+		errorf("subs_rotation_notice must not be negative")
+	}
+	if c.SubsTokenTTL < 1 {
+		errorf("subs_token_ttl must be at least 1 hour")
+	}
+	if _, port, err := net.SplitHostPort(c.SubsLocalProxy); err != nil {
+		errorf("subs_local_proxy: %v", err)
+	} else {
+		checkPort("subs_local_proxy", port)
+	}
+	if c.SubsListenPort != "" && c.SubsTLSCert == "" && len(c.ACMEDomains) == 0 {
+		warnf("subscriptions are served over plain HTTP, links with passwords can be read on the way (set subs_tls_cert or acme_domains)")
+	}
+	if (c.SubsTLSCert == "") != (c.SubsTLSKey == "") {
+		errorf("subs_tls_cert and subs_tls_key must be set together")
+	}
+	if c.SubsClientCA != "" && c.SubsTLSCert == "" && len(c.ACMEDomains) == 0 {
+		errorf("subs_client_ca requires HTTPS (subs_tls_cert or acme_domains)")
+	}
+	checkFile("subs_tls_cert", c.SubsTLSCert)
+	checkFile("subs_tls_key", c.SubsTLSKey)
+	checkFile("subs_client_ca", c.SubsClientCA)
+	if len(c.ACMEDomains) > 0 {
+		if c.SubsListenPort == "" {
+			warnf("acme_domains is set but subs_listen_port is not, no certificate is needed")
+		}
+		oneOf("acme_challenge", c.ACMEChallenge, ACMEChallengeHTTP, ACMEChallengeDNS)
+		if c.ACMEChallenge == ACMEChallengeHTTP {
+			checkPort("acme_http_port", c.ACMEHTTPPort)
+		}
+		if c.ACMEChallenge == ACMEChallengeDNS {
+			if c.ACMEDNSHook == "" {
+				errorf("acme_challenge dns-01 requires acme_dns_hook")
+			} else if _, err := exec.LookPath(c.ACMEDNSHook); err != nil {
+				errorf("acme_dns_hook: %v", err)
+			}
+		}
+		for i, d := range c.ACMEDomains {
+			if strings.HasPrefix(d, "*.") && c.ACMEChallenge != ACMEChallengeDNS {
+				errorf("acme_domains[%d]: wildcard certificates require the dns-01 challenge", i)
+			}
+		}
+	}
+	if c.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListen); err != nil {
+			errorf("admin_listen: %v", err)
+		}
+		if c.AdminToken == "" {
+			warnf("admin_listen is set but admin_token is empty, the admin server will not start")
+		} else if len(c.AdminToken) < 16 || c.AdminToken == "CHANGE_ME" {
+			warnf("admin_token is short or a placeholder")
+		}
+	}
+
+	// Passwords
+	seen := make(map[[32]byte]bool)
+	names := make(map[string]bool)
+	subsKeys := make(map[string]bool)
+	for i, u := range c.Passwords {
+		if seen[u.TunnelKey()] {
+			errorf("passwords[%d]: duplicate password", i)
+		}
+		seen[u.TunnelKey()] = true
+		if u.Name != "" && names[u.Name] {
+			errorf("passwords[%d]: duplicate name %q", i, u.Name)
+		}
+		names[u.Name] = true
+		if key := u.SubsKey(); key != "" && subsKeys[key] {
+			errorf("passwords[%d]: subscription %q is already used by another user (set a unique id)", i, key)
+		}
+		subsKeys[u.SubsKey()] = true
+		if _, ok := c.EgressGroups[u.Group]; u.Group != "" && !ok {
+			errorf("passwords[%d]: unknown egress group %q", i, u.Group)
+		}
+		if u.Key != "" {
+			continue // Strength unknown
+		}
+		if strings.Contains(u.Password, "REPLACE_ME") {
+			warnf("passwords[%d]: example password still in use", i)
+		} else if len(u.Password) < 16 {
+			warnf("passwords[%d]: password shorter than 16 characters", i)
+		}
+	}
+	if len(c.Passwords) == 0 {
+		errorf("passwords: no passwords configured, no client can log in")
+	}
+
+	// Player simulation
+	if c.OnlineMin < 0 || c.OnlineMax < 0 {
+		errorf("online_min/online_max must not be negative")
+	}
+	if c.OnlineMin > c.OnlineMax {
+		errorf("online_min (%d) is greater than online_max (%d)", c.OnlineMin, c.OnlineMax)
+	}
+	if c.OnlineMax > c.MaxPlayers {
+		warnf("online_max (%d) is greater than max_players (%d)", c.OnlineMax, c.MaxPlayers)
+	}
+	if c.ProtocolID < 0 {
+		errorf("protocol_id: %d is not a valid protocol version", c.ProtocolID)
+	}
+	oneOf("packet_ids", c.PacketIDs, core.PacketIDsLegacy, core.PacketIDsVersion)
+	oneOf("tunnel_framing", c.TunnelFraming, core.FramingRandom, core.FramingSequenced)
+	if c.TunnelFraming == core.FramingSequenced {
+		warnf("tunnel_framing is sequenced: clients that seal frames with random nonces can't connect")
+	}
+	if _, ok := mcproto.IDsFor(c.ProtocolID); c.PacketIDs == core.PacketIDsVersion && !ok {
+		warnf("packet_ids is version but protocol_id %d is older than %d: old clients get the legacy IDs", c.ProtocolID, mcproto.MinKnownVersion)
+	}
+
+	// Enumerations
+	oneOf("status_mode", c.StatusMode, StatusModeNormal, StatusModeWhitelist, StatusModeMaintenance)
+	oneOf("destination_stats", c.DestinationStats, DestStatsFull, DestStatsHashed, DestStatsAggregate, DestStatsOff)
+	oneOf("foreign_protocol", c.ForeignProtocol, ForeignClose, ForeignTimeout, ForeignForward)
+	if _, _, err := net.SplitHostPort(c.ForeignProtocolBackend); c.ForeignProtocolBackend != "" && err != nil {
+		errorf("foreign_protocol_backend: %v", err)
+	}
+	if c.ForeignProtocol == ForeignForward && c.ForeignProtocolBackend == "" {
+		errorf("foreign_protocol is forward but foreign_protocol_backend is not set")
+	}
+	if c.LogOutput != "" {
+		oneOf("log_output", c.LogOutput, "stderr", "journald", "syslog")
+	}
+	if c.LogUsernames && c.RedactLogs != nil && *c.RedactLogs {
+		warnf("log_usernames is ignored with redact_logs: true")
+	}
+
+	// Listener rules
+	for key, list := range map[string][]string{"listener_allow": c.ListenerAllow, "listener_deny": c.ListenerDeny} {
+		for i, rule := range list {
+			if _, err := parsePrefix(rule); err != nil {
+				errorf("%s[%d]: %v", key, i, err)
+			}
+		}
+	}
+	if c.MemoryLimit < 0 {
+		errorf("memory_limit must not be negative")
+	}
+	for key, v := range map[string]int{"access_log_rotate_hours": c.AccessLogRotateHours, "access_log_max_age": c.AccessLogMaxAge,
+		"event_log_rotate_hours": c.EventLogRotateHours, "event_log_max_age": c.EventLogMaxAge} {
+		if v < 0 {
+			errorf("%s must not be negative", key)
+		}
+	}
+	if c.BanNetworkThreshold < 0 {
+		errorf("ban_network_threshold must not be negative")
+	}
+	policies := map[string]EgressPolicy{"egress": c.Egress}
+	for name, p := range c.EgressGroups {
+		policies["egress_groups."+name] = p
+	}
+	for key, p := range policies {
+		if _, err := p.compile(""); err != nil {
+			errorf("%s: %v", key, err)
+		}
+		if c.ASNDatabase == "" && slices.ContainsFunc(p.Rules, func(r EgressRule) bool { return len(r.Countries) > 0 }) {
+			warnf("%s: country rules never match without asn_database", key)
+		}
+		for i, r := range p.Rules {
+			for _, name := range r.Lists {
+				if _, ok := c.EgressLists[name]; !ok {
+					errorf("%s: rule %d: unknown egress list %q", key, i+1, name)
+				}
+			}
+		}
+	}
+	for name, l := range c.EgressLists {
+		if (l.URL == "") == (l.Path == "") {
+			errorf("egress_lists.%s needs either url or path", name)
+		}
+		if u, err := url.Parse(l.URL); l.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errorf("egress_lists.%s: url %q must be an http:// or https:// URL", name, l.URL)
+		}
+		if l.Path != "" {
+			if _, err := os.Stat(l.Path); err != nil {
+				warnf("egress_lists.%s: %v", name, err)
+			}
+		}
+		if l.Refresh < 0 {
+			errorf("egress_lists.%s: refresh must not be negative", name)
+		}
+	}
+	if c.DNSCacheSize < -1 {
+		errorf("dns_cache_size must be positive, or -1 to disable the cache")
+	}
+	for key, v := range map[string]int{"dns_cache_max_ttl": c.DNSCacheMaxTTL, "dns_cache_negative_ttl": c.DNSCacheNegativeTTL} {
+		if v < 0 {
+			errorf("%s must not be negative", key)
+		}
+	}
+	if c.UpstreamCheckInterval < -1 {
+		errorf("upstream_check_interval must be positive, or -1 to disable")
+	}
+	if c.UpstreamCheckTarget != "" {
+		if _, port, err := net.SplitHostPort(c.UpstreamCheckTarget); err != nil || port == "" {
+			errorf("upstream_check_target %q must be host:port", c.UpstreamCheckTarget)
+		}
+	}
+	for key, v := range map[string]int{"user_stream_rate": c.UserStreamRate, "user_max_dials": c.UserMaxDials} {
+		if v < -1 {
+			errorf("%s must be positive, or -1 to disable", key)
+		}
+	}
+	if c.RateLimitSuspend < 0 {
+		errorf("rate_limit_suspend must not be negative")
+	}
+	if c.DestinationKeepAlive < -1 {
+		errorf("destination_keepalive must be a number of seconds, or -1 to disable TCP keepalives")
+	}
+	if c.StreamKeepAlive < 0 {
+		errorf("stream_keepalive must be a number of seconds, or 0 to disable it")
+	}
+	if c.BandwidthLimit < 0 {
+		errorf("bandwidth_limit must be a number of Mbit/s, or 0 for unlimited")
+	}
+	if c.FirewallBackend != "" {
+		oneOf("firewall_backend", c.FirewallBackend, FirewallNftables, FirewallIPSet, FirewallScript)
+		command := map[string]string{FirewallNftables: "nft", FirewallIPSet: "ipset", FirewallScript: c.FirewallScript}[c.FirewallBackend]
+		if c.FirewallBackend == FirewallScript && c.FirewallScript == "" {
+			errorf("firewall_backend script requires firewall_script")
+		} else if _, err := exec.LookPath(command); command != "" && err != nil {
+			warnf("firewall_backend %s: %v", c.FirewallBackend, err)
+		}
+		if !c.AnomalyScoring {
+			warnf("firewall_backend has no effect without anomaly_scoring")
+		}
+	}
+
+	// Files
+	checkFile("icon_path", c.IconPath)
+	checkFile("capture_template", c.CaptureTemplate)
+	checkFile("asn_database", c.ASNDatabase)
+
+	// Ranges
+	if c.KeepAliveInterval < 1 {
+		errorf("keepalive_interval must be at least 1 second")
+	}
+	if c.ChatInterval < 1 {
+		errorf("chat_interval must be at least 1 second")
+	}
+	if c.KeepAliveTimeout < -1 {
+		errorf("keepalive_timeout must be -1 (disabled) or a number of seconds")
+	}
+	if c.TunnelFrameSize < 256 || c.TunnelFrameSize > 1<<19 {
+		errorf("tunnel_frame_size must be between 256 and 524288 bytes")
+	}
+	if c.TunnelCoalesceDelay < -1 || c.TunnelCoalesceDelay > 100 {
+		errorf("tunnel_coalesce_delay must be between 1 and 100 milliseconds, or -1")
+	}
+	if c.TunNetwork != "" {
+		if p, err := netip.ParsePrefix(c.TunNetwork); err != nil || !p.Addr().Is4() || p.Bits() > 30 {
+			errorf("tun_network must be an IPv4 network of at least 4 addresses, e.g. 10.66.0.0/24")
+		} else if p.Masked() != p {
+			warnf("tun_network %s has host bits set, the network is %s", c.TunNetwork, p.Masked())
+		}
+	}
+	if c.TunMTU < 576 || c.TunMTU > 65535 {
+		errorf("tun_mtu must be between 576 and 65535 bytes")
+	}
+	if c.TunnelCryptoWorkers < 0 || c.TunnelCryptoWorkers > 1024 {
+		errorf("tunnel_crypto_workers must be between 0 and 1024")
+	} else if c.TunnelCryptoWorkers > runtime.NumCPU() {
+		warnf("tunnel_crypto_workers is %d but there are %d CPUs: more workers than CPUs don't add speed", c.TunnelCryptoWorkers, runtime.NumCPU())
+	}
+	if c.TCPSendBuffer < 0 || c.TCPReceiveBuffer < 0 {
+		errorf("tcp_send_buffer and tcp_receive_buffer must be a number of bytes, or 0 for the system's default")
+	}
+	if c.TCPKeepAliveIdle < -1 || c.TCPKeepAliveInterval < 0 || c.TCPKeepAliveCount < 0 {
+		errorf("tcp_keepalive_idle, tcp_keepalive_interval and tcp_keepalive_count must not be negative (tcp_keepalive_idle -1 disables keepalives)")
+	}
+	if c.TCPUserTimeout < 0 {
+		errorf("tcp_user_timeout must be a number of seconds, or 0 to disable it")
+	}
+	if c.TCPMaxSegment != 0 && (c.TCPMaxSegment < 536 || c.TCPMaxSegment > 65495) {
+		errorf("tcp_max_segment must be between 536 and 65495 bytes")
+	}
+	if (c.TCPUserTimeout > 0 || c.TCPMaxSegment > 0) && runtime.GOOS != "linux" {
+		warnf("tcp_user_timeout and tcp_max_segment are only supported on Linux, they are ignored on %s", runtime.GOOS)
+	}
+	if c.HandshakeTimeout < -1 {
+		errorf("handshake_timeout must be a number of seconds or -1")
+	}
+	if c.WriteTimeout < -1 {
+		errorf("write_timeout must be a number of seconds or -1")
+	}
+	if c.BanScore <= c.TarpitScore && c.AnomalyScoring {
+		warnf("ban_score (%.1f) is not above tarpit_score (%.1f), sources are banned before being tarpitted", c.BanScore, c.TarpitScore)
+	}
+	if c.ResourcePackURL != "" {
+		if b, err := hex.DecodeString(c.ResourcePackSHA1); c.ResourcePackSHA1 != "" && (err != nil || len(b) != 20) {
+			errorf("resource_pack_sha1: expected 40 hex characters")
+		}
+	}
+	if c.CaptureMaxRate < 0 {
+		errorf("capture_max_rate must not be negative")
+	}
+
+	// Additional game servers: report problems of inherited settings only once
+	if len(c.Servers) > 0 {
+		problems = append(problems, validateServers(c, problems)...)
+	}
+	return problems
+}
+
+// validateServers checks the servers entries and the names, ports and passwords shared between
+// all game servers. Problems already reported for the top level are left out.
+func validateServers(c *Config, reported []string) []string {
+	var problems []string
+	known := make(map[string]bool)
+	for _, p := range reported {
+		known[p] = true
+	}
+	names := map[string]bool{c.Name: true}
+	ports := map[string]bool{c.ListenPort: true}
+	if c.SubsListenPort != "" {
+		ports[c.SubsListenPort] = true
+	}
+	passwords := make(map[[32]byte]bool)
+	subsKeys := make(map[string]bool)
+	for _, u := range c.Passwords {
+		passwords[u.TunnelKey()] = true
+		subsKeys[u.SubsKey()] = true
+	}
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		prefix := fmt.Sprintf("servers[%d]", i)
+		for _, p := range validateConfig(s) {
+			if !known[p] {
+				level, msg, _ := strings.Cut(p, " ")
+				problems = append(problems, level+" "+prefix+": "+msg)
+			}
+		}
+		if names[s.Name] {
+			problems = append(problems, fmt.Sprintf("ERROR %s: duplicate server name %q", prefix, s.Name))
+		}
+		names[s.Name] = true
+		if ports[s.ListenPort] {
+			problems = append(problems, fmt.Sprintf("ERROR %s: listen_port %s is already used", prefix, s.ListenPort))
+		}
+		ports[s.ListenPort] = true
+		for j, u := range s.Passwords {
+			if passwords[u.TunnelKey()] {
+				problems = append(problems, fmt.Sprintf("ERROR %s: passwords[%d] is also used by another server", prefix, j))
+			}
+			passwords[u.TunnelKey()] = true
+			if key := u.SubsKey(); key != "" && subsKeys[key] {
+				problems = append(problems, fmt.Sprintf("ERROR %s: passwords[%d]: subscription %q is also used on another server", prefix, j, key))
+			}
+			subsKeys[u.SubsKey()] = true
+		}
+	}
+	for i, e := range c.SubsEndpoints {
+		if e.Server != "" && !names[e.Server] {
+			problems = append(problems, fmt.Sprintf("ERROR subs_endpoints[%d]: unknown server %q", i, e.Server))
+		}
+	}
+	return problems
+}
+
+// runConfigGen writes a commented config with freshly generated passwords,
+// asking for the main settings when run on a terminal.
+func runConfigGen(args []string) int {
+	fs := flag.NewFlagSet("config gen", flag.ExitOnError)
+	output := fs.String("o", "", "write the config to this file instead of stdout")
+	force := fs.Bool("force", false, "overwrite an existing output file")
+	fs.Parse(args)
+
+	in := bufio.NewReader(os.Stdin)
+	interactive := false
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+	}
+	ask := func(question, def string) string {
+		if !interactive {
+			return def
+		}
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+		line, _ := in.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+		return def
+	}
+
+	port := ask("Listen port", "25565")
+	profile := ask("Disguise profile (vanilla, paper, purpur, forge, modded)", "paper")
+	if _, ok := disguiseProfiles[profile]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown profile: %s\n", profile)
+		return 1
+	}
+	motd := ask("MOTD", "§aA Minecraft Server")
+	users := ask("Users (comma-separated nicknames)", "User1")
+	adminToken := ""
+	if strings.HasPrefix(strings.ToLower(ask("Enable the admin dashboard on 127.0.0.1:8090? (y/n)", "n")), "y") {
+		adminToken = randomHex(32)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Minewire Server Configuration\n")
+	fmt.Fprintf(&b, "# Generated by \"minewire-server config gen\". See the server.yaml shipped with\n")
+	fmt.Fprintf(&b, "# Minewire for every available option.\n\n")
+	fmt.Fprintf(&b, "# Port to listen on for incoming connections\n")
+	fmt.Fprintf(&b, "listen_port: %q\n\n", port)
+	fmt.Fprintf(&b, "# Authorized passwords with their nicknames. Share each password with its user only.\n")
+	fmt.Fprintf(&b, "# The id names the user's subscription and stays the same when the nickname changes.\n")
+	fmt.Fprintf(&b, "passwords:\n")
+	for _, nick := range strings.Split(users, ",") {
+		if nick = strings.TrimSpace(nick); nick != "" {
+			fmt.Fprintf(&b, "  - id: %q\n    name: %q\n    password: %q\n", randomHex(8), nick, randomHex(16))
+		}
+	}
+	fmt.Fprintf(&b, "\n# Disguise profile: version, brand and protocol details of a real server software\n")
+	fmt.Fprintf(&b, "profile: %q\n\n", profile)
+	fmt.Fprintf(&b, "# Server list message (§ color codes, \\\\n for a second line)\n")
+	fmt.Fprintf(&b, "motd: %q\n", motd)
+	fmt.Fprintf(&b, "icon_path: \"server-icon.png\"\n\n")
+	fmt.Fprintf(&b, "# Player count simulation\n")
+	fmt.Fprintf(&b, "max_players: 20\nonline_min: 4\nonline_max: 20\n\n")
+	fmt.Fprintf(&b, "# Active-probing resistance and scanner detection\n")
+	fmt.Fprintf(&b, "decoy_mode: true\nanomaly_scoring: true\n")
+	if adminToken != "" {
+		fmt.Fprintf(&b, "\n# Admin dashboard, reach it with: ssh -L 8090:127.0.0.1:8090 your-server\n")
+		fmt.Fprintf(&b, "# Log in with any username and the token as password.\n")
+		fmt.Fprintf(&b, "admin_listen: \"127.0.0.1:8090\"\nadmin_token: %q\n", adminToken)
+	}
+
+	if *output == "" {
+		fmt.Print(b.String())
+		return 0
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*output, flags, 0640)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write config: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", *output)
+	return 0
+}
+
+// runConfigKey prints a passwords entry holding the tunnel key instead of the password, so the
+// password itself needn't be stored on the server. The password is read from stdin.
+func runConfigKey(args []string) int {
+	fs := flag.NewFlagSet("config key", flag.ExitOnError)
+	name := fs.String("name", "", "nickname of the user")
+	fs.Parse(args)
+
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimSpace(line)
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "no password given")
+		return 1
+	}
+	key := core.TunnelKey(password)
+	fmt.Printf("  - name: %q\n    key: \"%x\" # %s\n", *name, key, usernameFor(password))
+	return 0
+}
+
+// randomHex returns n random bytes as a hex string.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
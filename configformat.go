@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, chosen by file extension
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+	formatTOML = "toml"
+)
+
+// configFormat returns the format of a config file from its extension; YAML by default.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".toml":
+		return formatTOML
+	}
+	return formatYAML
+}
+
+// readConfigFile reads the config file as a YAML document, whatever its format.
+func readConfigFile() ([]byte, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return toYAML(configFormat(configPath), data)
+}
+
+// toYAML converts a JSON or TOML config document to the YAML the config loader understands.
+// Line numbers in later errors refer to the converted document.
+func toYAML(format string, data []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	switch format {
+	case formatJSON:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		if _, err := toml.Decode(string(data), &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	return yaml.Marshal(doc)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
+)
+
+// runConformanceCommand plays a vanilla client against the top-level game server, served in
+// process on loopback: status and ping, legacy pings, a rejected login and a full login for
+// every protocol version with known packet IDs. Responses must match the expected packets byte
+// for byte, apart from the values a server picks at random. Returns the process exit code.
+func runConformanceCommand(args []string) int {
+	var versionList string
+	parseFlags("conformance", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&versionList, "versions", "", "comma-separated protocol versions (default: all with known packet IDs)")
+	})
+	loadConfig()
+	cfg := currentConfig()
+
+	versions := mcproto.KnownVersions()
+	if !slices.Contains(versions, cfg.ProtocolID) {
+		versions = append(versions, cfg.ProtocolID)
+	}
+	if versionList != "" {
+		versions = nil
+		for _, s := range strings.Split(versionList, ",") {
+			v, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				fmt.Printf("FAIL -versions: %v\n", err)
+				return 1
+			}
+			versions = append(versions, v)
+		}
+	}
+
+	// A temporary user to log in with, and no anomaly scoring: the rejected logins would
+	// otherwise tarpit and ban loopback
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	password := hex.EncodeToString(secret)
+	test := *cfg
+	test.Passwords = append(slices.Clone(cfg.Passwords), UserConfig{Name: "conformance", Password: password})
+	test.AnomalyScoring = false
+	publishConfig(&test)
+	cfg = &test
+
+	// The server logs of the simulated sessions would only clutter the report
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initAuthMap()
+	initListenerACL()
+	initLimits()
+
+	addr, stop, err := dryRunServe(cfg)
+	if err != nil {
+		fmt.Printf("FAIL loopback listener: %v\n", err)
+		return 1
+	}
+	defer stop()
+
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("  FAIL %s: %v\n", name, err)
+			failed = true
+		} else {
+			fmt.Printf("  OK   %s\n", name)
+		}
+	}
+
+	fmt.Printf("Legacy ping\n")
+	report("beta 1.8-1.3", conformLegacyPing(addr, []byte{mcproto.LegacyPingMagic}, 0))
+	report("1.4-1.5", conformLegacyPing(addr, []byte{mcproto.LegacyPingMagic, 0x01}, 1))
+	report("1.6", conformLegacyPing(addr, legacyPingHost(addr), 1))
+
+	for _, v := range versions {
+		fmt.Printf("Protocol %d\n", v)
+		report("status and ping", conformStatus(addr, v))
+		report("rejected login", conformRejectedLogin(addr, v))
+		report("login and join", conformJoin(addr, v, usernameFor(password)))
+	}
+
+	if failed {
+		fmt.Printf("Conformance failed\n")
+		return 1
+	}
+	fmt.Printf("Conformance OK\n")
+	return 0
+}
+
+// conformDial connects to addr with the check timeout as deadline.
+func conformDial(addr string) (net.Conn, *mcproto.PacketReader, error) {
+	conn, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	return conn, mcproto.NewPacketReader(conn), nil
+}
+
+// expectPacket reads the next packet and compares it with the expected ID and body.
+func expectPacket(packets *mcproto.PacketReader, name string, id int, body []byte) error {
+	pid, got, err := packets.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if pid != id {
+		return fmt.Errorf("%s: packet 0x%02X, expected 0x%02X", name, pid, id)
+	}
+	if !bytes.Equal(got, body) {
+		return fmt.Errorf("%s: %s", name, describeMismatch(body, got))
+	}
+	return nil
+}
+
+// describeMismatch locates the first difference between two packet bodies.
+func describeMismatch(want, got []byte) string {
+	i := 0
+	for i < len(want) && i < len(got) && want[i] == got[i] {
+		i++
+	}
+	window := func(b []byte) []byte { return b[i:min(len(b), i+8)] }
+	return fmt.Sprintf("differs at byte %d of %d (expected %d): expected % x, got % x", i, len(got), len(want), window(want), window(got))
+}
+
+// conformStatus runs a server list ping and expects the status of the config and the echoed ping.
+func conformStatus(addr string, version int) error {
+	cfg := currentConfig()
+	conn, packets, err := conformDial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := core.WriteHandshake(conn, version, "localhost", 25565, core.NextStateStatus); err != nil {
+		return err
+	}
+	if err := mcproto.WritePacket(conn, 0x00, nil); err != nil {
+		return err
+	}
+
+	pid, body, err := packets.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+	if pid != PID_CB_StatusResp {
+		return fmt.Errorf("status: packet 0x%02X", pid)
+	}
+	doc, err := mcproto.ReadString(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+	var status mcproto.StatusResponse
+	if err := json.Unmarshal([]byte(doc), &status); err != nil {
+		return fmt.Errorf("status JSON: %w", err)
+	}
+	if err := checkStatusFields(status); err != nil {
+		return err
+	}
+	// The players are simulated: the expected document takes them from the response
+	want := mcproto.NewPacketBuffer()
+	want.String(string(statusJSON(cfg, status.Players.Online, status.Players.Sample)))
+	wantBody, err := want.Body()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(body, wantBody) {
+		return fmt.Errorf("status: %s", describeMismatch(wantBody, body))
+	}
+
+	var payload [8]byte
+	rand.Read(payload[:])
+	if err := mcproto.WritePacket(conn, 0x01, payload[:]); err != nil {
+		return err
+	}
+	return expectPacket(packets, "pong", PID_CB_Ping, payload[:])
+}
+
+// checkStatusFields compares the status response with what the config advertises.
+func checkStatusFields(s mcproto.StatusResponse) error {
+	cfg := currentConfig()
+	wantVersion := mcproto.Version{Name: cfg.VersionName, Protocol: cfg.ProtocolID}
+	wantMotd := cfg.Motd
+	if cfg.StatusMode == StatusModeMaintenance {
+		wantVersion = mcproto.Version{Name: cfg.MaintenanceVersion, Protocol: -1}
+		wantMotd = cfg.MaintenanceMotd
+	}
+	switch {
+	case s.Version != wantVersion:
+		return fmt.Errorf("status version %+v, expected %+v", s.Version, wantVersion)
+	case s.Description.Text != strings.ReplaceAll(wantMotd, `\n`, "\n"):
+		return fmt.Errorf("status MOTD %q", s.Description.Text)
+	case s.Players.Max != cfg.MaxPlayers:
+		return fmt.Errorf("status max players %d, expected %d", s.Players.Max, cfg.MaxPlayers)
+	case s.Players.Online < 0 || s.Players.Online > s.Players.Max && cfg.MaxPlayers > 0:
+		return fmt.Errorf("status online players %d of %d", s.Players.Online, s.Players.Max)
+	case len(s.Players.Sample) > s.Players.Online:
+		return fmt.Errorf("status sample of %d players with %d online", len(s.Players.Sample), s.Players.Online)
+	}
+	return nil
+}
+
+// legacyPingHost returns the ping of a 1.6 client: 0xFE 0x01 and a MC|PingHost plugin message.
+func legacyPingHost(addr string) []byte {
+	utf16be := func(s string) []byte {
+		b := binary.BigEndian.AppendUint16(nil, uint16(len(s)))
+		for _, r := range s {
+			b = binary.BigEndian.AppendUint16(b, uint16(r))
+		}
+		return b
+	}
+	host := utf16be("localhost")
+	req := []byte{mcproto.LegacyPingMagic, 0x01, 0xFA}
+	req = append(req, utf16be("MC|PingHost")...)
+	req = binary.BigEndian.AppendUint16(req, uint16(1+len(host)+4))
+	req = append(req, 74) // Protocol of 1.6.2
+	req = append(req, host...)
+	return binary.BigEndian.AppendUint32(req, 25565)
+}
+
+// conformLegacyPing sends a pre-1.7 ping and expects the legacy status of the config, after which
+// the server closes the connection.
+func conformLegacyPing(addr string, req []byte, format int) error {
+	cfg := currentConfig()
+	conn, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	got, err := mcproto.ReadLegacyKick(conn)
+	if err != nil {
+		return err
+	}
+
+	version, motd, online := cfg.VersionName, cfg.Motd, 0
+	if cfg.StatusMode == StatusModeMaintenance {
+		version, motd = cfg.MaintenanceVersion, cfg.MaintenanceMotd
+	}
+	motd = strings.ReplaceAll(motd, `\n`, "\n")
+	// The online count is simulated: take it from the response
+	sep := "§"
+	if format == 1 {
+		sep = "\x00"
+	}
+	fields := strings.Split(got, sep)
+	if len(fields) >= 2 {
+		online, _ = strconv.Atoi(fields[len(fields)-2])
+	}
+	if want := mcproto.LegacyStatus(format, version, motd, online, cfg.MaxPlayers); got != want {
+		return fmt.Errorf("response %q, expected %q", got, want)
+	}
+	if n, err := conn.Read(make([]byte, 1)); n > 0 || err != io.EOF {
+		return fmt.Errorf("connection not closed after the response")
+	}
+	return nil
+}
+
+// conformLogin sends the handshake and Login Start of a vanilla client of the version.
+func conformLogin(conn net.Conn, version int, username string) error {
+	if err := core.WriteHandshake(conn, version, "localhost", 25565, core.NextStateLogin); err != nil {
+		return err
+	}
+	return core.WriteLoginStart(conn, version, username)
+}
+
+// conformRejectedLogin logs in with an unknown username and expects the configured rejection.
+func conformRejectedLogin(addr string, version int) error {
+	cfg := currentConfig()
+	conn, packets, err := conformDial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conformLogin(conn, version, "Steve"); err != nil {
+		return err
+	}
+	want := mcproto.NewPacketBuffer()
+	want.String(ParseLegacyText(rejectMessage(cfg)).JSON())
+	body, err := want.Body()
+	if err != nil {
+		return err
+	}
+	return expectPacket(packets, "disconnect", PID_CB_LoginDisconnect, body)
+}
+
+// conformJoin logs in as username and expects the join sequence of the version: Login Success,
+// Join Game, the server brand, the player position and the resource pack if one is configured.
+func conformJoin(addr string, version int, username string) error {
+	cfg := currentConfig()
+	conn, packets, err := conformDial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conformLogin(conn, version, username); err != nil {
+		return err
+	}
+	proto := sessionProtocol(cfg, version)
+
+	// Login Success: the UUID is random, but must be a version 4 UUID
+	pid, body, err := packets.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("login success: %w", err)
+	}
+	if pid != proto.ID(mcproto.LoginSuccess) {
+		return fmt.Errorf("login success: packet 0x%02X", pid)
+	}
+	var login LoginSuccessPacket
+	if err := mcproto.Unmarshal(body, &login, proto.Version); err != nil {
+		return fmt.Errorf("login success: %w", err)
+	}
+	if login.UUID[6]>>4 != 4 || login.UUID[8]>>6 != 2 {
+		return fmt.Errorf("login success: UUID %x is not version 4", login.UUID)
+	}
+	if err := expectMarshaled(body, "login success", LoginSuccessPacket{UUID: login.UUID, Username: username, Properties: []LoginProperty{}}, proto); err != nil {
+		return err
+	}
+
+	join, err := mcproto.Marshal(JoinGamePacket{
+		EntityID:           100,
+		Dimensions:         []string{"minecraft:overworld"},
+		ViewDistance:       8,
+		SimulationDistance: 8,
+		RespawnScreen:      true,
+		DimensionTypeName:  "minecraft:overworld",
+		DimensionName:      "minecraft:overworld",
+		HashedSeed:         123456789,
+		GameMode:           1,
+		PreviousGameMode:   -1,
+		SeaLevel:           63,
+	}, proto.Version)
+	if err != nil {
+		return err
+	}
+	if err := expectPacket(packets, "join game", proto.ID(mcproto.JoinGame), join); err != nil {
+		return err
+	}
+
+	brand := mcproto.NewPacketBuffer()
+	brand.String("minecraft:brand")
+	brand.String(cfg.Brand)
+	if body, err = brand.Body(); err != nil {
+		return err
+	}
+	if err := expectPacket(packets, "brand", proto.ID(mcproto.PluginMessage), body); err != nil {
+		return err
+	}
+
+	// Player position: the spawn point is random, everything else is fixed
+	pid, body, err = packets.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("player position: %w", err)
+	}
+	if pid != proto.ID(mcproto.PlayerPosition) {
+		return fmt.Errorf("player position: packet 0x%02X", pid)
+	}
+	var pos PlayerPositionPacket
+	if err := mcproto.Unmarshal(body, &pos, proto.Version); err != nil {
+		return fmt.Errorf("player position: %w", err)
+	}
+	if pos.Y < -64 || pos.Y > 320 {
+		return fmt.Errorf("player position: Y %.1f outside the world", pos.Y)
+	}
+	if err := expectMarshaled(body, "player position", PlayerPositionPacket{X: pos.X, Y: pos.Y, Z: pos.Z, Yaw: pos.Yaw}, proto); err != nil {
+		return err
+	}
+
+	if cfg.ResourcePackURL != "" {
+		var pack bytes.Buffer
+		if err := sendResourcePack(&pack, cfg, proto); err != nil {
+			return err
+		}
+		pid, body, err := mcproto.NewPacketReader(&pack).ReadPacket()
+		if err != nil {
+			return err
+		}
+		if err := expectPacket(packets, "resource pack", pid, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectMarshaled compares a received body with the encoding of the expected packet.
+func expectMarshaled(body []byte, name string, want mcproto.Packet, proto mcproto.Protocol) error {
+	wantBody, err := mcproto.Marshal(want, proto.Version)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(body, wantBody) {
+		return fmt.Errorf("%s: %s", name, describeMismatch(wantBody, body))
+	}
+	return nil
+}
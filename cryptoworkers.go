@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"runtime"
+)
+
+// cryptoJobs feeds the workers that seal and open tunnel frames when tunnel_crypto_workers is
+// set, so a single busy session can use more than one core. Nil: every session seals and opens
+// its frames on its own goroutines.
+var cryptoJobs chan func()
+
+// maxParallelFrames is the most frames of one write sealed at once, bounding the buffers a
+// session holds for a batch
+const maxParallelFrames = 64
+
+// startCryptoWorkers starts the workers of tunnel_crypto_workers, if set.
+func startCryptoWorkers() {
+	cfg := currentConfig()
+	n := cfg.TunnelCryptoWorkers
+	if n <= 0 {
+		return
+	}
+	cryptoJobs = make(chan func(), n*4)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range cryptoJobs {
+				job()
+			}
+		}()
+	}
+	log.Printf("Tunnel frames sealed and opened by %d workers (%d CPUs)", n, runtime.NumCPU())
+}
+
+// openResult is a tunnel frame opened by a crypto worker
+type openResult struct {
+	plaintext []byte
+	err       error
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// newUserRequest is the body of POST /api/users
+type newUserRequest struct {
+	Name     string     `json:"name"`
+	ID       string     `json:"id"`     // Default: random
+	Server   string     `json:"server"` // Game server name, default: the top-level server
+	Group    string     `json:"group"`  // Egress group
+	Limits   UserLimits `json:"limits"`
+	Telegram string     `json:"telegram"` // Chat ID to send the links to
+	Email    string     `json:"email"`    // Address to send the links to
+}
+
+// newUserResult is the response of POST /api/users
+type newUserResult struct {
+	Username     string   `json:"username"`
+	ID           string   `json:"id"`
+	Password     string   `json:"password"`
+	Links        []string `json:"links"`
+	Subscription string   `json:"subscription,omitempty"` // URL of the subscription
+	Delivered    []string `json:"delivered"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// handleAdminCreateUser adds a user with a generated password and sends its links by Telegram
+// and/or email. With ?save=1 the user is also added to the config file.
+func handleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	var req newUserRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fail := func(err error) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+	}
+	if req.ID == "" {
+		req.ID = randomHex(8)
+	}
+	if !validUserID(req.ID) {
+		fail(errors.New("id may only contain letters, digits, - and _ (up to 64)"))
+		return
+	}
+	if req.Limits.MaxSessions < 0 || req.Limits.MaxStreams < 0 || req.Limits.QuotaMB < 0 ||
+		req.Limits.StreamRate < -1 || req.Limits.MaxDials < -1 || req.Limits.DialTimeout < 0 || req.Limits.BandwidthWeight < 0 {
+		fail(errors.New("limits must not be negative (-1 for unlimited stream_rate and max_dials)"))
+		return
+	}
+	if _, err := time.Parse(time.DateOnly, req.Limits.Expires); req.Limits.Expires != "" && err != nil {
+		fail(errors.New("expires must be a date like 2026-12-31"))
+		return
+	}
+	if _, ok := cfg.EgressGroups[req.Group]; req.Group != "" && !ok {
+		fail(fmt.Errorf("unknown egress group %q", req.Group))
+		return
+	}
+	hosts := deliveryHosts()
+	if len(hosts) == 0 && (req.Telegram != "" || req.Email != "") {
+		fail(errors.New("set public_addresses, subs_hosts or acme_domains: links need the public address of the server"))
+		return
+	}
+
+	u := UserConfig{ID: req.ID, Name: req.Name, Password: randomHex(16), Group: req.Group, Limits: req.Limits}
+	if err := addUser(req.Server, u); err != nil {
+		fail(err)
+		return
+	}
+	res := newUserResult{Username: u.Username(), ID: u.ID, Password: u.Password, Delivered: []string{}}
+	log.Printf("Admin added user %s (id %s)", logUser(res.Username), res.ID)
+	if r.URL.Query().Get("save") == "1" {
+		if err := saveNewUser(req.Server, u); err != nil {
+			res.Warnings = append(res.Warnings, "added but not saved: "+err.Error())
+		}
+	}
+
+	if len(hosts) > 0 {
+		user, _ := lookupSubscription(u.SubsKey())
+		res.Links = subscriptionLinks(user, hosts)
+		if cfg.SubsListenPort != "" {
+			res.Subscription = subscriptionURL(hosts[0], u.SubsKey())
+		}
+	}
+	text := deliveryMessage(req.Name, res.Links, res.Subscription)
+	if req.Telegram != "" {
+		if err := sendTelegram(req.Telegram, text); err != nil {
+			res.Warnings = append(res.Warnings, "telegram: "+err.Error())
+		} else {
+			res.Delivered = append(res.Delivered, "telegram")
+		}
+	}
+	if req.Email != "" {
+		if err := sendEmail(req.Email, "Your Minewire access", text); err != nil {
+			res.Warnings = append(res.Warnings, "email: "+err.Error())
+		} else {
+			res.Delivered = append(res.Delivered, "email")
+		}
+	}
+	writeJSON(w, res)
+}
+
+// deliveryHosts returns the public hosts put into delivered links: public_addresses, or else the
+// first of subs_hosts or acme_domains.
+func deliveryHosts() []string {
+	cfg := currentConfig()
+	if len(cfg.PublicAddresses) > 0 {
+		return cfg.PublicAddresses
+	}
+	if len(cfg.SubsHosts) > 0 {
+		return cfg.SubsHosts[:1]
+	}
+	return cfg.ACMEDomains[:min(len(cfg.ACMEDomains), 1)]
+}
+
+// subscriptionURL returns the URL of the subscription key served on host.
+func subscriptionURL(host, key string) string {
+	cfg := currentConfig()
+	scheme := "http"
+	if cfg.SubsTLSCert != "" || acmeEnabled() {
+		scheme = "https"
+	}
+	if cfg.SubsSecret != "" {
+		t, err := newSubscriptionToken(key, 0)
+		if err != nil {
+			return ""
+		}
+		key = t.Token
+	}
+	return fmt.Sprintf("%s://%s%s%s", scheme, net.JoinHostPort(host, cfg.SubsListenPort), cfg.SubsPath, key)
+}
+
+// deliveryMessage is the text sent to a new user.
+func deliveryMessage(name string, links []string, subscription string) string {
+	var b strings.Builder
+	if name != "" {
+		fmt.Fprintf(&b, "Hello %s,\n\n", name)
+	}
+	b.WriteString("Import this link into your Minewire client:\n\n")
+	b.WriteString(strings.Join(links, "\n"))
+	if subscription != "" {
+		fmt.Fprintf(&b, "\n\nOr subscribe to receive updates automatically:\n\n%s", subscription)
+	}
+	b.WriteString("\n\nKeep it private: the link contains your password.\n")
+	return b.String()
+}
+
+// sendTelegram sends text to a chat through the Telegram bot of telegram_bot_token.
+func sendTelegram(chatID, text string) error {
+	cfg := currentConfig()
+	if cfg.TelegramBotToken == "" {
+		return errors.New("telegram_bot_token is not set")
+	}
+	form := url.Values{"chat_id": {chatID}, "text": {text}, "disable_web_page_preview": {"true"}}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.PostForm("https://api.telegram.org/bot"+cfg.TelegramBotToken+"/sendMessage", form)
+	if err != nil {
+		// The error contains the URL, which contains the token
+		return errors.New("could not reach the Telegram API")
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.OK {
+		return fmt.Errorf("%s %s", resp.Status, result.Description)
+	}
+	return nil
+}
+
+// sendEmail sends text through smtp_server, authenticating with smtp_username if set. Go's
+// SMTP client upgrades to STARTTLS when the server offers it and refuses to send the password
+// over an unencrypted connection to a remote host.
+func sendEmail(to, subject, text string) error {
+	cfg := currentConfig()
+	if cfg.SMTPServer == "" || cfg.SMTPFrom == "" {
+		return errors.New("smtp_server and smtp_from are not set")
+	}
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("invalid address")
+	}
+	host, _, err := net.SplitHostPort(cfg.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		cfg.SMTPFrom, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(cfg.SMTPServer, auth, cfg.SMTPFrom, []string{to}, []byte(msg))
+}
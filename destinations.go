@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Destination statistics privacy modes
+const (
+	DestStatsFull      = "full"      // Host names per user
+	DestStatsHashed    = "hashed"    // Keyed hashes of host names per user: repeats are visible, hosts are not
+	DestStatsAggregate = "aggregate" // Host names across all users only
+	DestStatsOff       = "off"
+)
+
+// destUsage is the traffic towards one destination host
+type destUsage struct {
+	Host      string `json:"host"`
+	Streams   int64  `json:"streams"`
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+}
+
+// destBucket holds one hour of destination counters, per user ("" when aggregated)
+type destBucket struct {
+	hour  time.Time
+	users map[string]map[string]*destUsage
+}
+
+var (
+	destBuckets []*destBucket // Oldest first
+	destLock    sync.Mutex
+	destSalt    []byte
+)
+
+// initDestinationStats checks the privacy mode and prepares the hashing key used in hashed mode.
+func initDestinationStats() {
+	cfg := currentConfig()
+	switch cfg.DestinationStats {
+	case DestStatsFull, DestStatsHashed, DestStatsAggregate, DestStatsOff:
+	default:
+		log.Fatalf("Unknown destination_stats mode: %s", cfg.DestinationStats)
+	}
+	if cfg.DestinationStatsSalt != "" {
+		destSalt = []byte(cfg.DestinationStatsSalt)
+	} else {
+		destSalt = make([]byte, 32)
+		rand.Read(destSalt)
+	}
+}
+
+// destinationKey returns the label under which a destination is counted, or "" if it must not be recorded.
+// Only the host is kept, ports and anything beyond are never stored.
+func destinationKey(dest string) string {
+	cfg := currentConfig()
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	switch cfg.DestinationStats {
+	case DestStatsFull, DestStatsAggregate:
+		return host
+	case DestStatsHashed:
+		mac := hmac.New(sha256.New, destSalt)
+		mac.Write([]byte(host))
+		return "h:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return ""
+}
+
+// recordDestination adds a finished stream to the current hour's destination counters.
+func recordDestination(username, dest string, up, down int64) {
+	cfg := currentConfig()
+	key := destinationKey(dest)
+	if key == "" {
+		return
+	}
+	if cfg.DestinationStats == DestStatsAggregate {
+		username = ""
+	}
+	hour := time.Now().Truncate(time.Hour)
+
+	destLock.Lock()
+	defer destLock.Unlock()
+	if n := len(destBuckets); n == 0 || !destBuckets[n-1].hour.Equal(hour) {
+		destBuckets = append(destBuckets, &destBucket{hour: hour, users: make(map[string]map[string]*destUsage)})
+	}
+	pruneDestinations()
+	b := destBuckets[len(destBuckets)-1]
+	hosts, ok := b.users[username]
+	if !ok {
+		hosts = make(map[string]*destUsage)
+		b.users[username] = hosts
+	}
+	u, ok := hosts[key]
+	if !ok {
+		u = &destUsage{Host: key}
+		hosts[key] = u
+	}
+	u.Streams++
+	u.BytesUp += up
+	u.BytesDown += down
+}
+
+// pruneDestinations drops buckets older than the retention period. Must be called with destLock held.
+func pruneDestinations() {
+	cfg := currentConfig()
+	cutoff := time.Now().Add(-time.Duration(cfg.DestinationStatsRetention) * time.Hour)
+	for len(destBuckets) > 0 && destBuckets[0].hour.Add(time.Hour).Before(cutoff) {
+		destBuckets = destBuckets[1:]
+	}
+}
+
+// topDestinations sums the retained buckets and returns the top n hosts for each user
+// ("" = all users) and across all users.
+func topDestinations(n int) (map[string][]destUsage, []destUsage) {
+	sums := make(map[string]map[string]*destUsage)
+	total := make(map[string]*destUsage)
+	add := func(m map[string]*destUsage, u *destUsage) {
+		t, ok := m[u.Host]
+		if !ok {
+			t = &destUsage{Host: u.Host}
+			m[u.Host] = t
+		}
+		t.Streams += u.Streams
+		t.BytesUp += u.BytesUp
+		t.BytesDown += u.BytesDown
+	}
+
+	destLock.Lock()
+	pruneDestinations()
+	for _, b := range destBuckets {
+		for user, hosts := range b.users {
+			if sums[user] == nil {
+				sums[user] = make(map[string]*destUsage)
+			}
+			for _, u := range hosts {
+				add(sums[user], u)
+				add(total, u)
+			}
+		}
+	}
+	destLock.Unlock()
+
+	top := func(m map[string]*destUsage) []destUsage {
+		list := make([]destUsage, 0, len(m))
+		for _, u := range m {
+			list = append(list, *u)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Streams > list[j].Streams })
+		if len(list) > n {
+			list = list[:n]
+		}
+		return list
+	}
+	perUser := make(map[string][]destUsage)
+	for user, m := range sums {
+		if user != "" {
+			perUser[user] = top(m)
+		}
+	}
+	return perUser, top(total)
+}
+
+// destinationsResponse is the document served by /api/destinations
+type destinationsResponse struct {
+	Mode           string                 `json:"mode"`
+	RetentionHours int                    `json:"retention_hours"`
+	Users          map[string][]destUsage `json:"users,omitempty"` // Not collected in aggregate mode
+	Total          []destUsage            `json:"total"`
+}
+
+func handleAdminDestinations(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	n := cfg.DestinationStatsTop
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		n = limit
+	}
+	users, total := topDestinations(n)
+	if user := r.URL.Query().Get("user"); user != "" {
+		users = map[string][]destUsage{user: users[user]}
+	}
+	writeJSON(w, destinationsResponse{
+		Mode:           cfg.DestinationStats,
+		RetentionHours: cfg.DestinationStatsRetention,
+		Users:          users,
+		Total:          total,
+	})
+}
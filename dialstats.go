@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxDialDestinations  = 1000 // Destinations tracked individually; others only count towards the totals
+	slowDialMinSamples   = 5    // Dials needed before a destination can be flagged
+	slowDialRatioFlagged = 0.5  // Moving share of slow dials above which a destination is flagged
+)
+
+// Address families destinations are dialed at (egress_family)
+const (
+	FamilyPreferIPv4 = "prefer_ipv4" // IPv4 addresses first, then IPv6
+	FamilyPreferIPv6 = "prefer_ipv6" // IPv6 addresses first, then IPv4
+	FamilyIPv4       = "ipv4"        // IPv4 addresses only
+	FamilyIPv6       = "ipv6"        // IPv6 addresses only
+)
+
+// Upper bounds of the latency histogram buckets; the last bucket is unbounded
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// latencyHistogram counts observed latencies per bucket
+type latencyHistogram struct {
+	Counts []int64 `json:"counts"` // len(latencyBuckets)+1 entries
+	Sum    float64 `json:"sum_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int64, len(latencyBuckets)+1)
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.Counts[i]++
+	ms := float64(d) / float64(time.Millisecond)
+	h.Sum += ms
+	if ms > h.Max {
+		h.Max = ms
+	}
+}
+
+// clone returns a copy that doesn't share the counts slice.
+func (h latencyHistogram) clone() latencyHistogram {
+	counts := make([]int64, len(latencyBuckets)+1)
+	copy(counts, h.Counts)
+	h.Counts = counts
+	return h
+}
+
+// dialStats holds DNS and connect latencies of one destination (or of all of them)
+type dialStats struct {
+	Dest     string           `json:"dest,omitempty"`
+	Dials    int64            `json:"dials"`
+	Failures int64            `json:"failures"`
+	DNS      latencyHistogram `json:"dns"`
+	Connect  latencyHistogram `json:"connect"`
+	Slow     bool             `json:"slow"`       // Consistently exceeds slow_dial_threshold
+	SlowRate float64          `json:"slow_ratio"` // Moving share of slow dials
+	LastSeen time.Time        `json:"last_seen"`
+}
+
+// snapshot returns a deep copy of the statistics. Must be called with dialLock held.
+func (s *dialStats) snapshot() *dialStats {
+	c := *s
+	c.DNS = s.DNS.clone()
+	c.Connect = s.Connect.clone()
+	return &c
+}
+
+var (
+	dialTotals = dialStats{}
+	dialByDest = make(map[string]*dialStats)
+	dialLock   sync.Mutex
+)
+
+// recordDial adds one dial attempt to the destination's and the global statistics.
+func recordDial(dest string, dnsTime, connectTime time.Duration, resolved, failed bool) {
+	cfg := currentConfig()
+	threshold := time.Duration(cfg.SlowDialThreshold) * time.Second
+	slow := dnsTime+connectTime > threshold
+
+	dialLock.Lock()
+	defer dialLock.Unlock()
+	targets := []*dialStats{&dialTotals}
+	// Per-destination entries follow the destination_stats privacy mode
+	key := destinationKey(dest)
+	d, ok := dialByDest[key]
+	if !ok && key != "" && len(dialByDest) < maxDialDestinations {
+		d = &dialStats{Dest: key}
+		dialByDest[key] = d
+		ok = true
+	}
+	if ok {
+		targets = append(targets, d)
+	}
+
+	for _, s := range targets {
+		s.Dials++
+		s.LastSeen = time.Now()
+		if failed {
+			s.Failures++
+		}
+		if resolved {
+			s.DNS.observe(dnsTime)
+		}
+		if !failed {
+			s.Connect.observe(connectTime)
+		}
+	}
+	if !ok {
+		return
+	}
+
+	// A destination is flagged once most of its recent dials were slow, and unflagged when they recover
+	sample := 0.0
+	if slow || failed {
+		sample = 1
+	}
+	d.SlowRate = 0.8*d.SlowRate + 0.2*sample
+	wasSlow := d.Slow
+	d.Slow = d.Dials >= slowDialMinSamples && d.SlowRate > slowDialRatioFlagged
+	if d.Slow && !wasSlow {
+		log.Printf("Destination %s is consistently slow (DNS %s, connect %s, threshold %s)",
+			key, dnsTime.Round(time.Millisecond), connectTime.Round(time.Millisecond), threshold)
+	}
+}
+
+// dialTimeout is the time streams have to connect to their destination, lookup included, unless
+// their user's limits set another.
+func dialTimeout() time.Duration {
+	cfg := currentConfig()
+	return time.Duration(cfg.DialTimeout) * time.Second
+}
+
+// userDialTimeout is the connect timeout of the streams of a user.
+func userDialTimeout(username string) time.Duration {
+	if _, limits, _ := lookupUser(username); limits.DialTimeout > 0 {
+		return time.Duration(limits.DialTimeout) * time.Second
+	}
+	return dialTimeout()
+}
+
+// dialDestination resolves and connects to dest within timeout, timing DNS resolution and the
+// TCP connect separately.
+func dialDestination(dest string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	ips, dnsTime, err := resolveDestination(ctx, host)
+	if err != nil {
+		recordDial(dest, dnsTime, 0, true, true)
+		return nil, err
+	}
+	return dialAddresses(ctx, dest, port, ips, dnsTime, net.ParseIP(host) == nil)
+}
+
+// resolveDestination returns the addresses of a destination host and how long the lookup
+// took: host itself if it is an address. Lookups go through the DNS cache unless it is
+// disabled.
+func resolveDestination(ctx context.Context, host string) ([]string, time.Duration, error) {
+	cfg := currentConfig()
+	if net.ParseIP(host) != nil {
+		return []string{host}, 0, nil
+	}
+	start := time.Now()
+	if cfg.DNSCacheSize > 0 {
+		ips, err := cachedLookup(ctx, host)
+		return ips, time.Since(start), err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	dnsTime := time.Since(start)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		return nil, dnsTime, err
+	}
+	ips := make([]string, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.String()
+	}
+	return ips, dnsTime, nil
+}
+
+// dialRounds splits the addresses of a destination into the rounds of a dial. Without
+// dial_retry it is a single round in egress_family order, the other family left out with ipv4
+// or ipv6. With dial_retry the first round has the addresses of the preferred family (else of
+// the first address), the retry those of the other family.
+func dialRounds(ips []string) (first, retry []string) {
+	cfg := currentConfig()
+	var v4, v6 []string
+	for _, ip := range ips {
+		if isIPv4(ip) {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if cfg.DialRetry {
+		switch cfg.EgressFamily {
+		case FamilyPreferIPv4, FamilyIPv4:
+			first, retry = v4, v6
+		case FamilyPreferIPv6, FamilyIPv6:
+			first, retry = v6, v4
+		default:
+			first, retry = v4, v6
+			if len(ips) > 0 && !isIPv4(ips[0]) {
+				first, retry = v6, v4
+			}
+		}
+		if len(first) == 0 {
+			first, retry = retry, nil
+		}
+		return first, retry
+	}
+	switch cfg.EgressFamily {
+	case FamilyPreferIPv4:
+		return append(v4, v6...), nil
+	case FamilyPreferIPv6:
+		return append(v6, v4...), nil
+	case FamilyIPv4:
+		return v4, nil
+	case FamilyIPv6:
+		return v6, nil
+	}
+	return ips, nil
+}
+
+// dialAddresses connects to the first of the addresses of dest that accepts, in the rounds of
+// dialRounds, recording the dial with the time its lookup took (resolved is false for
+// destinations given as addresses). A retry round gets the second half of the time left; within
+// a round each address gets an equal share, so an unreachable family doesn't use up the timeout.
+func dialAddresses(ctx context.Context, dest, port string, ips []string, dnsTime time.Duration, resolved bool) (net.Conn, error) {
+	cfg := currentConfig()
+	first, retry := dialRounds(ips)
+	start := time.Now()
+	if len(first) == 0 {
+		recordDial(dest, dnsTime, 0, resolved, true)
+		return nil, fmt.Errorf("no %s address", cfg.EgressFamily)
+	}
+	roundCtx, cancel := ctx, context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok && len(retry) > 0 {
+		roundCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/2)
+	}
+	conn, err := dialRound(roundCtx, first, port)
+	cancel()
+	if err != nil && len(retry) > 0 && ctx.Err() == nil {
+		conn, err = dialRound(ctx, retry, port)
+	}
+	recordDial(dest, dnsTime, time.Since(start), resolved, err != nil)
+	return conn, err
+}
+
+// destinationDialer returns a dialer for destination connections, with the TCP keepalives of
+// destination_keepalive.
+func destinationDialer() net.Dialer {
+	cfg := currentConfig()
+	if cfg.DestinationKeepAlive < 0 {
+		return net.Dialer{KeepAlive: -1}
+	}
+	interval := time.Duration(cfg.DestinationKeepAlive) * time.Second
+	return net.Dialer{KeepAliveConfig: net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval}}
+}
+
+// dialRound connects to the first of the addresses that accepts, each getting an equal share of
+// the time left.
+func dialRound(ctx context.Context, ips []string, port string) (net.Conn, error) {
+	var err error
+	dialer := destinationDialer()
+	for i, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(ips)-i))
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(ip, port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialStatsResponse is the document served by /api/dials
+type dialStatsResponse struct {
+	ThresholdSeconds int           `json:"slow_threshold_seconds"`
+	BucketsMs        []int64       `json:"buckets_ms"` // Upper bounds; the last histogram count is above the last bound
+	Total            dialStats     `json:"total"`
+	Destinations     []*dialStats  `json:"destinations"` // Slow destinations first, then by dial count
+	DNSCache         dnsCacheStats `json:"dns_cache"`
+}
+
+func handleAdminDials(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	resp := dialStatsResponse{ThresholdSeconds: cfg.SlowDialThreshold, DNSCache: collectDNSCacheStats()}
+	for _, b := range latencyBuckets {
+		resp.BucketsMs = append(resp.BucketsMs, b.Milliseconds())
+	}
+
+	dialLock.Lock()
+	resp.Total = *dialTotals.snapshot()
+	for _, d := range dialByDest {
+		resp.Destinations = append(resp.Destinations, d.snapshot())
+	}
+	dialLock.Unlock()
+
+	sort.Slice(resp.Destinations, func(i, j int) bool {
+		a, b := resp.Destinations[i], resp.Destinations[j]
+		if a.Slow != b.Slow {
+			return a.Slow
+		}
+		return a.Dials > b.Dials
+	})
+	writeJSON(w, resp)
+}
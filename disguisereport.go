@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
+)
+
+// Protocol version of 1.20.2, which added the configuration phase between login and play
+const protocolConfigPhase = 764
+
+// disguiseReport describes how the game server srv presents itself to clients and scanners: the
+// status JSON, the packets sent after login, the realism features in use and known differences
+// from a real server. The same configuration always gives the same report.
+func disguiseReport(srv *Config) []string {
+	var lines []string
+	add := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+
+	add("Disguise report for server %s (port %s)", srv.Name, srv.ListenPort)
+	profile := srv.Profile
+	if profile == "" {
+		profile = "none"
+	}
+	add("  profile %s, version %q, protocol %d, brand %q, status mode %s",
+		profile, srv.VersionName, srv.ProtocolID, srv.Brand, srv.StatusMode)
+
+	// Simulated players are left out so the report only changes with the configuration
+	add("Status JSON (players.online varies between %d and %d, players.sample lists up to %d simulated players):",
+		srv.OnlineMin, srv.OnlineMax, maxStatusSample)
+	add("  %s", reportStatusJSON(srv))
+	add("  Unauthorized logins are disconnected with %q", rejectMessage(srv))
+
+	// Clients of protocol_id; with packet_ids: version other versions get their own IDs
+	proto := sessionProtocol(srv, srv.ProtocolID)
+	add("Packets after an authorized login (%s packet IDs):", srv.PacketIDs)
+	add("  -> 0x%02X Login Success", PID_CB_LoginSuccess)
+	add("  -> 0x%02X Join Game (minecraft:overworld, view distance 8)", proto.ID(mcproto.JoinGame))
+	add("  -> 0x%02X Plugin Message minecraft:brand %q", proto.ID(mcproto.PluginMessage), srv.Brand)
+	add("  -> 0x%02X Synchronize Player Position", proto.ID(mcproto.PlayerPosition))
+	if srv.ResourcePackURL != "" {
+		add("  -> 0x%02X Add Resource Pack %s (forced: %t)", proto.ID(mcproto.AddResourcePack), srv.ResourcePackURL, srv.ResourcePackForced)
+	}
+	add("  -> 0x%02X Player Info Update (simulated players)", proto.ID(mcproto.PlayerInfoUpdate))
+	if srv.TimeUpdateInterval > 0 {
+		add("  -> 0x%02X Time Update, then every %ds", proto.ID(mcproto.TimeUpdate), srv.TimeUpdateInterval)
+	}
+	add("  -> 0x%02X Keep Alive every %ds", proto.ID(mcproto.KeepAlive), srv.KeepAliveInterval)
+	add("  <> 0x%02X Chunk Data / 0x%02X Plugin Message carrying tunnel frames (chunks of up to %d bytes of tunnel data)",
+		proto.ID(mcproto.ChunkData), proto.ID(mcproto.ServerboundPluginMessage), srv.TunnelFrameSize)
+	add("  -> 0x%02X/0x%02X Player Info Update/Remove as simulated players join and leave", proto.ID(mcproto.PlayerInfoUpdate), proto.ID(mcproto.PlayerInfoRemove))
+	if srv.Weather && srv.TimeUpdateInterval > 0 {
+		add("  -> 0x%02X Game Event when the simulated weather changes", proto.ID(mcproto.GameEvent))
+	}
+	if srv.ChatSimulation {
+		add("  -> 0x%02X System Chat about every %ds", proto.ID(mcproto.SystemChat), srv.ChatInterval)
+	}
+
+	add("Realism features:")
+	feature := func(name string, on bool, detail string) {
+		state := "off"
+		if on {
+			state = "on "
+		}
+		if detail != "" && on {
+			detail = " (" + detail + ")"
+		} else {
+			detail = ""
+		}
+		add("  %s %s%s", state, name, detail)
+	}
+	feature("player simulation", srv.StatusMode == StatusModeNormal && srv.OnlineMax > 0,
+		fmt.Sprintf("%d-%d of %d", srv.OnlineMin, srv.OnlineMax, srv.MaxPlayers))
+	feature("server icon", srv.IconPath != "" && fileExists(srv.IconPath), srv.IconPath)
+	feature("query protocol", srv.QueryEnabled, "UDP "+srv.QueryPort)
+	feature("world time", srv.TimeUpdateInterval > 0, "")
+	feature("weather", srv.Weather && srv.TimeUpdateInterval > 0, "")
+	feature("chat simulation", srv.ChatSimulation, "")
+	feature("resource pack", srv.ResourcePackURL != "", "")
+	feature("cover traffic", srv.CaptureTemplate != "", srv.CaptureTemplate)
+	feature("decoy sessions", srv.DecoyMode, "")
+	feature("scanner tarpit and bans", srv.AnomalyScoring, "")
+
+	add("Fingerprint warnings:")
+	for _, w := range fingerprintWarnings(srv) {
+		add("  - %s", w)
+	}
+	return lines
+}
+
+// reportStatusJSON returns the status JSON of srv without simulated players, with the icon shortened.
+func reportStatusJSON(srv *Config) string {
+	d := string(statusJSON(srv, 0, nil))
+	var status struct {
+		Favicon string `json:"favicon"`
+	}
+	if json.Unmarshal([]byte(d), &status) == nil && status.Favicon != "" {
+		d = strings.Replace(d, status.Favicon, fmt.Sprintf("data:image/png;base64,... (%d bytes)", len(status.Favicon)), 1)
+	}
+	return d
+}
+
+// fingerprintWarnings lists known differences between srv and a real server of the version it claims.
+func fingerprintWarnings(srv *Config) []string {
+	warnings := []string{
+		"compression is disabled: vanilla servers send Set Compression (threshold 256) before Login Success",
+		"no Encryption Request: the login looks like an offline-mode server",
+	}
+	if srv.VersionName == "" && srv.StatusMode != StatusModeMaintenance {
+		warnings = append(warnings, "version_name is empty: clients show no version")
+	}
+	if srv.ProtocolID >= protocolConfigPhase {
+		warnings = append(warnings, "no configuration phase: play packets follow Login Success directly, as before 1.20.2")
+	}
+	if srv.TunnelCoalesceDelay < 0 {
+		warnings = append(warnings, "tunnel_coalesce_delay is -1: multiplexer headers go out as tiny Chunk Data packets")
+	}
+	if _, ok := mcproto.IDsFor(srv.ProtocolID); ok && srv.PacketIDs == core.PacketIDsLegacy {
+		warnings = append(warnings, "packet_ids is legacy: play packets use the IDs of 1.20.3 whatever the client's version")
+	}
+	if !srv.EnforcesSecureChat && srv.ProtocolID >= 761 && srv.StatusMode != StatusModeMaintenance {
+		warnings = append(warnings, "enforces_secure_chat is false: vanilla 1.19.3+ servers report true by default")
+	}
+	if srv.IconPath == "" || !fileExists(srv.IconPath) {
+		warnings = append(warnings, "no server icon: most public servers have one")
+	}
+	if srv.TimeUpdateInterval <= 0 {
+		warnings = append(warnings, "time updates are disabled: vanilla servers send the world time every second")
+	}
+	if srv.StatusMode == StatusModeNormal && srv.OnlineMax == 0 {
+		warnings = append(warnings, "nobody is ever online: an empty server that authorized agents keep joining stands out")
+	}
+	if srv.Profile == "" && srv.Brand == "vanilla" && len(srv.StatusExtras) > 0 {
+		warnings = append(warnings, "status_extras are set but the brand is vanilla")
+	}
+	if srv.ResourcePackURL != "" && srv.ResourcePackSHA1 == "" {
+		warnings = append(warnings, "resource pack without resource_pack_sha1: clients download it on every join")
+	}
+	return warnings
+}
+
+// fileExists reports whether path names an existing file.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// logDisguiseReport logs the disguise report of every game server at startup.
+func logDisguiseReport() {
+	for _, srv := range allServers() {
+		for _, line := range disguiseReport(srv) {
+			log.Print(line)
+		}
+	}
+}
+
+// runConfigReport prints the disguise report of every game server. Returns the process exit code.
+func runConfigReport() int {
+	for i, srv := range allServers() {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(strings.Join(disguiseReport(srv), "\n"))
+	}
+	return 0
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TTL of answers without one, i.e. from the hosts file or a system resolver
+	dnsDefaultTTL = time.Minute
+	// Lookups failing for other reasons than a missing name (timeouts, SERVFAIL) are retried
+	// after at most this long
+	dnsFailureTTL = 5 * time.Second
+)
+
+// dnsEntry is a cached lookup: addresses, or the error of a negative answer
+type dnsEntry struct {
+	ips     []string
+	err     error
+	expires time.Time
+}
+
+// dnsCall is a lookup in progress, shared by the streams asking for the same host meanwhile
+type dnsCall struct {
+	done chan struct{}
+	ips  []string
+	err  error
+}
+
+// dnsCacheStats is the cache part of /api/dials
+type dnsCacheStats struct {
+	Entries      int   `json:"entries"`
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	Misses       int64 `json:"misses"` // Lookups sent to the resolver
+	Shared       int64 `json:"shared"` // Lookups that waited for the same one in progress
+}
+
+var (
+	dnsCache     = make(map[string]*dnsEntry) // By lower case host
+	dnsCalls     = make(map[string]*dnsCall)
+	dnsStats     dnsCacheStats
+	dnsCacheLock sync.Mutex
+)
+
+// cachedLookup returns the addresses of host from the cache, else looks them up once for all
+// the streams asking meanwhile and caches the answer for its TTL, capped by dns_cache_max_ttl,
+// or a negative answer for at most dns_cache_negative_ttl.
+func cachedLookup(ctx context.Context, host string) ([]string, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	dnsCacheLock.Lock()
+	if e := dnsCache[key]; e != nil && now.Before(e.expires) {
+		if e.err != nil {
+			dnsStats.NegativeHits++
+		} else {
+			dnsStats.Hits++
+		}
+		dnsCacheLock.Unlock()
+		return e.ips, e.err
+	}
+	call := dnsCalls[key]
+	if call != nil {
+		dnsStats.Shared++
+	} else {
+		dnsStats.Misses++
+		call = &dnsCall{done: make(chan struct{})}
+		dnsCalls[key] = call
+		// The lookup outlives the stream that started it, for the others waiting
+		go func() {
+			lookupCtx, cancel := context.WithTimeout(context.Background(), dialTimeout())
+			defer cancel()
+			ips, ttl, err := lookupWithTTL(lookupCtx, host)
+			call.ips, call.err = ips, err
+			dnsCacheLock.Lock()
+			delete(dnsCalls, key)
+			if ttl > 0 {
+				storeDNSEntry(key, &dnsEntry{ips: ips, err: err, expires: time.Now().Add(ttl)})
+			}
+			dnsCacheLock.Unlock()
+			close(call.done)
+		}()
+	}
+	dnsCacheLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// storeDNSEntry caches a lookup. A full cache first drops the tenth of its entries expiring
+// soonest, expired ones included. Must be called with dnsCacheLock held.
+func storeDNSEntry(key string, e *dnsEntry) {
+	cfg := currentConfig()
+	if len(dnsCache) >= cfg.DNSCacheSize {
+		keys := make([]string, 0, len(dnsCache))
+		for k := range dnsCache {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b string) int { return dnsCache[a].expires.Compare(dnsCache[b].expires) })
+		for _, k := range keys[:len(keys)/10+1] {
+			delete(dnsCache, k)
+		}
+	}
+	dnsCache[key] = e
+}
+
+// lookupWithTTL looks up the addresses of host with the Go resolver (resolv.conf, search
+// domains, hosts file) and returns how long to cache the answer, read from the DNS responses.
+func lookupWithTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	cfg := currentConfig()
+	ttls := &dnsTTLs{positive: -1, negative: -1}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// The resolver frames messages for TCP unless the connection is a PacketConn
+			if udp, ok := conn.(*net.UDPConn); ok {
+				return &dnsTTLPacketConn{UDPConn: udp, ttls: ttls}, nil
+			}
+			return &dnsTTLConn{Conn: conn, ttls: ttls}, nil
+		},
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+
+	ttls.mu.Lock()
+	defer ttls.mu.Unlock()
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, min(dnsFailureTTL, time.Duration(cfg.DNSCacheNegativeTTL)*time.Second), err
+		}
+		ttl := time.Duration(cfg.DNSCacheNegativeTTL) * time.Second
+		if ttls.negative >= 0 {
+			ttl = min(ttl, ttls.negative)
+		}
+		return nil, ttl, err
+	}
+	ips := make([]string, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.String()
+	}
+	ttl := dnsDefaultTTL
+	if ttls.positive >= 0 {
+		ttl = ttls.positive
+	}
+	return ips, min(ttl, time.Duration(cfg.DNSCacheMaxTTL)*time.Second), nil
+}
+
+// dnsTTLs collects the TTLs of the DNS responses of a lookup: the lowest of the answers, and
+// for negative answers the lowest SOA minimum (RFC 2308). -1 until seen.
+type dnsTTLs struct {
+	mu       sync.Mutex
+	positive time.Duration
+	negative time.Duration
+}
+
+// observe reads the TTLs of a DNS response. Malformed responses are ignored: the resolver
+// rejects them too.
+func (t *dnsTTLs) observe(msg []byte) {
+	positive, negative, ok := parseDNSTTLs(msg)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if positive >= 0 && (t.positive < 0 || positive < t.positive) {
+		t.positive = positive
+	}
+	if negative >= 0 && (t.negative < 0 || negative < t.negative) {
+		t.negative = negative
+	}
+}
+
+// parseDNSTTLs returns the lowest TTL of the answer records of a response, and for responses
+// without answers the negative caching TTL of the SOA record in the authority section. Either
+// is -1 if absent.
+func parseDNSTTLs(msg []byte) (positive, negative time.Duration, ok bool) {
+	positive, negative = -1, -1
+	if len(msg) < 12 || msg[2]&0x80 == 0 { // Not a response
+		return positive, negative, false
+	}
+	rcode := msg[3] & 0x0f
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	off := 12
+	for range qdcount {
+		if off = skipDNSName(msg, off); off < 0 || off+4 > len(msg) {
+			return positive, negative, false
+		}
+		off += 4
+	}
+	for i := range ancount + nscount {
+		if off = skipDNSName(msg, off); off < 0 || off+10 > len(msg) {
+			return positive, negative, false
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return positive, negative, false
+		}
+		switch {
+		case i < ancount && rcode == 0:
+			if positive < 0 || ttl < positive {
+				positive = ttl
+			}
+		case i >= ancount && ancount == 0 && rrType == 6 && rdlen >= 20: // SOA
+			// The TTL of a negative answer is the lower of the SOA's TTL and MINIMUM fields
+			minimum := time.Duration(binary.BigEndian.Uint32(msg[off+rdlen-4:])) * time.Second
+			negative = min(ttl, minimum)
+		}
+		off += rdlen
+	}
+	return positive, negative, true
+}
+
+// skipDNSName returns the offset after the name at off, or -1 if it is malformed.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1
+		case n&0xc0 == 0xc0: // Compression pointer
+			return off + 2
+		case n&0xc0 != 0:
+			return -1
+		}
+		off += 1 + n
+	}
+	return -1
+}
+
+// dnsTTLPacketConn passes the DNS responses read by the resolver over UDP to dnsTTLs
+type dnsTTLPacketConn struct {
+	*net.UDPConn
+	ttls *dnsTTLs
+}
+
+func (c *dnsTTLPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	c.ttls.observe(b[:n])
+	return n, err
+}
+
+// dnsTTLConn passes the DNS responses read by the resolver over TCP, where messages are
+// prefixed with their length, to dnsTTLs
+type dnsTTLConn struct {
+	net.Conn
+	ttls *dnsTTLs
+	buf  []byte // Bytes of the message being read
+}
+
+func (c *dnsTTLConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.ttls.observe(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
+
+// collectDNSCacheStats returns the cache counters for /api/dials.
+func collectDNSCacheStats() dnsCacheStats {
+	dnsCacheLock.Lock()
+	defer dnsCacheLock.Unlock()
+	stats := dnsStats
+	stats.Entries = len(dnsCache)
+	return stats
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
+)
+
+// Set by --dry-run: check the configuration end to end instead of serving
+var dryRun bool
+
+// runDryRun validates the configuration, binds every configured port briefly, runs the status
+// and login handshakes of each game server against a built-in client over loopback, and prints
+// the usernames and subscription links that would be served. Returns the process exit code.
+func runDryRun() int {
+	cfg := currentConfig()
+	failed := false
+	report := func(ok bool, format string, a ...interface{}) {
+		status := "OK  "
+		if !ok {
+			status, failed = "FAIL", true
+		}
+		fmt.Printf("  %s %s\n", status, fmt.Sprintf(format, a...))
+	}
+
+	fmt.Printf("Config %s\n", configPath)
+	for _, p := range validateConfig(cfg) {
+		report(!strings.HasPrefix(p, "ERROR"), "%s", p)
+	}
+
+	// The server logs of the simulated sessions would only clutter the report
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initAuthMap()
+	initListenerACL()
+	initLimits()
+
+	fmt.Printf("Listeners\n")
+	for _, b := range dryRunBinds() {
+		var err error
+		if b.udp {
+			var pc net.PacketConn
+			if pc, err = net.ListenPacket("udp", b.addr); err == nil {
+				pc.Close()
+			}
+		} else {
+			var ln net.Listener
+			if ln, err = net.Listen("tcp", b.addr); err == nil {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			report(false, "%s %s: %v", b.name, b.addr, err)
+		} else {
+			report(true, "%s %s", b.name, b.addr)
+		}
+	}
+
+	hosts := []string{"<server-address>"}
+	if len(cfg.PublicAddresses) > 0 {
+		hosts = cfg.PublicAddresses
+	} else if len(cfg.ACMEDomains) > 0 {
+		hosts = cfg.ACMEDomains[:1]
+	}
+	for _, srv := range allServers() {
+		fmt.Printf("Server %s (port %s)\n", srv.Name, srv.ListenPort)
+		addr, stop, err := dryRunServe(srv)
+		if err != nil {
+			report(false, "loopback listener: %v", err)
+			continue
+		}
+		if status, err := dryRunStatus(addr, srv); err != nil {
+			report(false, "status: %v", err)
+		} else {
+			report(true, "status: %s", status)
+		}
+		for _, u := range srv.Passwords {
+			name := u.Name
+			if name == "" {
+				name = "(no name)"
+			}
+			fmt.Printf("  user %s -> %s\n", name, u.Username())
+			if u.Password == "" {
+				fmt.Printf("       configured by key, no login test or subscription link\n")
+				continue
+			}
+			if res, err := checkTunnel(addr, u.Password, 64<<10); err != nil {
+				report(false, "tunnel %v", err)
+			} else {
+				report(true, "login %s, stream round trip %s", res.login.Round(time.Millisecond), res.roundTrip.Round(time.Millisecond))
+			}
+			if key := u.SubsKey(); key != "" && cfg.SubsListenPort != "" {
+				user, _ := lookupSubscription(key)
+				for _, link := range subscriptionLinks(user, hosts) {
+					fmt.Printf("       %s\n", link)
+				}
+			}
+		}
+		stop()
+	}
+
+	if failed {
+		fmt.Printf("Dry run failed\n")
+		return 1
+	}
+	fmt.Printf("Dry run OK, nothing was served\n")
+	return 0
+}
+
+// dryRunBind is a configured address checked by the dry run
+type dryRunBind struct {
+	name, addr string
+	udp        bool
+}
+
+// dryRunBinds lists the addresses the server would listen on.
+func dryRunBinds() []dryRunBind {
+	cfg := currentConfig()
+	var binds []dryRunBind
+	for _, srv := range allServers() {
+		binds = append(binds, dryRunBind{name: socketName(srv), addr: gameAddr(srv)})
+	}
+	if cfg.QueryEnabled {
+		binds = append(binds, dryRunBind{name: "query", addr: ":" + cfg.QueryPort, udp: true})
+	}
+	if cfg.SubsListenPort != "" {
+		binds = append(binds, dryRunBind{name: "subs", addr: subsAddr(cfg)})
+	}
+	if acmeEnabled() && cfg.ACMEChallenge == ACMEChallengeHTTP {
+		binds = append(binds, dryRunBind{name: "acme", addr: ":" + cfg.ACMEHTTPPort})
+	}
+	if cfg.AdminListen != "" && cfg.AdminToken != "" {
+		binds = append(binds, dryRunBind{name: "admin", addr: cfg.AdminListen})
+	}
+	return binds
+}
+
+// dryRunServe serves the game server srv on a loopback port until stop is called.
+func dryRunServe(srv *Config) (addr string, stop func(), err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, srv)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }, nil
+}
+
+// dryRunStatus performs a server list ping and summarizes the status response.
+func dryRunStatus(addr string, srv *Config) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	if err := core.WriteHandshake(conn, srv.ProtocolID, host, port, core.NextStateStatus); err != nil {
+		return "", err
+	}
+	if err := mcproto.WritePacket(conn, 0x00, nil); err != nil { // Status Request
+		return "", err
+	}
+
+	pid, body, err := mcproto.NewPacketReader(conn).ReadPacket()
+	if err != nil {
+		return "", err
+	}
+	if pid != PID_CB_StatusResp {
+		return "", fmt.Errorf("unexpected packet 0x%02x", pid)
+	}
+	text, err := mcproto.ReadString(bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	var status struct {
+		Version mcproto.Version `json:"version"`
+		Players mcproto.Players `json:"players"`
+	}
+	if err := json.Unmarshal([]byte(text), &status); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%q protocol %d, %d/%d online, %d bytes",
+		status.Version.Name, status.Version.Protocol, status.Players.Online, status.Players.Max, len(text)), nil
+}
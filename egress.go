@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"minewire-server/internal/core"
+)
+
+// Egress actions
+const (
+	EgressAllow    = "allow"    // Connect from the server
+	EgressDeny     = "deny"     // Close the stream without connecting
+	EgressUpstream = "upstream" // Connect through one of the rule's upstream exits
+)
+
+// EgressRule decides what happens to the streams whose destination it matches. Every condition
+// a rule sets must match (a list matches if any entry does): domains and regex the hostname a
+// client asked for, ips and countries the address it asked for or the addresses its hostname
+// resolves to, ports the destination port. lists names egress_lists whose domains match the
+// hostname and whose networks match the addresses.
+type EgressRule struct {
+	Action    string   `yaml:"action" json:"action"`
+	Domains   []string `yaml:"domains,omitempty" json:"domains,omitempty"`     // Domains and their subdomains
+	Regex     string   `yaml:"regex,omitempty" json:"regex,omitempty"`         // Hostname regular expression
+	IPs       []string `yaml:"ips,omitempty" json:"ips,omitempty"`             // Addresses or networks (CIDR)
+	Countries []string `yaml:"countries,omitempty" json:"countries,omitempty"` // ISO 3166 codes, from asn_database
+	Ports     []string `yaml:"ports,omitempty" json:"ports,omitempty"`         // Ports or ranges like 6881-6889
+	Lists     []string `yaml:"lists,omitempty" json:"lists,omitempty"`         // Names of egress_lists
+	Upstream  string   `yaml:"upstream,omitempty" json:"upstream,omitempty"`   // Exit of the upstream action, see upstreams
+	// More exits of the upstream action: socks5:// or http:// proxies, or direct:// with a local
+	// address to connect from. strategy picks among upstream and upstreams.
+	Upstreams []string `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
+	Strategy  string   `yaml:"strategy,omitempty" json:"strategy,omitempty"` // round_robin (default), least_latency, hash or failover
+}
+
+// EgressPolicy is an ordered list of rules: the first one matching a destination decides,
+// Default (allow when empty) decides for the others.
+type EgressPolicy struct {
+	Default string       `yaml:"default,omitempty" json:"default,omitempty"`
+	Rules   []EgressRule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+// egressRule is an EgressRule ready to match
+type egressRule struct {
+	EgressRule
+	index     int // Position in its policy, from 1, for close reasons
+	group     string
+	regex     *regexp.Regexp
+	networks  []netip.Prefix
+	ports     [][2]int
+	countries []string // Upper case
+	upstreams []*url.URL
+	next      atomic.Uint64 // Round robin position
+}
+
+// egressRuleSet is an EgressPolicy ready to match
+type egressRuleSet struct {
+	def   string
+	rules []*egressRule
+}
+
+// Compiled egress policies, replaced on config reload
+var (
+	egressGlobal *egressRuleSet
+	egressGroups map[string]*egressRuleSet
+	egressLock   sync.RWMutex
+)
+
+// compile checks a policy and prepares its rules. group names the policy in close reasons.
+func (p EgressPolicy) compile(group string) (*egressRuleSet, error) {
+	set := &egressRuleSet{def: p.Default}
+	if p.Default != "" && p.Default != EgressAllow && p.Default != EgressDeny {
+		return nil, fmt.Errorf("default %q must be allow or deny", p.Default)
+	}
+	for i, r := range p.Rules {
+		rule := &egressRule{EgressRule: r, index: i + 1, group: group}
+		fail := func(format string, a ...any) error {
+			return fmt.Errorf("rule %d: %s", i+1, fmt.Sprintf(format, a...))
+		}
+		switch r.Action {
+		case EgressAllow, EgressDeny:
+			if r.Upstream != "" || len(r.Upstreams) > 0 || r.Strategy != "" {
+				return nil, fail("upstream, upstreams and strategy are only used by the upstream action")
+			}
+		case EgressUpstream:
+			exits := r.Upstreams
+			if r.Upstream != "" {
+				exits = append([]string{r.Upstream}, exits...)
+			}
+			if len(exits) == 0 {
+				return nil, fail("the upstream action needs upstream or upstreams")
+			}
+			for _, exit := range exits {
+				u, err := parseUpstream(exit)
+				if err != nil {
+					return nil, fail("%v", err)
+				}
+				rule.upstreams = append(rule.upstreams, u)
+			}
+			switch r.Strategy {
+			case "", StrategyRoundRobin, StrategyLeastLatency, StrategyHash, StrategyFailover:
+			default:
+				return nil, fail("strategy %q must be round_robin, least_latency, hash or failover", r.Strategy)
+			}
+		default:
+			return nil, fail("action %q must be allow, deny or upstream", r.Action)
+		}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fail("regex: %v", err)
+			}
+			rule.regex = re
+		}
+		for _, ip := range r.IPs {
+			n, err := core.ParseNetwork(ip)
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			rule.networks = append(rule.networks, n)
+		}
+		for _, c := range r.Countries {
+			if len(c) != 2 {
+				return nil, fail("%q is not a two-letter country code", c)
+			}
+			rule.countries = append(rule.countries, strings.ToUpper(c))
+		}
+		for _, p := range r.Ports {
+			lo, hi, isRange := strings.Cut(p, "-")
+			from, err1 := strconv.Atoi(lo)
+			to, err2 := from, error(nil)
+			if isRange {
+				to, err2 = strconv.Atoi(hi)
+			}
+			if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+				return nil, fail("invalid port or range %q", p)
+			}
+			rule.ports = append(rule.ports, [2]int{from, to})
+		}
+		if len(r.Domains) == 0 && r.Regex == "" && len(r.IPs) == 0 && len(r.Countries) == 0 && len(r.Ports) == 0 && len(r.Lists) == 0 {
+			return nil, fail("matches nothing (no domains, regex, ips, countries, ports or lists)")
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+// needsAddresses reports whether the rule looks at the addresses of the destination host. Lists
+// only need them when none matches the hostname itself.
+func (r *egressRule) needsAddresses(host string, name bool) bool {
+	if len(r.networks) > 0 || len(r.countries) > 0 {
+		return true
+	}
+	var networks bool
+	for _, n := range r.Lists {
+		if l := egressList(n); l != nil {
+			if name && l.matchName(host) {
+				return false
+			}
+			networks = networks || len(l.networks) > 0
+		}
+	}
+	return networks
+}
+
+// match reports whether the rule matches a destination: host as the client sent it (name is
+// false for an address), its port and its addresses.
+func (r *egressRule) match(host string, name bool, port int, addrs []netip.Addr) bool {
+	if len(r.ports) > 0 && !slices.ContainsFunc(r.ports, func(p [2]int) bool { return port >= p[0] && port <= p[1] }) {
+		return false
+	}
+	if len(r.Domains) > 0 && (!name || !slices.ContainsFunc(r.Domains, func(d string) bool { return core.MatchDomain(host, d) })) {
+		return false
+	}
+	if r.regex != nil && (!name || !r.regex.MatchString(strings.ToLower(strings.TrimSuffix(host, ".")))) {
+		return false
+	}
+	if len(r.networks) > 0 && !slices.ContainsFunc(addrs, func(a netip.Addr) bool {
+		return slices.ContainsFunc(r.networks, func(n netip.Prefix) bool { return n.Contains(a) })
+	}) {
+		return false
+	}
+	if len(r.countries) > 0 && !slices.ContainsFunc(addrs, func(a netip.Addr) bool {
+		rng, ok := asnDB.lookup(a.String())
+		return ok && slices.Contains(r.countries, rng.country)
+	}) {
+		return false
+	}
+	// A list not loaded yet matches nothing
+	if len(r.Lists) > 0 && !slices.ContainsFunc(r.Lists, func(n string) bool {
+		l := egressList(n)
+		return l != nil && (name && l.matchName(host) || slices.ContainsFunc(addrs, l.matchAddr))
+	}) {
+		return false
+	}
+	return true
+}
+
+// describe names the rule in close reasons and the access log.
+func (r *egressRule) describe() string {
+	if r.group != "" {
+		return fmt.Sprintf("egress group %s rule %d", r.group, r.index)
+	}
+	return fmt.Sprintf("egress rule %d", r.index)
+}
+
+// initEgress compiles the egress policy and the policies of the egress groups. The config was
+// validated, so errors only leave a policy out.
+func initEgress() {
+	cfg := currentConfig()
+	global, _ := cfg.Egress.compile("")
+	groups := make(map[string]*egressRuleSet)
+	for name, p := range cfg.EgressGroups {
+		if set, err := p.compile(name); err == nil {
+			groups[name] = set
+		}
+	}
+	egressLock.Lock()
+	egressGlobal, egressGroups = global, groups
+	egressLock.Unlock()
+}
+
+// errEgressDenied is returned for streams to destinations the egress policy denies
+var errEgressDenied = errors.New("denied")
+
+// dialEgress connects a stream of username to dest as the egress policy says: directly, through
+// an upstream proxy, or not at all. The rules of the user's egress group come first, then the
+// global ones; the group's default, else the global default, decides for destinations none
+// matches. Destinations are resolved at most once, when a rule needs their addresses, and
+// dialed at those addresses, all within the user's dial timeout.
+func dialEgress(username, dest string) (net.Conn, error) {
+	timeout := userDialTimeout(username)
+	egressLock.RLock()
+	global, group := egressGlobal, egressGroups[userGroup(username)]
+	egressLock.RUnlock()
+	if (global == nil || len(global.rules) == 0 && global.def != EgressDeny) && group == nil {
+		return dialDestination(dest, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	literal, err := netip.ParseAddr(host)
+	name := err != nil
+	var addrs []netip.Addr
+	var ips []string
+	var dnsTime time.Duration
+	if !name {
+		addrs, ips = []netip.Addr{literal.Unmap()}, []string{host}
+	}
+
+	var rules []*egressRule
+	def := EgressAllow
+	if global != nil {
+		def = cmp.Or(global.def, def)
+	}
+	if group != nil {
+		rules = append(rules, group.rules...)
+		def = cmp.Or(group.def, def)
+	}
+	if global != nil {
+		rules = append(rules, global.rules...)
+	}
+
+	for _, r := range rules {
+		if addrs == nil && r.needsAddresses(host, name) {
+			if ips, dnsTime, err = resolveDestination(ctx, host); err != nil {
+				recordDial(dest, dnsTime, 0, true, true)
+				return nil, err
+			}
+			for _, ip := range ips {
+				if a, err := netip.ParseAddr(ip); err == nil {
+					addrs = append(addrs, a.Unmap())
+				}
+			}
+		}
+		if !r.match(host, name, port, addrs) {
+			continue
+		}
+		switch r.Action {
+		case EgressDeny:
+			return nil, fmt.Errorf("%w by %s", errEgressDenied, r.describe())
+		case EgressUpstream:
+			return dialUpstreams(ctx, r, dest)
+		}
+		def = EgressAllow
+		break
+	}
+	if def == EgressDeny {
+		return nil, fmt.Errorf("%w by the default egress action", errEgressDenied)
+	}
+	if ips == nil {
+		return dialDestination(dest, timeout)
+	}
+	return dialAddresses(ctx, dest, portStr, ips, dnsTime, name)
+}
+
+// socks5Handshake greets a SOCKS5 proxy on conn and authenticates with user if set (RFC 1929).
+func socks5Handshake(conn net.Conn, user *url.Userinfo) error {
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks5: authentication method refused")
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("socks5: credentials too long")
+		}
+		auth := append([]byte{0x01, byte(len(name))}, name...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+	return nil
+}
+
+// socks5Connect asks a SOCKS5 proxy on conn to connect to dest (RFC 1928), authenticating
+// with user if set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, dest string) error {
+	host, portStr, _ := net.SplitHostPort(dest)
+	port, _ := strconv.Atoi(portStr)
+	if err := socks5Handshake(conn, user); err != nil {
+		return err
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Unmap().Is4() {
+		req = append(append(req, 0x01), addr.Unmap().AsSlice()...)
+	} else if err == nil {
+		req = append(append(req, 0x04), addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: hostname too long")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: %w with code %d", errUpstreamRefused, head[1])
+	}
+	// Skip the bound address and port
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = 4 + 2
+	case 0x04:
+		skip = 16 + 2
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return errors.New("socks5: invalid reply")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// httpConnect asks an HTTP proxy on conn to open a tunnel to dest with CONNECT, with basic
+// auth if user is set.
+func httpConnect(conn net.Conn, user *url.Userinfo, dest string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: dest},
+		Host:   dest,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// The tunnel starts right after the response headers: read them byte by byte so no data
+	// of the destination is buffered away
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 1), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT: %w: %s", errUpstreamRefused, resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader reads at most one byte at a time
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
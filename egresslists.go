@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+)
+
+// EgressList is an external list of domains and networks egress rules refer to by name (lists).
+// The file or URL is read at startup and every Refresh hours; the lines may be in any of these
+// formats, mixed:
+//
+//	example.com                  a domain and its subdomains
+//	0.0.0.0 ads.example.com      hosts file: every name after the address
+//	full:www.example.com         geosite style: exactly this name
+//	domain:example.com           geosite style: the domain and its subdomains
+//	keyword:tracker              geosite style: names containing the word
+//	regexp:^ad[0-9]+\.           geosite style: names matching the expression
+//	203.0.113.0/24               a network, or a single address
+//
+// Comments start with #, geosite attributes (@ads) are ignored.
+type EgressList struct {
+	URL     string `yaml:"url,omitempty" json:"url,omitempty"`
+	Path    string `yaml:"path,omitempty" json:"path,omitempty"`
+	Refresh int    `yaml:"refresh,omitempty" json:"refresh,omitempty"` // Hours between reloads, default 24
+}
+
+// source identifies what a list is loaded from, to notice changes on reload.
+func (l EgressList) source() string {
+	return l.URL + l.Path
+}
+
+// Largest list download accepted
+const maxEgressListSize = 64 << 20
+
+// domainList is the parsed content of an egress list
+type domainList struct {
+	suffixes map[string]bool // Domains matching themselves and their subdomains
+	full     map[string]bool // Names matching only themselves
+	keywords []string
+	regexps  []*regexp.Regexp
+	networks []netip.Prefix
+}
+
+// loadedList is an egress list as loaded, with when to load it again
+type loadedList struct {
+	source string
+	list   *domainList
+	next   time.Time
+}
+
+var (
+	egressLists     = make(map[string]*loadedList) // By list name
+	egressListsLock sync.RWMutex
+	egressRefresh   sync.Mutex // Serializes refreshEgressLists
+)
+
+// parseDomainList reads a list in any of the formats of EgressList. It returns the number of
+// lines it could not use.
+func parseDomainList(r io.Reader) (*domainList, int, error) {
+	l := &domainList{suffixes: make(map[string]bool), full: make(map[string]bool)}
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<10)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// Hosts file: an address followed by names
+		if _, err := netip.ParseAddr(fields[0]); err == nil && len(fields) > 1 {
+			for _, name := range fields[1:] {
+				name = normalizeDomain(name)
+				if name != "localhost" && name != "" {
+					l.suffixes[name] = true
+				}
+			}
+			continue
+		}
+		entry := fields[0] // Geosite attributes follow as @attr
+		kind, value, ok := strings.Cut(entry, ":")
+		if !ok || strings.Contains(value, ":") { // IPv6 addresses aren't kinds
+			kind, value = "", entry
+		}
+		switch kind {
+		case "full":
+			l.full[normalizeDomain(value)] = true
+		case "domain":
+			l.suffixes[normalizeDomain(value)] = true
+		case "keyword":
+			l.keywords = append(l.keywords, strings.ToLower(value))
+		case "regexp":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				skipped++
+				continue
+			}
+			l.regexps = append(l.regexps, re)
+		case "":
+			if n, err := core.ParseNetwork(value); err == nil {
+				l.networks = append(l.networks, n)
+			} else if name := normalizeDomain(value); strings.Contains(name, ".") || !strings.ContainsAny(name, "/:") {
+				l.suffixes[name] = true
+			} else {
+				skipped++
+			}
+		default:
+			skipped++ // include: and unknown kinds
+		}
+	}
+	return l, skipped, scanner.Err()
+}
+
+// normalizeDomain returns a domain in lower case without a trailing dot.
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+// matchName reports whether the list contains a hostname.
+func (l *domainList) matchName(host string) bool {
+	host = normalizeDomain(host)
+	if l.full[host] {
+		return true
+	}
+	for name := host; ; {
+		if l.suffixes[name] {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	if slices.ContainsFunc(l.keywords, func(k string) bool { return strings.Contains(host, k) }) {
+		return true
+	}
+	return slices.ContainsFunc(l.regexps, func(re *regexp.Regexp) bool { return re.MatchString(host) })
+}
+
+// matchAddr reports whether an address is in one of the list's networks.
+func (l *domainList) matchAddr(addr netip.Addr) bool {
+	return slices.ContainsFunc(l.networks, func(n netip.Prefix) bool { return n.Contains(addr) })
+}
+
+// egressList returns the loaded content of the named list, nil while it isn't loaded.
+func egressList(name string) *domainList {
+	egressListsLock.RLock()
+	defer egressListsLock.RUnlock()
+	if l := egressLists[name]; l != nil {
+		return l.list
+	}
+	return nil
+}
+
+// loadEgressList reads a list from its file or URL.
+func loadEgressList(l EgressList) (*domainList, int, error) {
+	var r io.Reader
+	if l.Path != "" {
+		f, err := os.Open(l.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		client := &http.Client{Timeout: time.Minute}
+		resp, err := client.Get(l.URL)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("status %s", resp.Status)
+		}
+		r = io.LimitReader(resp.Body, maxEgressListSize)
+	}
+	return parseDomainList(r)
+}
+
+// refreshEgressLists loads the lists that are new, changed or due, and forgets the ones no
+// longer configured. A list that fails to load keeps its previous content and is retried in
+// an hour.
+func refreshEgressLists() {
+	cfg := currentConfig()
+	egressRefresh.Lock()
+	defer egressRefresh.Unlock()
+	now := time.Now()
+
+	egressListsLock.Lock()
+	for name := range egressLists {
+		if _, ok := cfg.EgressLists[name]; !ok {
+			delete(egressLists, name)
+		}
+	}
+	due := make(map[string]EgressList)
+	for name, l := range cfg.EgressLists {
+		if cur := egressLists[name]; cur == nil || cur.source != l.source() || now.After(cur.next) {
+			due[name] = l
+		}
+	}
+	egressListsLock.Unlock()
+
+	for name, l := range due {
+		list, skipped, err := loadEgressList(l)
+		egressListsLock.Lock()
+		cur := egressLists[name]
+		if cur == nil || cur.source != l.source() {
+			cur = &loadedList{source: l.source()}
+			egressLists[name] = cur
+		}
+		if err != nil {
+			cur.next = now.Add(time.Hour)
+			egressListsLock.Unlock()
+			log.Printf("Could not load egress list %s from %s: %v", name, l.source(), err)
+			continue
+		}
+		refresh := l.Refresh
+		if refresh <= 0 {
+			refresh = 24
+		}
+		cur.list, cur.next = list, now.Add(time.Duration(refresh)*time.Hour)
+		egressListsLock.Unlock()
+		log.Printf("Loaded egress list %s: %d domains, %d keywords and expressions, %d networks (%d lines skipped)",
+			name, len(list.suffixes)+len(list.full), len(list.keywords)+len(list.regexps), len(list.networks), skipped)
+	}
+}
+
+// startEgressLists loads the egress lists, so the rules using them work from the first stream,
+// then checks every minute for lists due for a refresh.
+func startEgressLists() {
+	refreshEgressLists()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			refreshEgressLists()
+		}
+	}()
+}
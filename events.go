@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Security event kinds
+const (
+	EventBan           = "ban"
+	EventRejectedLogin = "rejected_login"
+	EventTarpit        = "tarpit"
+	EventLimit         = "limit"  // Session closed for exceeding a resource limit
+	EventReplay        = "replay" // Session closed for a replayed tunnel frame
+)
+
+// Events kept in memory for the admin API; older ones are only in the event log file
+const maxSecurityEvents = 5000
+
+// securityEvent is a ban, rejection or rate-limit decision taken against a source
+type securityEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	IP       string    `json:"ip"`
+	Username string    `json:"username,omitempty"`
+	Reason   string    `json:"reason"`
+}
+
+var (
+	securityEvents []securityEvent
+	eventsLock     sync.Mutex
+	eventLog       *RotatingFile
+)
+
+// initEventLog opens the event log, if configured, and reloads its latest entries into memory.
+func initEventLog() {
+	cfg := currentConfig()
+	if cfg.EventLog == "" {
+		return
+	}
+	if f, err := os.Open(cfg.EventLog); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ev securityEvent
+			if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+				appendEvent(ev)
+			}
+		}
+		f.Close()
+	}
+
+	f, err := OpenRotatingFile(cfg.EventLog, cfg.EventLogMaxSize, cfg.EventLogMaxBackups,
+		cfg.EventLogRotateHours, cfg.EventLogMaxAge)
+	if err != nil {
+		log.Fatalf("Could not open event log %s: %v", cfg.EventLog, err)
+	}
+	eventLog = f
+}
+
+// appendEvent adds an event to the in-memory list, dropping the oldest beyond maxSecurityEvents.
+func appendEvent(ev securityEvent) {
+	eventsLock.Lock()
+	securityEvents = append(securityEvents, ev)
+	if len(securityEvents) > maxSecurityEvents {
+		securityEvents = securityEvents[len(securityEvents)-maxSecurityEvents:]
+	}
+	eventsLock.Unlock()
+}
+
+// recordEvent records a security event in memory and in the event log.
+func recordEvent(kind, ip, username, reason string) {
+	ev := securityEvent{Time: time.Now().UTC(), Kind: kind, IP: ip, Username: username, Reason: reason}
+	appendEvent(ev)
+	logSecurityLine(kind, ip, reason)
+	if eventLog != nil {
+		if line, err := json.Marshal(ev); err == nil {
+			eventLog.Write(append(line, '\n'))
+		}
+	}
+}
+
+// queryEvents returns events matching the request filters (kind, ip, since, limit), newest first.
+func queryEvents(r *http.Request) []securityEvent {
+	q := r.URL.Query()
+	kind, ip := q.Get("kind"), q.Get("ip")
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		since, _ = time.Parse(time.RFC3339, s)
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	list := []securityEvent{}
+	for i := len(securityEvents) - 1; i >= 0; i-- {
+		ev := securityEvents[i]
+		if ev.Time.Before(since) {
+			break
+		}
+		if (kind != "" && ev.Kind != kind) || (ip != "" && ev.IP != ip) {
+			continue
+		}
+		list = append(list, ev)
+		if limit > 0 && len(list) == limit {
+			break
+		}
+	}
+	return list
+}
+
+func handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, queryEvents(r))
+}
+
+// handleAdminEventsCSV exports events as CSV, e.g. to attach to an abuse report.
+func handleAdminEventsCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="minewire-events.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "kind", "ip", "username", "reason"})
+	for _, ev := range queryEvents(r) {
+		cw.Write([]string{ev.Time.Format(time.RFC3339), ev.Kind, ev.IP, ev.Username, ev.Reason})
+	}
+	cw.Flush()
+}
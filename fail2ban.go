@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fail2banPrefix starts every security line, so log watchers can match them without knowing
+// the wording of the other log lines
+const fail2banPrefix = "minewire-security:"
+
+// logSecurityLine writes a security event or anomaly as a single line in a stable format when
+// fail2ban_log is set:
+//
+//	minewire-security: kind=rejected_login ip=203.0.113.7 reason="unknown user"
+//
+// kind is an event or anomaly kind, ip an address or, for network bans, a CIDR block. The reason
+// is quoted Go-style and may be empty.
+func logSecurityLine(kind, ip, reason string) {
+	cfg := currentConfig()
+	if !cfg.Fail2banLog {
+		return
+	}
+	log.Printf("%s kind=%s ip=%s reason=%q", fail2banPrefix, kind, ip, reason)
+}
+
+// banEntry is an address or network banned by the ban engine
+type banEntry struct {
+	Addr    string    `json:"addr"` // Address, or CIDR block of a network ban
+	Network bool      `json:"network"`
+	Until   time.Time `json:"until"`
+}
+
+// currentBans lists the addresses and networks banned now, sorted by address.
+func currentBans() []banEntry {
+	now := time.Now()
+	bans := []banEntry{}
+	scoreLock.Lock()
+	for ip, s := range scores {
+		if now.Before(s.bannedUntil) {
+			bans = append(bans, banEntry{Addr: ip, Until: s.bannedUntil})
+		}
+	}
+	scoreLock.Unlock()
+	networkLock.Lock()
+	for network, until := range bannedNetworks {
+		if now.Before(until) {
+			bans = append(bans, banEntry{Addr: network.String(), Network: true, Until: until})
+		}
+	}
+	networkLock.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Addr < bans[j].Addr })
+	return bans
+}
+
+// isIPv6Ban reports whether a ban entry is an IPv6 address or network.
+func isIPv6Ban(b banEntry) bool {
+	if prefix, err := netip.ParsePrefix(b.Addr); err == nil {
+		return prefix.Addr().Unmap().Is6()
+	}
+	addr, err := netip.ParseAddr(b.Addr)
+	return err == nil && addr.Unmap().Is6()
+}
+
+// handleAdminBans exports the ban list for OS firewalls. ?format= picks json (default), text
+// (one address or CIDR block per line), nftables (an nft -f script adding the entries to a
+// set) or ipset (an ipset restore script); ?family=4 or 6 keeps one address family, which
+// nftables and ipset sets need. The scripts give every entry the timeout left on its ban, so
+// the firewall lifts it at the same time as the server; ?set= and ?table= override the sets of
+// the firewall_ settings.
+func handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	q := r.URL.Query()
+	bans := currentBans()
+	if family := q.Get("family"); family != "" {
+		if family != "4" && family != "6" {
+			http.Error(w, "family must be 4 or 6", http.StatusBadRequest)
+			return
+		}
+		kept := bans[:0]
+		for _, b := range bans {
+			if isIPv6Ban(b) == (family == "6") {
+				kept = append(kept, b)
+			}
+		}
+		bans = kept
+	}
+	timeout := func(b banEntry) int {
+		return max(int(time.Until(b.Until).Seconds()), 1)
+	}
+	// The scripts fill the sets of firewall_backend unless told otherwise
+	table, set := q.Get("table"), q.Get("set")
+	if table == "" {
+		table = cfg.FirewallTable
+	}
+	if set == "" {
+		set = cfg.FirewallSet
+		if q.Get("family") == "6" {
+			set = cfg.FirewallSet6
+		}
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		writeJSON(w, bans)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, b := range bans {
+			fmt.Fprintln(w, b.Addr)
+		}
+	case "nftables":
+		// The set needs "flags interval, timeout" for network bans and per-entry timeouts
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(bans) == 0 {
+			return
+		}
+		// Interval sets reject overlapping elements: addresses in a banned network are left out
+		var networks []netip.Prefix
+		for _, b := range bans {
+			if b.Network {
+				networks = append(networks, netip.MustParsePrefix(b.Addr))
+			}
+		}
+		var elements []string
+		for _, b := range bans {
+			if addr, err := netip.ParseAddr(b.Addr); err == nil && slices.ContainsFunc(networks, func(n netip.Prefix) bool { return n.Contains(addr.Unmap()) }) {
+				continue
+			}
+			elements = append(elements, fmt.Sprintf("%s timeout %ds", b.Addr, timeout(b)))
+		}
+		fmt.Fprintf(w, "add element %s %s { %s }\n", table, set, strings.Join(elements, ", "))
+	case "ipset":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, b := range bans {
+			fmt.Fprintf(w, "add %s %s timeout %d\n", set, b.Addr, timeout(b))
+		}
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
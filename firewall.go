@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firewall backends the ban engine pushes its bans to (firewall_backend)
+const (
+	FirewallNftables = "nftables" // Add elements with a timeout to an nftables set
+	FirewallIPSet    = "ipset"    // Add entries with a timeout to an ipset set
+	FirewallScript   = "script"   // Run firewall_script ban|unban <address or CIDR> <seconds>
+)
+
+// firewallQueueSize is how many bans wait for the firewall before new ones are dropped
+const firewallQueueSize = 256
+
+// Timeout of a single firewall command
+const firewallCommandTimeout = 10 * time.Second
+
+// firewallBan is a ban to push to the firewall: an address or a CIDR block
+type firewallBan struct {
+	addr  netip.Prefix
+	until time.Time
+}
+
+var (
+	firewallQueue chan firewallBan
+
+	// Bans pushed to firewall_script, to unban them when they expire
+	scriptBans    = make(map[netip.Prefix]time.Time)
+	scriptBansMu  sync.Mutex
+	firewallFails int // Consecutive failed commands, to log only the first of a series
+)
+
+// startFirewall starts pushing bans to firewall_backend, if set. Commands run on a single
+// goroutine, so a slow firewall never holds up the ban engine; bans beyond the queue are
+// dropped with a log line.
+func startFirewall() {
+	cfg := currentConfig()
+	if cfg.FirewallBackend == "" {
+		return
+	}
+	firewallQueue = make(chan firewallBan, firewallQueueSize)
+	log.Printf("Bans are pushed to the firewall (%s)", cfg.FirewallBackend)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case ban := <-firewallQueue:
+				pushFirewallBan(ban)
+			case now := <-ticker.C:
+				if cfg.FirewallBackend == FirewallScript {
+					expireScriptBans(now)
+				}
+			}
+		}
+	}()
+}
+
+// queueFirewallBan hands a ban of the ban engine to the firewall. It never blocks: it is called
+// with the ban engine's locks held.
+func queueFirewallBan(addr string, until time.Time) {
+	if firewallQueue == nil {
+		return
+	}
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		a, err := netip.ParseAddr(addr)
+		if err != nil {
+			return
+		}
+		a = a.Unmap()
+		prefix = netip.PrefixFrom(a, a.BitLen())
+	}
+	select {
+	case firewallQueue <- firewallBan{prefix, until}:
+	default:
+		log.Printf("Firewall queue full, %s is only banned by the server", addr)
+	}
+}
+
+// pushFirewallBan adds a ban to the firewall with the time left on it.
+func pushFirewallBan(ban firewallBan) {
+	cfg := currentConfig()
+	seconds := int(time.Until(ban.until).Seconds())
+	if seconds < 1 {
+		return
+	}
+	addr := ban.addr.String()
+	if ban.addr.IsSingleIP() {
+		addr = ban.addr.Addr().String()
+	}
+	var args []string
+	switch cfg.FirewallBackend {
+	case FirewallNftables:
+		set := cfg.FirewallSet
+		if ban.addr.Addr().Is6() {
+			set = cfg.FirewallSet6
+		}
+		if set == "" {
+			return
+		}
+		args = []string{"nft", "add", "element", cfg.FirewallTable, set, fmt.Sprintf("{ %s timeout %ds }", addr, seconds)}
+	case FirewallIPSet:
+		set := cfg.FirewallSet
+		if ban.addr.Addr().Is6() {
+			set = cfg.FirewallSet6
+		}
+		if set == "" {
+			return
+		}
+		args = []string{"ipset", "-exist", "add", set, addr, "timeout", strconv.Itoa(seconds)}
+	case FirewallScript:
+		args = []string{cfg.FirewallScript, "ban", addr, strconv.Itoa(seconds)}
+	default:
+		return
+	}
+	if runFirewallCommand(args) && cfg.FirewallBackend == FirewallScript {
+		scriptBansMu.Lock()
+		scriptBans[ban.addr] = ban.until
+		scriptBansMu.Unlock()
+	}
+}
+
+// expireScriptBans runs firewall_script unban for the bans that ended.
+func expireScriptBans(now time.Time) {
+	cfg := currentConfig()
+	var expired []netip.Prefix
+	scriptBansMu.Lock()
+	for addr, until := range scriptBans {
+		if now.After(until) {
+			expired = append(expired, addr)
+			delete(scriptBans, addr)
+		}
+	}
+	scriptBansMu.Unlock()
+	for _, prefix := range expired {
+		addr := prefix.String()
+		if prefix.IsSingleIP() {
+			addr = prefix.Addr().String()
+		}
+		runFirewallCommand([]string{cfg.FirewallScript, "unban", addr, "0"})
+	}
+}
+
+// runFirewallCommand runs a firewall command and reports whether it succeeded. Failures are
+// logged once until a command succeeds again, so a missing set doesn't flood the log.
+func runFirewallCommand(args []string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if firewallFails == 0 {
+			log.Printf("Firewall command %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		firewallFails++
+		return false
+	}
+	if firewallFails > 0 {
+		log.Printf("Firewall commands work again after %d failures", firewallFails)
+		firewallFails = 0
+	}
+	return true
+}
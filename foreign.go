@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// Responses to connections speaking another protocol (foreign_protocol)
+const (
+	ForeignClose   = "close"   // Close the connection, as before
+	ForeignTimeout = "timeout" // Read and never answer, like a server that hangs
+	ForeignForward = "forward" // Splice the connection to foreign_protocol_backend
+)
+
+// foreignHoldTime is how long the timeout response reads a connection before closing it
+const foreignHoldTime = 2 * time.Minute
+
+// Set while foreign_protocol_backend refuses connections, so the failure is logged once
+var foreignBackendDown atomic.Bool
+
+// isHandshakeStart reports whether the first bytes of a connection can start a handshake: a
+// packet length of up to two VarInt bytes, the largest handshake being 1024 bytes, followed by
+// the packet ID 0x00. TLS records (0x16 0x03), HTTP methods and SSH banners fail at the ID.
+func isHandshakeStart(b []byte) bool {
+	switch {
+	case len(b) >= 2 && b[0]&0x80 == 0:
+		return b[0] >= 2 && b[1] == 0x00
+	case len(b) >= 3 && b[1]&0x80 == 0:
+		return b[2] == 0x00
+	}
+	return false
+}
+
+// serveForeignProtocol answers a connection whose first bytes aren't a handshake the way
+// foreign_protocol of srv says, so protocol-confusion probes don't see a telltale reset. The
+// bytes read so far are still buffered in packets.
+func serveForeignProtocol(conn net.Conn, packets *mcproto.PacketReader, srv *Config) {
+	defer conn.Close()
+	if srv.ForeignProtocol == ForeignForward {
+		backend, err := net.DialTimeout("tcp", srv.ForeignProtocolBackend, dialTimeout())
+		if err == nil {
+			if foreignBackendDown.Swap(false) {
+				log.Printf("foreign_protocol_backend %s accepts connections again", srv.ForeignProtocolBackend)
+			}
+			forwardForeign(conn, packets, backend)
+			return
+		}
+		if !foreignBackendDown.Swap(true) {
+			log.Printf("foreign_protocol_backend %s: %v, holding connections until it is back", srv.ForeignProtocolBackend, err)
+		}
+	}
+
+	// No answer, whatever the peer sends, until it gives up. Reading everything makes the close
+	// a normal one instead of a reset.
+	conn.SetReadDeadline(time.Now().Add(foreignHoldTime))
+	io.Copy(io.Discard, conn)
+}
+
+// forwardForeign replays the buffered first bytes to backend and relays between the two
+// connections until both directions are done.
+func forwardForeign(conn net.Conn, packets *mcproto.PacketReader, backend net.Conn) {
+	defer backend.Close()
+	conn.SetReadDeadline(time.Time{}) // The backend applies its own timeouts
+	if _, err := backend.Write(packets.Buffered()); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, backend)
+		closeWrite(conn)
+		close(done)
+	}()
+	io.Copy(backend, conn)
+	closeWrite(backend)
+	<-done
+}
+
+// closeWrite half-closes a TCP connection, so the peer sees the end of the data while the other
+// direction continues.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asnRange is one entry of the IP to ASN database
+type asnRange struct {
+	start, end [16]byte
+	asn        uint32
+	country    string
+	name       string
+}
+
+// asnDatabase maps addresses to their autonomous system and country
+type asnDatabase struct {
+	ranges []asnRange // Sorted by start
+}
+
+var asnDB *asnDatabase
+
+// loadASNDatabase reads an iptoasn.com style TSV ("ip2asn-combined.tsv", optionally gzipped):
+// range_start, range_end, AS number, country code, AS description.
+func loadASNDatabase(path string) (*asnDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &asnDatabase{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("line %d: invalid range entry", line)
+		}
+		if asn == 0 {
+			continue // Not routed
+		}
+		rng := asnRange{asn: uint32(asn), country: fields[3]}
+		copy(rng.start[:], start.To16())
+		copy(rng.end[:], end.To16())
+		if len(fields) == 5 {
+			rng.name = fields[4]
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start[:], db.ranges[j].start[:]) < 0
+	})
+	return db, nil
+}
+
+// lookup returns the range containing ip, if any.
+func (db *asnDatabase) lookup(ip string) (asnRange, bool) {
+	parsed := net.ParseIP(ip)
+	if db == nil || parsed == nil {
+		return asnRange{}, false
+	}
+	var key [16]byte
+	copy(key[:], parsed.To16())
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start[:], key[:]) > 0
+	})
+	if i == 0 {
+		return asnRange{}, false
+	}
+	rng := db.ranges[i-1]
+	if bytes.Compare(key[:], rng.end[:]) > 0 {
+		return asnRange{}, false
+	}
+	return rng, true
+}
+
+// initASNDatabase loads the configured IP to ASN database, if any.
+func initASNDatabase() {
+	cfg := currentConfig()
+	if cfg.ASNDatabase == "" {
+		return
+	}
+	db, err := loadASNDatabase(cfg.ASNDatabase)
+	if err != nil {
+		log.Fatalf("Could not load ASN database %s: %v", cfg.ASNDatabase, err)
+	}
+	asnDB = db
+	log.Printf("Loaded ASN database %s (%d ranges)", cfg.ASNDatabase, len(db.ranges))
+}
@@ -3,6 +3,9 @@ module minewire-server
 go 1.25.4
 
 require (
-	github.com/hashicorp/yamux v0.1.2 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/BurntSushi/toml v1.5.0
+	github.com/hashicorp/yamux v0.1.2
+	golang.org/x/crypto v0.47.0
+	golang.org/x/sys v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
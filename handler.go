@@ -5,150 +5,327 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"cmp"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/big"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"minewire-server/internal/core"
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+
 	"github.com/hashicorp/yamux"
 )
 
-// Minecraft protocol packet IDs
+// Minecraft protocol packet IDs of the status and login states, the same in every version.
+// Play state IDs depend on the version, see mcproto.PacketIDs.
 const (
 	PID_CB_StatusResp      = 0x00 // Server -> Client: Status response
 	PID_CB_Ping            = 0x01 // Server -> Client: Ping
 	PID_CB_LoginSuccess    = 0x02 // Server -> Client: Login success
 	PID_CB_LoginDisconnect = 0x00 // Server -> Client: Disconnect during login
-	PID_CB_JoinGame        = 0x29 // Server -> Client: Join game
-	PID_CB_KeepAlive       = 0x24 // Server -> Client: Keep alive
-	PID_CB_ChunkData       = 0x25 // Server -> Client: Chunk data
-	PID_CB_PlayerPos       = 0x3E // Server -> Client: Synchronize Player Position
-	PID_CB_TimeUpdate      = 0x62 // Server -> Client: Time Update
+)
 
-	PID_SB_PluginMsg = 0x0D // Client -> Server: Plugin message
+// Status presentation modes
+const (
+	StatusModeNormal      = "normal"      // Simulated players online
+	StatusModeWhitelist   = "whitelist"   // Private whitelisted server, nobody online
+	StatusModeMaintenance = "maintenance" // Server under maintenance
 )
 
-// Global state for player count simulation and authentication
+// Resource Pack Response results sent by the client
+const (
+	resourcePackDeclined = 1
+	resourcePackFailed   = 2
+)
+
+// resourcePackUUID identifies the server resource pack, stable for the lifetime of the process
+var resourcePackUUID = func() (u [16]byte) {
+	rand.Read(u[:])
+	return
+}()
+
+// Global authentication state
 var (
-	currentOnline int
-	onlineLock    sync.Mutex
-	validUsers    = make(map[string]string) // Map: GeneratedUsername -> OriginalPassword
-	nicknameMap   = make(map[string]string) // Map: Nickname -> OriginalPassword
+	validUsers  = make(map[string]*[32]byte)  // Map: GeneratedUsername -> Tunnel key in userKeys
+	userKeys    = newKeyArena(0)              // Memory of the tunnel keys
+	userLabels  = make(map[string]string)     // Map: GeneratedUsername -> Nickname or id, for logUser
+	nicknameMap = make(map[string]UserConfig) // Map: Nickname -> User
+	subsUsers   = make(map[string]UserConfig) // Map: Subscription key (id or nickname) -> User
+	userLimits  = make(map[string]UserLimits) // Map: GeneratedUsername -> Limits
+	userServers = make(map[string]string)     // Map: GeneratedUsername -> Game server name
+	userGroups  = make(map[string]string)     // Map: GeneratedUsername -> Egress group
+	authLock    sync.RWMutex                  // Guards the maps above, replaced on config reload
 )
 
 // initAuthMap initializes the authentication map by generating expected usernames
 // from configured passwords. Clients generate usernames using the same algorithm.
 func initAuthMap() {
-	hashAndRegister := func(pwd, nick string) {
-		h := sha256.Sum256([]byte(pwd))
-		// Generate expected username the same way the client does
-		expectedUser := "Player" + hex.EncodeToString(h[:])[:8]
-		validUsers[expectedUser] = pwd
-		if nick != "" {
-			nicknameMap[nick] = pwd
-			log.Printf("Registered agent access for: %s (Nick: %s)", expectedUser, nick)
-		} else {
-			log.Printf("Registered agent access for: %s", expectedUser)
-		}
+	servers := allServers() // One snapshot for all the maps
+	count := 0
+	for _, srv := range servers {
+		count += len(srv.Passwords)
 	}
-
-	for _, item := range cfg.Passwords {
-		switch v := item.(type) {
-		case string:
-			hashAndRegister(v, "")
-		case map[string]interface{}:
-			for pwd, nickVal := range v {
-				if nick, ok := nickVal.(string); ok {
-					hashAndRegister(pwd, nick)
+	keys := newKeyArena(count)
+	users := make(map[string]*[32]byte)
+	labels := make(map[string]string)
+	nicks := make(map[string]UserConfig)
+	subs := make(map[string]UserConfig)
+	limits := make(map[string]UserLimits)
+	userServerNames := make(map[string]string)
+	groups := make(map[string]string)
+	for _, srv := range servers {
+		for _, u := range srv.Passwords {
+			key := u.TunnelKey()
+			expectedUser := core.Username(key)
+			users[expectedUser] = keys.add(&key)
+			labels[expectedUser] = cmp.Or(u.Name, u.ID)
+			limits[expectedUser] = u.Limits
+			userServerNames[expectedUser] = srv.Name
+			if u.Group != "" {
+				groups[expectedUser] = u.Group
+			}
+			if u.Name != "" {
+				nicks[u.Name] = u
+			}
+			if key := u.SubsKey(); key != "" {
+				if u.Name == "" {
+					u.Name = u.ID // Links of users without a nickname are labeled with the id
 				}
+				subs[key] = u
 			}
 		}
 	}
+
+	authLock.Lock()
+	old := userKeys
+	validUsers, userKeys, userLabels = users, keys, labels
+	nicknameMap, subsUsers, userLimits, userServers, userGroups = nicks, subs, limits, userServerNames, groups
+	authLock.Unlock()
+	old.wipe() // Lookups copy keys under the lock, so none reads the old ones any more
+}
+
+// lookupUser returns the tunnel key and limits of a generated username.
+func lookupUser(username string) ([32]byte, UserLimits, bool) {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	var key [32]byte
+	p, ok := validUsers[username]
+	if ok {
+		key = *p
+	}
+	return key, userLimits[username], ok
+}
+
+// userServer returns the name of the game server a generated username belongs to.
+func userServer(username string) string {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return userServers[username]
+}
+
+// userGroup returns the egress group of a generated username, "" without one.
+func userGroup(username string) string {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return userGroups[username]
+}
+
+// logUser returns how log lines name a user: its nickname or id, a label that can't be traced
+// back to the username for users with neither, and "unknown user" for names of failed logins.
+// With redact_logs: false it is the generated username.
+func logUser(username string) string {
+	cfg := currentConfig()
+	if cfg.RedactLogs != nil && !*cfg.RedactLogs {
+		return username
+	}
+	authLock.RLock()
+	label, ok := userLabels[username]
+	authLock.RUnlock()
+	switch {
+	case !ok:
+		return "unknown user"
+	case label != "":
+		return label
+	}
+	sum := sha256.Sum256([]byte(username))
+	return "user-" + hex.EncodeToString(sum[:4])
+}
+
+// lookupSubscription returns the user with a subscription key (see UserConfig.SubsKey).
+func lookupSubscription(key string) (UserConfig, bool) {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	u, ok := subsUsers[key]
+	return u, ok
 }
 
 // startPlayerCountSimulator simulates realistic player count fluctuations
-// to make the server appear more legitimate when queried.
+// to make the servers appear more legitimate when queried.
 func startPlayerCountSimulator() {
 	// Initialize with average player count
-	onlineLock.Lock()
-	currentOnline = (cfg.OnlineMin + cfg.OnlineMax) / 2
-	onlineLock.Unlock()
+	for _, srv := range allServers() {
+		simFor(srv.Name)
+	}
 
-	// Update player count every 30 minutes
+	// Update player counts every 30 minutes
 	ticker := time.NewTicker(30 * time.Minute)
 	for range ticker.C {
-		onlineLock.Lock()
-		// Apply smooth random change (-3 to +3 players)
-		change := getSecureRandomInt(7) - 3
-		newVal := currentOnline + change
-
-		// Clamp to configured min/max range
-		if newVal < cfg.OnlineMin {
-			newVal = cfg.OnlineMin
+		for _, srv := range allServers() {
+			simFor(srv.Name).step()
 		}
-		if newVal > cfg.OnlineMax {
-			newVal = cfg.OnlineMax
-		}
-
-		currentOnline = newVal
-		log.Printf("Player count simulation: %d players online", currentOnline)
-		onlineLock.Unlock()
 	}
 }
 
+// getSecureRandomInt returns a uniform random int in [0, max) from crypto/rand.
 func getSecureRandomInt(max int) int {
-	b := make([]byte, 1)
-	rand.Read(b)
-	return int(b[0]) % max
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		panic(err) // Only fails for max < 1
+	}
+	return int(n.Int64())
+}
+
+// stateMaxPacketSize returns the largest packet accepted in a state before the tunnel.
+// Handshake, status and login packets are small, anything bigger is garbage or a probe.
+func stateMaxPacketSize(state int) int {
+	switch state {
+	case 0:
+		return 1024 // Handshake: a host name of up to 255 characters, plus Forge markers
+	case 1:
+		return 16 // Status Request, Ping Request
+	default:
+		return 4096 // Login Start, with the signature data of 1.19-1.19.2
+	}
 }
 
-func processPacket(conn net.Conn, reader io.Reader, pBuf *bytes.Buffer, state *int) {
-	pid, _ := ReadVarInt(pBuf)
+func processPacket(conn net.Conn, packets *mcproto.PacketReader, pid int, pBuf *bytes.Buffer, state, protocol *int, trace *sessionTrace, srv *Config) {
+	cfg := srv.root
+	// Packets that don't decode end the connection, like decoding errors on a vanilla server
+	malformed := func(reason string) {
+		recordAnomaly(remoteIP(conn), AnomalyMalformedHandshake)
+		trace.fail(reason)
+		conn.Close()
+	}
 
+	var err error
 	switch *state {
 	case 0: // Handshake
-		if pid == 0x00 {
-			ReadVarInt(pBuf)
-			l, _ := ReadVarInt(pBuf)
-			pBuf.Next(l)
-			pBuf.Next(2)
-			*state, _ = ReadVarInt(pBuf)
+		if pid != 0x00 {
+			malformed("malformed handshake")
+			return
+		}
+		var host string
+		if *protocol, host, *state, err = readHandshake(pBuf); err != nil {
+			malformed("malformed handshake")
+			return
+		}
+		trace.stage.SetAttr("protocol", *protocol)
+		trace.stage.SetAttr("next_state", *state)
+		switch *state {
+		case 1:
+			recordStatusProbe(remoteIP(conn), *protocol, host)
+			trace.next("status")
+		case 2:
+			trace.next("login")
+		default:
+			malformed("invalid next state")
 		}
 	case 1: // Status
 		if pid == 0x00 {
-			sendFakeStatus(conn)
+			ip := remoteIP(conn)
+			recordStatusQuery(ip)
+			tarpit(ip)
+			if sendFakeStatus(conn, srv) != nil {
+				conn.Close()
+			}
 		}
 		if pid == 0x01 {
-			WritePacket(conn, PID_CB_Ping, pBuf.Bytes())
+			recordStatusPing()
+			if mcproto.WritePacket(conn, PID_CB_Ping, pBuf.Bytes()) != nil {
+				conn.Close()
+			}
 		}
 	case 2: // Login
 		if pid == 0x00 {
-			l, _ := ReadVarInt(pBuf)
-			nameBytes := make([]byte, l)
-			pBuf.Read(nameBytes)
-			username := string(nameBytes)
+			username, err := mcproto.ReadString(pBuf)
+			if err != nil {
+				malformed("malformed login start")
+				return
+			}
+			trace.stage.SetAttr("username", username)
+
+			userKey, limits, ok := lookupUser(username)
+			defer clear(userKey[:])
+			ok = ok && userServer(username) == srv.Name // Users only log in on their own server
+
+			// Users over their concurrent session limit are turned away like a duplicate login
+			if max := limits.MaxSessions; ok && max > 0 && sessions.UserCount(username) >= max {
+				log.Printf("Session limit reached for %s (%d)", logUser(username), max)
+				recordLogin(username, conn, false)
+				trace.fail("session limit")
+				recordEvent(EventLimit, remoteIP(conn), username, fmt.Sprintf("session limit %d", max))
+				sendDisconnect(conn, "You are already connected to this server")
+				conn.Close()
+				return
+			}
+
+			// Expired users and users over their quota are turned away like unknown players
+			if reason := accessEnded(username, limits); ok && reason != "" {
+				log.Printf("Access of %s ended: %s", logUser(username), reason)
+				recordLogin(username, conn, false)
+				trace.fail("access ended")
+				recordEvent(EventLimit, remoteIP(conn), username, reason)
+				sendDisconnect(conn, rejectMessage(srv))
+				conn.Close()
+				return
+			}
+
+			// Over the global session limit agents are turned away like players from a full server
+			if ok && sessionsFull() {
+				log.Printf("Session limit reached (%d), refusing %s", cfg.MaxSessionsTotal, logUser(username))
+				recordLogin(username, conn, false)
+				trace.fail("server full")
+				recordEvent(EventLimit, remoteIP(conn), username, fmt.Sprintf("max_sessions_total %d", cfg.MaxSessionsTotal))
+				sendDisconnect(conn, "The server is full!")
+				conn.Close()
+				return
+			}
 
 			// Check if username is in the authorized users map
-			if userPassword, ok := validUsers[username]; ok {
-				log.Printf("Authorized agent connected: %s", username)
-				// Pass the user's specific password for encryption key generation
-				startDeepCoverSession(conn, username, reader, userPassword)
+			if ok && !isUserDisabled(username) {
+				log.Printf("Authorized agent connected: %s", logUser(username))
+				recordLogin(username, conn, true)
+				// Pass the user's specific tunnel key for encryption
+				startDeepCoverSession(conn, username, packets, &userKey, trace, srv, sessionProtocol(srv, *protocol))
 				return
 			} else {
-				log.Printf("Rejected unauthorized connection from: %s", username)
-				sendDisconnect(conn, "§cNot whitelisted!")
+				log.Printf("Rejected unauthorized connection from: %s", logUser(username))
+				recordLogin(username, conn, false)
+				trace.fail("unauthorized")
+				ip := remoteIP(conn)
+				reason := "unknown user"
+				if ok {
+					reason = "user disabled"
+				}
+				recordEvent(EventRejectedLogin, ip, username, reason)
+				recordAnomaly(ip, AnomalyBadLogin)
+				tarpit(ip)
+				sendDisconnect(conn, rejectMessage(srv))
 				conn.Close()
 				return
 			}
@@ -156,141 +333,313 @@ func processPacket(conn net.Conn, reader io.Reader, pBuf *bytes.Buffer, state *i
 	}
 }
 
+// readHandshake decodes the body of a Handshake packet.
+func readHandshake(pBuf *bytes.Buffer) (protocol int, host string, nextState int, err error) {
+	if protocol, err = mcproto.ReadVarInt(pBuf); err != nil {
+		return
+	}
+	if host, err = mcproto.ReadString(pBuf); err != nil {
+		return
+	}
+	if _, err = mcproto.ReadShort(pBuf); err != nil { // Port
+		return
+	}
+	nextState, err = mcproto.ReadVarInt(pBuf)
+	return
+}
+
 // startDeepCoverSession establishes an encrypted tunnel session disguised as a Minecraft connection.
 // It sends the necessary Minecraft protocol packets and then starts the multiplexed tunnel.
-func startDeepCoverSession(conn net.Conn, username string, leftoverReader io.Reader, password string) {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
+func startDeepCoverSession(conn net.Conn, username string, packets *mcproto.PacketReader, key *[32]byte, trace *sessionTrace, srv *Config, proto mcproto.Protocol) {
+	trace.next("join")
+	if tcpConn, ok := unwrapConn(conn).(*net.TCPConn); ok {
+		tuneCarrier(tcpConn, srv)
 	}
+	// The join sequence is checked once at the end: the first failed write skips the rest
+	pw := mcproto.NewPacketWriter(conn)
+
 	// Step 1: Send Login Success packet
-	uuid := make([]byte, 16)
-	rand.Read(uuid)
-	buf := new(bytes.Buffer)
-	buf.Write(uuid)
-	WriteString(buf, username)
-	WriteVarInt(buf, 0)
-	WritePacket(conn, PID_CB_LoginSuccess, buf.Bytes())
-
-	// Step 2: Send Join Game packet (Protocol 773 / Minecraft 1.21.10)
-	buf.Reset()
-	WriteInt(buf, 100)
-	WriteBool(buf, false)
-	WriteVarInt(buf, 1)
-	WriteString(buf, "minecraft:overworld")
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 8)
-	WriteVarInt(buf, 8)
-	WriteBool(buf, false)
-	WriteBool(buf, true)
-	WriteBool(buf, false)
-	WriteVarInt(buf, 0)
-	WriteString(buf, "minecraft:overworld")
-	WriteLong(buf, 123456789)
-	WriteByte(buf, 1)
-	WriteByte(buf, 0xFF)
-	WriteBool(buf, false)
-	WriteBool(buf, false)
-	WriteBool(buf, false)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 63)
-	WriteBool(buf, false)
-	WritePacket(conn, PID_CB_JoinGame, buf.Bytes())
-
-	// Step 3: Send Synchronize Player Position (Protocol 773 / 1.20.4-1.21.x mix)
+	login := LoginSuccessPacket{Username: username, Properties: []LoginProperty{}}
+	rand.Read(login.UUID[:])
+	login.UUID[6] = (login.UUID[6] & 0x0F) | 0x40 // Version 4, like online-mode accounts
+	login.UUID[8] = (login.UUID[8] & 0x3F) | 0x80
+	pw.Send(proto, login)
+
+	// Step 2: Send Join Game packet
+	pw.Send(proto, JoinGamePacket{
+		EntityID:           100,
+		Dimensions:         []string{"minecraft:overworld"},
+		ViewDistance:       8,
+		SimulationDistance: 8,
+		RespawnScreen:      true,
+		DimensionTypeName:  "minecraft:overworld",
+		DimensionName:      "minecraft:overworld",
+		HashedSeed:         123456789,
+		GameMode:           1,
+		PreviousGameMode:   -1,
+		SeaLevel:           63,
+	})
+
+	// Step 3: Advertise the server brand, real servers always send it right after join
+	sendServerBrand(pw, srv, proto)
+
+	// Step 4: Send Synchronize Player Position
 	// Sets the initial player position to a realistic value
 	motion := NewMotionGenerator()
-	buf.Reset()
-	WriteDouble(buf, motion.X)
-	WriteDouble(buf, motion.Y)
-	WriteDouble(buf, motion.Z)
-	WriteFloat(buf, float32(motion.Angle*180/math.Pi)) // Yaw
-	WriteFloat(buf, 0)                                 // Pitch
-	WriteByte(buf, 0x00)                               // Flags (absolute)
-	WriteVarInt(buf, 0)                                // Teleport ID
-	WritePacket(conn, PID_CB_PlayerPos, buf.Bytes())
+	pw.Send(proto, PlayerPositionPacket{
+		X: motion.X, Y: motion.Y, Z: motion.Z,
+		Yaw: float32(motion.Angle * 180 / math.Pi),
+	})
 
-	// Step 4: Start encrypted multiplexed tunnel (using password for encryption)
-	startMuxTunnel(conn, leftoverReader, password, motion)
+	// Step 5: Push the server resource pack, if configured
+	if srv.ResourcePackURL != "" {
+		sendResourcePack(pw, srv, proto)
+	}
+	if err := pw.Err(); err != nil {
+		log.Printf("Join sequence for %s failed: %v", logUser(username), err)
+		trace.fail("join failed")
+		conn.Close()
+		return
+	}
+
+	// Step 6: Start encrypted multiplexed tunnel (using the key derived from the password, bound
+	// to the session by the random UUID of the Login Success)
+	startMuxTunnel(conn, username, packets, key, login.UUID, motion, trace, srv, proto)
 }
 
+// maxReusedPlaintext is the largest tunnel frame plaintext buffer a session keeps for the next frame
+const maxReusedPlaintext = 64 << 10
+
 // startMuxTunnel creates an encrypted yamux session over the Minecraft connection.
 // Traffic is encrypted with AES-GCM and disguised as Minecraft chunk data packets.
-func startMuxTunnel(conn net.Conn, leftoverReader io.Reader, password string, motion *MotionGenerator) {
-	// Use the user's password to derive AES encryption key
-	key := sha256.Sum256([]byte(password))
-	block, _ := aes.NewCipher(key[:])
-	aead, _ := cipher.NewGCM(block)
+func startMuxTunnel(conn net.Conn, username string, packets *mcproto.PacketReader, key *[32]byte, nonce mcproto.UUID, motion *MotionGenerator, trace *sessionTrace, srv *Config, proto mcproto.Protocol) {
+	cfg := srv.root
+	// The user's AES key is the SHA-256 of the password; the ciphers keep what they need of it
+	sealer, opener := core.Ciphers(srv.TunnelFraming, *key, nonce, disguise.ServerToClient, disguise.ClientToServer)
+	clear(key[:])
 	pr, pw := io.Pipe()
 
-	mc := &MinecraftConn{conn: conn, r: pr, w: pw, aead: aead, rawReader: leftoverReader, motion: motion}
+	sess := sessions.Register(username, srv.Name, conn)
+	sess.span = trace.next("tunnel")
+	sess.span.SetAttr("session.id", int64(sess.ID))
+	defer func() {
+		sess.span.SetAttr("bytes_up", sess.BytesUp.Load())
+		sess.span.SetAttr("bytes_down", sess.BytesDown.Load())
+		if rtt := sess.RTT.Load(); rtt != 0 {
+			sess.span.SetAttr("rtt_ms", time.Duration(rtt).Milliseconds())
+		}
+		sessions.Unregister(sess)
+	}()
+
+	mc := &MinecraftConn{conn: conn, r: pr, w: pw, sealer: sealer, motion: motion, session: sess, srv: srv, proto: proto,
+		frameSize: srv.TunnelFrameSize}
+	if srv.TunnelCoalesceDelay > 0 {
+		mc.coalesceDelay = time.Duration(srv.TunnelCoalesceDelay) * time.Millisecond
+	}
+	readerDone := make(chan struct{})
 
-	go func() {
+	// In decoy mode a session that never proves knowledge of the key keeps playing as a normal game session
+	if srv.DecoyMode && srv.DecoyTimeout > 0 {
+		decoyTimer := time.AfterFunc(time.Duration(srv.DecoyTimeout)*time.Second, func() {
+			if !mc.established.Load() {
+				mc.enterDecoy("no tunnel frame received")
+			}
+		})
+		defer decoyTimer.Stop()
+	}
+
+	sess.spawn(func() {
+		defer close(readerDone)
 		defer pw.Close()
-		var r io.ByteReader
-		if br, ok := leftoverReader.(*bufio.Reader); ok {
-			r = br
+		scope := &panicScope{stage: "tunnel", remote: sess.Remote, close: sess.Kick}
+		defer scope.recoverPanic()
+		packets.SetLimits(mcproto.MaxPacketSize, 0) // Play packets may be large and sparse
+
+		// deliver hands the plaintext of a frame to yamux, or handles the frame's error. False
+		// ends the tunnel.
+		deliver := func(pt []byte, err error) bool {
+			switch {
+			case err == nil:
+				mc.established.Store(true)
+				pw.Write(pt)
+			case errors.Is(err, disguise.ErrMalformed):
+				// Too short to be a frame
+			case errors.Is(err, disguise.ErrReplayed):
+				// The frame authenticated but was already delivered: someone on the path
+				// captured and re-sent it
+				log.Printf("Tunnel frame of %s from %s replayed, closing the session (possible replay attack)", logUser(username), sess.Remote)
+				recordEvent(EventReplay, remoteIP(conn), username, "replayed tunnel frame")
+				return false
+			case srv.DecoyMode && !mc.established.Load():
+				mc.enterDecoy("tunnel frame failed authentication")
+			case errors.Is(err, disguise.ErrOutOfSequence) && mc.established.Load():
+				// Sequenced frames can't be dropped, reordered or replayed into a session
+				log.Printf("Tunnel frame of %s out of sequence, closing the session", logUser(username))
+				return false
+			}
+			return true
+		}
+
+		// With crypto workers frames are opened on the workers, and a second goroutine delivers
+		// them in the order received. The queue between them is short: once it is full the
+		// reader waits, like it waits for yamux otherwise.
+		var opened chan chan openResult
+		delivered := make(chan struct{})
+		if cryptoJobs != nil {
+			opened = make(chan chan openResult, max(cfg.TunnelCryptoWorkers, 2))
+			sess.spawn(func() {
+				defer close(delivered)
+				ok := true
+				for res := range opened {
+					r := <-res
+					if ok && !deliver(r.plaintext, r.err) {
+						ok = false
+						pw.Close() // Ends the yamux session, and with it the connection
+					}
+				}
+			})
+			defer func() { close(opened); <-delivered }()
 		} else {
-			r = bufio.NewReader(leftoverReader)
+			// Packets and their plaintext go through buffers reused for every frame: pw.Write
+			// only returns once yamux has taken all of it, which also holds the reader back while
+			// yamux is busy, so a fast sender can't queue up memory here
+			packets.ReuseBuffer()
 		}
+		var plain []byte
 
+	read:
 		for {
-			length, err := ReadVarInt(r)
+			pid, payload, err := packets.ReadPacket()
 			if err != nil {
-				return
+				break
 			}
-			data := make([]byte, length)
-			_, err = io.ReadFull(leftoverReader, data)
-			if err != nil {
-				return
+			scope.packet = payload
+			pBuf := bytes.NewBuffer(payload)
+
+			if pid == proto.ID(mcproto.ServerboundResourcePackResponse) {
+				mc.handleResourcePackResponse(pBuf)
+				continue
 			}
-			pBuf := bytes.NewBuffer(data)
-			pid, _ := ReadVarInt(pBuf)
-
-			if pid == PID_SB_PluginMsg {
-				channel, _ := ReadString(pBuf)
-				if channel == "minecraft:brand" || channel == "minewire:tunnel" {
-					enc := pBuf.Bytes()
-					if len(enc) < aead.NonceSize() {
-						continue
+			if pid == proto.ID(mcproto.ServerboundKeepAlive) {
+				mc.handleKeepAlive(payload)
+				continue
+			}
+			if mc.decoy.Load() {
+				continue // Decoy sessions just consume whatever the peer sends
+			}
+
+			if pid == proto.ID(mcproto.ServerboundPluginMessage) {
+				channel, enc, err := disguise.DecodePluginMessage(pBuf.Bytes())
+				if err != nil || !disguise.IsTunnelChannel(channel) {
+					continue
+				}
+				if opened != nil {
+					frame, ct, err := opener.ReserveOpen(enc)
+					if err != nil {
+						continue // Too short to be a frame
 					}
-					nonce := enc[:aead.NonceSize()]
-					pt, err := aead.Open(nil, nonce, enc[aead.NonceSize():], nil)
-					if err == nil {
-						pw.Write(pt)
+					res := make(chan openResult, 1)
+					cryptoJobs <- func() {
+						pt, err := frame.AppendOpen(nil, ct)
+						res <- openResult{pt, err}
 					}
+					opened <- res
+					continue
+				}
+				pt, err := opener.AppendOpen(plain[:0], enc)
+				if !deliver(pt, err) {
+					break read
+				}
+				if err == nil && cap(pt) <= maxReusedPlaintext {
+					plain = pt
 				}
 			}
 		}
-	}()
 
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		timeTicker := time.NewTicker(20 * time.Second) // Minecraft time flows...
+		// The yamux session no longer owns the connection once in decoy mode
+		if mc.decoy.Load() {
+			conn.Close()
+		}
+	})
+
+	sess.spawn(func() {
+		ticker := time.NewTicker(time.Duration(srv.KeepAliveInterval) * time.Second)
+		motionTicker := time.NewTicker(20 * time.Second)
 		defer ticker.Stop()
-		defer timeTicker.Stop()
+		defer motionTicker.Stop()
 
-		worldTime := int64(0)
+		// Show the simulated players in the tab list and keep it in sync with the roster
+		sim := simFor(srv.Name)
+		roster, players := sim.subscribe()
+		defer sim.unsubscribe(roster)
+		if mc.sendPlayerInfoUpdate(players) != nil {
+			return
+		}
+
+		// Vanilla servers send the world time on join and then once per second
+		world := NewWorldClock()
+		var timeC <-chan time.Time
+		if srv.TimeUpdateInterval > 0 {
+			timeTicker := time.NewTicker(time.Duration(srv.TimeUpdateInterval) * time.Second)
+			defer timeTicker.Stop()
+			timeC = timeTicker.C
+			if mc.sendTimeUpdate(world) != nil {
+				return
+			}
+		}
+
+		// Occasional chat messages diversify the packet types on long-lived sessions
+		var chatC <-chan time.Time
+		if srv.ChatSimulation {
+			chatC = time.After(nextChatDelay(srv))
+		}
 
 		for {
 			select {
 			case <-ticker.C:
-				buf := new(bytes.Buffer)
-				WriteLong(buf, time.Now().UnixNano())
-				WritePacket(conn, PID_CB_KeepAlive, buf.Bytes())
-			case <-timeTicker.C:
-				// Send Time Update to encourage client simulation
-				worldTime += 20 * 20 // Advance 20 seconds (20 ticks/sec)
-				buf := new(bytes.Buffer)
-				WriteLong(buf, worldTime)        // World Age
-				WriteLong(buf, -worldTime%24000) // Time of day (negative to stop internal cycle if client respected it, but here just updating)
-				WritePacket(conn, PID_CB_TimeUpdate, buf.Bytes())
-
+				if srv.KeepAliveTimeout > 0 && mc.keepAliveExpired(time.Duration(srv.KeepAliveTimeout)*time.Second) {
+					log.Printf("Keep Alive timeout for %s, closing the session", logUser(username))
+					sess.Kick()
+					return
+				}
+				if mc.sendKeepAlive() != nil {
+					return
+				}
+			case <-timeC:
+				weatherChanged := world.Advance(int64(srv.TimeUpdateInterval) * ticksPerSecond)
+				if mc.sendTimeUpdate(world) != nil {
+					return
+				}
+				if srv.Weather && weatherChanged && mc.sendWeather(world.Raining) != nil {
+					return
+				}
+			case <-roster.Dirty:
+				change := sim.changes(roster)
+				if len(change.Left) > 0 && mc.sendPlayerInfoRemove(change.Left) != nil {
+					return
+				}
+				if len(change.Joined) > 0 && mc.sendPlayerInfoUpdate(change.Joined) != nil {
+					return
+				}
+				if srv.ChatSimulation && mc.sendRosterChat(change) != nil {
+					return
+				}
+			case <-chatC:
+				if msg := randomChatMessage(srv); msg != "" && mc.sendSystemChat(msg, "") != nil {
+					return
+				}
+				chatC = time.After(nextChatDelay(srv))
+			case <-motionTicker.C:
 				// Update motion simulation rarely to be efficient
 				mc.motion.Update()
 			}
 		}
-	}()
+	})
+
+	// Cover traffic statistically matching a real deployment
+	if captureTemplate != nil {
+		sess.spawn(func() { mc.replayCoverTraffic(captureTemplate) })
+	}
 
 	session, err := yamux.Server(mc, nil)
 	if err != nil {
@@ -298,174 +647,659 @@ func startMuxTunnel(conn net.Conn, leftoverReader io.Reader, password string, mo
 	}
 
 	for {
-		stream, err := session.Accept()
+		// At max_streams_total new streams queue in the yamux backlog until a slot frees up
+		if !acquireStreamSlot(session.CloseChan()) {
+			break
+		}
+		stream, err := session.AcceptStream()
 		if err != nil {
-			return
+			releaseStreamSlot()
+			break
+		}
+		if _, limits, _ := lookupUser(username); limits.MaxStreams > 0 && sess.Streams.Load() >= int64(limits.MaxStreams) {
+			releaseStreamSlot()
+			stream.Close() // Over the per-session stream limit
+			continue
+		}
+		sess.spawn(func() {
+			defer releaseStreamSlot()
+			handleStream(stream, sess)
+		})
+	}
+
+	// Keep the connection owned by this session until the peer goes away (matters for decoy sessions)
+	<-readerDone
+}
+
+// enterDecoy turns a session that failed the tunnel bootstrap into a plain fake-gameplay session.
+// The yamux session is torn down without closing the connection, and the client receives the
+// spawn chunks a real server would send, while ambient packets keep flowing as usual.
+func (mc *MinecraftConn) enterDecoy(reason string) {
+	if mc.decoy.Swap(true) {
+		return
+	}
+	log.Printf("Tunnel bootstrap failed for %s (%s), continuing as decoy session", mc.conn.RemoteAddr(), reason)
+	mc.session.span.SetAttr("decoy", reason)
+	mc.w.CloseWithError(io.EOF)
+	mc.session.spawn(mc.sendSpawnChunks)
+}
+
+// sendSpawnChunks sends the chunks around the player position, like a real server after join.
+func (mc *MinecraftConn) sendSpawnChunks() {
+	centerX := int(mc.motion.X) >> 4
+	centerZ := int(mc.motion.Z) >> 4
+	for dx := -3; dx <= 3; dx++ {
+		for dz := -3; dz <= 3; dz++ {
+			// Compressed-looking section data of a plausible size
+			data := make([]byte, 2048+getSecureRandomInt(200)*32)
+			rand.Read(data)
+			if mc.writeChunk(centerX+dx, centerZ+dz, data) != nil {
+				return
+			}
 		}
-		go handleStream(stream)
 	}
 }
 
 // handleStream handles a single multiplexed stream by proxying it to the requested destination.
-func handleStream(stream net.Conn) {
+func handleStream(stream *yamux.Stream, sess *Session) {
+	cfg := currentConfig()
 	defer stream.Close()
+	scope := &panicScope{stage: "stream", remote: sess.Remote, close: func() { stream.Close() }}
+	defer scope.recoverPanic()
+	sess.Streams.Add(1)
+	defer sess.Streams.Add(-1)
+
+	rec := streamRecord{
+		User:     sess.Username,
+		Remote:   stream.Session().RemoteAddr().String(),
+		StreamID: stream.StreamID(),
+		Start:    time.Now(),
+	}
+	span := startSpan(sess.span, "stream")
+	span.SetAttr("stream.id", rec.StreamID)
+	defer func() {
+		rec.End = time.Now()
+		logStream(rec)
+		if rec.Dest != "" {
+			recordDestination(rec.User, rec.Dest, rec.BytesUp, rec.BytesDown)
+		}
+		span.SetAttr("dest", rec.Dest)
+		span.SetAttr("bytes_up", rec.BytesUp)
+		span.SetAttr("bytes_down", rec.BytesDown)
+		span.SetAttr("close_reason", rec.Reason)
+		span.End()
+	}()
+
 	br := bufio.NewReader(stream)
-	dest, err := ReadString(br)
+	dest, err := core.ReadStreamRequest(br)
 	if err != nil {
+		rec.Reason = "bad request"
+		span.Fail(rec.Reason)
+		return
+	}
+	rec.Dest = dest
+	if dest != core.PacketStream {
+		if dest, err = core.NormalizeDestination(dest); err != nil {
+			rec.Reason = "bad destination: " + err.Error()
+			span.Fail(rec.Reason)
+			return
+		}
+		rec.Dest = dest
+	}
+	st := sessions.OpenStream(sess, rec.StreamID, dest)
+	defer sessions.CloseStream(st)
+	if dest == core.PacketStream {
+		rec.Reason = servePacketStream(stream, br, sess, st)
+		rec.BytesUp, rec.BytesDown = st.BytesUp.Load(), st.BytesDown.Load()
 		return
 	}
 
-	target, err := net.DialTimeout("tcp", dest, 10*time.Second)
+	if limit := acquireDial(sess.Username, addrHost(stream.Session().RemoteAddr())); limit != "" {
+		rec.Reason = "rate limited: " + limit
+		span.Fail(rec.Reason)
+		return
+	}
+	target, err := dialEgress(sess.Username, dest)
+	releaseDial(sess.Username)
+	if errors.Is(err, errEgressDenied) {
+		rec.Reason = err.Error()
+		span.Fail(rec.Reason)
+		return
+	}
 	if err != nil {
+		rec.Reason = "dial failed: " + err.Error()
+		span.Fail(rec.Reason)
 		return
 	}
 	defer target.Close()
+	sess.Conns.Add(1)
+	defer sess.Conns.Add(-1)
+
+	// Streams with no traffic in either direction are closed, so half-open peers can't strand the copy loops
+	done := make(chan string, 1)
+	finish := func(reason string) {
+		select {
+		case done <- reason:
+		default: // Only the first reason is kept
+		}
+	}
+	up, down := io.Reader(countingReader{br, &st.BytesUp}), io.Reader(countingReader{target, &st.BytesDown})
+	if cfg.StreamKeepAlive > 0 {
+		// Idle streams stay open while the tunnel answers, and the destination's TCP keepalives
+		// end them if it goes away
+		interval := time.Duration(cfg.StreamKeepAlive) * time.Second
+		ended := make(chan struct{})
+		var check *time.Timer
+		check = time.AfterFunc(interval, func() {
+			if err := sess.pingTunnel(stream.Session(), interval); err != nil {
+				finish("keepalive failed: " + err.Error())
+				return
+			}
+			select {
+			case <-ended:
+			default:
+				check.Reset(interval)
+			}
+		})
+		defer check.Stop()
+		defer close(ended)
+		up = &activityReader{r: up, timer: check, timeout: interval}
+		down = &activityReader{r: down, timer: check, timeout: interval}
+	} else if cfg.StreamIdleTimeout > 0 {
+		timeout := time.Duration(cfg.StreamIdleTimeout) * time.Second
+		idle := time.AfterFunc(timeout, func() { finish("idle timeout") })
+		defer idle.Stop()
+		up = &activityReader{r: up, timer: idle, timeout: timeout}
+		down = &activityReader{r: down, timer: idle, timeout: timeout}
+	}
+
+	// Bidirectional copy between stream and target, both directions paced by bandwidth_limit
+	weight := userBandwidthWeight(sess.Username)
+	toTarget := shapedWriter{w: target, username: sess.Username, weight: weight}
+	toStream := shapedWriter{w: stream, username: sess.Username, weight: weight}
+	copies := make(chan struct{}, 2)
+	sess.spawn(func() { rec.BytesUp, _ = io.Copy(toTarget, up); finish("client closed"); copies <- struct{}{} })
+	sess.spawn(func() { rec.BytesDown, _ = io.Copy(toStream, down); finish("destination closed"); copies <- struct{}{} })
+	rec.Reason = <-done
+
+	// Unblock both directions and wait for them so the byte counts are final
+	stream.Close()
+	target.Close()
+	<-copies
+	<-copies
+}
+
+// activityReader pushes back an idle timer on every successful read.
+type activityReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
 
-	// Bidirectional copy between stream and target
-	done := make(chan bool, 2)
-	go func() { io.Copy(target, br); done <- true }()
-	go func() { io.Copy(stream, target); done <- true }()
-	<-done
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.timer.Reset(a.timeout)
+	}
+	return n, err
+}
+
+// writeTimeoutConn gives every write on a game connection a deadline, so a client that stops
+// reading can't block the writers of its session forever.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// WriteBuffers implements mcproto.BuffersWriter, so packets keep using writev on the socket.
+func (c *writeTimeoutConn) WriteBuffers(b *net.Buffers) (int64, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return b.WriteTo(c.Conn)
+}
+
+// unwrapConn returns the connection accepted from the listener under conn.
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*writeTimeoutConn); ok {
+		return c.Conn
+	}
+	return conn
 }
 
 // MinecraftConn wraps a net.Conn to encrypt/decrypt data and disguise it as Minecraft packets.
 
 type MinecraftConn struct {
-	conn      net.Conn
-	r         *io.PipeReader
-	w         *io.PipeWriter
-	aead      cipher.AEAD
-	rawReader io.Reader
-	motion    *MotionGenerator
+	conn    net.Conn
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	sealer  disguise.ParallelSealer // Frames to the client, sealed or reserved under frameMu
+	motion  *MotionGenerator
+	session *Session
+	srv     *Config // Game server the session logged in on
+	proto   mcproto.Protocol
+	writeMu sync.Mutex // Serializes packet writes from the tunnel and ambient packet senders
+
+	// Tunnel framing (tunnel_frame_size, tunnel_coalesce_delay)
+	frameSize     int
+	coalesceDelay time.Duration // 0: every write is sent at once
+	frameMu       sync.Mutex    // Guards the fields below and orders tunnel frames
+	pending       []byte        // Small writes waiting to share a frame
+	flushTimer    *time.Timer
+	flushErr      error // Error of a timer flush, returned by the next Write
+
+	established atomic.Bool // At least one tunnel frame was authenticated
+	decoy       atomic.Bool // Session failed the tunnel bootstrap and only simulates gameplay
+
+	keepAlive keepAliveState
 }
 
-func (mc *MinecraftConn) Read(b []byte) (int, error) { return mc.r.Read(b) }
+func (mc *MinecraftConn) Read(b []byte) (int, error) {
+	n, err := mc.r.Read(b)
+	mc.session.BytesUp.Add(int64(n))
+	return n, err
+}
 
-// Write encrypts data and wraps it in a realistic Minecraft chunk data packet.
+// Write encrypts data and wraps it in realistic Minecraft chunk data packets: large writes are
+// split into frames of frameSize bytes, small ones held for coalesceDelay to share a frame.
 func (mc *MinecraftConn) Write(b []byte) (int, error) {
-	nonce := make([]byte, mc.aead.NonceSize())
-	rand.Read(nonce)
-	encrypted := mc.aead.Seal(nonce, nonce, b, nil)
+	if mc.decoy.Load() {
+		return len(b), nil // Tunnel traffic is discarded once the session became a decoy
+	}
+
+	mc.frameMu.Lock()
+	defer mc.frameMu.Unlock()
+	if mc.flushErr != nil {
+		return 0, mc.flushErr
+	}
+	n := len(b)
 
-	buf := new(bytes.Buffer)
+	// The frames this write completes, the pending one first so data goes out in order
+	var completed [8][]byte
+	frames := completed[:0]
+	if len(mc.pending) > 0 {
+		k := min(len(b), mc.frameSize-len(mc.pending))
+		mc.pending = append(mc.pending, b[:k]...)
+		b = b[k:]
+		if len(mc.pending) == mc.frameSize {
+			frames = append(frames, mc.pending)
+		}
+	}
+	for len(b) >= mc.frameSize || (len(b) > 0 && mc.coalesceDelay == 0) {
+		k := min(len(b), mc.frameSize)
+		frames = append(frames, b[:k])
+		b = b[k:]
+	}
+	if err := mc.sendFrames(frames); err != nil {
+		return 0, err
+	}
+	if len(mc.pending) == mc.frameSize {
+		mc.pending = mc.pending[:0]
+	}
+	if len(b) > 0 {
+		if len(mc.pending) == 0 {
+			if mc.flushTimer == nil {
+				mc.flushTimer = time.AfterFunc(mc.coalesceDelay, mc.timerFlush)
+			} else {
+				mc.flushTimer.Reset(mc.coalesceDelay)
+			}
+		}
+		mc.pending = append(mc.pending, b...)
+	}
+
+	mc.session.BytesDown.Add(int64(n))
+	return n, nil
+}
+
+// timerFlush sends the writes held for coalescing once coalesceDelay has passed.
+func (mc *MinecraftConn) timerFlush() {
+	mc.frameMu.Lock()
+	defer mc.frameMu.Unlock()
+	if len(mc.pending) > 0 && mc.flushErr == nil {
+		mc.flushErr = mc.flushPending()
+	}
+}
+
+// flushPending sends the held writes as one frame. Must be called with frameMu held.
+func (mc *MinecraftConn) flushPending() error {
+	err := mc.writeFrame(mc.pending)
+	mc.pending = mc.pending[:0]
+	return err
+}
 
+// writeFrame encrypts a tunnel frame and sends it as a chunk data packet.
+func (mc *MinecraftConn) writeFrame(b []byte) error {
 	// Use simulated coordinates for Chunk X/Z based on current player position
 	// This makes the "chunks" appear around the player
 	chunkX := int(mc.motion.X) >> 4
 	chunkZ := int(mc.motion.Z) >> 4
 
-	WriteInt(buf, int32(chunkX)) // Chunk X
-	WriteInt(buf, int32(chunkZ)) // Chunk Z
+	// The packet is assembled in a pooled buffer and the frame encrypted straight into it
+	buf := mcproto.GetBuffer()
+	bodyLen := disguise.ChunkLen(mc.sealer.SealedLen(len(b)))
+	packet := mcproto.AppendPacketHeader(*buf, mc.proto.ID(mcproto.ChunkData), bodyLen)
+	packet = disguise.AppendSealedChunk(packet, mc.sealer, chunkX, chunkZ, b)
+	err := mc.writeRaw(packet)
+	*buf = packet
+	mcproto.PutBuffer(buf)
+	return err
+}
 
-	// Add realistic NBT heightmap data to disguise the packet
-	// TAG_Compound (Start)
-	buf.WriteByte(0x0A)
-	buf.Write([]byte{0x00, 0x00}) // Empty name
+// sendFrames sends frames in order: sealed on the crypto workers in batches if there are any,
+// otherwise one by one.
+func (mc *MinecraftConn) sendFrames(frames [][]byte) error {
+	if cryptoJobs != nil && len(frames) > 1 {
+		for len(frames) > 0 {
+			batch := frames[:min(len(frames), maxParallelFrames)]
+			if err := mc.writeFrames(batch); err != nil {
+				return err
+			}
+			frames = frames[len(batch):]
+		}
+		return nil
+	}
+	for _, f := range frames {
+		if err := mc.writeFrame(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// TAG_Long_Array "MOTION_BLOCKING"
-	buf.WriteByte(0x0C) // Type: Long Array
-	WriteStringNBT(buf, "MOTION_BLOCKING")
-	WriteInt(buf, 37) // Array length: 37 longs
+// writeFrames seals frames on the crypto workers and sends them in order with one write.
+func (mc *MinecraftConn) writeFrames(frames [][]byte) error {
+	chunkX := int(mc.motion.X) >> 4
+	chunkZ := int(mc.motion.Z) >> 4
+	id := mc.proto.ID(mcproto.ChunkData)
 
-	// Write 37 longs containing packed height data
-	// Using constant height of 64 for simplicity
-	heights := createPackedHeights(64)
-	for _, h := range heights {
-		WriteLong(buf, h)
+	bufs := make([]*[]byte, len(frames))
+	var wg sync.WaitGroup
+	wg.Add(len(frames))
+	for i, pt := range frames {
+		frame := mc.sealer.ReserveSeal() // In order, under frameMu
+		buf := mcproto.GetBuffer()
+		bufs[i] = buf
+		cryptoJobs <- func() {
+			defer wg.Done()
+			packet := mcproto.AppendPacketHeader(*buf, id, disguise.ChunkLen(frame.SealedLen(len(pt))))
+			*buf = disguise.AppendSealedChunk(packet, frame, chunkX, chunkZ, pt)
+		}
 	}
+	wg.Wait()
 
-	// TAG_End
-	buf.WriteByte(0x00)
+	packets := make(net.Buffers, len(bufs))
+	for i, buf := range bufs {
+		packets[i] = *buf
+	}
+	err := mc.writeBuffers(packets)
+	for _, buf := range bufs {
+		mcproto.PutBuffer(buf)
+	}
+	return err
+}
 
-	// Add encrypted payload
-	WriteVarInt(buf, len(encrypted))
-	buf.Write(encrypted)
+// writeChunk wraps data in a realistic Minecraft chunk data packet at the given chunk coordinates.
+func (mc *MinecraftConn) writeChunk(chunkX, chunkZ int, data []byte) error {
+	return mc.writePacket(mc.proto.ID(mcproto.ChunkData), disguise.EncodeChunk(chunkX, chunkZ, data))
+}
 
-	// Add empty post-data fields (block entities, light masks)
-	WriteVarInt(buf, 0) // Block entities count
-	// Light masks (all empty)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 0)
-	WriteVarInt(buf, 0)
+// writePacket writes a single packet, never interleaving with packets written by other goroutines.
+func (mc *MinecraftConn) writePacket(packetID int, data []byte) error {
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+	return mcproto.WritePacket(mc.conn, packetID, data)
+}
 
-	err := WritePacket(mc.conn, PID_CB_ChunkData, buf.Bytes())
-	return len(b), err
+// writeRaw writes an already framed packet like writePacket.
+func (mc *MinecraftConn) writeRaw(packet []byte) error {
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+	_, err := mc.conn.Write(packet)
+	return err
 }
 
-// createPackedHeights generates packed height data for Minecraft chunk heightmaps.
-// Each height value is 9 bits, packed into an array of 37 longs.
-func createPackedHeights(y int64) [37]int64 {
-	var data [37]int64
-	for i := 0; i < 256; i++ {
-		longIndex := i / 7
-		bitOffset := (i % 7) * 9
-		value := y & 0x1FF // Mask to 9 bits
-		data[longIndex] |= (value << bitOffset)
+// writeBuffers writes several framed packets at once like writeRaw.
+func (mc *MinecraftConn) writeBuffers(packets net.Buffers) error {
+	mc.writeMu.Lock()
+	defer mc.writeMu.Unlock()
+	if bw, ok := mc.conn.(mcproto.BuffersWriter); ok {
+		_, err := bw.WriteBuffers(&packets)
+		return err
 	}
-	return data
+	_, err := packets.WriteTo(mc.conn)
+	return err
 }
 
-func WriteStringNBT(w io.Writer, s string) {
-	b := []byte(s)
-	binary.Write(w, binary.BigEndian, int16(len(b))) // Short Len
-	w.Write(b)
+// sendBody writes the packet body collected in pw, or returns the error that building it hit.
+func (mc *MinecraftConn) sendBody(kind mcproto.PacketKind, pw *mcproto.PacketWriter) error {
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mc.writePacket(mc.proto.ID(kind), body)
+}
+
+// sendTimeUpdate sends the current world age and time of day.
+func (mc *MinecraftConn) sendTimeUpdate(world *WorldClock) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.Long(world.Age)
+	pw.Long(world.TimeOfDay) // Positive value keeps the client's day/night cycle running
+	return mc.sendBody(mcproto.TimeUpdate, pw)
+}
+
+// sendPlayerInfoUpdate adds players to the client's tab list.
+func (mc *MinecraftConn) sendPlayerInfoUpdate(players []SimPlayer) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.Byte(0x01 | 0x04 | 0x08 | 0x10) // Actions: add player, game mode, listed, latency
+	pw.VarInt(len(players))
+	for _, p := range players {
+		pw.Raw(p.UUID[:])
+		pw.String(p.Name)
+		pw.VarInt(0) // No skin properties
+		pw.VarInt(0) // Game mode: survival
+		pw.Bool(true)
+		pw.VarInt(p.Ping)
+	}
+	return mc.sendBody(mcproto.PlayerInfoUpdate, pw)
+}
+
+// sendPlayerInfoRemove removes players from the client's tab list.
+func (mc *MinecraftConn) sendPlayerInfoRemove(players []SimPlayer) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.VarInt(len(players))
+	for _, p := range players {
+		pw.Raw(p.UUID[:])
+	}
+	return mc.sendBody(mcproto.PlayerInfoRemove, pw)
+}
+
+// sendWeather sends the Game Event packets a vanilla server emits when rain starts or stops.
+func (mc *MinecraftConn) sendWeather(raining bool) error {
+	event, level := byte(2), float32(0) // End raining
+	if raining {
+		event, level = 1, 1 // Begin raining
+	}
+	pw := mcproto.NewPacketBuffer()
+	pw.Byte(event)
+	pw.Float(0)
+	if err := mc.sendBody(mcproto.GameEvent, pw); err != nil {
+		return err
+	}
+	pw = mcproto.NewPacketBuffer()
+	pw.Byte(7) // Rain level change
+	pw.Float(level)
+	return mc.sendBody(mcproto.GameEvent, pw)
+}
+
+func (mc *MinecraftConn) Close() error {
+	if mc.decoy.Load() {
+		return nil // Decoy sessions outlive the yamux session that would close the connection
+	}
+	// Held writes still go out, like data written to a socket before closing it
+	mc.frameMu.Lock()
+	if mc.flushTimer != nil {
+		mc.flushTimer.Stop()
+	}
+	if len(mc.pending) > 0 && mc.flushErr == nil {
+		mc.flushPending()
+	}
+	mc.frameMu.Unlock()
+	return mc.conn.Close()
 }
 
-func (mc *MinecraftConn) Close() error                       { return mc.conn.Close() }
 func (mc *MinecraftConn) LocalAddr() net.Addr                { return mc.conn.LocalAddr() }
 func (mc *MinecraftConn) RemoteAddr() net.Addr               { return mc.conn.RemoteAddr() }
 func (mc *MinecraftConn) SetDeadline(t time.Time) error      { return mc.conn.SetDeadline(t) }
 func (mc *MinecraftConn) SetReadDeadline(t time.Time) error  { return mc.conn.SetReadDeadline(t) }
 func (mc *MinecraftConn) SetWriteDeadline(t time.Time) error { return mc.conn.SetWriteDeadline(t) }
 
-func sendFakeStatus(conn io.Writer) {
-	iconData, _ := os.ReadFile(cfg.IconPath)
+func sendFakeStatus(conn io.Writer, srv *Config) error {
+	sim := simFor(srv.Name)
+	pw := mcproto.NewPacketBuffer()
+	pw.String(string(statusJSON(srv, sim.Online(), sim.statusSample())))
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(conn, PID_CB_StatusResp, body)
+}
+
+// sendLegacyStatus answers the server list ping of a client before 1.7 with the same MOTD, version
+// and simulated players as the status response.
+func sendLegacyStatus(conn io.Writer, srv *Config, format int) error {
+	version, motd, online := srv.VersionName, srv.Motd, 0
+	switch srv.StatusMode {
+	case StatusModeWhitelist:
+	case StatusModeMaintenance:
+		version, motd = srv.MaintenanceVersion, srv.MaintenanceMotd
+	default:
+		online = simFor(srv.Name).Online()
+	}
+	motd = strings.ReplaceAll(motd, `\n`, "\n")
+	return mcproto.WriteLegacyKick(conn, mcproto.LegacyStatus(format, version, motd, online, srv.MaxPlayers))
+}
+
+// statusJSON returns the status response of srv with the given simulated players, which are
+// hidden in whitelist and maintenance mode.
+func statusJSON(srv *Config, online int, sample []interface{}) []byte {
+	iconData, _ := os.ReadFile(srv.IconPath)
 	icon64 := ""
 	if len(iconData) > 0 {
 		icon64 = "data:image/png;base64," + base64.StdEncoding.EncodeToString(iconData)
 	}
 
-	onlineLock.Lock()
-	on := currentOnline
-	onlineLock.Unlock()
+	resp := mcproto.StatusResponse{
+		Version:            mcproto.Version{Name: srv.VersionName, Protocol: srv.ProtocolID},
+		Players:            mcproto.Players{Max: srv.MaxPlayers},
+		Description:        mcproto.Description{Text: strings.ReplaceAll(srv.Motd, `\n`, "\n")},
+		Favicon:            icon64,
+		EnforcesSecureChat: srv.EnforcesSecureChat,
+		PreviewsChat:       srv.PreviewsChat,
+	}
 
-	resp := StatusResponse{
-		Version:     Version{Name: cfg.VersionName, Protocol: cfg.ProtocolID},
-		Players:     Players{Max: cfg.MaxPlayers, Online: on},
-		Description: Description{Text: cfg.Motd},
-		Favicon:     icon64,
+	switch srv.StatusMode {
+	case StatusModeWhitelist:
+		// Private server: nobody online, players only see a normal MOTD
+	case StatusModeMaintenance:
+		// Maintenance plugins replace the version with a red label, which clients show as incompatible
+		resp.Version = mcproto.Version{Name: srv.MaintenanceVersion, Protocol: -1}
+		resp.Description.Text = strings.ReplaceAll(srv.MaintenanceMotd, `\n`, "\n")
+	default:
+		resp.Players.Sample = sample
+		resp.Players.Online = online
 	}
+
 	d, _ := json.Marshal(resp)
-	b := new(bytes.Buffer)
-	WriteString(b, string(d))
-	WritePacket(conn, PID_CB_StatusResp, b.Bytes())
+	if len(srv.StatusExtras) > 0 {
+		d = mergeStatusExtras(d, srv.StatusExtras)
+	}
+	return d
+}
+
+// sendResourcePack sends the Add Resource Pack packet, like server networks that always push a pack.
+func sendResourcePack(conn io.Writer, srv *Config, proto mcproto.Protocol) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.Raw(resourcePackUUID[:])
+	pw.String(srv.ResourcePackURL)
+	pw.String(srv.ResourcePackSHA1)
+	pw.Bool(srv.ResourcePackForced)
+	pw.Bool(srv.ResourcePackPrompt != "")
+	if srv.ResourcePackPrompt != "" {
+		ParseLegacyText(srv.ResourcePackPrompt).WriteNBT(pw)
+	}
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(conn, proto.ID(mcproto.AddResourcePack), body)
 }
 
-func sendDisconnect(conn io.Writer, r string) {
-	s := fmt.Sprintf(`{"text": "%s"}`, r)
-	b := new(bytes.Buffer)
-	WriteString(b, s)
-	WritePacket(conn, PID_CB_LoginDisconnect, b.Bytes())
+// handleResourcePackResponse reacts to the client's resource pack status like a real server:
+// clients declining a forced pack get kicked.
+func (mc *MinecraftConn) handleResourcePackResponse(pBuf *bytes.Buffer) {
+	pBuf.Next(16) // Pack UUID
+	result, err := mcproto.ReadVarInt(pBuf)
+	if err != nil {
+		return
+	}
+	if mc.srv.ResourcePackForced && (result == resourcePackDeclined || result == resourcePackFailed) {
+		pw := mcproto.NewPacketBuffer()
+		TextComponent{Text: "You must accept the resource pack to play on this server."}.WriteNBT(pw)
+		mc.sendBody(mcproto.PlayDisconnect, pw)
+		mc.conn.Close()
+	}
 }
 
-type StatusResponse struct {
-	Version     Version     `json:"version"`
-	Players     Players     `json:"players"`
-	Description Description `json:"description"`
-	Favicon     string      `json:"favicon,omitempty"`
+// mergeStatusExtras adds the configured extra fields (forgeData, modinfo, ...) to the status JSON.
+func mergeStatusExtras(status []byte, extras map[string]interface{}) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(status, &m); err != nil {
+		return status
+	}
+	for k, v := range extras {
+		m[k] = v
+	}
+	merged, err := json.Marshal(m)
+	if err != nil {
+		return status
+	}
+	return merged
 }
-type Version struct {
-	Name     string `json:"name"`
-	Protocol int    `json:"protocol"`
+
+// sendServerBrand sends the minecraft:brand plugin message with the configured server brand.
+func sendServerBrand(conn io.Writer, srv *Config, proto mcproto.Protocol) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.String("minecraft:brand")
+	pw.String(srv.Brand)
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(conn, proto.ID(mcproto.PluginMessage), body)
 }
-type Players struct {
-	Max    int           `json:"max"`
-	Online int           `json:"online"`
-	Sample []interface{} `json:"sample,omitempty"`
+
+// rejectMessage returns the disconnect reason for unauthorized logins, matching the status mode
+func rejectMessage(srv *Config) string {
+	switch srv.StatusMode {
+	case StatusModeWhitelist:
+		return "You are not white-listed on this server!"
+	case StatusModeMaintenance:
+		return srv.MaintenanceMotd
+	default:
+		return "§cNot whitelisted!"
+	}
 }
-type Description struct {
-	Text string `json:"text"`
+
+// sendDisconnect sends a login-state disconnect. The reason may contain legacy § formatting codes.
+func sendDisconnect(conn io.Writer, r string) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.String(ParseLegacyText(r).JSON())
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(conn, PID_CB_LoginDisconnect, body)
 }
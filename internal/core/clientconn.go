@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+)
+
+// Vanilla servers refuse serverbound plugin messages over 32767 bytes, so writes are split into
+// frames that stay below it with the channel name and AEAD overhead
+const MaxClientFrame = 31 << 10
+
+// ClientConn is the client end of a tunnel, carrying the yamux session: frames are sent as
+// encrypted plugin messages and received from chunk data packets. Keep Alive packets are
+// answered like a vanilla client does.
+type ClientConn struct {
+	conn    net.Conn
+	packets *mcproto.PacketReader
+	sealer  disguise.Sealer
+	opener  disguise.Opener
+	proto   mcproto.Protocol
+	pending []byte
+	writeMu sync.Mutex // Orders sealing and packet writes
+}
+
+func (c *ClientConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		pid, body, err := c.packets.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+		switch pid {
+		case c.proto.ID(mcproto.ChunkData):
+			_, _, enc, err := disguise.DecodeChunk(body)
+			if err != nil {
+				continue // Cover traffic or a real chunk
+			}
+			pt, err := c.opener.AppendOpen(nil, enc)
+			if err != nil {
+				continue
+			}
+			c.pending = pt
+		case c.proto.ID(mcproto.KeepAlive):
+			if err := c.WritePacket(mcproto.ServerboundKeepAlive, body); err != nil {
+				return 0, err
+			}
+		case c.proto.ID(mcproto.PlayDisconnect):
+			reason, _ := mcproto.ReadString(bytes.NewReader(body))
+			return 0, fmt.Errorf("disconnected by server: %s", reason)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *ClientConn) Write(b []byte) (int, error) {
+	for written := 0; written < len(b); {
+		n := min(len(b)-written, MaxClientFrame)
+		if err := c.writeFrame(b[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(b), nil
+}
+
+// writeFrame seals plaintext into one plugin message.
+func (c *ClientConn) writeFrame(plaintext []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	body := disguise.EncodePluginMessage(disguise.TunnelChannel, c.sealer.AppendSeal(nil, plaintext)) // Sealed in send order
+	return mcproto.WritePacket(c.conn, c.proto.ID(mcproto.ServerboundPluginMessage), body)
+}
+
+// WritePacket sends a packet between tunnel frames.
+func (c *ClientConn) WritePacket(kind mcproto.PacketKind, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return mcproto.WritePacket(c.conn, c.proto.ID(kind), body)
+}
+
+// Conn returns the game connection the tunnel runs over.
+func (c *ClientConn) Conn() net.Conn { return c.conn }
+
+func (c *ClientConn) Close() error { return c.conn.Close() }
@@ -0,0 +1,47 @@
+// Package core holds the parts of the Minewire protocol the server and its clients must
+// implement identically: the username and tunnel key derived from a password, the frame
+// ciphers of each tunnel framing, the legacy packet IDs, the disguised login and the stream
+// request.
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+)
+
+// Tunnel framings (tunnel_framing)
+const (
+	FramingRandom    = "random"    // A random nonce in front of every frame
+	FramingSequenced = "sequenced" // Counter nonces under per-session keys, in-order frames only
+)
+
+// ReplayWindow is how many of the last received random nonce frames a session remembers per
+// generation to reject replays of them
+const ReplayWindow = 8192
+
+// TunnelKey returns the AES-256 key of a password's tunnel: its SHA-256.
+func TunnelKey(password string) [32]byte {
+	return sha256.Sum256([]byte(password))
+}
+
+// Username returns the Minecraft name a client logs in with: "Player" and the first 8 hex
+// characters of the tunnel key. The server finds the user, and so the key, by this name.
+func Username(key [32]byte) string {
+	return "Player" + hex.EncodeToString(key[:4])
+}
+
+// Ciphers returns the sealer of the frames one side of a tunnel sends in direction send, and
+// the opener of those it receives from direction receive. session is the nonce the server picked
+// for the session: the UUID of its Login Success, which sequenced framing binds its keys to.
+// Random framing keeps the user's key, the format every client speaks, and its openers reject
+// frames replayed within ReplayWindow with disguise.ErrReplayed.
+func Ciphers(framing string, key [32]byte, session mcproto.UUID, send, receive string) (disguise.ParallelSealer, disguise.ParallelOpener) {
+	if framing == FramingSequenced {
+		return disguise.NewSequencedSealer(key, session[:], send), disguise.NewSequencedOpener(key, session[:], receive)
+	}
+	aead, _ := disguise.NewAEAD(key)
+	return disguise.RandomNonce{AEAD: aead}, disguise.RandomNonce{AEAD: aead, Seen: disguise.NewNonceWindow(ReplayWindow)}
+}
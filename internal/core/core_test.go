@@ -0,0 +1,60 @@
+package core
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+)
+
+// TestCiphers checks that the ciphers of the two ends of a tunnel open each other's frames, and
+// that sequenced frames only open in the session they were sealed in.
+func TestCiphers(t *testing.T) {
+	key := TunnelKey("password")
+	session, other := mcproto.UUID{1}, mcproto.UUID{2}
+	for _, framing := range []string{FramingRandom, FramingSequenced} {
+		serverSeal, serverOpen := Ciphers(framing, key, session, disguise.ServerToClient, disguise.ClientToServer)
+		clientSeal, clientOpen := Ciphers(framing, key, session, disguise.ClientToServer, disguise.ServerToClient)
+
+		down := serverSeal.AppendSeal(nil, []byte("down"))
+		if got, err := clientOpen.AppendOpen(nil, down); err != nil || string(got) != "down" {
+			t.Errorf("%s: server frame opened as %q, %v", framing, got, err)
+		}
+		up := clientSeal.AppendSeal(nil, []byte("up"))
+		if got, err := serverOpen.AppendOpen(nil, up); err != nil || string(got) != "up" {
+			t.Errorf("%s: client frame opened as %q, %v", framing, got, err)
+		}
+		if _, err := serverOpen.AppendOpen(nil, up); err == nil {
+			t.Errorf("%s: replayed client frame opened", framing)
+		}
+	}
+
+	_, replayOpen := Ciphers(FramingSequenced, key, other, disguise.ServerToClient, disguise.ClientToServer)
+	clientSeal, _ := Ciphers(FramingSequenced, key, session, disguise.ClientToServer, disguise.ServerToClient)
+	if _, err := replayOpen.AppendOpen(nil, clientSeal.AppendSeal(nil, []byte("up"))); err == nil {
+		t.Error("sequenced client frame opened in another session")
+	}
+}
+
+// TestCiphersRandomWire checks random framing against the wire format of every client: frames
+// sealed with the SHA-256 of the password, whatever the session.
+func TestCiphersRandomWire(t *testing.T) {
+	aead, err := disguise.NewAEAD(sha256.Sum256([]byte("password")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := disguise.Seal(aead, []byte("up"))
+	_, open := Ciphers(FramingRandom, TunnelKey("password"), mcproto.UUID{7}, disguise.ServerToClient, disguise.ClientToServer)
+	if got, err := open.AppendOpen(nil, frame); err != nil || string(got) != "up" {
+		t.Fatalf("client frame opened as %q, %v", got, err)
+	}
+	if _, err := open.AppendOpen(nil, frame); err == nil {
+		t.Error("replayed client frame opened")
+	}
+
+	seal, _ := Ciphers(FramingRandom, TunnelKey("password"), mcproto.UUID{7}, disguise.ServerToClient, disguise.ClientToServer)
+	if got, err := disguise.Open(aead, seal.AppendSeal(nil, []byte("down"))); err != nil || string(got) != "down" {
+		t.Errorf("server frame opened by a client as %q, %v", got, err)
+	}
+}
@@ -0,0 +1,41 @@
+package core
+
+import "minewire-server/pkg/mcproto"
+
+// Packet ID modes (packet_ids)
+const (
+	PacketIDsLegacy  = "legacy"  // The fixed IDs Minewire clients expect
+	PacketIDsVersion = "version" // The IDs of the client's protocol version
+)
+
+// LegacyIDs are the play packet IDs Minewire always used, whatever the version: those of
+// 1.20.3, except the serverbound plugin message of 1.19.4 that carries tunnel frames.
+var LegacyIDs = mcproto.PacketIDs{
+	mcproto.LoginSuccess:                    PIDLoginSuccess,
+	mcproto.JoinGame:                        0x29,
+	mcproto.KeepAlive:                       0x24,
+	mcproto.ChunkData:                       0x25,
+	mcproto.PluginMessage:                   0x18,
+	mcproto.PlayDisconnect:                  0x1B,
+	mcproto.GameEvent:                       0x20,
+	mcproto.PlayerInfoRemove:                0x3B,
+	mcproto.PlayerInfoUpdate:                0x3C,
+	mcproto.PlayerPosition:                  0x3E,
+	mcproto.AddResourcePack:                 0x44,
+	mcproto.TimeUpdate:                      0x62,
+	mcproto.SystemChat:                      0x69,
+	mcproto.EntityPosition:                  0x2C,
+	mcproto.ServerboundPluginMessage:        0x0D,
+	mcproto.ServerboundResourcePackResponse: 0x28,
+	mcproto.ServerboundKeepAlive:            0x15,
+}
+
+// Protocol returns the protocol of a session announcing version with the packet ID mode, and
+// false with packet_ids: version for versions without known IDs.
+func Protocol(mode string, version int) (mcproto.Protocol, bool) {
+	if mode == PacketIDsVersion {
+		ids, ok := mcproto.IDsFor(version)
+		return mcproto.Protocol{Version: version, IDs: ids}, ok
+	}
+	return mcproto.Protocol{Version: version, IDs: LegacyIDs}, true
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"minewire-server/pkg/disguise"
+	"minewire-server/pkg/mcproto"
+)
+
+// Packet IDs before the play state, the same in every version
+const (
+	PIDHandshake       = 0x00
+	PIDLoginStart      = 0x00
+	PIDLoginSuccess    = 0x02
+	PIDLoginDisconnect = 0x00
+)
+
+// Handshake next states
+const (
+	NextStateStatus = 1
+	NextStateLogin  = 2
+)
+
+// LoginStart is the Login Start a vanilla client of each version sends.
+type LoginStart struct {
+	Name       string
+	SigData    bool          `mc:",before=761"` // Always false: no chat signing key
+	PlayerUUID *mcproto.UUID `mc:"optional,since=760,before=764"`
+	UUID       mcproto.UUID  `mc:",since=764"`
+}
+
+// WriteHandshake sends a Handshake packet announcing protocol and the next state.
+func WriteHandshake(w io.Writer, protocol int, host string, port, nextState int) error {
+	pw := mcproto.NewPacketBuffer()
+	pw.VarInt(protocol)
+	pw.String(host)
+	pw.Short(int16(port))
+	pw.VarInt(nextState)
+	body, err := pw.Body()
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(w, PIDHandshake, body)
+}
+
+// WriteLoginStart sends the Login Start of a vanilla client of the version, with a random UUID.
+func WriteLoginStart(w io.Writer, version int, username string) error {
+	login := LoginStart{Name: username}
+	rand.Read(login.UUID[:])
+	login.PlayerUUID = &login.UUID
+	body, err := mcproto.Marshal(login, version)
+	if err != nil {
+		return err
+	}
+	return mcproto.WritePacket(w, PIDLoginStart, body)
+}
+
+// Login logs in to the server at addr over conn like a vanilla client of the protocol version,
+// with the username of password, and returns the client end of the tunnel once the server
+// accepted the login.
+func Login(conn net.Conn, addr, password string, proto mcproto.Protocol, framing string) (*ClientConn, error) {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	key := TunnelKey(password)
+	defer clear(key[:]) // The ciphers keep what they need of it
+
+	if err := WriteHandshake(conn, proto.Version, host, port, NextStateLogin); err != nil {
+		return nil, err
+	}
+	if err := WriteLoginStart(conn, proto.Version, Username(key)); err != nil {
+		return nil, err
+	}
+
+	packets := mcproto.NewPacketReader(conn)
+	pid, body, err := packets.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if pid != PIDLoginSuccess {
+		reason, _ := mcproto.ReadString(bytes.NewReader(body))
+		return nil, fmt.Errorf("login rejected: %s", reason)
+	}
+	// The UUID the server picked for the session binds the tunnel keys to it
+	session, err := mcproto.ReadUUID(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("login success: %w", err)
+	}
+	packets.SetLimits(mcproto.MaxPacketSize, 0) // Play packets may be large and sparse
+
+	sealer, opener := Ciphers(framing, key, session, disguise.ClientToServer, disguise.ServerToClient)
+	return &ClientConn{conn: conn, packets: packets, sealer: sealer, opener: opener, proto: proto}, nil
+}
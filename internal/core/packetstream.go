@@ -0,0 +1,89 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// PacketStream is the destination of a stream request that opens an IP packet stream instead
+// of a TCP connection. The server answers with the client's address (a prefix such as
+// 10.66.0.2/24 as a String) and the MTU (VarInt), then both sides exchange raw IP packets, each
+// prefixed with its length as a VarInt. Servers without a TUN interface close the stream.
+const PacketStream = "@ip"
+
+// MaxPacket is the largest IP packet a packet stream carries
+const MaxPacket = 65535
+
+// WritePacketAssignment answers a packet stream request with the client's address and MTU.
+func WritePacketAssignment(w io.Writer, addr netip.Prefix, mtu int) error {
+	if err := mcproto.WriteString(w, addr.String()); err != nil {
+		return err
+	}
+	return mcproto.WriteVarInt(w, mtu)
+}
+
+// ReadPacketAssignment reads the address and MTU the server assigned to a packet stream.
+func ReadPacketAssignment(r *bufio.Reader) (netip.Prefix, int, error) {
+	s, err := mcproto.ReadString(r)
+	if err != nil {
+		return netip.Prefix{}, 0, err
+	}
+	addr, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, 0, err
+	}
+	mtu, err := mcproto.ReadVarInt(r)
+	if err != nil {
+		return netip.Prefix{}, 0, err
+	}
+	if mtu < 576 || mtu > MaxPacket {
+		return netip.Prefix{}, 0, fmt.Errorf("bad MTU %d", mtu)
+	}
+	return addr, mtu, nil
+}
+
+// WriteIPPacket sends one IP packet over a packet stream.
+func WriteIPPacket(w io.Writer, packet []byte) error {
+	b := mcproto.AppendVarInt(make([]byte, 0, len(packet)+3), len(packet))
+	_, err := w.Write(append(b, packet...))
+	return err
+}
+
+// ReadIPPacket reads one IP packet from a packet stream into buf, which must hold MaxPacket
+// bytes, and returns it.
+func ReadIPPacket(r *bufio.Reader, buf []byte) ([]byte, error) {
+	n, err := mcproto.ReadLength(r, MaxPacket)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// PacketDestination returns the destination address of an IPv4 or IPv6 packet.
+func PacketDestination(packet []byte) (netip.Addr, bool) {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(packet[16:20])), true
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(packet[24:40])), true
+	}
+	return netip.Addr{}, false
+}
+
+// PacketSource returns the source address of an IPv4 or IPv6 packet.
+func PacketSource(packet []byte) (netip.Addr, bool) {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(packet[12:16])), true
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(packet[8:24])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Routing actions
+const (
+	RouteProxy  = "proxy"  // Through the tunnel
+	RouteDirect = "direct" // From the client's own network
+)
+
+// RoutingRule sends the destinations it matches through the tunnel or directly. A rule matches
+// its domains and their subdomains, addresses in its networks, and addresses the client's
+// GeoIP database places in its countries.
+type RoutingRule struct {
+	Action    string   `yaml:"action" json:"action"`
+	Domains   []string `yaml:"domains" json:"domains,omitempty"`
+	IPs       []string `yaml:"ips" json:"ips,omitempty"`             // Addresses or networks (CIDR)
+	Countries []string `yaml:"countries" json:"countries,omitempty"` // ISO 3166 codes, e.g. RU
+}
+
+// Routing is the split tunneling policy of a client: the first rule matching a destination
+// decides where it goes, Default (proxy when empty) decides for the others.
+type Routing struct {
+	Default string        `yaml:"default" json:"default,omitempty"`
+	Rules   []RoutingRule `yaml:"rules" json:"rules,omitempty"`
+}
+
+// Empty reports whether the policy sends everything through the tunnel without any rule.
+func (r Routing) Empty() bool {
+	return len(r.Rules) == 0 && (r.Default == "" || r.Default == RouteProxy)
+}
+
+// Validate checks the actions and networks of a policy.
+func (r Routing) Validate() error {
+	if r.Default != "" && r.Default != RouteProxy && r.Default != RouteDirect {
+		return fmt.Errorf("default route %q must be proxy or direct", r.Default)
+	}
+	for i, rule := range r.Rules {
+		if rule.Action != RouteProxy && rule.Action != RouteDirect {
+			return fmt.Errorf("rule %d: action %q must be proxy or direct", i+1, rule.Action)
+		}
+		if len(rule.Domains)+len(rule.IPs)+len(rule.Countries) == 0 {
+			return fmt.Errorf("rule %d matches nothing (no domains, ips or countries)", i+1)
+		}
+		for _, ip := range rule.IPs {
+			if _, err := ParseNetwork(ip); err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+		for _, c := range rule.Countries {
+			if len(c) != 2 {
+				return fmt.Errorf("rule %d: %q is not a two-letter country code", i+1, c)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseNetwork parses a CIDR network, or a single address as a network of its own.
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// MatchDomain reports whether host is domain or one of its subdomains.
+func MatchDomain(host, domain string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// Status state packet IDs, the same in every version
+const (
+	PIDStatusRequest  = 0x00
+	PIDStatusResponse = 0x00
+	PIDPing           = 0x01
+	PIDPong           = 0x01
+)
+
+// StatusPing does what the server list of a vanilla client does over conn: the status
+// handshake, a Status Request, then a Ping whose Pong gives the round trip time. It returns
+// the status JSON and the round trip.
+func StatusPing(conn net.Conn, addr string, version int) (string, time.Duration, error) {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	if err := WriteHandshake(conn, version, host, port, NextStateStatus); err != nil {
+		return "", 0, err
+	}
+	if err := mcproto.WritePacket(conn, PIDStatusRequest, nil); err != nil {
+		return "", 0, err
+	}
+	packets := mcproto.NewPacketReader(conn)
+	pid, body, err := packets.ReadPacket()
+	if err != nil {
+		return "", 0, err
+	}
+	if pid != PIDStatusResponse {
+		return "", 0, fmt.Errorf("unexpected packet 0x%02x", pid)
+	}
+	status, err := mcproto.ReadString(bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+
+	start := time.Now()
+	ping := mcproto.NewPacketBuffer()
+	ping.Long(start.UnixMilli())
+	if body, err = ping.Body(); err != nil {
+		return "", 0, err
+	}
+	if err := mcproto.WritePacket(conn, PIDPing, body); err != nil {
+		return "", 0, err
+	}
+	pid, pong, err := packets.ReadPacket()
+	if err != nil {
+		return "", 0, err
+	}
+	if pid != PIDPong || !bytes.Equal(pong, body) {
+		return "", 0, errors.New("unexpected pong")
+	}
+	return status, time.Since(start), nil
+}
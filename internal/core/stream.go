@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// WriteStreamRequest starts a tunnel stream with its destination (host:port) as a String. The
+// server answers by connecting to it, or by closing the stream.
+func WriteStreamRequest(w io.Writer, dest string) error {
+	return mcproto.WriteString(w, dest)
+}
+
+// ReadStreamRequest reads the destination a tunnel stream starts with.
+func ReadStreamRequest(r io.Reader) (string, error) {
+	return mcproto.ReadString(r)
+}
+
+// NormalizeDestination checks a stream destination and returns it as net.JoinHostPort writes
+// it: IPv6 literals in brackets, addresses in their canonical form. Unbracketed IPv6 literals (2001:db8::1:443)
+// are accepted, the port being after the last colon.
+func NormalizeDestination(dest string) (string, error) {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		i := strings.LastIndexByte(dest, ':')
+		if i < 0 {
+			return "", err
+		}
+		if _, perr := netip.ParseAddr(dest[:i]); perr != nil || !strings.Contains(dest[:i], ":") {
+			return "", err
+		}
+		host, port = dest[:i], dest[i+1:]
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", errors.New("invalid port " + strconv.Quote(port))
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.String()
+	} else if strings.ContainsAny(host, "[]%/ ") {
+		return "", errors.New("invalid host " + strconv.Quote(host))
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,31 @@
+// Package tun opens TUN interfaces, the virtual network devices that carry the IP packets of
+// packet streams: on the server they hand the clients' packets to the kernel for routing, on the
+// client they capture the traffic of the whole device.
+package tun
+
+import (
+	"net/netip"
+	"os"
+)
+
+// Device is an open TUN interface. Read and Write move one raw IP packet each, without a
+// protocol information header.
+type Device struct {
+	file *os.File
+	name string
+}
+
+// Name returns the name the kernel gave the interface.
+func (d *Device) Name() string { return d.name }
+
+func (d *Device) Read(b []byte) (int, error)  { return d.file.Read(b) }
+func (d *Device) Write(b []byte) (int, error) { return d.file.Write(b) }
+
+// Close removes the interface, unblocking a pending Read.
+func (d *Device) Close() error { return d.file.Close() }
+
+// Configure gives the interface its address and MTU and brings it up. The kernel adds the
+// route to the address's network.
+func (d *Device) Configure(addr netip.Prefix, mtu int) error {
+	return configure(d.name, addr, mtu)
+}
@@ -0,0 +1,91 @@
+package tun
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const cloneDevice = "/dev/net/tun"
+
+// Open creates the TUN interface name, or one named by the kernel (tun0, tun1...) if name is
+// empty. It needs CAP_NET_ADMIN.
+func Open(name string) (*Device, error) {
+	fd, err := unix.Open(cloneDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: cloneDevice, Err: err}
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, &os.SyscallError{Syscall: "TUNSETIFF", Err: err}
+	}
+	// Non-blocking, so the file goes through the runtime poller and Close interrupts Read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Device{file: os.NewFile(uintptr(fd), cloneDevice), name: ifr.Name()}, nil
+}
+
+func configure(name string, addr netip.Prefix, mtu int) error {
+	if !addr.Addr().Is4() {
+		return errors.New("only IPv4 addresses can be configured")
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	set := func(req uint, call string, fill func(*unix.Ifreq) error) error {
+		ifr, err := unix.NewIfreq(name)
+		if err != nil {
+			return err
+		}
+		if err := fill(ifr); err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(fd, req, ifr); err != nil {
+			return &os.SyscallError{Syscall: call, Err: err}
+		}
+		return nil
+	}
+	if err := set(unix.SIOCSIFADDR, "SIOCSIFADDR", func(ifr *unix.Ifreq) error {
+		return ifr.SetInet4Addr(addr.Addr().AsSlice())
+	}); err != nil {
+		return err
+	}
+	if err := set(unix.SIOCSIFNETMASK, "SIOCSIFNETMASK", func(ifr *unix.Ifreq) error {
+		return ifr.SetInet4Addr(net.CIDRMask(addr.Bits(), 32))
+	}); err != nil {
+		return err
+	}
+	if err := set(unix.SIOCSIFMTU, "SIOCSIFMTU", func(ifr *unix.Ifreq) error {
+		ifr.SetUint32(uint32(mtu))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return &os.SyscallError{Syscall: "SIOCGIFFLAGS", Err: err}
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return &os.SyscallError{Syscall: "SIOCSIFFLAGS", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var errUnsupported = errors.New("TUN interfaces are only supported on Linux")
+
+// Open creates a TUN interface; only implemented on Linux.
+func Open(name string) (*Device, error) {
+	return nil, errUnsupported
+}
+
+func configure(name string, addr netip.Prefix, mtu int) error {
+	return errUnsupported
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// keepAliveState pairs the Keep Alive packets sent to a client with its answers
+type keepAliveState struct {
+	mu       sync.Mutex
+	id       int64 // ID of the Keep Alive awaiting its answer, 0 if none
+	sent     time.Time
+	answered bool // The client answered a Keep Alive, so it must answer the next ones too
+}
+
+// sendKeepAlive sends a Keep Alive packet with the current time as its ID. Like vanilla servers,
+// no new one is sent while a client that answers them still owes the previous one; clients that
+// never answered get one every interval.
+func (mc *MinecraftConn) sendKeepAlive() error {
+	ka := &mc.keepAlive
+	ka.mu.Lock()
+	if ka.id != 0 && ka.answered {
+		ka.mu.Unlock()
+		return nil
+	}
+	ka.sent = time.Now()
+	ka.id = ka.sent.UnixNano()
+	id := ka.id
+	ka.mu.Unlock()
+
+	pw := mcproto.NewPacketBuffer()
+	pw.Long(id)
+	return mc.sendBody(mcproto.KeepAlive, pw)
+}
+
+// handleKeepAlive takes the client's answer to a Keep Alive. An answer carrying the pending ID
+// updates the session round trip time, smoothed like the latency vanilla servers show in the
+// tab list; answers with any other ID are ignored.
+func (mc *MinecraftConn) handleKeepAlive(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	id := int64(binary.BigEndian.Uint64(payload))
+	ka := &mc.keepAlive
+	ka.mu.Lock()
+	if ka.id == 0 || id != ka.id {
+		ka.mu.Unlock()
+		return
+	}
+	rtt := time.Since(ka.sent)
+	ka.id = 0
+	ka.answered = true
+	ka.mu.Unlock()
+
+	if prev := mc.session.RTT.Load(); prev != 0 {
+		rtt = (3*time.Duration(prev) + rtt) / 4
+	}
+	mc.session.RTT.Store(int64(rtt))
+}
+
+// keepAliveExpired reports whether a client that answers Keep Alive packets left the last one
+// unanswered for longer than timeout, meaning the peer is gone.
+func (mc *MinecraftConn) keepAliveExpired(timeout time.Duration) bool {
+	ka := &mc.keepAlive
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	return ka.answered && ka.id != 0 && time.Since(ka.sent) > timeout
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/client"
+)
+
+// runLabCommand runs the loopback lab: the top-level game server and a pkg/client Dialer in one
+// process, connected by an in-memory network, with transfers through the whole disguise
+// pipeline for every framing. Each transfer is checked byte for byte and timed. Returns the
+// process exit code: 1 if a check failed.
+func runLabCommand(args []string) int {
+	var framings string
+	var payloadMB, streams, pings int
+	parseFlags("lab", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&framings, "framing", "random,sequenced", "comma-separated tunnel framings to run")
+		fs.IntVar(&payloadMB, "payload", 16, "MiB per transfer")
+		fs.IntVar(&streams, "streams", 8, "parallel streams of the concurrent transfer")
+		fs.IntVar(&pings, "pings", 200, "round trips through the tunnel to measure latency")
+	})
+	loadConfig()
+	cfg := currentConfig()
+	if payloadMB < 1 || streams < 1 || pings < 1 {
+		fmt.Printf("FAIL -payload, -streams and -pings must be at least 1\n")
+		return 1
+	}
+
+	// A temporary user without limits, and no anomaly scoring: the unreachable destination
+	// check must not count against the lab's address
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	password := hex.EncodeToString(secret)
+	test := *cfg
+	test.Passwords = append(slices.Clone(cfg.Passwords), UserConfig{Name: "lab", Password: password})
+	test.AnomalyScoring = false
+	publishConfig(&test)
+	cfg = &test
+
+	// The server logs of the lab sessions would only clutter the report
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initAuthMap()
+	initListenerACL()
+	initEgress()
+	initLimits()
+	startCryptoWorkers()
+
+	payload := make([]byte, payloadMB<<20)
+	rand.Read(payload)
+	web, err := startLabWebServer(payload)
+	if err != nil {
+		fmt.Printf("FAIL web server: %v\n", err)
+		return 1
+	}
+	defer web.Close()
+	echo, err := startEchoServer()
+	if err != nil {
+		fmt.Printf("FAIL echo server: %v\n", err)
+		return 1
+	}
+	defer echo.Close()
+
+	fmt.Printf("frame_size=%d crypto_workers=%d payload=%dMiB\n", cfg.TunnelFrameSize, cfg.TunnelCryptoWorkers, payloadMB)
+	failed := false
+	for _, framing := range strings.Split(framings, ",") {
+		framing = strings.TrimSpace(framing)
+		fmt.Printf("Framing %s\n", framing)
+		if framing != core.FramingRandom && framing != core.FramingSequenced {
+			fmt.Printf("  FAIL unknown framing\n")
+			failed = true
+			continue
+		}
+		lab := &labRun{
+			password: password,
+			payload:  payload,
+			web:      "http://" + web.Addr().String() + "/payload",
+			echo:     echo.Addr().String(),
+			streams:  streams,
+			pings:    pings,
+		}
+		if !lab.run(framing) {
+			failed = true
+		}
+	}
+
+	if failed {
+		fmt.Printf("Loopback lab failed\n")
+		return 1
+	}
+	fmt.Printf("Loopback lab OK\n")
+	return 0
+}
+
+// labRun is one pass of the lab with a framing
+type labRun struct {
+	password string
+	payload  []byte
+	web      string // URL serving the payload
+	echo     string // Address of the echo server
+	streams  int
+	pings    int
+}
+
+// run serves the server with framing on an in-memory network, connects a Dialer to it and
+// runs the checks. It reports whether all of them passed.
+func (l *labRun) run(framing string) bool {
+	srv := *currentConfig()
+	srv.TunnelFraming = framing
+	srv.root = &srv
+	network := newMemNetwork(net.JoinHostPort("127.0.0.1", srv.ListenPort))
+	defer network.Close()
+	go func() {
+		for {
+			conn, err := network.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, &srv)
+		}
+	}()
+
+	ok := true
+	report := func(name string, detail string, err error) {
+		if err != nil {
+			fmt.Printf("  FAIL %-24s %v\n", name, err)
+			ok = false
+		} else {
+			fmt.Printf("  OK   %-24s %s\n", name, detail)
+		}
+	}
+
+	d, err := client.NewDialer(client.Config{
+		Endpoints:     []client.Endpoint{{Name: "lab", Addr: network.Addr().String(), Password: l.password}},
+		Framing:       framing,
+		PacketIDs:     srv.PacketIDs,
+		Protocol:      srv.ProtocolID,
+		ProbeInterval: -1,
+		Dial:          network.DialContext,
+		Logf:          func(string, ...any) {},
+	})
+	if err != nil {
+		report("login", "", err)
+		return false
+	}
+	defer d.Close()
+	start := time.Now()
+	if err := d.Connect(); err != nil {
+		report("login", "", err)
+		return false
+	}
+	report("login", time.Since(start).Round(time.Microsecond).String(), nil)
+
+	detail, err := l.download(d)
+	report("HTTP download", detail, err)
+	detail, err = l.echoStreams(d, 1)
+	report("echo", detail, err)
+	detail, err = l.echoStreams(d, l.streams)
+	report(fmt.Sprintf("echo x%d", l.streams), detail, err)
+	detail, err = l.roundTrips(d)
+	report(fmt.Sprintf("round trips x%d", l.pings), detail, err)
+	report("unreachable destination", "closed without data", l.unreachable(d))
+	return ok
+}
+
+// throughput formats the rate of a transfer of n bytes.
+func throughput(n int, elapsed time.Duration) string {
+	return fmt.Sprintf("%.2f MB/s", float64(n)/1e6/elapsed.Seconds())
+}
+
+// download fetches the payload from the web server through the Dialer with net/http and
+// compares its hash.
+func (l *labRun) download(d *client.Dialer) (string, error) {
+	hc := &http.Client{Transport: &http.Transport{DialContext: d.Dial}, Timeout: checkTimeout}
+	defer hc.CloseIdleConnections()
+	start := time.Now()
+	resp, err := hc.Get(l.web)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("after %d bytes: %w", n, err)
+	}
+	elapsed := time.Since(start)
+	if want := sha256.Sum256(l.payload); int(n) != len(l.payload) || !bytes.Equal(h.Sum(nil), want[:]) {
+		return "", fmt.Errorf("received %d bytes that don't match the payload", n)
+	}
+	return throughput(int(n), elapsed), nil
+}
+
+// echoStreams echoes the payload through n streams at once, split between them.
+func (l *labRun) echoStreams(d *client.Dialer, n int) (string, error) {
+	part := len(l.payload) / n
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = l.echoOnce(d, l.payload[i*part:(i+1)*part])
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+	return throughput(part*n, elapsed), nil
+}
+
+// echoOnce writes data to the echo server through a stream while reading it back.
+func (l *labRun) echoOnce(d *client.Dialer, data []byte) error {
+	stream, err := d.Dial(context.Background(), "tcp", l.echo)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(checkTimeout))
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		writeErr <- err
+	}()
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if !bytes.Equal(data, received) {
+		return errors.New("echoed data does not match")
+	}
+	return nil
+}
+
+// roundTrips measures one byte round trips through a stream to the echo server.
+func (l *labRun) roundTrips(d *client.Dialer) (string, error) {
+	stream, err := d.Dial(context.Background(), "tcp", l.echo)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(checkTimeout))
+	rtts := make([]time.Duration, 0, l.pings)
+	one := []byte{0x42}
+	for range l.pings {
+		t := time.Now()
+		if _, err := stream.Write(one); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(stream, one); err != nil {
+			return "", err
+		}
+		rtts = append(rtts, time.Since(t))
+	}
+	slices.Sort(rtts)
+	p50, p99 := rtts[(len(rtts)-1)*50/100], rtts[(len(rtts)-1)*99/100]
+	return fmt.Sprintf("p50 %s p99 %s", p50.Round(time.Microsecond), p99.Round(time.Microsecond)), nil
+}
+
+// unreachable opens a stream to a closed port, which the server must close without data.
+func (l *labRun) unreachable(d *client.Dialer) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	stream, err := d.Dial(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(checkTimeout))
+	if n, err := io.Copy(io.Discard, stream); err != nil || n > 0 {
+		return fmt.Errorf("read %d bytes (%v), expected a closed stream", n, err)
+	}
+	return nil
+}
+
+// startLabWebServer serves payload at /payload on a loopback port.
+func startLabWebServer(payload []byte) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /payload", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload", time.Time{}, bytes.NewReader(payload))
+	})
+	go http.Serve(ln, mux)
+	return ln, nil
+}
+
+// memNetwork is an in-memory network with a single listener: DialContext connects to it with
+// a pipe whose ends are addressed like loopback TCP connections.
+type memNetwork struct {
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	nextPort  int
+}
+
+func newMemNetwork(addr string) *memNetwork {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return &memNetwork{addr: tcpAddr, conns: make(chan net.Conn), done: make(chan struct{}), nextPort: 40000}
+}
+
+// DialContext connects to the listener, whatever the address.
+func (m *memNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	m.mu.Lock()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: m.nextPort}
+	m.nextPort++
+	m.mu.Unlock()
+	c, s := net.Pipe()
+	select {
+	case m.conns <- &memConn{Conn: s, local: m.addr, remote: local}:
+		return &memConn{Conn: c, local: local, remote: m.addr}, nil
+	case <-m.done:
+		c.Close()
+		s.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		c.Close()
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (m *memNetwork) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *memNetwork) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
+func (m *memNetwork) Addr() net.Addr { return m.addr }
+
+// memConn is one end of a memNetwork pipe
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
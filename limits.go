@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Global resource limits. A nil slot channel means unlimited.
+var (
+	connSlots   chan struct{} // Open game connections, all servers together
+	streamSlots chan struct{} // Open tunnel streams, all sessions together
+
+	memoryPressure atomic.Bool  // Heap above memory_limit, accepting is paused
+	pauseLogged    atomic.Int64 // Unix time of the last "not accepting" log line
+)
+
+// initLimits prepares the connection and stream slots and the memory guard.
+func initLimits() {
+	cfg := currentConfig()
+	if cfg.MaxConnections > 0 {
+		connSlots = make(chan struct{}, cfg.MaxConnections)
+	}
+	if cfg.MaxStreamsTotal > 0 {
+		streamSlots = make(chan struct{}, cfg.MaxStreamsTotal)
+	}
+	if cfg.MemoryLimit > 0 {
+		// The GC works harder near the limit; accepting pauses before it is reached
+		debug.SetMemoryLimit(int64(cfg.MemoryLimit) << 20)
+		go startMemoryGuard()
+	}
+}
+
+// acquireConnSlot blocks while the connection limit is reached or memory is short, so new
+// connections wait in the kernel backlog instead of consuming memory.
+func acquireConnSlot() {
+	for memoryPressure.Load() {
+		pauseAccepting("memory_limit reached")
+		time.Sleep(100 * time.Millisecond)
+	}
+	if connSlots == nil {
+		return
+	}
+	select {
+	case connSlots <- struct{}{}:
+	default:
+		pauseAccepting("max_connections reached")
+		connSlots <- struct{}{}
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
+
+// pauseAccepting logs that accepting stopped, at most once a minute under sustained load.
+func pauseAccepting(reason string) {
+	now := time.Now().Unix()
+	if last := pauseLogged.Load(); now-last >= 60 && pauseLogged.CompareAndSwap(last, now) {
+		log.Printf("Not accepting connections: %s", reason)
+	}
+}
+
+// acquireStreamSlot waits for a free stream slot, giving up when done is closed.
+func acquireStreamSlot(done <-chan struct{}) bool {
+	if streamSlots == nil {
+		return true
+	}
+	select {
+	case streamSlots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func releaseStreamSlot() {
+	if streamSlots != nil {
+		<-streamSlots
+	}
+}
+
+// sessionsFull reports whether max_sessions_total tunnel sessions are live.
+func sessionsFull() bool {
+	cfg := currentConfig()
+	return cfg.MaxSessionsTotal > 0 && sessions.Count() >= cfg.MaxSessionsTotal
+}
+
+// startMemoryGuard flags memory pressure when the heap grows past 90% of memory_limit.
+func startMemoryGuard() {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		cfg := currentConfig()
+		metrics.Read(sample)
+		high := sample[0].Value.Uint64() > uint64(cfg.MemoryLimit)<<20*9/10
+		if memoryPressure.Swap(high) != high && !high {
+			log.Printf("Memory back under memory_limit")
+		}
+	}
+}
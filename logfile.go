@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only log file that rotates itself once it exceeds a maximum size or
+// a rotation period ends. Rotated files are renamed to path.1, path.2, ... keeping at most
+// maxBackups of them, and none older than maxAge.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	interval   time.Duration
+	maxAge     time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	period time.Time // Rotation period of the current file's entries
+}
+
+// OpenRotatingFile opens (or creates) the log file at path. maxSizeMB <= 0 disables rotation by
+// size, rotateHours <= 0 rotation by time (periods start at multiples of the interval in UTC,
+// e.g. midnight for 24) and maxAgeDays <= 0 removal of old backups by age.
+func OpenRotatingFile(path string, maxSizeMB, maxBackups, rotateHours, maxAgeDays int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) << 20,
+		maxBackups: maxBackups,
+		interval:   time.Duration(rotateHours) * time.Hour,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.removeExpired()
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	r.period = time.Now()
+	if r.size > 0 {
+		r.period = info.ModTime() // Entries left from before a restart may belong to an earlier period
+	}
+	r.period = r.period.Truncate(r.interval)
+	return nil
+}
+
+// Write appends p to the file, rotating first if p would push the file over the size limit.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bySize := r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize
+	byTime := r.interval > 0 && time.Now().Truncate(r.interval).After(r.period)
+	if r.size > 0 && (bySize || byTime) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one and starts a fresh file. Must be called with mu held.
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	r.removeExpired()
+	return r.open()
+}
+
+// removeExpired deletes the backups last written more than maxAge ago.
+func (r *RotatingFile) removeExpired() {
+	if r.maxAge <= 0 {
+		return
+	}
+	for i := 1; i <= r.maxBackups; i++ {
+		name := fmt.Sprintf("%s.%d", r.path, i)
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > r.maxAge {
+			os.Remove(name)
+		}
+	}
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
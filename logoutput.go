@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Syslog severities (RFC 5424), also understood by journald as "<N>" line prefixes
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+)
+
+// logSeverity guesses the severity of a log line from its wording.
+func logSeverity(msg string) int {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "panic"):
+		return sevCrit
+	case strings.Contains(lower, "error"), strings.Contains(lower, "failed"),
+		strings.Contains(lower, "could not"), strings.Contains(lower, "invalid"):
+		return sevErr
+	case strings.Contains(lower, "banned"), strings.Contains(lower, "anomaly"),
+		strings.Contains(lower, "rejected"), strings.Contains(lower, "disabled"):
+		return sevWarning
+	}
+	return sevInfo
+}
+
+// journaldWriter prefixes every line with its severity so journald can filter by priority.
+type journaldWriter struct {
+	out io.Writer
+}
+
+func (w journaldWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "<%d>", logSeverity(string(line)))
+		buf.Write(line)
+	}
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// initLogOutput redirects the standard logger according to cfg.LogOutput.
+func initLogOutput() {
+	cfg := currentConfig()
+	switch cfg.LogOutput {
+	case "", "stderr":
+	case "journald":
+		log.SetFlags(0) // journald adds its own timestamps
+		log.SetOutput(journaldWriter{out: os.Stderr})
+	case "syslog":
+		w, err := openSyslog(cfg.SyslogAddress, cfg.SyslogTag)
+		if err != nil {
+			log.Fatalf("Could not connect to syslog: %v", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		log.Fatalf("Unknown log_output: %s", cfg.LogOutput)
+	}
+}
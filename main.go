@@ -3,162 +3,556 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
-	"strings"
+	"slices"
+	"sync/atomic"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
 )
 
-// Config holds the server configuration loaded from server.yaml
+// Config holds the server configuration loaded from server.yaml (see config.go for overrides)
 type Config struct {
-	ListenPort string        `yaml:"listen_port"`
-	Passwords  []interface{} `yaml:"passwords"` // List of authorized passwords (string or map)
+	ListenPort    string       `yaml:"listen_port"`
+	ListenAddress string       `yaml:"listen_address"` // Default: all interfaces, IPv4 and IPv6
+	Passwords     []UserConfig `yaml:"passwords"`      // Authorized users (see UserConfig for the accepted forms)
+
+	// Additional game servers in this process, each with its own port, users and disguise. Entries
+	// take the keys of this file and inherit every top-level setting except name, port and users.
+	Name    string   `yaml:"name"` // Name of the top-level server in logs and the admin API
+	Servers []Config `yaml:"servers"`
 
 	// Subscription settings
-	SubsListenPort string `yaml:"subs_listen_port"`
+	SubsListenPort    string `yaml:"subs_listen_port"`
+	SubsListenAddress string `yaml:"subs_listen_address"` // Default: all interfaces
+	SubsRateLimit     int    `yaml:"subs_rate_limit"`     // Subscription requests per minute and IP
+	SubsAccessLog     string `yaml:"subs_access_log"`     // JSON lines, one per request
+	SubsPath          string `yaml:"subs_path"`           // Prefix of subscription paths
+	SubsDecoyDir      string `yaml:"subs_decoy_dir"`      // Static website served on all other paths
+
+	// HTTPS for the subscription server with a certificate from files or from ACME (below), and
+	// access restricted to clients with a certificate signed by subs_client_ca or the subs_token
+	SubsTLSCert  string `yaml:"subs_tls_cert"` // PEM certificate chain
+	SubsTLSKey   string `yaml:"subs_tls_key"`
+	SubsClientCA string `yaml:"subs_client_ca"` // PEM CA certificates, enables mutual TLS
+	SubsToken    string `yaml:"subs_token"`     // Bearer token or ?token= parameter
+
+	// Public hostnames links may point at; other Host headers get the first one
+	SubsHosts []string `yaml:"subs_hosts"`
+
+	// Canonical public addresses of the server (IPv4, IPv6, domains) listed in every subscription
+	// instead of the requested host; client_family only lists those of the client's IP family
+	PublicAddresses      []string `yaml:"public_addresses"`
+	SubsAddressSelection string   `yaml:"subs_address_selection"` // all, client_family
+
+	// Addresses listed in every subscription (other domains, ports, fallback servers), by priority
+	SubsEndpoints []SubsEndpoint `yaml:"subs_endpoints"`
+
+	// Split tunneling rules sent to clients in ?format=json subscriptions
+	SubsRouting core.Routing `yaml:"subs_routing"`
+
+	// Signed, expiring subscription paths (subs_path + token) replacing subs_path + nickname
+	SubsSecret   string `yaml:"subs_secret"`    // HMAC key; changing it revokes every token
+	SubsTokenTTL int    `yaml:"subs_token_ttl"` // Default validity in hours
+
+	// Hours the subscription path of a rotated user answers with a notice (0 = plain 404)
+	SubsRotationNotice int `yaml:"subs_rotation_notice"`
+
+	// SOCKS5 address of the Minewire client in Clash, sing-box and Xray subscriptions
+	SubsLocalProxy string `yaml:"subs_local_proxy"`
+
+	// Delivery of the links of users created with POST /api/users
+	TelegramBotToken string `yaml:"telegram_bot_token"`
+	SMTPServer       string `yaml:"smtp_server"` // host:port
+	SMTPUsername     string `yaml:"smtp_username"`
+	SMTPPassword     string `yaml:"smtp_password"`
+	SMTPFrom         string `yaml:"smtp_from"`
+
+	// Certificates from an ACME CA (e.g. Let's Encrypt) for the subscription server
+	ACMEDomains   []string `yaml:"acme_domains"` // Enables HTTPS when set
+	ACMEEmail     string   `yaml:"acme_email"`
+	ACMEDirectory string   `yaml:"acme_directory"` // Directory URL of the CA
+	ACMECacheDir  string   `yaml:"acme_cache_dir"` // Account key and certificates, kept across restarts
+	ACMEChallenge string   `yaml:"acme_challenge"` // http-01 or dns-01
+	ACMEHTTPPort  string   `yaml:"acme_http_port"` // Port answering http-01 challenges
+	ACMEDNSHook   string   `yaml:"acme_dns_hook"`  // Command publishing dns-01 TXT records
+
+	// Admin API and web dashboard (HTTP basic auth with any username, or bearer token)
+	AdminListen string `yaml:"admin_listen"`
+	AdminToken  string `yaml:"admin_token"`
+
+	// Health check ("minewire-server check"): credential and address of the server to test
+	CheckPassword string `yaml:"check_password"` // Defaults to the first configured password
+	CheckAddress  string `yaml:"check_address"`  // Defaults to 127.0.0.1:listen_port
+
+	// Server log destination: stderr (default), journald (stderr with priority prefixes) or syslog
+	LogOutput     string `yaml:"log_output"`
+	SyslogAddress string `yaml:"syslog_address"` // Remote syslog as udp://host:514 or tcp://host:514 (empty = local)
+	SyslogTag     string `yaml:"syslog_tag"`
+	RedactLogs    *bool  `yaml:"redact_logs"`   // Name users by nickname, id or label instead of their generated username (default)
+	LogUsernames  bool   `yaml:"log_usernames"` // Alias of redact_logs: false
+	Fail2banLog   bool   `yaml:"fail2ban_log"`  // Also log security events and anomalies in a stable single-line format
+
+	// Per-stream access log (JSON lines), rotated by size and time
+	AccessLog            string `yaml:"access_log"`
+	AccessLogMaxSize     int    `yaml:"access_log_max_size"` // Megabytes
+	AccessLogMaxBackups  int    `yaml:"access_log_max_backups"`
+	AccessLogRotateHours int    `yaml:"access_log_rotate_hours"` // 0 = by size only
+	AccessLogMaxAge      int    `yaml:"access_log_max_age"`      // Days to keep backups (0 = by count only)
+
+	// Security event log (bans, rejected logins, tarpits, limits) as JSON lines, rotated by size and time
+	EventLog            string `yaml:"event_log"`
+	EventLogMaxSize     int    `yaml:"event_log_max_size"` // Megabytes
+	EventLogMaxBackups  int    `yaml:"event_log_max_backups"`
+	EventLogRotateHours int    `yaml:"event_log_rotate_hours"`
+	EventLogMaxAge      int    `yaml:"event_log_max_age"`
+
+	// Disguise profile (vanilla, paper, purpur, forge, modded) providing defaults for the settings below
+	Profile string `yaml:"profile"`
 
 	// Minecraft server metadata for masquerading
 	VersionName string `yaml:"version_name"`
 	ProtocolID  int    `yaml:"protocol_id"`
+	PacketIDs   string `yaml:"packet_ids"` // legacy or version (play packet IDs of the client's version)
 	IconPath    string `yaml:"icon_path"`
 	Motd        string `yaml:"motd"`
+	Brand       string `yaml:"brand"` // Server brand sent in the minecraft:brand plugin message
+
+	// Additional top-level fields merged into the status JSON (e.g. forgeData, modinfo)
+	StatusExtras map[string]interface{} `yaml:"status_extras"`
+
+	// Status presentation: normal, whitelist (0 online) or maintenance. Agents are accepted in every mode.
+	StatusMode         string `yaml:"status_mode"`
+	MaintenanceMotd    string `yaml:"maintenance_motd"`
+	MaintenanceVersion string `yaml:"maintenance_version"` // Label shown instead of the version in maintenance mode
+
+	// Chat signing fields modern clients expect in the status JSON
+	EnforcesSecureChat bool  `yaml:"enforces_secure_chat"`
+	PreviewsChat       *bool `yaml:"previews_chat"` // Only set when disguising as 1.19-1.19.2
 
 	// Player count simulation settings
 	MaxPlayers int `yaml:"max_players"`
 	OnlineMin  int `yaml:"online_min"`
 	OnlineMax  int `yaml:"online_max"`
+
+	// GS4 Query protocol settings (UDP)
+	QueryEnabled bool   `yaml:"query_enabled"`
+	QueryPort    string `yaml:"query_port"`    // Defaults to listen_port, like vanilla
+	QueryPlugins string `yaml:"query_plugins"` // Plugin list reported in full stat responses
+
+	// Server resource pack pushed to every session after join
+	ResourcePackURL    string `yaml:"resource_pack_url"`
+	ResourcePackSHA1   string `yaml:"resource_pack_sha1"`
+	ResourcePackForced bool   `yaml:"resource_pack_forced"`
+	ResourcePackPrompt string `yaml:"resource_pack_prompt"`
+
+	// Active-probing resistance: sessions that fail the tunnel bootstrap degrade into fake gameplay
+	DecoyMode    bool `yaml:"decoy_mode"`
+	DecoyTimeout int  `yaml:"decoy_timeout"` // Seconds to wait for the first tunnel frame (0 = wait forever)
+
+	// Connections whose first bytes aren't a Minecraft handshake (TLS, HTTP, SSH...): close
+	// (default), timeout (read and never answer) or forward (to foreign_protocol_backend)
+	ForeignProtocol        string `yaml:"foreign_protocol"`
+	ForeignProtocolBackend string `yaml:"foreign_protocol_backend"` // host:port of a real server, e.g. a web server
+
+	// Tunnel framing: writes are split into Chunk Data packets of at most tunnel_frame_size bytes,
+	// and small writes wait up to tunnel_coalesce_delay milliseconds for more data (-1 disables)
+	TunnelFrameSize     int `yaml:"tunnel_frame_size"`
+	TunnelCoalesceDelay int `yaml:"tunnel_coalesce_delay"`
+
+	// How tunnel frames are sealed: random (a nonce per frame, what every client speaks) or
+	// sequenced (counter nonces with replay and reordering detection; clients must support it)
+	TunnelFraming string `yaml:"tunnel_framing"`
+
+	// Goroutines sealing and opening the tunnel frames of all sessions in parallel, keeping each
+	// session's order (0: every session on its own goroutines)
+	TunnelCryptoWorkers int `yaml:"tunnel_crypto_workers"`
+
+	// Socket options of the game connections tunnel sessions run over (0: the default)
+	TCPSendBuffer        int `yaml:"tcp_send_buffer"`        // Bytes
+	TCPReceiveBuffer     int `yaml:"tcp_receive_buffer"`     // Bytes
+	TCPKeepAliveIdle     int `yaml:"tcp_keepalive_idle"`     // Idle seconds before the first probe (-1 disables keepalives)
+	TCPKeepAliveInterval int `yaml:"tcp_keepalive_interval"` // Seconds between probes
+	TCPKeepAliveCount    int `yaml:"tcp_keepalive_count"`    // Unanswered probes that drop the connection
+	TCPUserTimeout       int `yaml:"tcp_user_timeout"`       // Seconds sent data may stay unacknowledged (Linux)
+	TCPMaxSegment        int `yaml:"tcp_max_segment"`        // Largest segment sent, in bytes (Linux)
+
+	// Full-device tunneling: the IP packet streams of clients in TUN mode are routed through a
+	// TUN interface (Linux), with addresses from tun_network
+	TunNetwork string `yaml:"tun_network"` // IPv4 network, e.g. 10.66.0.0/24 (empty disables)
+	TunName    string `yaml:"tun_name"`
+	TunMTU     int    `yaml:"tun_mtu"`
+
+	// IP to ASN database (iptoasn.com ip2asn-combined.tsv, optionally .gz) for status probe analytics
+	ASNDatabase string `yaml:"asn_database"`
+
+	// Destination statistics: full, hashed, aggregate or off (see server.yaml)
+	DestinationStats          string `yaml:"destination_stats"`
+	DestinationStatsRetention int    `yaml:"destination_stats_retention"` // Hours
+	DestinationStatsTop       int    `yaml:"destination_stats_top"`       // Hosts listed per user
+	DestinationStatsSalt      string `yaml:"destination_stats_salt"`      // Key for hashed mode, random per run if empty
+
+	// Destinations whose DNS + connect time exceeds this many seconds on most dials are flagged as slow
+	SlowDialThreshold int `yaml:"slow_dial_threshold"`
+
+	// Address family of destinations with both: prefer_ipv4, prefer_ipv6, ipv4 or ipv6 (only)
+	EgressFamily string `yaml:"egress_family"`
+
+	// Seconds a stream has to connect to its destination, lookup included (users' limits may set their own)
+	DialTimeout int  `yaml:"dial_timeout"`
+	DialRetry   bool `yaml:"dial_retry"` // Retry once with the other address family, in the second half of the timeout
+
+	// Cache of destination lookups, honoring the TTLs of the answers
+	DNSCacheSize        int `yaml:"dns_cache_size"`         // Hosts cached (-1 disables the cache)
+	DNSCacheMaxTTL      int `yaml:"dns_cache_max_ttl"`      // Seconds an answer is cached at most
+	DNSCacheNegativeTTL int `yaml:"dns_cache_negative_ttl"` // Seconds a missing host is cached at most
+
+	// Scanner detection: score anomalies per source IP, tarpit and temporarily ban offenders
+	AnomalyScoring bool    `yaml:"anomaly_scoring"`
+	TarpitScore    float64 `yaml:"tarpit_score"`
+	BanScore       float64 `yaml:"ban_score"`
+	BanDuration    int     `yaml:"ban_duration"` // Minutes
+
+	// Sources allowed to (if set) and refused from the game ports, as CIDR blocks or addresses
+	ListenerAllow       []string `yaml:"listener_allow"`
+	ListenerDeny        []string `yaml:"listener_deny"`
+	BanNetworkThreshold int      `yaml:"ban_network_threshold"` // Banned addresses that ban their /24 or /64 (0 disables)
+
+	// Firewall the bans are pushed to: nftables or ipset sets with timeouts, or a script
+	FirewallBackend string `yaml:"firewall_backend"`
+	FirewallTable   string `yaml:"firewall_table"` // nftables family and table of the sets
+	FirewallSet     string `yaml:"firewall_set"`   // Set of IPv4 bans
+	FirewallSet6    string `yaml:"firewall_set6"`  // Set of IPv6 bans
+	FirewallScript  string `yaml:"firewall_script"`
+
+	// Leak watchdog: per-session goroutine and destination connection limits (-1 disables a limit)
+	WatchdogInterval     int `yaml:"watchdog_interval"` // Seconds between checks
+	SessionMaxGoroutines int `yaml:"session_max_goroutines"`
+	SessionMaxConns      int `yaml:"session_max_conns"`
+	StreamIdleTimeout    int `yaml:"stream_idle_timeout"` // Seconds without traffic before a stream is closed
+
+	// Keepalives of proxied connections: TCP keepalives on destination sockets every
+	// destination_keepalive seconds of silence (-1 disables), and with stream_keepalive an idle
+	// stream pings the tunnel every that many seconds and stays open while it answers,
+	// instead of being closed at stream_idle_timeout (0 disables)
+	DestinationKeepAlive int `yaml:"destination_keepalive"`
+	StreamKeepAlive      int `yaml:"stream_keepalive"`
+
+	// Deadlines of game connections, in seconds (-1 disables): each packet before the tunnel must
+	// arrive within handshake_timeout, and each packet write must complete within write_timeout
+	HandshakeTimeout int `yaml:"handshake_timeout"`
+	WriteTimeout     int `yaml:"write_timeout"`
+
+	// Global resource limits (-1 disables): accepting pauses at the connection limit or under memory
+	// pressure, logins get "server full" at the session limit, streams wait for a free slot
+	MaxConnections   int `yaml:"max_connections"`
+	MaxSessionsTotal int `yaml:"max_sessions_total"`
+	MaxStreamsTotal  int `yaml:"max_streams_total"`
+	MemoryLimit      int `yaml:"memory_limit"` // Megabytes, 0 = no limit
+
+	// Outbound limits of every user across its sessions, unless its limits set others (-1 disables)
+	UserStreamRate   int `yaml:"user_stream_rate"`   // New streams per second, in bursts of up to twice as many
+	UserMaxDials     int `yaml:"user_max_dials"`     // Destination connections being dialed at once
+	RateLimitSuspend int `yaml:"rate_limit_suspend"` // Rejected streams that disable the user (0 = never)
+
+	// Ceiling of the traffic the server relays for all sessions, in Mbit/s of both directions
+	// together (0 = unlimited), shared between users in proportion to their bandwidth_weight limit
+	BandwidthLimit int `yaml:"bandwidth_limit"`
+
+	// Egress policy: allow, deny or route destinations via an upstream proxy, for everyone and per
+	// group of users (the group field of a user)
+	Egress       EgressPolicy            `yaml:"egress"`
+	EgressGroups map[string]EgressPolicy `yaml:"egress_groups"`
+	EgressLists  map[string]EgressList   `yaml:"egress_lists"` // Domain and network lists of the lists rule condition
+
+	// Health checks of the exits of upstream egress rules
+	UpstreamCheckInterval int    `yaml:"upstream_check_interval"` // Seconds between checks (-1 disables)
+	UpstreamCheckTarget   string `yaml:"upstream_check_target"`   // host:port to connect to through every exit, "" = handshake only
+
+	// Log the packet being processed, as hex, when a session panics (for bug reports; may contain user data)
+	PanicDump bool `yaml:"panic_dump"`
+
+	// Seconds the old process keeps serving its sessions after a binary upgrade (SIGUSR2), -1 = until they end
+	UpgradeDrainTimeout int `yaml:"upgrade_drain_timeout"`
+
+	// World simulation settings for established sessions
+	KeepAliveInterval  int  `yaml:"keepalive_interval"`   // Seconds between Keep Alive packets
+	KeepAliveTimeout   int  `yaml:"keepalive_timeout"`    // Seconds a client that answers Keep Alives may leave one unanswered (-1 disables)
+	TimeUpdateInterval int  `yaml:"time_update_interval"` // Seconds between Time Update packets (-1 disables)
+	Weather            bool `yaml:"weather"`              // Send rain start/stop Game Event packets
+
+	// Cover traffic replayed from a capture of a real server session (.pcap or packet log)
+	CaptureTemplate   string `yaml:"capture_template"`
+	CaptureServerPort int    `yaml:"capture_server_port"` // Server port in the pcap capture
+	CaptureMaxRate    int    `yaml:"capture_max_rate"`    // Bytes per second of cover traffic per session
+
+	// OpenTelemetry tracing of the session lifecycle, exported over OTLP/HTTP (JSON)
+	TracingEndpoint    string            `yaml:"tracing_endpoint"` // e.g. http://collector:4318/v1/traces
+	TracingServiceName string            `yaml:"tracing_service_name"`
+	TracingHeaders     map[string]string `yaml:"tracing_headers"` // Extra HTTP headers, e.g. authentication
+
+	// Simulated system chat (join/leave notices, advancements)
+	ChatSimulation bool     `yaml:"chat_simulation"`
+	ChatInterval   int      `yaml:"chat_interval"`  // Average seconds between simulated messages
+	ChatTemplates  []string `yaml:"chat_templates"` // {player} is replaced with a simulated player name
+
+	root *Config // The top-level config this one belongs to, itself for the top level
+}
+
+// The running configuration. A reload publishes a new one instead of changing it, so a
+// connection or task that loads it once keeps consistent settings for as long as it runs.
+var runningConfig atomic.Pointer[Config]
+
+func init() {
+	publishConfig(&Config{})
+}
+
+// currentConfig returns the running configuration. It must not be changed.
+func currentConfig() *Config {
+	return runningConfig.Load()
 }
 
-var cfg Config
+// publishConfig makes c the running configuration. c must not be changed afterwards.
+func publishConfig(c *Config) {
+	c.Servers = slices.Clone(c.Servers) // Copies of a config share the entries
+	c.root = c
+	for i := range c.Servers {
+		c.Servers[i].root = c
+	}
+	runningConfig.Store(c)
+}
 
 const ServerVersion = "26.1.1"
 
 func main() {
-	// Handle Version Flags
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
+	// Handle Version Flags and subcommands
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
 		case "-v", "--version", "--about":
 			fmt.Printf("Minewire Server v%s\n", ServerVersion)
 			return
+		case "check":
+			parseFlags("check", args[1:])
+			loadConfig()
+			os.Exit(runHealthCheck())
+		case "bench":
+			os.Exit(runBenchCommand(args[1:]))
+		case "conformance":
+			os.Exit(runConformanceCommand(args[1:]))
+		case "lab":
+			os.Exit(runLabCommand(args[1:]))
+		case "config":
+			os.Exit(runConfigCommand(args[1:]))
+		case "service":
+			os.Exit(runServiceCommand(args[1:]))
+		case "subs":
+			os.Exit(runSubsCommand(args[1:]))
 		}
 	}
 
-	f, err := os.Open("server.yaml")
-	if err != nil {
-		log.Fatal("Could not open server.yaml: ", err)
+	parseFlags("minewire-server", args)
+	loadConfig()
+	if dryRun {
+		os.Exit(runDryRun())
 	}
-	decoder := yaml.NewDecoder(f)
-	if err := decoder.Decode(&cfg); err != nil {
-		log.Fatal("Invalid server.yaml: ", err)
+
+	// Started by the Windows service manager: it controls the server's lifetime
+	if runAsService(runServer) {
+		return
 	}
-	f.Close()
+	runServer()
+}
+
+// runServer starts all servers and serves game connections until the process exits.
+func runServer() {
+	// Redirect server logs to journald or syslog if configured
+	initLogOutput()
 
-	// Apply defaults if not specified in config
-	if cfg.ProtocolID == 0 {
-		cfg.ProtocolID = 773
+	// Report what a reload would refuse, but keep starting with configs that used to work.
+	// Only a chat_interval below 1 is fatal: it floods every session with chat messages.
+	c := currentConfig()
+	for _, p := range validateConfig(c) {
+		log.Printf("%s: %s", configPath, p)
 	}
-	if cfg.MaxPlayers == 0 {
-		cfg.MaxPlayers = 20
+	for _, srv := range append([]Config{*c}, c.Servers...) {
+		if srv.ChatInterval < 1 {
+			log.Fatalf("%s: chat_interval of server %s must be at least 1 second, not starting", configPath, srv.Name)
+		}
 	}
 
+	// Open stream access log
+	initAccessLog()
+	initSubsAccessLog()
+
+	// Load IP to ASN database for status probe analytics
+	initASNDatabase()
+
+	// Prepare destination statistics and per-user totals
+	initDestinationStats()
+	initSessionStats()
+
+	// Open security event log
+	initEventLog()
+
+	// Start exporting session traces if a collector is configured
+	initTracing()
+
+	// Load cover traffic template
+	initCaptureTemplate()
+
 	// Initialize authentication map (convert passwords to expected usernames)
 	initAuthMap()
 
-	listener, err := net.Listen("tcp", "0.0.0.0:"+cfg.ListenPort)
+	// Compile the listener allow and deny lists
+	initListenerACL()
+	initEgress()
+	startEgressLists()
+	startUpstreamChecks()
+
+	// Prepare global connection, session and stream limits
+	initLimits()
+	startCryptoWorkers()
+
+	// Create the TUN interface of clients in TUN mode
+	initTunRouter()
+
+	// Sockets passed by systemd socket activation replace the configured ports
+	initSocketActivation()
+
+	cfg := currentConfig()
+	listener, err := listenGame(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("Minewire Server started (version: %s, protocol: %d, port: %s)", cfg.VersionName, cfg.ProtocolID, cfg.ListenPort)
 
+	// Show how each server presents itself, for review against the real server software
+	logDisguiseReport()
+
+	// Start the additional game servers of the servers list
+	startExtraServers()
+
+	// Obtain and renew the subscription server certificate
+	initACME()
+
 	// Start Subscriptions Server if configured
 	if cfg.SubsListenPort != "" {
 		go startSubscriptionServer()
 	}
 
+	// Start Admin Server if configured
+	if cfg.AdminListen != "" {
+		go startAdminServer()
+	}
+
+	// Start Query Server if enabled
+	if cfg.QueryEnabled {
+		go startQueryServer()
+	}
+
+	// Start scanner score cleanup
+	if cfg.AnomalyScoring {
+		go startScoreJanitor()
+		startFirewall()
+	}
+
+	// Reload the config file on SIGHUP, upgrade the binary on SIGUSR2
+	go handleSignals()
+
+	// Start session leak watchdog
+	go startWatchdog()
+
 	// Start Player Count Simulator
 	go startPlayerCountSimulator()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go handleConnection(conn)
-	}
+	// Tell systemd the server is up and keep its watchdog fed
+	sdNotify("READY=1")
+	go startSystemdWatchdog()
+
+	// Let the previous process drain if this one was started by a binary upgrade
+	signalUpgradeReady()
+
+	serveGame(listener, cfg.Name)
+	select {} // Handed over to an upgraded process, which exits this one after draining
 }
 
-func handleConnection(conn net.Conn) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Recovered from panic: %v", r)
-			conn.Close()
-		}
-	}()
+// handleConnection serves a game connection accepted by the server srv.
+func handleConnection(conn net.Conn, srv *Config) {
+	trace := newSessionTrace(remoteIP(conn))
+	defer trace.end()
+	scope := &panicScope{trace: trace, remote: remoteIP(conn), close: func() { conn.Close() }}
+	defer scope.recoverPanic()
 
-	reader := bufio.NewReader(conn)
+	if srv.WriteTimeout > 0 {
+		conn = &writeTimeoutConn{Conn: conn, timeout: time.Duration(srv.WriteTimeout) * time.Second}
+	}
+	var readTimeout time.Duration
+	if srv.HandshakeTimeout > 0 {
+		readTimeout = time.Duration(srv.HandshakeTimeout) * time.Second
+	}
+
+	packets := mcproto.NewPacketReader(conn)
 	state := 0
+	protocol := 0 // Protocol version of the handshake
+	received := 0
 
-	for {
-		length, err := ReadVarInt(reader)
-		if err != nil {
-			conn.Close()
-			return
-		}
-
-		if length < 0 || length > 1048576 { // Sanity check
-			conn.Close()
-			return
+	// Clients before 1.7 ping with a bare 0xFE instead of a packet, and real servers still answer
+	packets.SetLimits(stateMaxPacketSize(state), readTimeout)
+	if first, err := packets.PeekByte(); err != nil {
+		recordAnomaly(remoteIP(conn), AnomalyEmptyConnection)
+		trace.fail("empty connection")
+		conn.Close()
+		return
+	} else if first == mcproto.LegacyPingMagic {
+		trace.next("legacy status")
+		if format, err := packets.ReadLegacyPing(); err == nil {
+			ip := remoteIP(conn)
+			recordStatusQuery(ip)
+			tarpit(ip)
+			sendLegacyStatus(conn, srv, format)
 		}
+		conn.Close()
+		return
+	}
 
-		packetData := make([]byte, length)
-		_, err = io.ReadFull(reader, packetData)
-		if err != nil {
-			conn.Close()
+	// Other protocols get the configured response instead of the reset a failed handshake gets
+	if srv.ForeignProtocol != ForeignClose {
+		if first, err := packets.Peek(3); err == nil && !isHandshakeStart(first) {
+			recordAnomaly(remoteIP(conn), AnomalyMalformedHandshake)
+			trace.fail("foreign protocol")
+			serveForeignProtocol(conn, packets, srv)
 			return
 		}
-
-		pBuf := bytes.NewBuffer(packetData)
-		processPacket(conn, reader, pBuf, &state)
 	}
-}
 
-func startSubscriptionServer() {
-	log.Printf("Starting Subscription Server on port %s", cfg.SubsListenPort)
-	http.HandleFunc("/subs/", func(w http.ResponseWriter, r *http.Request) {
-		nickname := strings.TrimPrefix(r.URL.Path, "/subs/")
-		if nickname == "" {
-			http.Error(w, "Nickname required", http.StatusBadRequest)
+	for {
+		packets.SetLimits(stateMaxPacketSize(state), readTimeout)
+		pid, payload, err := packets.ReadPacket()
+		switch {
+		case errors.Is(err, mcproto.ErrPacketTooLarge) || errors.Is(err, mcproto.ErrEmptyPacket):
+			recordAnomaly(remoteIP(conn), AnomalyMalformedHandshake)
+			trace.fail("oversized packet")
+			conn.Close()
 			return
-		}
-
-		password, ok := nicknameMap[nickname]
-		if !ok {
-			http.Error(w, "Subscription not found", http.StatusNotFound)
+		case err != nil:
+			if received == 0 {
+				// Connected and left without a single packet: typical for port scanners
+				recordAnomaly(remoteIP(conn), AnomalyEmptyConnection)
+				trace.fail("empty connection")
+			}
+			conn.Close()
 			return
 		}
+		received++
 
-		// Construct mw:// link
-		// Format: mw://password@host:port#name
-		// We use the Host header from the request to determine the IP/Domain
-		host := r.Host
-		if strings.Contains(host, ":") {
-			host, _, _ = net.SplitHostPort(host)
-		}
-
-		link := fmt.Sprintf("mw://%s@%s:%s#%s", password, host, cfg.ListenPort, nickname)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(link))
-	})
-
-	err := http.ListenAndServe(":"+cfg.SubsListenPort, nil)
-	if err != nil {
-		log.Printf("Subscription Server Error: %v", err)
+		scope.packet = payload
+		processPacket(conn, packets, pid, bytes.NewBuffer(payload), &state, &protocol, trace, srv)
 	}
 }
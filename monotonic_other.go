@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// monotonicUsec is only needed for systemd, which runs on Linux.
+func monotonicUsec() int64 { return 0 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Validity limits of one-time links
+const (
+	defaultOneTimeTTL = 15 * time.Minute
+	maxOneTimeTTL     = 24 * time.Hour
+)
+
+// oneTimeLink is a subscription path that works once, until it expires
+type oneTimeLink struct {
+	key     string // Subscription key of the user
+	expires time.Time
+}
+
+// One-time link tokens, kept in memory: a restart invalidates them
+var (
+	oneTimeLinks     = make(map[string]oneTimeLink)
+	oneTimeLinksLock sync.Mutex
+)
+
+// newOneTimeLink mints a one-time subscription path for the user with the subscription key
+// name, valid for ttl (15 minutes if zero).
+func newOneTimeLink(name string, ttl time.Duration) (subscriptionToken, error) {
+	cfg := currentConfig()
+	if user, ok := lookupSubscription(name); !ok || user.Password == "" {
+		return subscriptionToken{}, fmt.Errorf("no user %q with a password", name)
+	}
+	if ttl <= 0 {
+		ttl = defaultOneTimeTTL
+	}
+	if ttl > maxOneTimeTTL {
+		return subscriptionToken{}, fmt.Errorf("ttl must be at most %s", maxOneTimeTTL)
+	}
+	token := randomHex(24)
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	oneTimeLinksLock.Lock()
+	defer oneTimeLinksLock.Unlock()
+	for t, l := range oneTimeLinks {
+		if time.Now().After(l.expires) {
+			delete(oneTimeLinks, t)
+		}
+	}
+	oneTimeLinks[token] = oneTimeLink{key: name, expires: expires}
+	return subscriptionToken{Name: name, Token: token, Path: cfg.SubsPath + token, Expires: expires}, nil
+}
+
+// takeOneTimeLink removes a one-time link token and returns the subscription key and expiry
+// it was minted for, if it is still valid.
+func takeOneTimeLink(token string) (string, time.Time, bool) {
+	oneTimeLinksLock.Lock()
+	defer oneTimeLinksLock.Unlock()
+	l, ok := oneTimeLinks[token]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	delete(oneTimeLinks, token)
+	if time.Now().After(l.expires) {
+		return "", time.Time{}, false
+	}
+	return l.key, l.expires, true
+}
+
+// requestOneTimeLink asks the running server, through the admin API on admin_listen, for a
+// one-time link: the links live in its memory.
+func requestOneTimeLink(name string, ttl time.Duration) (subscriptionToken, error) {
+	cfg := currentConfig()
+	var t subscriptionToken
+	if cfg.AdminListen == "" || cfg.AdminToken == "" {
+		return t, errors.New("one-time links need the admin API (admin_listen and admin_token)")
+	}
+	host, port, err := net.SplitHostPort(cfg.AdminListen)
+	if err != nil {
+		return t, err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	u := fmt.Sprintf("http://%s/api/subs/%s/once", net.JoinHostPort(host, port), url.PathEscape(name))
+	if ttl > 0 {
+		u += "?ttl=" + ttl.String()
+	}
+	req, _ := http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return t, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return t, fmt.Errorf("admin API: %s %s", resp.Status, e.Error)
+	}
+	return t, json.NewDecoder(resp.Body).Decode(&t)
+}
+
+// handleAdminSubsOnce mints a one-time subscription link for a user, valid for ?ttl= (e.g. 30m).
+func handleAdminSubsOnce(w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := newOneTimeLink(r.PathValue("name"), ttl)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin minted a one-time subscription link for %s, valid until %s", t.Name, t.Expires.Format(time.RFC3339))
+	writeJSON(w, t)
+}
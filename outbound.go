@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rejected streams counted toward rate_limit_suspend halve every 10 minutes, so a user who
+// hits a limit now and then is never suspended
+const outboundHalfLife = 10 * time.Minute
+
+// userOutbound is the outbound budget of one user across all its sessions: a token bucket of
+// new streams and the dials in progress.
+type userOutbound struct {
+	tokens   float64
+	updated  time.Time
+	dials    int
+	rejected float64   // Rejected streams, decaying with outboundHalfLife
+	logged   time.Time // Last violation log line, at most one a minute
+}
+
+var (
+	outbound       = make(map[string]*userOutbound) // By generated username
+	outboundPruned time.Time
+	outboundLock   sync.Mutex
+)
+
+// outboundLimits returns the stream rate and dial limit of a user: its own limits, else the
+// server defaults. 0 means unlimited.
+func outboundLimits(l UserLimits) (rate, dials int) {
+	cfg := currentConfig()
+	rate, dials = cfg.UserStreamRate, cfg.UserMaxDials
+	if l.StreamRate != 0 {
+		rate = l.StreamRate
+	}
+	if l.MaxDials != 0 {
+		dials = l.MaxDials
+	}
+	return max(rate, 0), max(dials, 0)
+}
+
+// acquireDial takes a new stream of username to a destination from its budget and reserves a
+// dial slot, released with releaseDial once the dial is done. It returns the violated limit,
+// or "" if the stream may dial. Violations are logged, recorded as limit events from ip and
+// may suspend the user (rate_limit_suspend).
+func acquireDial(username, ip string) string {
+	cfg := currentConfig()
+	_, limits, _ := lookupUser(username)
+	rate, dials := outboundLimits(limits)
+	now := time.Now()
+
+	outboundLock.Lock()
+	pruneOutbound(now)
+	u, ok := outbound[username]
+	if !ok {
+		u = &userOutbound{tokens: float64(2 * rate), updated: now}
+		outbound[username] = u
+	}
+	elapsed := now.Sub(u.updated)
+	u.rejected *= math.Pow(0.5, float64(elapsed)/float64(outboundHalfLife))
+	u.updated = now
+
+	var violation string
+	if rate > 0 {
+		// Bursts of up to two seconds worth of streams, e.g. a browser opening a page
+		u.tokens = min(float64(2*rate), u.tokens+elapsed.Seconds()*float64(rate))
+		if u.tokens < 1 {
+			violation = fmt.Sprintf("stream rate %d/s", rate)
+		}
+	}
+	if violation == "" && dials > 0 && u.dials >= dials {
+		violation = fmt.Sprintf("%d dials in progress", dials)
+	}
+	if violation == "" {
+		if rate > 0 {
+			u.tokens--
+		}
+		u.dials++
+		outboundLock.Unlock()
+		return ""
+	}
+
+	u.rejected++
+	logNow := now.Sub(u.logged) >= time.Minute
+	if logNow {
+		u.logged = now
+	}
+	suspend := cfg.RateLimitSuspend > 0 && u.rejected >= float64(cfg.RateLimitSuspend)
+	if suspend {
+		u.rejected = 0
+	}
+	outboundLock.Unlock()
+
+	if logNow {
+		log.Printf("Outbound limit of %s reached (%s), rejecting new streams", logUser(username), violation)
+		recordEvent(EventLimit, ip, username, violation)
+	}
+	if suspend && !isUserDisabled(username) {
+		log.Printf("Suspended %s after %d rate-limited streams", logUser(username), cfg.RateLimitSuspend)
+		recordEvent(EventLimit, ip, username, fmt.Sprintf("suspended after %d rate-limited streams", cfg.RateLimitSuspend))
+		setUserDisabled(username, true)
+	}
+	return violation
+}
+
+// releaseDial frees the dial slot taken by acquireDial.
+func releaseDial(username string) {
+	outboundLock.Lock()
+	defer outboundLock.Unlock()
+	if u := outbound[username]; u != nil && u.dials > 0 {
+		u.dials--
+	}
+}
+
+// pruneOutbound drops, once a minute, the budgets of users without dials idle for an hour: full
+// again, with next to nothing left of their rejected streams. Must be called with outboundLock
+// held.
+func pruneOutbound(now time.Time) {
+	if now.Sub(outboundPruned) < time.Minute {
+		return
+	}
+	outboundPruned = now
+	for name, u := range outbound {
+		if u.dials == 0 && now.Sub(u.updated) > time.Hour {
+			delete(outbound, name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// Panics recovered since process start, by stage (handshake, status, login, join, tunnel, stream)
+var (
+	panicCounts = make(map[string]int64)
+	panicsLock  sync.Mutex
+)
+
+// panicScope describes what a goroutine is working on, for the diagnostics of a recovered panic.
+type panicScope struct {
+	stage  string
+	trace  *sessionTrace // Current stage of a connection, takes precedence over stage
+	remote string
+	packet []byte // Packet being processed, logged as hex with panic_dump
+	close  func() // Tears down the affected connection, session or stream
+}
+
+// recoverPanic must be deferred directly. A panic is logged with its stack trace and counted,
+// and only the connection, session or stream of this scope is closed.
+func (p *panicScope) recoverPanic() {
+	cfg := currentConfig()
+	r := recover()
+	if r == nil {
+		return
+	}
+	stage := p.stage
+	if p.trace != nil {
+		stage = p.trace.name
+		p.trace.fail("panic")
+	}
+	panicsLock.Lock()
+	panicCounts[stage]++
+	panicsLock.Unlock()
+
+	log.Printf("Recovered from panic in %s stage (%s): %v\n%s", stage, p.remote, r, debug.Stack())
+	if cfg.PanicDump && len(p.packet) > 0 {
+		log.Printf("Packet being processed (%d bytes):\n%s", len(p.packet), hex.Dump(p.packet))
+	}
+	if p.close != nil {
+		p.close()
+	}
+}
+
+// panicStats returns the number of recovered panics per stage.
+func panicStats() map[string]int64 {
+	panicsLock.Lock()
+	defer panicsLock.Unlock()
+	stats := make(map[string]int64, len(panicCounts))
+	for stage, n := range panicCounts {
+		stats[stage] = n
+	}
+	return stats
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed web/status.html
+var statusHTML []byte
+
+// statusInfo is the API representation of the Dialer's status and counters
+type statusInfo struct {
+	Connected bool           `json:"connected"`
+	Server    string         `json:"server,omitempty"` // Name of the active endpoint
+	Addr      string         `json:"addr,omitempty"`
+	RTTMillis float64        `json:"rtt_ms,omitempty"`
+	Endpoints []endpointInfo `json:"endpoints"`
+
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	OpenStreams   int64 `json:"open_streams"`
+	TotalStreams  int64 `json:"total_streams"`
+}
+
+// endpointInfo is the API representation of an endpoint
+type endpointInfo struct {
+	Name      string  `json:"name"`
+	Addr      string  `json:"addr"`
+	Active    bool    `json:"active"`
+	RTTMillis float64 `json:"rtt_ms,omitempty"` // Last status ping, if the endpoints are probed
+	Failures  int     `json:"failures"`
+}
+
+// connInfo is the API representation of a tunnel stream
+type connInfo struct {
+	ID            uint64     `json:"id"`
+	Dest          string     `json:"dest"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+	BytesSent     int64      `json:"bytes_sent"`
+	BytesReceived int64      `json:"bytes_received"`
+}
+
+// APIHandler serves a JSON API and a status page for GUI frontends polling the Dialer:
+//
+//	GET /             status page
+//	GET /api/status   session, round trip, endpoints and traffic counters
+//	GET /api/conns    open tunnel streams
+//	GET /api/log      last closed tunnel streams, most recent first
+//
+// A non-empty token is required as a bearer token or basic auth password, which keeps other
+// local programs and web pages out.
+func (d *Dialer) APIHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(statusHTML)
+	})
+	mux.HandleFunc("GET /api/status", d.handleAPIStatus)
+	mux.HandleFunc("GET /api/conns", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, apiConns(d.Conns()))
+	})
+	mux.HandleFunc("GET /api/log", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, apiConns(d.ClosedConns()))
+	})
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, pass, ok := r.BasicAuth(); ok {
+			got = pass
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Minewire Client"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (d *Dialer) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	st, stats := d.Status(), d.Stats()
+	info := statusInfo{
+		Connected:     st.Connected,
+		RTTMillis:     millis(st.RTT),
+		Endpoints:     []endpointInfo{},
+		BytesSent:     stats.BytesSent,
+		BytesReceived: stats.BytesReceived,
+		OpenStreams:   stats.OpenStreams,
+		TotalStreams:  stats.TotalStreams,
+	}
+	for i, ep := range st.Endpoints {
+		if i == st.Active {
+			info.Server, info.Addr = ep.Name, ep.Addr
+		}
+		info.Endpoints = append(info.Endpoints, endpointInfo{
+			Name:      ep.Name,
+			Addr:      ep.Addr,
+			Active:    i == st.Active,
+			RTTMillis: millis(ep.RTT),
+			Failures:  ep.Failures,
+		})
+	}
+	writeJSON(w, info)
+}
+
+// apiConns converts streams to their API representation.
+func apiConns(conns []ConnInfo) []connInfo {
+	list := []connInfo{}
+	for _, c := range conns {
+		info := connInfo{
+			ID:            c.ID,
+			Dest:          c.Dest,
+			Start:         c.Start,
+			BytesSent:     c.BytesSent,
+			BytesReceived: c.BytesReceived,
+		}
+		if !c.End.IsZero() {
+			info.End = &c.End
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,313 @@
+// Package client is the client side of Minewire as a library: a Dialer logs in to a Minewire
+// server like a Minecraft client and opens connections through the disguised tunnel, so
+// programs can route their own traffic through a server without running a separate proxy.
+//
+//	d, err := client.NewDialer(client.Config{Endpoints: []client.Endpoint{ep}})
+//	if err != nil { ... }
+//	defer d.Close()
+//	conn, err := d.Dial(ctx, "tcp", "example.com:443")
+//
+// A Dialer keeps one tunnel session to the best endpoint that accepts the login and opens
+// its streams over it. A session that ended is replaced on the next Dial; one whose endpoint
+// degrades is replaced by a session to a better endpoint while its open streams finish.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Config configures a Dialer. Framing, PacketIDs and Protocol must match the server, as they
+// aren't part of the links; the zero values match a server with default settings.
+type Config struct {
+	Endpoints []Endpoint
+
+	Framing   string // Server tunnel_framing: random (default) or sequenced
+	PacketIDs string // Server packet_ids: legacy (default) or version
+	Protocol  int    // Protocol version announced in the handshake (default 773)
+
+	// Split tunneling: destinations the policy routes directly are dialed from the local
+	// network. GeoIP is the path of the IP to country database country rules need: an
+	// iptoasn.com ip2country or ip2asn-combined TSV, optionally gzipped.
+	Routing *Routing
+	GeoIP   string
+
+	// Interval of the status pings ranking several endpoints (0: default 1 minute, -1 disables),
+	// and the round trip advantage that makes the Dialer move to another endpoint (0: 100ms)
+	ProbeInterval time.Duration
+	SwitchMargin  time.Duration
+
+	// Dial connects to the endpoints (default net.Dialer.DialContext), e.g. to bind the
+	// connections to an interface or to run over a network other than TCP/IP
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logf receives the Dialer's log messages (default log.Printf)
+	Logf func(format string, args ...any)
+}
+
+// Dialer opens connections through a Minewire server. It is safe for concurrent use.
+type Dialer struct {
+	endpoints []Endpoint
+	opts      options
+	router    *router // Split tunneling rules, nil sends everything through the tunnel
+	interval  time.Duration
+	margin    time.Duration
+	logf      func(format string, args ...any)
+	counters  counters
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	session *yamux.Session
+	active  int              // Index of the session's endpoint
+	health  []endpointHealth // Per endpoint, guarded by mu
+}
+
+// endpointHealth is what the Dialer knows about the reachability of an endpoint
+type endpointHealth struct {
+	rtt      time.Duration // Round trip of the last successful status ping, 0 if never probed
+	failures int           // Consecutive failed status pings and logins
+}
+
+// NewDialer checks a configuration and returns a Dialer for it. It doesn't connect yet: the
+// first Dial logs in, or Connect does.
+func NewDialer(cfg Config) (*Dialer, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	opts := options{framing: cfg.Framing, packetIDs: cfg.PacketIDs, protocol: cfg.Protocol, dial: cfg.Dial}
+	if opts.framing == "" {
+		opts.framing = core.FramingRandom
+	}
+	if opts.packetIDs == "" {
+		opts.packetIDs = core.PacketIDsLegacy
+	}
+	if opts.protocol == 0 {
+		opts.protocol = 773
+	}
+	if opts.dial == nil {
+		var dialer net.Dialer
+		opts.dial = dialer.DialContext
+	}
+	if opts.framing != core.FramingRandom && opts.framing != core.FramingSequenced {
+		return nil, fmt.Errorf("unknown framing %q (expected random or sequenced)", opts.framing)
+	}
+	if opts.packetIDs != core.PacketIDsLegacy && opts.packetIDs != core.PacketIDsVersion {
+		return nil, fmt.Errorf("unknown packet IDs %q (expected legacy or version)", opts.packetIDs)
+	}
+	if _, err := opts.ids(); err != nil {
+		return nil, err
+	}
+
+	d := &Dialer{
+		endpoints: cfg.Endpoints,
+		opts:      opts,
+		interval:  cfg.ProbeInterval,
+		margin:    cfg.SwitchMargin,
+		logf:      cfg.Logf,
+		stop:      make(chan struct{}),
+		active:    -1,
+		health:    make([]endpointHealth, len(cfg.Endpoints)),
+	}
+	if d.interval == 0 {
+		d.interval = time.Minute
+	}
+	if d.margin == 0 {
+		d.margin = 100 * time.Millisecond
+	}
+	if d.logf == nil {
+		d.logf = log.Printf
+	}
+	if cfg.Routing != nil && !cfg.Routing.Empty() {
+		var geoip *geoIPDatabase
+		if cfg.GeoIP != "" {
+			db, err := loadGeoIP(cfg.GeoIP)
+			if err != nil {
+				return nil, fmt.Errorf("GeoIP database: %w", err)
+			}
+			geoip = db
+		}
+		r, err := newRouter(*cfg.Routing, geoip)
+		if err != nil {
+			return nil, fmt.Errorf("routing rules: %w", err)
+		}
+		if r.usesCountries() && geoip == nil {
+			d.logf("Country rules match nothing without a GeoIP database")
+		}
+		d.router = r
+	}
+	return d, nil
+}
+
+// Connect ranks the endpoints if there are several, logs in to the best one and starts
+// probing them in the background. Calling it is optional: Dial logs in on its own, but
+// Connect reports a server that can't be reached before the first connection.
+func (d *Dialer) Connect() error {
+	probing := len(d.endpoints) > 1 && d.interval > 0
+	if probing {
+		d.probe() // Rank the endpoints before picking one
+	}
+	if _, err := d.tunnel(); err != nil {
+		return err
+	}
+	if probing {
+		go d.probeLoop()
+	}
+	return nil
+}
+
+// Dial connects to addr (host:port) through the tunnel, or from the local network when the
+// routing rules send it directly. Only TCP networks are supported. ctx bounds direct
+// connections; a login to the server has its own timeout. The server doesn't report whether
+// it reached a tunneled destination: a failed connection is closed without data.
+func (d *Dialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if d.router.route(host) == RouteDirect {
+		var direct net.Dialer
+		return direct.DialContext(ctx, network, addr)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.openStream(addr)
+}
+
+// Close ends the tunnel session and stops probing. Connections still open are closed.
+func (d *Dialer) Close() error {
+	d.closeOnce.Do(func() { close(d.stop) })
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil {
+		return d.session.Close()
+	}
+	return nil
+}
+
+// ranked returns the endpoint indexes, best first: those without recent failures before the
+// others, then probed ones by status ping round trip before those never probed, which keep
+// the order of the subscription. Called with mu held.
+func (d *Dialer) ranked() []int {
+	order := make([]int, len(d.endpoints))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ha, hb := d.health[order[a]], d.health[order[b]]
+		if (ha.failures > 0) != (hb.failures > 0) {
+			return ha.failures == 0
+		}
+		if (ha.rtt == 0) != (hb.rtt == 0) {
+			return hb.rtt == 0
+		}
+		return ha.rtt < hb.rtt
+	})
+	return order
+}
+
+// tunnel returns the live tunnel session, logging in again if there is none.
+func (d *Dialer) tunnel() (*yamux.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil && !d.session.IsClosed() {
+		return d.session, nil
+	}
+	select {
+	case <-d.stop:
+		return nil, net.ErrClosed
+	default:
+	}
+	if d.session != nil {
+		d.health[d.active].failures++ // The session ended under the Dialer
+		d.session = nil
+	}
+	var errs []error
+	for _, i := range d.ranked() {
+		if err := d.connect(i); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.endpoints[i].Addr, err))
+			continue
+		}
+		return d.session, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// connect logs in to endpoint i and makes its session the active one. Called with mu held.
+func (d *Dialer) connect(i int) error {
+	session, err := dialTunnel(d.endpoints[i], d.opts)
+	if err != nil {
+		d.loginFailed(i, err)
+		return err
+	}
+	d.install(i, session)
+	return nil
+}
+
+// loginFailed records a failed login to endpoint i. Called with mu held.
+func (d *Dialer) loginFailed(i int, err error) {
+	d.health[i].failures++
+	d.logf("Could not connect to %s (%s): %v", d.endpoints[i].Name, d.endpoints[i].Addr, err)
+}
+
+// install makes a new session to endpoint i the active one. The previous session is drained:
+// it keeps carrying its open streams and is closed once they ended. Called with mu held.
+func (d *Dialer) install(i int, session *yamux.Session) {
+	d.logf("Connected to %s (%s)", d.endpoints[i].Name, d.endpoints[i].Addr)
+	if old := d.session; old != nil {
+		go drainSession(old)
+	}
+	d.session, d.active = session, i
+}
+
+// drainSession closes a replaced session once its last stream ended.
+func drainSession(session *yamux.Session) {
+	for session.NumStreams() > 0 && !session.IsClosed() {
+		time.Sleep(time.Second)
+	}
+	session.Close()
+}
+
+// openStream opens a tunnel stream the server connects to dest (host:port).
+func (d *Dialer) openStream(dest string) (net.Conn, error) {
+	session, err := d.tunnel()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := core.WriteStreamRequest(stream, dest); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return d.counters.counted(stream, dest), nil
+}
+
+// onActiveSession reports whether stream was opened on the active session.
+func (d *Dialer) onActiveSession(stream net.Conn) bool {
+	if c, ok := stream.(*countedConn); ok {
+		stream = c.Conn
+	}
+	s, ok := stream.(*yamux.Stream)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return ok && s.Session() == d.session
+}
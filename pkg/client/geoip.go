@@ -0,0 +1,86 @@
+package client
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// countryRange is an address range of the GeoIP database
+type countryRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// geoIPDatabase maps addresses to countries for the country routing rules
+type geoIPDatabase struct {
+	ranges []countryRange // Sorted by start
+}
+
+// loadGeoIP reads an iptoasn.com style TSV, optionally gzipped: ip2country (range start, range
+// end, country code) or ip2asn-combined (range start, range end, AS number, country code,
+// description), the same file the server takes as asn_database.
+func loadGeoIP(path string) (*geoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &geoIPDatabase{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("line %d: invalid range entry", line)
+		}
+		country := fields[2]
+		if len(fields) >= 4 {
+			country = fields[3]
+		}
+		if country == "None" || country == "" {
+			continue // Not routed
+		}
+		db.ranges = append(db.ranges, countryRange{start.Unmap(), end.Unmap(), strings.ToUpper(country)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	return db, nil
+}
+
+// country returns the country code of addr, or "" if the database doesn't know it.
+func (db *geoIPDatabase) country(addr netip.Addr) string {
+	if db == nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) })
+	if i == 0 {
+		return ""
+	}
+	if rng := db.ranges[i-1]; addr.Compare(rng.end) <= 0 && addr.BitLen() == rng.end.BitLen() {
+		return rng.country
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ServeHTTPProxy accepts HTTP proxy clients on ln and connects them with Dial. It takes
+// CONNECT tunnels and plain http:// requests, and serves the PAC file at /proxy.pac. It returns
+// when ln is closed.
+func (d *Dialer) ServeHTTPProxy(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go d.handleHTTPProxy(conn)
+	}
+}
+
+// handleHTTPProxy serves one HTTP proxy connection: a CONNECT tunnel, or a plain http://
+// request in absolute form. Plain requests are sent with Connection: close, so each one gets
+// its own stream and the connection ends with the response.
+func (d *Dialer) handleHTTPProxy(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		stream, err := d.Dial(context.Background(), "tcp", withDefaultPort(req.Host, "443"))
+		if err != nil {
+			d.logf("HTTP CONNECT %s: %v", req.Host, err)
+			httpProxyError(conn, http.StatusBadGateway)
+			return
+		}
+		defer stream.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+		relay(conn, br, stream)
+		return
+	}
+
+	if isPACRequest(req) {
+		pac := d.PAC(conn.LocalAddr().String())
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(pac), pac)
+		return
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		httpProxyError(conn, http.StatusBadRequest) // Origin-form requests aren't meant for a proxy
+		return
+	}
+	dest := withDefaultPort(req.URL.Host, "80")
+	stream, err := d.Dial(context.Background(), "tcp", dest)
+	if err != nil {
+		d.logf("HTTP %s: %v", dest, err)
+		httpProxyError(conn, http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+
+	// Forwarded in origin form, without the headers meant for the proxy
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(stream); err != nil {
+		httpProxyError(conn, http.StatusBadGateway)
+		return
+	}
+	// The server closes the stream without a word when it can't reach the destination
+	if n, _ := io.Copy(conn, stream); n == 0 {
+		httpProxyError(conn, http.StatusBadGateway)
+	}
+}
+
+// isPACRequest reports whether an origin-form request asks the proxy for its proxy
+// auto-config file.
+func isPACRequest(req *http.Request) bool {
+	return req.URL.Host == "" && req.Method == http.MethodGet && req.URL.Path == "/proxy.pac"
+}
+
+// withDefaultPort returns host:port, adding port to hosts given without one.
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// httpProxyError answers a proxy request with an empty error response.
+func httpProxyError(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
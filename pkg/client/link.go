@@ -0,0 +1,119 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Endpoint is a server address with the password to log in with
+type Endpoint struct {
+	Name     string
+	Addr     string // host:port
+	Password string
+}
+
+// ParseLink parses an mw://password@host:port#name link. The password is taken verbatim up to
+// the last @, as the server writes it unescaped.
+func ParseLink(link string) (Endpoint, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(link), "mw://")
+	if !ok {
+		return Endpoint{}, fmt.Errorf("not an mw:// link: %q", link)
+	}
+	var ep Endpoint
+	rest, fragment, _ := strings.Cut(rest, "#")
+	at := strings.LastIndex(rest, "@")
+	if at <= 0 {
+		return Endpoint{}, errors.New("link has no password")
+	}
+	ep.Password, ep.Addr = rest[:at], rest[at+1:]
+	if _, _, err := net.SplitHostPort(ep.Addr); err != nil {
+		return Endpoint{}, fmt.Errorf("link address: %w", err)
+	}
+	ep.Name, _ = url.PathUnescape(fragment)
+	if ep.Name == "" {
+		ep.Name = ep.Addr
+	}
+	return ep, nil
+}
+
+// subscriptionDocument is the part of the server's ?format=json subscription the client uses
+type subscriptionDocument struct {
+	Password  string   `json:"password"`
+	Routing   *Routing `json:"routing"`
+	Endpoints []struct {
+		Name     string `json:"name"`
+		Host     string `json:"host"`
+		Port     string `json:"port"`
+		Priority int    `json:"priority"`
+	} `json:"endpoints"`
+}
+
+// Subscription is what a client takes from a subscription
+type Subscription struct {
+	Endpoints []Endpoint
+	Routing   *Routing // Split tunneling rules, only in the JSON document
+}
+
+// ParseSubscription parses a subscription in any of the formats the server serves: plain
+// mw:// links one per line, the same list base64-encoded, or the JSON document.
+func ParseSubscription(data []byte) (*Subscription, error) {
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "{") {
+		var doc subscriptionDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		sort.SliceStable(doc.Endpoints, func(i, j int) bool { return doc.Endpoints[i].Priority < doc.Endpoints[j].Priority })
+		var list []Endpoint
+		for _, e := range doc.Endpoints {
+			list = append(list, Endpoint{Name: e.Name, Addr: net.JoinHostPort(e.Host, e.Port), Password: doc.Password})
+		}
+		return &Subscription{Endpoints: list, Routing: doc.Routing}, nil
+	}
+	if !strings.Contains(text, "mw://") {
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.New("subscription holds no mw:// links")
+		}
+		text = string(decoded)
+	}
+	var list []Endpoint
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		ep, err := ParseLink(line)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ep)
+	}
+	return &Subscription{Endpoints: list}, nil
+}
+
+// FetchSubscription downloads and parses a subscription.
+func FetchSubscription(subsURL string) (*Subscription, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(subsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("subscription server answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseSubscription(data)
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pacFile returns a proxy auto-config script for the HTTP proxy at proxyAddr. Destinations the
+// domain rules route decide in the browser; from the first rule that needs an address (ips,
+// countries) on, everything goes to the proxy, which applies the rest of the rules itself.
+func (r *router) pacFile(proxyAddr string) string {
+	proxy := fmt.Sprintf("PROXY %s", proxyAddr)
+	target := func(action string) string {
+		if action == RouteDirect {
+			return "DIRECT"
+		}
+		return proxy
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	final := proxy
+	if r != nil {
+		final = target(r.policy.Default)
+		for _, rule := range r.rules {
+			var conds []string
+			for _, d := range rule.domains {
+				d = strings.ToLower(strings.Trim(d, "."))
+				conds = append(conds, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", d, "."+d))
+			}
+			if len(conds) > 0 {
+				fmt.Fprintf(&b, "  if (%s) return %q;\n", strings.Join(conds, " || "), target(rule.action))
+			}
+			if len(rule.networks) > 0 || len(rule.countries) > 0 {
+				final = proxy
+				break
+			}
+		}
+	}
+	fmt.Fprintf(&b, "  return %q;\n}\n", final)
+	return b.String()
+}
+
+// PAC returns a proxy auto-config script sending the destinations of the Dialer's routing
+// rules to the HTTP proxy at proxyAddr, or directly.
+func (d *Dialer) PAC(proxyAddr string) string {
+	return d.router.pacFile(proxyAddr)
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"minewire-server/internal/core"
+)
+
+// PacketStream carries raw IP packets through the tunnel, for full-device tunneling over a TUN
+// interface: the server routes them through its own network stack. It needs tun_network on
+// the server.
+type PacketStream struct {
+	Addr netip.Prefix // Address the server assigned to the client, with its network
+	MTU  int
+
+	d    *Dialer
+	conn net.Conn
+	br   *bufio.Reader
+	buf  []byte
+}
+
+// OpenPacketStream asks the server for an IP packet stream. Packet streams ignore the routing
+// rules.
+func (d *Dialer) OpenPacketStream() (*PacketStream, error) {
+	conn, err := d.openStream(core.PacketStream)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	addr, mtu, err := core.ReadPacketAssignment(br)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no TUN mode on the server (tun_network): %w", err)
+	}
+	return &PacketStream{Addr: addr, MTU: mtu, d: d, conn: conn, br: br, buf: make([]byte, core.MaxPacket)}, nil
+}
+
+// ReadPacket returns the next IP packet from the server. The packet is only valid until the
+// next call. Not safe for concurrent use.
+func (p *PacketStream) ReadPacket() ([]byte, error) {
+	return core.ReadIPPacket(p.br, p.buf)
+}
+
+// WritePacket sends an IP packet whose source is Addr to the server.
+func (p *PacketStream) WritePacket(packet []byte) error {
+	return core.WriteIPPacket(p.conn, packet)
+}
+
+// Stale reports whether the Dialer moved to another session since the stream was opened.
+// The old session is drained, so the packets should follow the new one on a new stream.
+func (p *PacketStream) Stale() bool {
+	return !p.d.onActiveSession(p.conn)
+}
+
+// Close ends the packet stream, unblocking ReadPacket.
+func (p *PacketStream) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+)
+
+// Consecutive failed status pings after which the active endpoint is left for another one
+const maxProbeFailures = 2
+
+// probeEndpoint measures the status ping round trip of an endpoint, the way the server list of
+// a vanilla client refreshes.
+func probeEndpoint(ep Endpoint, opts options) (time.Duration, error) {
+	conn, err := opts.dialServer(ep.Addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	_, rtt, err := core.StatusPing(conn, ep.Addr, opts.protocol)
+	return rtt, err
+}
+
+// probe pings every endpoint at once and records the results.
+func (d *Dialer) probe() {
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	results := make([]result, len(d.endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range d.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].rtt, results[i].err = probeEndpoint(ep, d.opts)
+		}()
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, r := range results {
+		ep := d.endpoints[i]
+		if r.err != nil {
+			if d.health[i].failures++; d.health[i].failures == 1 {
+				d.logf("Status ping of %s (%s) failed: %v", ep.Name, ep.Addr, r.err)
+			}
+			continue
+		}
+		if d.health[i].failures > 0 {
+			d.logf("%s (%s) answers again, round trip %s", ep.Name, ep.Addr, r.rtt.Round(time.Millisecond))
+		}
+		d.health[i] = endpointHealth{rtt: r.rtt}
+	}
+}
+
+// probeLoop probes the endpoints every interval and moves the session to a better endpoint
+// when the active one degrades, until the Dialer is closed.
+func (d *Dialer) probeLoop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+		d.probe()
+		d.rebalance(d.margin)
+	}
+}
+
+// rebalance replaces the session with one to the best endpoint when the active endpoint failed
+// its last status pings, or the best one answers faster by more than margin. Streams open on
+// the old session finish there; new streams use the new one.
+func (d *Dialer) rebalance(margin time.Duration) {
+	d.mu.Lock()
+	if d.session == nil || d.session.IsClosed() {
+		d.mu.Unlock()
+		return // The next stream logs in to the best endpoint anyway
+	}
+	best, active := d.ranked()[0], d.active
+	cur, next := d.health[active], d.health[best]
+	var reason string
+	switch {
+	case best == active || next.failures > 0 || next.rtt == 0:
+	case cur.failures >= maxProbeFailures:
+		reason = fmt.Sprintf("%d status pings failed", cur.failures)
+	case cur.rtt-next.rtt > margin:
+		reason = fmt.Sprintf("round trip %s instead of %s", next.rtt.Round(time.Millisecond), cur.rtt.Round(time.Millisecond))
+	}
+	d.mu.Unlock()
+	if reason == "" {
+		return
+	}
+
+	d.logf("Switching from %s to %s: %s", d.endpoints[active].Name, d.endpoints[best].Name, reason)
+	session, err := dialTunnel(d.endpoints[best], d.opts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.loginFailed(best, err)
+		return
+	}
+	d.install(best, session)
+}
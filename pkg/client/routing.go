@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"minewire-server/internal/core"
+)
+
+// Split tunneling policies, in the format of the "routing" object of JSON subscriptions
+type (
+	Routing     = core.Routing
+	RoutingRule = core.RoutingRule
+)
+
+// Routing actions
+const (
+	RouteProxy  = core.RouteProxy
+	RouteDirect = core.RouteDirect
+)
+
+// router decides which destinations a Dialer sends through the tunnel and which it connects
+// to directly, from the rules of a Routing policy.
+type router struct {
+	policy Routing
+	rules  []routeRule
+	geoip  *geoIPDatabase
+}
+
+// routeRule is a RoutingRule with its networks parsed
+type routeRule struct {
+	action    string
+	domains   []string
+	networks  []netip.Prefix
+	countries map[string]bool
+}
+
+// newRouter compiles a policy; geoip may be nil when no rule lists countries.
+func newRouter(policy Routing, geoip *geoIPDatabase) (*router, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if policy.Default == "" {
+		policy.Default = RouteProxy
+	}
+	r := &router{policy: policy, geoip: geoip}
+	for _, rule := range policy.Rules {
+		rr := routeRule{action: rule.Action, domains: rule.Domains, countries: make(map[string]bool)}
+		for _, ip := range rule.IPs {
+			network, _ := core.ParseNetwork(ip)
+			rr.networks = append(rr.networks, network)
+		}
+		for _, c := range rule.Countries {
+			rr.countries[strings.ToUpper(c)] = true
+		}
+		r.rules = append(r.rules, rr)
+	}
+	return r, nil
+}
+
+// LoadRouting reads a routing policy from a JSON file, in the format of the "routing" object
+// of a subscription.
+func LoadRouting(path string) (Routing, error) {
+	var policy Routing
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	err = json.Unmarshal(data, &policy)
+	return policy, err
+}
+
+// usesCountries reports whether a rule needs the GeoIP database.
+func (r *router) usesCountries() bool {
+	for _, rule := range r.rules {
+		if len(rule.countries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns RouteProxy or RouteDirect for a destination host (a domain or an IP
+// address). Domain names are resolved locally only when an address or country rule must be
+// checked, like the IP rules of most proxy clients.
+func (r *router) route(host string) string {
+	if r == nil {
+		return RouteProxy
+	}
+	var addrs []netip.Addr
+	addr, err := netip.ParseAddr(host)
+	literal := err == nil
+	resolved := literal
+	if literal {
+		addrs = []netip.Addr{addr.Unmap()}
+	}
+	for _, rule := range r.rules {
+		if !literal {
+			for _, d := range rule.domains {
+				if core.MatchDomain(host, d) {
+					return rule.action
+				}
+			}
+		}
+		if len(rule.networks) == 0 && len(rule.countries) == 0 {
+			continue
+		}
+		if !resolved {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			ips, _ := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			cancel()
+			for _, ip := range ips {
+				addrs = append(addrs, ip.Unmap())
+			}
+			resolved = true
+		}
+		for _, addr := range addrs {
+			for _, n := range rule.networks {
+				if n.Contains(addr) {
+					return rule.action
+				}
+			}
+			if len(rule.countries) > 0 && rule.countries[r.geoip.country(addr)] {
+				return rule.action
+			}
+		}
+	}
+	return r.policy.Default
+}
+
+// DirectNetworks returns the networks of the routing rules that send destinations directly,
+// e.g. to keep them out of a TUN interface.
+func (d *Dialer) DirectNetworks() []netip.Prefix {
+	if d.router == nil {
+		return nil
+	}
+	var list []netip.Prefix
+	for _, rule := range d.router.rules {
+		if rule.action == RouteDirect {
+			list = append(list, rule.networks...)
+		}
+	}
+	return list
+}
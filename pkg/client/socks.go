@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xFF
+	socksConnect      = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksFailure            = 0x01
+	socksCommandUnsupported = 0x07
+	socksAddrUnsupported    = 0x08
+)
+
+// ServeSOCKS accepts SOCKS5 clients on ln and connects them with Dial: no authentication,
+// CONNECT only. It returns when ln is closed.
+func (d *Dialer) ServeSOCKS(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go d.handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS serves one SOCKS5 connection.
+func (d *Dialer) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	dest, err := socksHandshake(br, conn)
+	if err != nil {
+		return
+	}
+	stream, err := d.Dial(context.Background(), "tcp", dest)
+	if err != nil {
+		d.logf("SOCKS %s: %v", dest, err)
+		socksReply(conn, socksFailure)
+		return
+	}
+	defer stream.Close()
+	if socksReply(conn, socksSucceeded) != nil {
+		return
+	}
+	relay(conn, br, stream)
+}
+
+// socksHandshake negotiates the method and reads the CONNECT request, answering requests it
+// can't serve. It returns the requested host:port.
+func socksHandshake(br *bufio.Reader, w io.Writer) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", errors.New("not a SOCKS5 client")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil || method != socksNoAuth {
+		return "", errors.New("no acceptable SOCKS5 method")
+	}
+
+	var req [4]byte // Version, command, reserved, address type
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksAddrIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(w, socksAddrUnsupported)
+		return "", errors.New("unsupported SOCKS5 address type")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		socksReply(w, socksCommandUnsupported)
+		return "", errors.New("unsupported SOCKS5 command")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply sends a reply with an unspecified bound address: the server doesn't report the
+// address it connected from.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// relay copies between a local connection (read through r) and a tunnel stream until either
+// side is done.
+func relay(local net.Conn, r io.Reader, stream net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(stream, r); stream.Close(); done <- struct{}{} }()
+	go func() { io.Copy(local, stream); local.Close(); done <- struct{}{} }()
+	<-done
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Closed connections kept for ClosedConns
+const connLogSize = 100
+
+// Stats are the traffic counters of a Dialer since it was created. They cover what goes
+// through the tunnel: streams of Dial and packet streams, not destinations routed directly.
+type Stats struct {
+	BytesSent     int64 // Written to tunnel streams and packet streams
+	BytesReceived int64 // Read from them
+	OpenStreams   int64 // Tunnel streams and packet streams not closed yet
+	TotalStreams  int64 // Tunnel streams and packet streams ever opened
+}
+
+// Status describes the session of a Dialer and what it knows about its endpoints
+type Status struct {
+	Connected bool           // Whether a session is up
+	Active    int            // Index in Endpoints of the session's endpoint, -1 without one
+	RTT       time.Duration  // Round trip of a ping on the session, 0 when it failed
+	Endpoints []EndpointInfo // In the order of the configuration
+}
+
+// EndpointInfo describes an endpoint of a Dialer
+type EndpointInfo struct {
+	Name     string
+	Addr     string
+	RTT      time.Duration // Round trip of the last successful status ping, 0 if never probed
+	Failures int           // Consecutive failed status pings and logins
+}
+
+// Status reports the Dialer's session and endpoints. It pings the session to measure the
+// round trip to the server, so it blocks for one round trip; it doesn't log in.
+func (d *Dialer) Status() Status {
+	d.mu.Lock()
+	st := Status{Active: -1}
+	for i, ep := range d.endpoints {
+		st.Endpoints = append(st.Endpoints, EndpointInfo{
+			Name:     ep.Name,
+			Addr:     ep.Addr,
+			RTT:      d.health[i].rtt,
+			Failures: d.health[i].failures,
+		})
+	}
+	session := d.session
+	if session != nil && !session.IsClosed() {
+		st.Connected, st.Active = true, d.active
+	}
+	d.mu.Unlock()
+
+	if st.Connected {
+		st.RTT, _ = session.Ping()
+	}
+	return st
+}
+
+// ConnInfo describes a tunnel stream of the Dialer
+type ConnInfo struct {
+	ID            uint64
+	Dest          string // host:port, or @ip for a packet stream
+	Start         time.Time
+	End           time.Time // Zero while the stream is open
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// counters are the atomic counters behind Stats, and the registry of streams behind Conns
+type counters struct {
+	sent, received atomic.Int64
+	open, total    atomic.Int64
+
+	mu     sync.Mutex
+	conns  map[uint64]*countedConn // Open streams
+	closed []ConnInfo              // Last closed streams, oldest first
+}
+
+// Stats returns the current traffic counters.
+func (d *Dialer) Stats() Stats {
+	return Stats{
+		BytesSent:     d.counters.sent.Load(),
+		BytesReceived: d.counters.received.Load(),
+		OpenStreams:   d.counters.open.Load(),
+		TotalStreams:  d.counters.total.Load(),
+	}
+}
+
+// Conns lists the open tunnel streams, oldest first.
+func (d *Dialer) Conns() []ConnInfo {
+	c := &d.counters
+	c.mu.Lock()
+	list := make([]ConnInfo, 0, len(c.conns))
+	for _, conn := range c.conns {
+		list = append(list, conn.info())
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list
+}
+
+// ClosedConns lists the last closed tunnel streams, most recent first.
+func (d *Dialer) ClosedConns() []ConnInfo {
+	c := &d.counters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]ConnInfo, len(c.closed))
+	for i, info := range c.closed {
+		list[len(list)-1-i] = info
+	}
+	return list
+}
+
+// countedConn is a tunnel stream counting its traffic, and the Dialer's.
+type countedConn struct {
+	net.Conn
+	c              *counters
+	id             uint64
+	dest           string
+	start          time.Time
+	sent, received atomic.Int64
+	closeOnce      sync.Once
+}
+
+// counted registers a newly opened tunnel stream to dest.
+func (c *counters) counted(conn net.Conn, dest string) *countedConn {
+	cc := &countedConn{Conn: conn, c: c, id: uint64(c.total.Add(1)), dest: dest, start: time.Now()}
+	c.open.Add(1)
+	c.mu.Lock()
+	if c.conns == nil {
+		c.conns = make(map[uint64]*countedConn)
+	}
+	c.conns[cc.id] = cc
+	c.mu.Unlock()
+	return cc
+}
+
+func (c *countedConn) info() ConnInfo {
+	return ConnInfo{
+		ID:            c.id,
+		Dest:          c.dest,
+		Start:         c.start,
+		BytesSent:     c.sent.Load(),
+		BytesReceived: c.received.Load(),
+	}
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	c.c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	c.c.sent.Add(int64(n))
+	return n, err
+}
+
+// Close closes the stream and moves it to the closed streams.
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.c.open.Add(-1)
+		info := c.info()
+		info.End = time.Now()
+		c.c.mu.Lock()
+		delete(c.c.conns, c.id)
+		if len(c.c.closed) == connLogSize {
+			c.c.closed = append(c.c.closed[:0], c.c.closed[1:]...)
+		}
+		c.c.closed = append(c.c.closed, info)
+		c.c.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
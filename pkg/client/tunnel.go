@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/mcproto"
+
+	"github.com/hashicorp/yamux"
+)
+
+const dialTimeout = 15 * time.Second
+
+// options are the server settings the client must match, as they aren't part of the links
+type options struct {
+	framing   string // Server tunnel_framing: random or sequenced
+	packetIDs string // Server packet_ids: legacy or version
+	protocol  int    // Protocol version announced in the handshake
+
+	dial func(ctx context.Context, network, addr string) (net.Conn, error) // Connects to endpoints
+}
+
+// dialServer connects to the endpoint at addr within dialTimeout.
+func (o options) dialServer(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return o.dial(ctx, "tcp", addr)
+}
+
+// ids returns the protocol of the session and its packet IDs.
+func (o options) ids() (mcproto.Protocol, error) {
+	proto, ok := core.Protocol(o.packetIDs, o.protocol)
+	if !ok {
+		return proto, fmt.Errorf("no known packet IDs for protocol %d", o.protocol)
+	}
+	return proto, nil
+}
+
+// dialTunnel logs in to an endpoint like a vanilla client and starts the yamux session of the
+// tunnel over the connection.
+func dialTunnel(ep Endpoint, opts options) (*yamux.Session, error) {
+	proto, err := opts.ids()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := opts.dialServer(ep.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	tc, err := core.Login(conn, ep.Addr, ep.Password, proto, opts.framing)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	yc := yamux.DefaultConfig()
+	yc.LogOutput = log.Writer()
+	session, err := yamux.Client(tc, yc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
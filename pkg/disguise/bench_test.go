@@ -0,0 +1,79 @@
+package disguise
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// benchFrameSize is the default tunnel_frame_size
+const benchFrameSize = 16 << 10
+
+func BenchmarkSeal(b *testing.B) {
+	frame := make([]byte, benchFrameSize)
+	rand.Read(frame)
+	for _, f := range framings() {
+		b.Run(f.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(benchFrameSize)
+			s, _ := f.pair([32]byte{1}, []byte("session nonce 16"))
+			buf := make([]byte, 0, s.SealedLen(benchFrameSize))
+			for b.Loop() {
+				buf = s.AppendSeal(buf[:0], frame)
+			}
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	frame := make([]byte, benchFrameSize)
+	rand.Read(frame)
+	b.Run("random", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchFrameSize)
+		aead, _ := NewAEAD([32]byte{1})
+		sealed := Seal(aead, frame)
+		plain := make([]byte, 0, benchFrameSize)
+		for b.Loop() {
+			if _, err := AppendOpen(plain, aead, sealed); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// Sequenced frames only open once, so each op seals the frame it opens
+	b.Run("sequenced-with-seal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchFrameSize)
+		s, o := framings()[1].pair([32]byte{1}, []byte("session nonce 16"))
+		buf := make([]byte, 0, s.SealedLen(benchFrameSize)+saltSize)
+		plain := make([]byte, 0, benchFrameSize)
+		for b.Loop() {
+			buf = s.AppendSeal(buf[:0], frame)
+			if _, err := o.AppendOpen(plain, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkChunk(b *testing.B) {
+	aead, _ := NewAEAD([32]byte{1})
+	sealed := Seal(aead, make([]byte, benchFrameSize))
+	chunk := EncodeChunk(3, -7, sealed)
+	b.Run("wrap", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(sealed)))
+		buf := make([]byte, 0, ChunkLen(len(sealed)))
+		for b.Loop() {
+			buf = AppendChunk(buf[:0], 3, -7, sealed)
+		}
+	})
+	b.Run("unwrap", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(sealed)))
+		for b.Loop() {
+			if _, _, _, err := DecodeChunk(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
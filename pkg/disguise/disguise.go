@@ -0,0 +1,205 @@
+// Package disguise encodes Minewire tunnel frames as Minecraft play packets. Frames from the
+// server ride in the chunk section data of Chunk Data packets around the simulated player,
+// frames from the client in plugin messages. Every frame is sealed with AES-256-GCM keyed by
+// the SHA-256 of the user's password.
+package disguise
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// Packet IDs of the disguise packets (protocol 767, Minecraft 1.21)
+const (
+	ChunkDataPacketID     = 0x25 // Server -> Client: Chunk Data and Update Light
+	PluginMessagePacketID = 0x0D // Client -> Server: Plugin Message
+)
+
+// Plugin channels the server accepts tunnel frames on
+const (
+	TunnelChannel = "minewire:tunnel"
+	BrandChannel  = "minecraft:brand" // Blends in with the brand every client sends
+)
+
+// heightmapName is the NBT heightmap every chunk carries
+const heightmapName = "MOTION_BLOCKING"
+
+// ErrMalformed is returned for packets that are not disguised tunnel frames.
+var ErrMalformed = errors.New("disguise: malformed packet")
+
+// NewAEAD returns the AES-256-GCM cipher of a user's key, the SHA-256 of its password.
+func NewAEAD(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts a tunnel frame under a random nonce: [Nonce][Ciphertext][Tag].
+func Seal(aead cipher.AEAD, plaintext []byte) []byte {
+	return AppendSeal(nil, aead, plaintext)
+}
+
+// AppendSeal appends the frame Seal returns to dst, encrypting straight into it.
+func AppendSeal(dst []byte, aead cipher.AEAD, plaintext []byte) []byte {
+	n := len(dst)
+	dst = slices.Grow(dst, SealedLen(aead, len(plaintext)))
+	nonce := dst[n : n+aead.NonceSize()]
+	rand.Read(nonce)
+	return aead.Seal(dst[:n+len(nonce)], nonce, plaintext, nil)
+}
+
+// SealedLen returns the length of the sealed frame of n bytes.
+func SealedLen(aead cipher.AEAD, n int) int {
+	return aead.NonceSize() + n + aead.Overhead()
+}
+
+// Open decrypts a frame produced by Seal.
+func Open(aead cipher.AEAD, frame []byte) ([]byte, error) {
+	return AppendOpen(nil, aead, frame)
+}
+
+// AppendOpen decrypts a frame produced by Seal and appends the plaintext to dst, which must not
+// overlap the frame.
+func AppendOpen(dst []byte, aead cipher.AEAD, frame []byte) ([]byte, error) {
+	if len(frame) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce := frame[:aead.NonceSize()]
+	return aead.Open(dst, nonce, frame[aead.NonceSize():], nil)
+}
+
+// chunkHeightmaps is the heightmap NBT of every chunk, encoded once: a TAG_Compound with a
+// nameless root holding a TAG_Long_Array of flat terrain at y=64.
+var chunkHeightmaps = func() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0x0A)
+	buf.Write([]byte{0x00, 0x00})
+	buf.WriteByte(0x0C)
+	mcproto.WriteStringNBT(buf, heightmapName)
+	heights := PackedHeights(64)
+	mcproto.WriteInt(buf, int32(len(heights)))
+	for _, h := range heights {
+		mcproto.WriteLong(buf, h)
+	}
+	buf.WriteByte(0x00) // TAG_End
+	return buf.Bytes()
+}()
+
+// chunkTrailer follows the section data: no block entities, and the six empty light masks and
+// arrays (seven VarInt zeros)
+var chunkTrailer = make([]byte, 7)
+
+// EncodeChunk returns the body of a Chunk Data packet at the given chunk coordinates whose
+// section data is payload. The heightmap and the empty light data make it parse like a real
+// chunk of flat terrain.
+func EncodeChunk(chunkX, chunkZ int, payload []byte) []byte {
+	return AppendChunk(make([]byte, 0, ChunkLen(len(payload))), chunkX, chunkZ, payload)
+}
+
+// AppendChunk appends the chunk body EncodeChunk returns to dst.
+func AppendChunk(dst []byte, chunkX, chunkZ int, payload []byte) []byte {
+	dst = appendChunkHead(dst, chunkX, chunkZ, len(payload))
+	dst = append(dst, payload...)
+	return append(dst, chunkTrailer...)
+}
+
+// AppendSealedChunk appends a chunk body whose section data is the frame of plaintext sealed by
+// s, encrypting in place.
+func AppendSealedChunk(dst []byte, s Sealer, chunkX, chunkZ int, plaintext []byte) []byte {
+	dst = appendChunkHead(dst, chunkX, chunkZ, s.SealedLen(len(plaintext)))
+	dst = s.AppendSeal(dst, plaintext)
+	return append(dst, chunkTrailer...)
+}
+
+// ChunkLen returns the length of a chunk body with n bytes of section data.
+func ChunkLen(n int) int {
+	return 8 + len(chunkHeightmaps) + mcproto.VarIntSize(n) + n + len(chunkTrailer)
+}
+
+// appendChunkHead appends the coordinates, heightmaps and section data length of a chunk.
+func appendChunkHead(dst []byte, chunkX, chunkZ, n int) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(chunkX))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(chunkZ))
+	dst = append(dst, chunkHeightmaps...)
+	return mcproto.AppendVarInt(dst, n)
+}
+
+// DecodeChunk returns the coordinates and section data of a Chunk Data packet body produced by
+// EncodeChunk.
+func DecodeChunk(body []byte) (chunkX, chunkZ int, payload []byte, err error) {
+	r := bytes.NewReader(body)
+	skip := func(n int64) { r.Seek(n, io.SeekCurrent) }
+
+	var coords [2]int32
+	if err := binary.Read(r, binary.BigEndian, &coords); err != nil {
+		return 0, 0, nil, ErrMalformed
+	}
+	skip(1 + 2) // TAG_Compound with empty name
+	skip(1)     // TAG_Long_Array
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return 0, 0, nil, ErrMalformed
+	}
+	skip(int64(nameLen))
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil || count < 0 {
+		return 0, 0, nil, ErrMalformed
+	}
+	skip(int64(count) * 8)
+	skip(1) // TAG_End
+
+	n, err := mcproto.ReadVarInt(r)
+	if err != nil || n < 0 || n > r.Len() {
+		return 0, 0, nil, ErrMalformed
+	}
+	payload = make([]byte, n)
+	io.ReadFull(r, payload)
+	return int(coords[0]), int(coords[1]), payload, nil
+}
+
+// EncodePluginMessage returns the body of a plugin message carrying payload on channel.
+func EncodePluginMessage(channel string, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	mcproto.WriteString(buf, channel)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// DecodePluginMessage returns the channel and payload of a plugin message body.
+func DecodePluginMessage(body []byte) (channel string, payload []byte, err error) {
+	buf := bytes.NewBuffer(body)
+	channel, err = mcproto.ReadString(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return channel, buf.Bytes(), nil
+}
+
+// IsTunnelChannel reports whether the server reads tunnel frames from plugin messages on channel.
+func IsTunnelChannel(channel string) bool {
+	return channel == TunnelChannel || channel == BrandChannel
+}
+
+// PackedHeights returns a heightmap of a flat chunk at height y: 256 values of 9 bits, seven
+// per long.
+func PackedHeights(y int64) [37]int64 {
+	var data [37]int64
+	for i := 0; i < 256; i++ {
+		longIndex := i / 7
+		bitOffset := (i % 7) * 9
+		value := y & 0x1FF // Mask to 9 bits
+		data[longIndex] |= (value << bitOffset)
+	}
+	return data
+}
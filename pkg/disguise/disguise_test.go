@@ -0,0 +1,168 @@
+package disguise
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// framings returns constructors of the sealer and opener of one direction of a session, for
+// each framing.
+func framings() []struct {
+	name string
+	pair func(key [32]byte, session []byte) (ParallelSealer, ParallelOpener)
+} {
+	return []struct {
+		name string
+		pair func(key [32]byte, session []byte) (ParallelSealer, ParallelOpener)
+	}{
+		{"random", func(key [32]byte, _ []byte) (ParallelSealer, ParallelOpener) {
+			aead, _ := NewAEAD(key)
+			return RandomNonce{AEAD: aead}, RandomNonce{AEAD: aead, Seen: NewNonceWindow(64)}
+		}},
+		{"sequenced", func(key [32]byte, session []byte) (ParallelSealer, ParallelOpener) {
+			return NewSequencedSealer(key, session, ServerToClient), NewSequencedOpener(key, session, ServerToClient)
+		}},
+	}
+}
+
+// testFrames are plaintexts of frames of assorted sizes
+var testFrames = [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0x5A}, 16<<10), []byte("last")}
+
+func TestChunkRoundTrip(t *testing.T) {
+	for _, c := range []struct{ x, z, n int }{{0, 0, 0}, {3, -7, 5}, {-1 << 31, 1<<31 - 1, 300}, {12, 34, 64 << 10}} {
+		payload := bytes.Repeat([]byte{0x42}, c.n)
+		body := EncodeChunk(c.x, c.z, payload)
+		if len(body) != ChunkLen(c.n) {
+			t.Errorf("chunk of %d bytes is %d bytes long, ChunkLen says %d", c.n, len(body), ChunkLen(c.n))
+		}
+		if !bytes.Equal(AppendChunk([]byte("head"), c.x, c.z, payload)[4:], body) {
+			t.Errorf("AppendChunk differs from EncodeChunk")
+		}
+		x, z, got, err := DecodeChunk(body)
+		if err != nil || x != c.x || z != c.z || !bytes.Equal(got, payload) {
+			t.Errorf("chunk %d,%d of %d bytes read back as %d,%d of %d bytes, %v", c.x, c.z, c.n, x, z, len(got), err)
+		}
+	}
+	if _, _, _, err := DecodeChunk([]byte{1, 2, 3}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated chunk: %v, want %v", err, ErrMalformed)
+	}
+}
+
+func TestPluginMessageRoundTrip(t *testing.T) {
+	for _, channel := range []string{TunnelChannel, BrandChannel, "minecraft:register"} {
+		body := EncodePluginMessage(channel, []byte("payload"))
+		got, payload, err := DecodePluginMessage(body)
+		if err != nil || got != channel || string(payload) != "payload" {
+			t.Errorf("message on %s read back as %s %q, %v", channel, got, payload, err)
+		}
+		if IsTunnelChannel(channel) != (channel != "minecraft:register") {
+			t.Errorf("IsTunnelChannel(%s) = %v", channel, IsTunnelChannel(channel))
+		}
+	}
+	if _, _, err := DecodePluginMessage([]byte{0x05, 'a'}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated channel: %v, want %v", err, ErrMalformed)
+	}
+}
+
+// TestFramingRoundTrip carries frames of each framing like the tunnel does: server frames in
+// chunks, client frames in plugin messages, sealed and opened whole or reserved for workers.
+func TestFramingRoundTrip(t *testing.T) {
+	key := [32]byte{1}
+	session := []byte("session nonce 16")
+	for _, f := range framings() {
+		for _, parallel := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/parallel=%v", f.name, parallel), func(t *testing.T) {
+				sealer, opener := f.pair(key, session)
+				seal := func(plaintext []byte) []byte {
+					if parallel {
+						fr := sealer.ReserveSeal()
+						return fr.AppendSeal(make([]byte, 0, fr.SealedLen(len(plaintext))), plaintext)
+					}
+					return sealer.AppendSeal(nil, plaintext)
+				}
+				open := func(frame []byte) ([]byte, error) {
+					if parallel {
+						fr, ciphertext, err := opener.ReserveOpen(frame)
+						if err != nil {
+							return nil, err
+						}
+						return fr.AppendOpen(nil, ciphertext)
+					}
+					return opener.AppendOpen(nil, frame)
+				}
+
+				for i, plaintext := range testFrames {
+					var frame []byte
+					if i%2 == 0 {
+						n := sealer.SealedLen(len(plaintext))
+						var body []byte
+						if parallel {
+							body = EncodeChunk(i, -i, seal(plaintext))
+						} else {
+							body = AppendSealedChunk(nil, sealer, i, -i, plaintext)
+						}
+						x, z, payload, err := DecodeChunk(body)
+						if err != nil || x != i || z != -i {
+							t.Fatalf("frame %d: chunk %d,%d, %v", i, x, z, err)
+						}
+						if !parallel && len(payload) != n {
+							t.Errorf("frame %d: %d bytes sealed, SealedLen said %d", i, len(payload), n)
+						}
+						frame = payload
+					} else {
+						channel, payload, err := DecodePluginMessage(EncodePluginMessage(TunnelChannel, seal(plaintext)))
+						if err != nil || channel != TunnelChannel {
+							t.Fatalf("frame %d: plugin message on %s, %v", i, channel, err)
+						}
+						frame = payload
+					}
+					got, err := open(frame)
+					if err != nil || !bytes.Equal(got, plaintext) {
+						t.Fatalf("frame %d of %d bytes opened as %d bytes, %v", i, len(plaintext), len(got), err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFramingRejectsReplays(t *testing.T) {
+	key := [32]byte{1}
+	session := []byte("session nonce 16")
+	for _, f := range framings() {
+		t.Run(f.name, func(t *testing.T) {
+			sealer, opener := f.pair(key, session)
+			first := sealer.AppendSeal(nil, []byte("first"))
+			if _, err := opener.AppendOpen(nil, first); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := opener.AppendOpen(nil, first); err == nil {
+				t.Error("replayed frame opened")
+			}
+		})
+	}
+
+	// A sequenced frame of one session doesn't open in another, even with the same salt
+	sealer := NewSequencedSealer(key, session, ClientToServer)
+	frame := sealer.AppendSeal(nil, []byte("frame"))
+	if _, err := NewSequencedOpener(key, []byte("another session!"), ClientToServer).AppendOpen(nil, frame); !errors.Is(err, ErrOutOfSequence) {
+		t.Errorf("frame opened in another session: %v", err)
+	}
+	if _, err := NewSequencedOpener(key, session, ServerToClient).AppendOpen(nil, frame); !errors.Is(err, ErrOutOfSequence) {
+		t.Errorf("frame opened in the other direction: %v", err)
+	}
+
+	// Sequenced frames only open in order, and nothing opens after a frame out of sequence
+	sealer = NewSequencedSealer(key, session, ServerToClient)
+	opener := NewSequencedOpener(key, session, ServerToClient)
+	frames := [][]byte{sealer.AppendSeal(nil, []byte("0")), sealer.AppendSeal(nil, []byte("1")), sealer.AppendSeal(nil, []byte("2"))}
+	opener.AppendOpen(nil, frames[0])
+	if _, err := opener.AppendOpen(nil, frames[2]); !errors.Is(err, ErrOutOfSequence) {
+		t.Errorf("frame 2 opened after frame 0: %v", err)
+	}
+	if _, err := opener.AppendOpen(nil, frames[1]); !errors.Is(err, ErrOutOfSequence) {
+		t.Errorf("frame opened after one out of sequence: %v", err)
+	}
+}
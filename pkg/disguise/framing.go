@@ -0,0 +1,288 @@
+package disguise
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// Sealer encrypts the tunnel frames of one direction of a session.
+type Sealer interface {
+	AppendSeal(dst, plaintext []byte) []byte // Appends the frame of plaintext to dst
+	SealedLen(n int) int                     // Length of the next frame of n bytes
+}
+
+// Opener decrypts the tunnel frames of one direction of a session.
+type Opener interface {
+	AppendOpen(dst, frame []byte) ([]byte, error) // Appends the plaintext of frame to dst
+}
+
+// ParallelSealer is a Sealer whose frames can be sealed on several goroutines: ReserveSeal fixes
+// the place of the next frame, which is then sealed independently. Frames must be sent in the
+// order they were reserved.
+type ParallelSealer interface {
+	Sealer
+	ReserveSeal() *Frame
+}
+
+// ParallelOpener is an Opener whose frames can be opened on several goroutines: ReserveOpen takes
+// the next frame in the order received and returns it with the ciphertext to open.
+type ParallelOpener interface {
+	Opener
+	ReserveOpen(frame []byte) (*Frame, []byte, error)
+}
+
+// Frame is a single frame whose place in its direction is fixed. It seals (Sealer) or opens
+// (Opener) exactly that frame, and may do so on any goroutine.
+type Frame struct {
+	aead   cipher.AEAD
+	random bool         // RandomNonce framing: no sequence, a random nonce in the frame
+	seen   *NonceWindow // Replay check of an opened random nonce frame, if any
+	salt   []byte       // Sent in front of the first sequenced frame
+	nonce  [12]byte
+}
+
+func (f *Frame) SealedLen(n int) int {
+	if f.random {
+		return SealedLen(f.aead, n)
+	}
+	return len(f.salt) + n + f.aead.Overhead()
+}
+
+func (f *Frame) AppendSeal(dst, plaintext []byte) []byte {
+	if f.random {
+		return AppendSeal(dst, f.aead, plaintext)
+	}
+	dst = append(dst, f.salt...)
+	return f.aead.Seal(dst, f.nonce[:], plaintext, f.nonce[4:])
+}
+
+// AppendOpen opens the ciphertext returned by ParallelOpener.ReserveOpen.
+func (f *Frame) AppendOpen(dst, ciphertext []byte) ([]byte, error) {
+	if f.random {
+		return openRandom(dst, f.aead, f.seen, ciphertext)
+	}
+	pt, err := f.aead.Open(dst, f.nonce[:], ciphertext, f.nonce[4:])
+	if err != nil {
+		return nil, ErrOutOfSequence
+	}
+	return pt, nil
+}
+
+// RandomNonce seals every frame under a random nonce sent in front of it (Seal and Open). Frames
+// are independent: a lost or reordered frame is not noticed by this layer, and a replayed one
+// only if Seen is set.
+type RandomNonce struct {
+	AEAD cipher.AEAD
+	Seen *NonceWindow // Nonces of the frames opened so far, to reject replays; nil accepts them
+}
+
+func (r RandomNonce) AppendSeal(dst, plaintext []byte) []byte {
+	return AppendSeal(dst, r.AEAD, plaintext)
+}
+
+func (r RandomNonce) SealedLen(n int) int { return SealedLen(r.AEAD, n) }
+
+func (r RandomNonce) ReserveSeal() *Frame { return &Frame{aead: r.AEAD, random: true} }
+
+func (r RandomNonce) AppendOpen(dst, frame []byte) ([]byte, error) {
+	return openRandom(dst, r.AEAD, r.Seen, frame)
+}
+
+// ReserveOpen returns frame itself: random nonce frames open in any order.
+func (r RandomNonce) ReserveOpen(frame []byte) (*Frame, []byte, error) {
+	return &Frame{aead: r.AEAD, random: true, seen: r.Seen}, frame, nil
+}
+
+// ErrReplayed is returned for a random nonce frame whose nonce was already received: the frame
+// itself replayed, or a peer reusing nonces.
+var ErrReplayed = errors.New("disguise: replayed frame")
+
+// openRandom opens a random nonce frame and, with seen, rejects it if its nonce is in the window.
+// Only frames that authenticate are added, so forged frames can't poison the window.
+func openRandom(dst []byte, aead cipher.AEAD, seen *NonceWindow, frame []byte) ([]byte, error) {
+	pt, err := AppendOpen(dst, aead, frame)
+	if err != nil || seen == nil {
+		return pt, err
+	}
+	if !seen.add(frame[:aead.NonceSize()]) {
+		return nil, ErrReplayed
+	}
+	return pt, nil
+}
+
+// NonceWindow remembers the nonces of the last frames opened in a direction of a session. It
+// holds between size and twice size nonces in two generations; a frame replayed after that many
+// newer ones is no longer noticed, which only sequenced framing rules out. It is safe for
+// concurrent use by crypto workers.
+type NonceWindow struct {
+	mu        sync.Mutex
+	size      int
+	cur, prev map[uint64]struct{}
+}
+
+// NewNonceWindow returns an empty window of size nonces per generation.
+func NewNonceWindow(size int) *NonceWindow {
+	return &NonceWindow{size: size, cur: make(map[uint64]struct{})}
+}
+
+// add records nonce and reports whether it is new. Random nonces are 96 bits, so their first 64
+// are enough to tell them apart.
+func (w *NonceWindow) add(nonce []byte) bool {
+	key := binary.BigEndian.Uint64(nonce)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.cur[key]; ok {
+		return false
+	}
+	if _, ok := w.prev[key]; ok {
+		return false
+	}
+	if len(w.cur) >= w.size {
+		w.prev, w.cur = w.cur, make(map[uint64]struct{}, w.size)
+	}
+	w.cur[key] = struct{}{}
+	return true
+}
+
+// Directions of a tunnel, which never share a key in sequenced framing
+const (
+	ServerToClient = "minewire tunnel server to client"
+	ClientToServer = "minewire tunnel client to server"
+)
+
+// ErrOutOfSequence is returned for a sequenced frame that isn't the next one: replayed, reordered,
+// dropped or forged.
+var ErrOutOfSequence = errors.New("disguise: frame out of sequence")
+
+// saltSize is the length of the random salt in front of the first sequenced frame
+const saltSize = 16
+
+// Sequenced frames replace the random nonce with a counter. The first frame of a direction
+// carries a random salt: [Salt][Ciphertext][Tag], later frames only [Ciphertext][Tag]. The key of
+// the direction is HKDF-SHA256 of the user's key, the salt, the session nonce and the direction,
+// so sessions and directions never reuse a nonce. The session nonce is picked by the server, so
+// a client's frames recorded in one session don't open in another even though the client picks
+// their salt. The nonce of frame n is n, which is also the additional data,
+// so frames only open in the order they were sealed.
+type sequenced struct {
+	key     [32]byte
+	session []byte // Server-picked nonce of the session
+	dir     string
+	aead    cipher.AEAD // Nil until the salt was sent or received
+	seq     uint64
+	nonce   [12]byte // Zeros, then seq
+}
+
+// NewSequencedSealer returns a Sealer of sequenced frames for direction dir of the session
+// with the server-picked nonce session.
+func NewSequencedSealer(key [32]byte, session []byte, dir string) ParallelSealer {
+	return &sequenced{key: key, session: slices.Clone(session), dir: dir}
+}
+
+// NewSequencedOpener returns an Opener of the sequenced frames of direction dir of the session
+// with the server-picked nonce session.
+func NewSequencedOpener(key [32]byte, session []byte, dir string) ParallelOpener {
+	return &sequenced{key: key, session: slices.Clone(session), dir: dir}
+}
+
+// init derives the key of the direction from salt and the session nonce.
+func (s *sequenced) init(salt []byte) error {
+	key, err := hkdf.Key(sha256.New, s.key[:], slices.Concat(salt, s.session), s.dir, 32)
+	if err != nil {
+		return err
+	}
+	s.aead, err = NewAEAD([32]byte(key))
+	return err
+}
+
+// nextNonce returns the nonce and additional data of the current frame.
+func (s *sequenced) nextNonce() ([]byte, []byte) {
+	binary.BigEndian.PutUint64(s.nonce[4:], s.seq)
+	return s.nonce[:], s.nonce[4:]
+}
+
+func (s *sequenced) SealedLen(n int) int {
+	if s.aead == nil {
+		return saltSize + n + 16 // GCM tag
+	}
+	return n + s.aead.Overhead()
+}
+
+// AppendSeal appends the next frame. Frames must be sent in the order they are sealed.
+func (s *sequenced) AppendSeal(dst, plaintext []byte) []byte {
+	dst = slices.Grow(dst, s.SealedLen(len(plaintext)))
+	if s.aead == nil {
+		salt := make([]byte, saltSize)
+		rand.Read(salt)
+		if err := s.init(salt); err != nil {
+			panic(err) // Only fails for invalid parameters
+		}
+		dst = append(dst, salt...)
+	}
+	nonce, ad := s.nextNonce()
+	s.seq++
+	return s.aead.Seal(dst, nonce, plaintext, ad)
+}
+
+// ReserveSeal takes the next frame, sending the salt in front of it if it is the first.
+func (s *sequenced) ReserveSeal() *Frame {
+	f := &Frame{}
+	if s.aead == nil {
+		f.salt = make([]byte, saltSize)
+		rand.Read(f.salt)
+		if err := s.init(f.salt); err != nil {
+			panic(err) // Only fails for invalid parameters
+		}
+	}
+	f.aead = s.aead
+	binary.BigEndian.PutUint64(f.nonce[4:], s.seq)
+	s.seq++
+	return f
+}
+
+// ReserveOpen takes the next frame and returns its ciphertext. A frame that fails to open breaks
+// the direction like in AppendOpen: it took the place of the next frame, so later ones are out of
+// sequence.
+func (s *sequenced) ReserveOpen(frame []byte) (*Frame, []byte, error) {
+	if s.aead == nil {
+		if len(frame) < saltSize {
+			return nil, nil, ErrMalformed
+		}
+		if err := s.init(frame[:saltSize]); err != nil {
+			return nil, nil, err
+		}
+		frame = frame[saltSize:]
+	}
+	f := &Frame{aead: s.aead}
+	binary.BigEndian.PutUint64(f.nonce[4:], s.seq)
+	s.seq++
+	return f, frame, nil
+}
+
+// AppendOpen decrypts the next frame. After an error the direction is broken: later frames fail
+// too.
+func (s *sequenced) AppendOpen(dst, frame []byte) ([]byte, error) {
+	if s.aead == nil {
+		if len(frame) < saltSize {
+			return nil, ErrMalformed
+		}
+		if err := s.init(frame[:saltSize]); err != nil {
+			return nil, err
+		}
+		frame = frame[saltSize:]
+	}
+	nonce, ad := s.nextNonce()
+	pt, err := s.aead.Open(dst, nonce, frame, ad)
+	if err != nil {
+		s.seq = ^uint64(0) // Nothing opens after a frame out of sequence
+		return nil, ErrOutOfSequence
+	}
+	s.seq++
+	return pt, nil
+}
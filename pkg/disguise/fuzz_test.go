@@ -0,0 +1,76 @@
+package disguise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeChunk(f *testing.F) {
+	f.Add(EncodeChunk(3, -7, []byte("frame")))
+	f.Add(EncodeChunk(0, 0, nil))
+	f.Add(EncodeChunk(-1<<31, 1<<31-1, make([]byte, 300)))
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0x0A, 0, 0, 0x0C, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		x, z, payload, err := DecodeChunk(body)
+		if err != nil {
+			return
+		}
+		if len(payload) > len(body) {
+			t.Fatalf("%d byte payload from a %d byte chunk", len(payload), len(body))
+		}
+		x2, z2, payload2, err := DecodeChunk(EncodeChunk(x, z, payload))
+		if err != nil || x2 != x || z2 != z || !bytes.Equal(payload2, payload) {
+			t.Fatalf("chunk %d,%d %x decodes to %d,%d %x (%v)", x, z, payload, x2, z2, payload2, err)
+		}
+	})
+}
+
+func FuzzDecodePluginMessage(f *testing.F) {
+	f.Add(EncodePluginMessage(TunnelChannel, []byte("frame")))
+	f.Add(EncodePluginMessage(BrandChannel, []byte("\x07vanilla")))
+	f.Add([]byte{0x80})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		channel, payload, err := DecodePluginMessage(body)
+		if err != nil {
+			return
+		}
+		if enc := EncodePluginMessage(channel, payload); !bytes.Equal(enc, body) {
+			t.Fatalf("plugin message %x decodes to %q %x, which encodes to %x", body, channel, payload, enc)
+		}
+	})
+}
+
+// FuzzOpen feeds frames sealed under another key, or none, to the openers of both framings:
+// they must reject them, not panic.
+func FuzzOpen(f *testing.F) {
+	var key, other [32]byte
+	other[0] = 1
+	session := []byte("session nonce 16")
+	foreign, _ := NewAEAD(other)
+	f.Add(Seal(foreign, []byte("frame")), true)
+	f.Add(NewSequencedSealer(other, session, ClientToServer).AppendSeal(nil, []byte("frame")), false)
+	f.Add([]byte{}, true)
+	f.Add(make([]byte, saltSize), false)
+	aead, _ := NewAEAD(key)
+	f.Fuzz(func(t *testing.T, frame []byte, parallel bool) {
+		openers := []ParallelOpener{
+			RandomNonce{AEAD: aead, Seen: NewNonceWindow(16)},
+			NewSequencedOpener(key, session, ClientToServer),
+		}
+		for _, o := range openers {
+			var err error
+			if parallel {
+				var fr *Frame
+				var ciphertext []byte
+				if fr, ciphertext, err = o.ReserveOpen(frame); err == nil {
+					_, err = fr.AppendOpen(nil, ciphertext)
+				}
+			} else {
+				_, err = o.AppendOpen(nil, frame)
+			}
+			if err == nil {
+				t.Fatalf("%T opened a frame sealed for no one: %x", o, frame)
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package mcproto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchValues is a spread of values covering every VarInt length
+var benchValues = []int{0, 1, 127, 128, 300, 16383, 16384, 2097151, 2097152, 1 << 30, -1}
+
+func BenchmarkVarInt(b *testing.B) {
+	var encoded []byte
+	for _, v := range benchValues {
+		encoded = AppendVarInt(encoded, v)
+	}
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, 64)
+		for b.Loop() {
+			buf = buf[:0]
+			for _, v := range benchValues {
+				buf = AppendVarInt(buf, v)
+			}
+		}
+	})
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		r := bytes.NewReader(encoded)
+		for b.Loop() {
+			r.Reset(encoded)
+			for range benchValues {
+				if _, err := ReadVarInt(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkPacket(b *testing.B) {
+	body := make([]byte, 16<<10)
+	var stream bytes.Buffer
+	WritePacket(&stream, 0x25, body)
+	packet := stream.Bytes()
+	b.Run("write", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for b.Loop() {
+			if err := WritePacket(io.Discard, 0x25, body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		r := bytes.NewReader(packet)
+		packets := NewPacketReader(r)
+		packets.ReuseBuffer()
+		for b.Loop() {
+			r.Reset(packet)
+			if _, _, err := packets.ReadPacket(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
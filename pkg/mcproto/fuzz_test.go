@@ -0,0 +1,250 @@
+package mcproto
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+// fuzzPacket has a field of every type Marshal supports
+type fuzzPacket struct {
+	Flag   bool
+	Byte   int8
+	Short  int16
+	Port   uint16
+	Int    int32
+	Long   int64
+	Float  float32
+	Double float64
+	Count  int
+	Seed   int64   `mc:"varlong"`
+	Yaw    float32 `mc:"angle"`
+	Name   string
+	ID     UUID
+	Block  Position
+	Mask   BitSet
+	Tags   Compound
+	Spawn  *Position `mc:"optional"`
+	Names  []string
+	Data   []byte
+	Rest   []byte `mc:"rest"`
+}
+
+// handshake is the Handshake packet that starts every connection
+type handshake struct {
+	Protocol  int
+	Host      string
+	Port      uint16
+	NextState int
+}
+
+func FuzzReadVarInt(f *testing.F) {
+	for _, v := range []int{0, 1, 127, 128, 255, 25565, 2097151, 1<<31 - 1, -1, -1 << 31} {
+		f.Add(AppendVarInt(nil, v))
+	}
+	f.Add([]byte{0x80, 0x00})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x7F})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		v, err := ReadVarInt(r)
+		if err != nil {
+			return
+		}
+		// Only the shortest encoding is accepted, so it is exactly what was read
+		read := data[:len(data)-r.Len()]
+		if enc := AppendVarInt(nil, v); !bytes.Equal(enc, read) {
+			t.Fatalf("ReadVarInt(%x) = %d, which encodes to %x", read, v, enc)
+		}
+		if VarIntSize(v) != len(read) {
+			t.Fatalf("VarIntSize(%d) = %d, read %d bytes", v, VarIntSize(v), len(read))
+		}
+
+		r.Reset(data)
+		l, err := ReadVarLong(r)
+		if err != nil {
+			t.Fatalf("ReadVarLong(%x) failed where ReadVarInt succeeded: %v", read, err)
+		}
+		if v >= 0 && l != int64(v) {
+			t.Fatalf("ReadVarLong(%x) = %d, ReadVarInt = %d", read, l, v)
+		}
+	})
+}
+
+func FuzzReadString(f *testing.F) {
+	for _, s := range []string{"", "minecraft:brand", "§bMinewire", string(make([]byte, 300))} {
+		var buf bytes.Buffer
+		WriteString(&buf, s)
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{0x05, 'a'})
+	f.Add([]byte{0xFF, 0xFF, 0x03})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := ReadString(bytes.NewReader(data))
+
+		// A reader without ReadByte goes through byteReaderAdapter, a byte per Read, and must
+		// decode the same
+		r := iotest.OneByteReader(bytes.NewReader(data))
+		if _, ok := r.(interface{ ReadByte() (byte, error) }); ok {
+			t.Fatal("OneByteReader is an io.ByteReader")
+		}
+		s2, err2 := ReadString(r)
+		if s != s2 || (err == nil) != (err2 == nil) {
+			t.Fatalf("ReadString(%x) = %q, %v; through byteReaderAdapter %q, %v", data, s, err, s2, err2)
+		}
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		WriteString(&buf, s)
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Fatalf("ReadString(%x) = %q, which encodes to %x", data, s, buf.Bytes())
+		}
+	})
+}
+
+func FuzzByteReaderAdapter(f *testing.F) {
+	f.Add([]byte{0x01, 0x02, 0x03})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, r := range []*byteReaderAdapter{
+			{r: bytes.NewReader(data)},
+			{r: iotest.OneByteReader(bytes.NewReader(data))},
+			{r: iotest.DataErrReader(bytes.NewReader(data))},
+			{r: iotest.HalfReader(bytes.NewReader(data))},
+		} {
+			var got []byte
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					break
+				}
+				got = append(got, b)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %x from %x", got, data)
+			}
+		}
+	})
+}
+
+func FuzzReadNBT(f *testing.F) {
+	var named, network bytes.Buffer
+	c := Compound{
+		"name": "Steve", "level": int32(7), "xp": float32(0.5), "pos": []any{float64(1), float64(2)},
+		"inventory": []any{Compound{"id": "minecraft:dirt", "count": int8(64)}}, "blocks": []byte{1, 2},
+		"heights": []int64{1, 2, 3}, "ids": []int32{4}, "flags": int16(3), "seed": int64(-1),
+	}
+	WriteNBT(&named, "root", c)
+	WriteNetworkNBT(&network, c)
+	f.Add(named.Bytes())
+	f.Add(network.Bytes())
+	f.Add([]byte{TagCompound, TagList, 0, 0, TagList, 0x7F, 0xFF, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if name, c, err := ReadNBT(bytes.NewReader(data)); err == nil {
+			var buf bytes.Buffer
+			if err := WriteNBT(&buf, name, c); err != nil {
+				t.Fatalf("decoded NBT does not encode: %v", err)
+			}
+			name2, c2, err := ReadNBT(&buf)
+			if err != nil || name2 != name {
+				t.Fatalf("encoded NBT does not decode: %q %v", name2, err)
+			}
+			checkStableNBT(t, c2)
+		}
+		if c, err := ReadNetworkNBT(bytes.NewReader(data)); err == nil {
+			checkStableNBT(t, c)
+		}
+	})
+}
+
+// checkStableNBT fails unless c encodes to the same bytes after a decode of its encoding.
+func checkStableNBT(t *testing.T, c Compound) {
+	t.Helper()
+	var first, second bytes.Buffer
+	if err := WriteNetworkNBT(&first, c); err != nil {
+		t.Fatalf("decoded NBT does not encode: %v", err)
+	}
+	c2, err := ReadNetworkNBT(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatalf("encoded NBT does not decode: %v", err)
+	}
+	WriteNetworkNBT(&second, c2)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("NBT encodes to %x, then %x", first.Bytes(), second.Bytes())
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	p := fuzzPacket{
+		Flag: true, Byte: -1, Short: 300, Port: 25565, Int: -5, Long: 1 << 40, Float: 1.5, Double: -2,
+		Count: 42, Seed: -7, Yaw: 90, Name: "Steve", Block: Position{X: 1, Y: -2, Z: 3},
+		Mask: BitSet{5}, Tags: Compound{"a": int32(1)}, Spawn: &Position{X: -8}, Names: []string{"a", "b"},
+		Data: []byte{1, 2, 3}, Rest: []byte("rest"),
+	}
+	seed, err := Marshal(p, 773)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v fuzzPacket
+		if err := Unmarshal(data, &v, 773); err != nil {
+			return
+		}
+		// Encodings are canonical after one round trip (the angle, NBT strings and empty lists
+		// may normalize the input)
+		first, err := Marshal(v, 773)
+		if err != nil {
+			t.Fatalf("decoded packet does not encode: %v", err)
+		}
+		var v2 fuzzPacket
+		if err := Unmarshal(first, &v2, 773); err != nil {
+			t.Fatalf("encoded packet %x does not decode: %v", first, err)
+		}
+		second, _ := Marshal(v2, 773)
+		if !bytes.Equal(first, second) {
+			t.Fatalf("packet encodes to %x, then %x", first, second)
+		}
+	})
+}
+
+func FuzzHandshake(f *testing.F) {
+	for _, h := range []handshake{
+		{Protocol: 773, Host: "play.example.com", Port: 25565, NextState: 1},
+		{Protocol: 47, Host: "127.0.0.1\x00FML\x00", Port: 25565, NextState: 2},
+	} {
+		body, _ := Marshal(h, h.Protocol)
+		var buf bytes.Buffer
+		WritePacket(&buf, 0x00, body)
+		WritePacket(&buf, 0x00, nil) // Status Request
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{LegacyPingMagic, 0x01, 0xFA, 0x00, 0x0B})
+	f.Add([]byte{0x7F, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packets := NewPacketReader(bytes.NewReader(data))
+		packets.SetLimits(1024, 0)
+		if b, err := packets.PeekByte(); err == nil && b == LegacyPingMagic {
+			if format, err := packets.ReadLegacyPing(); err == nil && format != 0 && format != 1 {
+				t.Fatalf("legacy ping format %d", format)
+			}
+			return
+		}
+		id, body, err := packets.ReadPacket()
+		if err != nil {
+			return
+		}
+		if len(body) > 1024 {
+			t.Fatalf("%d byte packet read with a 1024 byte limit", len(body))
+		}
+		var h handshake
+		if id != 0x00 || Unmarshal(body, &h, 0) != nil {
+			return
+		}
+		enc, err := Marshal(h, 0)
+		if err != nil || !bytes.Equal(enc, body) {
+			t.Fatalf("handshake %+v from %x encodes to %x (%v)", h, body, enc, err)
+		}
+	})
+}
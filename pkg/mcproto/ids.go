@@ -0,0 +1,88 @@
+package mcproto
+
+import "sort"
+
+// PacketKind is a packet independent of the protocol version, the index into PacketIDs
+type PacketKind int
+
+// Packets Minewire sends and reads in the login and play states
+const (
+	LoginSuccess PacketKind = iota // Server -> Client, login state
+	JoinGame                       // Server -> Client: Login (play)
+	KeepAlive
+	ChunkData // Chunk Data and Update Light
+	PluginMessage
+	PlayDisconnect
+	GameEvent
+	PlayerInfoRemove // Since 1.19.3, -1 before
+	PlayerInfoUpdate // Since 1.19.3, -1 before
+	PlayerPosition   // Synchronize Player Position
+	AddResourcePack  // Resource Pack before 1.20.3
+	TimeUpdate
+	SystemChat
+	EntityPosition // Update Entity Position
+
+	ServerboundPluginMessage
+	ServerboundResourcePackResponse
+	ServerboundKeepAlive
+
+	numPacketKinds
+)
+
+// PacketIDs maps each PacketKind to its packet ID in one protocol version, -1 if absent.
+type PacketIDs [numPacketKinds]int
+
+// packetIDTable holds the IDs of each protocol version that changed one of them, in order.
+// A version uses the entry of the newest version not above it.
+var packetIDTable = []struct {
+	since int
+	ids   PacketIDs
+}{
+	{759, PacketIDs{0x02, 0x23, 0x1E, 0x1F, 0x15, 0x17, 0x1B, -1, -1, 0x36, 0x3A, 0x59, 0x5F, 0x26, 0x0C, 0x23, 0x11}},     // 1.19
+	{760, PacketIDs{0x02, 0x25, 0x20, 0x21, 0x16, 0x19, 0x1D, -1, -1, 0x39, 0x3D, 0x5C, 0x62, 0x28, 0x0D, 0x24, 0x12}},     // 1.19.1-2
+	{761, PacketIDs{0x02, 0x24, 0x1F, 0x20, 0x15, 0x17, 0x1C, 0x35, 0x36, 0x38, 0x3C, 0x5A, 0x60, 0x27, 0x0C, 0x24, 0x11}}, // 1.19.3
+	{762, PacketIDs{0x02, 0x28, 0x23, 0x24, 0x17, 0x1A, 0x1F, 0x39, 0x3A, 0x3C, 0x40, 0x5E, 0x64, 0x2B, 0x0D, 0x24, 0x12}}, // 1.19.4-1.20.1
+	{764, PacketIDs{0x02, 0x29, 0x24, 0x25, 0x18, 0x1B, 0x20, 0x3B, 0x3C, 0x3E, 0x42, 0x60, 0x67, 0x2C, 0x0F, 0x27, 0x14}}, // 1.20.2
+	{765, PacketIDs{0x02, 0x29, 0x24, 0x25, 0x18, 0x1B, 0x20, 0x3B, 0x3C, 0x3E, 0x44, 0x62, 0x69, 0x2C, 0x10, 0x28, 0x15}}, // 1.20.3-4
+	{766, PacketIDs{0x02, 0x2B, 0x26, 0x27, 0x19, 0x1D, 0x22, 0x3D, 0x3E, 0x40, 0x46, 0x64, 0x6C, 0x2E, 0x12, 0x2B, 0x18}}, // 1.20.5-1.21.1
+	{768, PacketIDs{0x02, 0x2C, 0x27, 0x28, 0x19, 0x1D, 0x23, 0x3F, 0x40, 0x42, 0x4A, 0x6B, 0x73, 0x2F, 0x14, 0x2D, 0x1A}}, // 1.21.2-3
+	{769, PacketIDs{0x02, 0x2C, 0x27, 0x28, 0x19, 0x1D, 0x23, 0x3F, 0x40, 0x42, 0x4A, 0x6B, 0x73, 0x2F, 0x14, 0x2F, 0x1A}}, // 1.21.4
+	{770, PacketIDs{0x02, 0x2B, 0x26, 0x27, 0x18, 0x1C, 0x22, 0x3E, 0x3F, 0x41, 0x49, 0x6A, 0x72, 0x2E, 0x15, 0x30, 0x1A}}, // 1.21.5-8
+	{773, PacketIDs{0x02, 0x30, 0x2B, 0x2C, 0x18, 0x20, 0x26, 0x43, 0x44, 0x46, 0x4E, 0x6F, 0x77, 0x33, 0x15, 0x30, 0x1B}}, // 1.21.9-10
+}
+
+// Range of protocol versions with known packet IDs
+var (
+	MinKnownVersion = packetIDTable[0].since
+	MaxKnownVersion = 773
+)
+
+// KnownVersions returns the oldest protocol version of each set of known packet IDs.
+func KnownVersions() []int {
+	versions := make([]int, len(packetIDTable))
+	for i, e := range packetIDTable {
+		versions[i] = e.since
+	}
+	return versions
+}
+
+// IDsFor returns the packet IDs of a protocol version, and false for versions older than
+// MinKnownVersion. Versions newer than MaxKnownVersion get its IDs.
+func IDsFor(version int) (PacketIDs, bool) {
+	i := sort.Search(len(packetIDTable), func(i int) bool { return packetIDTable[i].since > version })
+	if i == 0 {
+		return PacketIDs{}, false
+	}
+	return packetIDTable[i-1].ids, true
+}
+
+// Protocol is the protocol version of a connection and its packet IDs.
+type Protocol struct {
+	Version int
+	IDs     PacketIDs
+}
+
+// ID returns the packet ID of a packet kind.
+func (p Protocol) ID(k PacketKind) int {
+	return p.IDs[k]
+}
@@ -0,0 +1,310 @@
+// Package mcproto implements the Minecraft protocol primitives Minewire speaks: VarInts,
+// strings, fixed-size big-endian types, NBT strings, packet framing and the status response.
+package mcproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Errors of malformed encodings
+var (
+	ErrVarIntTooLong  = errors.New("varint is too big")                       // More bytes than the type holds
+	ErrVarIntOverflow = errors.New("varint overflows its type")               // Last byte sets bits beyond the type
+	ErrVarIntOverlong = errors.New("varint has redundant continuation bytes") // Not the shortest encoding
+	ErrLengthTooLarge = errors.New("length exceeds its limit or the rest of the packet")
+	ErrNegativeLength = errors.New("negative length")
+	ErrPacketTooLarge = errors.New("packet exceeds the maximum size")
+)
+
+// ReadVarInt reads a variable-length integer from the reader.
+// VarInt is a Minecraft protocol primitive that uses 1-5 bytes, and encodes a signed 32-bit
+// integer as its two's complement (negative values always take 5 bytes).
+func ReadVarInt(r io.ByteReader) (int, error) {
+	v, err := readVarUint(r, 5)
+	return int(int32(v)), err
+}
+
+// readVarUint reads a variable-length unsigned integer of 32 bits (maxBytes 5) or 64 bits
+// (maxBytes 10), rejecting encodings longer than needed and bits beyond the type.
+func readVarUint(r io.ByteReader, maxBytes int) (uint64, error) {
+	bits := 32
+	if maxBytes == 10 {
+		bits = 64
+	}
+	var result uint64
+	for i := 0; ; i++ {
+		if i == maxBytes {
+			return 0, ErrVarIntTooLong
+		}
+		b, err := r.ReadByte()
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF // Ended within the VarInt
+		}
+		if err != nil {
+			return 0, err
+		}
+		if i == maxBytes-1 && uint64(b&0x7F)>>(bits-7*i) != 0 {
+			return 0, ErrVarIntOverflow
+		}
+		result |= uint64(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrVarIntOverlong
+			}
+			return result, nil
+		}
+	}
+}
+
+// appendVarUint appends the variable-length encoding of v.
+func appendVarUint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendVarInt appends the VarInt encoding of value to b.
+func AppendVarInt(b []byte, value int) []byte {
+	return appendVarUint(b, uint64(uint32(value)))
+}
+
+// VarIntSize returns the number of bytes of the VarInt encoding of value.
+func VarIntSize(value int) int {
+	n := 1
+	for v := uint32(value); v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// WriteVarInt writes a variable-length integer to the writer. Values are truncated to 32 bits.
+func WriteVarInt(w io.Writer, value int) error {
+	var buf [5]byte
+	_, err := w.Write(AppendVarInt(buf[:0], value))
+	return err
+}
+
+// ReadVarIntZigZag reads a VarInt holding a zigzag-encoded signed integer, which keeps small
+// negative values short.
+func ReadVarIntZigZag(r io.ByteReader) (int, error) {
+	v, err := readVarUint(r, 5)
+	return int(int32(uint32(v)>>1) ^ -int32(v&1)), err
+}
+
+// WriteVarIntZigZag writes a zigzag-encoded signed integer as a VarInt.
+func WriteVarIntZigZag(w io.Writer, value int) error {
+	v := int32(value)
+	return WriteVarInt(w, int(uint32(v<<1)^uint32(v>>31)))
+}
+
+// remaining returns how many bytes are left in r, if it knows.
+func remaining(r any) (int, bool) {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return l.Len(), true
+	}
+	return 0, false
+}
+
+// ReadLength reads a VarInt length prefix of at most max, and no more than the bytes left in r
+// when r knows them (bytes.Buffer, bytes.Reader), so crafted lengths can't cause allocations
+// beyond the packet.
+func ReadLength(r io.ByteReader, max int) (int, error) {
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, ErrNegativeLength
+	}
+	if n > max {
+		return 0, ErrLengthTooLarge
+	}
+	if left, ok := remaining(r); ok && n > left {
+		return 0, ErrLengthTooLarge
+	}
+	return n, nil
+}
+
+// ReadBytes reads exactly n bytes, growing the buffer as they arrive instead of allocating n
+// upfront, so a peer announcing a large packet must actually send it. Running out of input
+// before n bytes is io.ErrUnexpectedEOF, even if nothing was read.
+func ReadBytes(r io.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrNegativeLength
+	}
+	if n <= 4096 {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return b, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err == nil && len(b) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// MaxPacketSize is the largest uncompressed packet accepted from a peer
+const MaxPacketSize = 1 << 20
+
+// maxStringBytes is the longest string ReadString accepts, in bytes
+const maxStringBytes = 32773
+
+// WriteString writes a string in Minecraft protocol format: [VarInt Length][UTF-8 Bytes]
+func WriteString(w io.Writer, s string) error {
+	b := []byte(s)
+	if err := WriteVarInt(w, len(b)); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadString reads a string in Minecraft protocol format: [VarInt Length][UTF-8 Bytes]
+func ReadString(r io.Reader) (string, error) {
+	// Protect against OOM attacks with excessively long strings
+	length, err := ReadLength(asByteReader(r), maxStringBytes)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // Strings are always part of a packet
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ReadBytes(r, length)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// byteReaderAdapter adapts io.Reader to io.ByteReader interface. It reads a byte at a time, so
+// it never consumes input past the value being decoded (bufio.Reader is faster where that's fine).
+type byteReaderAdapter struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+// ReadByte reads one byte. Read may return no data without an error, or the byte together with
+// an error, so it retries until a byte arrives and only fails if none did.
+func (b *byteReaderAdapter) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
+
+// --- Minecraft Types ---
+
+// WriteBool writes a boolean as a single byte.
+func WriteBool(w io.Writer, b bool) error {
+	var v byte
+	if b {
+		v = 0x01
+	}
+	return WriteByte(w, v)
+}
+
+// WriteByte writes a single byte.
+func WriteByte(w io.Writer, b byte) error {
+	_, err := w.Write([]byte{b})
+	return err
+}
+
+// WriteLong writes a big-endian 64-bit integer.
+func WriteLong(w io.Writer, v int64) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// WriteInt writes a big-endian 32-bit integer.
+func WriteInt(w io.Writer, v int32) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// WriteFloat writes a big-endian 32-bit float.
+func WriteFloat(w io.Writer, v float32) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// WriteDouble writes a big-endian 64-bit float.
+func WriteDouble(w io.Writer, v float64) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// AppendPacketHeader appends the length and ID of a packet with a body of bodyLen bytes, to be
+// followed by the body: [VarInt Length][VarInt ID]
+func AppendPacketHeader(b []byte, packetID, bodyLen int) []byte {
+	b = AppendVarInt(b, VarIntSize(packetID)+bodyLen) // The length covers the ID and the body
+	return AppendVarInt(b, packetID)
+}
+
+// Bodies from this size are sent with a gathered write of the header and the body instead of
+// being copied behind the header
+const minGatheredBody = 4 << 10
+
+// BuffersWriter is implemented by connection wrappers that pass gathered writes on to the
+// connection underneath: net.Buffers only uses writev on the net package's own connections.
+type BuffersWriter interface {
+	WriteBuffers(b *net.Buffers) (int64, error)
+}
+
+// WritePacket writes an uncompressed packet: [VarInt Length][VarInt ID][Data]
+func WritePacket(w io.Writer, packetID int, data []byte) error {
+	if VarIntSize(packetID)+len(data) > MaxPacketSize {
+		return ErrPacketTooLarge
+	}
+
+	// Large bodies: header and body in one writev, without copying the body
+	if len(data) >= minGatheredBody {
+		var header [10]byte
+		bufs := net.Buffers{AppendPacketHeader(header[:0], packetID, len(data)), data}
+		var err error
+		if bw, ok := w.(BuffersWriter); ok {
+			_, err = bw.WriteBuffers(&bufs)
+		} else {
+			_, err = bufs.WriteTo(w) // Sequential writes unless w is a net.Conn
+		}
+		return err
+	}
+
+	// Small bodies are copied behind the header in a pooled buffer, for a single Write
+	buf := GetBuffer()
+	packet := append(AppendPacketHeader(*buf, packetID, len(data)), data...)
+	_, err := w.Write(packet)
+	*buf = packet
+	PutBuffer(buf)
+	return err
+}
+
+// Packet buffers are pooled up to this capacity, enough for tunnel frames of a full yamux
+// window; larger ones are left to the GC, so a burst of big packets doesn't pin memory
+const maxPooledBuffer = 512 << 10
+
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, 4096)
+	return &b
+}}
+
+// GetBuffer returns an empty buffer from the pool shared by packet writers.
+func GetBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// PutBuffer returns a buffer from GetBuffer to the pool. Store the grown slice in it first, and
+// don't use it afterwards.
+func PutBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBuffer {
+		bufferPool.Put(b)
+	}
+}
@@ -0,0 +1,215 @@
+package mcproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	tests := []struct {
+		value int
+		size  int
+	}{
+		{0, 1}, {1, 1}, {127, 1}, {128, 2}, {255, 2}, {25565, 3}, {2097151, 3}, {2097152, 4},
+		{math.MaxInt32, 5}, {-1, 5}, {math.MinInt32, 5},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteVarInt(&buf, tt.value); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != tt.size || VarIntSize(tt.value) != tt.size {
+			t.Errorf("VarInt %d: %d bytes, VarIntSize %d, want %d", tt.value, buf.Len(), VarIntSize(tt.value), tt.size)
+		}
+		if !bytes.Equal(AppendVarInt(nil, tt.value), buf.Bytes()) {
+			t.Errorf("AppendVarInt(%d) differs from WriteVarInt", tt.value)
+		}
+		got, err := ReadVarInt(&buf)
+		if err != nil || got != tt.value {
+			t.Errorf("VarInt %d read back as %d, %v", tt.value, got, err)
+		}
+
+		buf.Reset()
+		WriteVarIntZigZag(&buf, tt.value)
+		if got, err := ReadVarIntZigZag(&buf); err != nil || got != tt.value {
+			t.Errorf("zigzag VarInt %d read back as %d, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestVarLongRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, math.MaxInt32, math.MaxInt32 + 1, math.MaxInt64, -1, math.MinInt64} {
+		var buf bytes.Buffer
+		if err := WriteVarLong(&buf, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadVarLong(&buf); err != nil || got != v {
+			t.Errorf("VarLong %d read back as %d, %v", v, got, err)
+		}
+		WriteVarLongZigZag(&buf, v)
+		if got, err := ReadVarLongZigZag(&buf); err != nil || got != v {
+			t.Errorf("zigzag VarLong %d read back as %d, %v", v, got, err)
+		}
+	}
+}
+
+func TestReadVarIntMalformed(t *testing.T) {
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{}, io.EOF},
+		{[]byte{0x80}, io.ErrUnexpectedEOF},
+		{[]byte{0x80, 0x00}, ErrVarIntOverlong},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x1F}, ErrVarIntOverflow},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x8F, 0x01}, ErrVarIntTooLong},
+	}
+	for _, tt := range tests {
+		if _, err := ReadVarInt(bytes.NewReader(tt.data)); !errors.Is(err, tt.err) {
+			t.Errorf("ReadVarInt(%x) = %v, want %v", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, s := range []string{"", "Steve", "§bMinewire Proxy Server\n§eSecure Tunnel Active", "日本語", strings.Repeat("x", maxStringBytes)} {
+		var buf bytes.Buffer
+		if err := WriteString(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadString(&buf); err != nil || got != s {
+			t.Errorf("string of %d bytes read back as %d bytes, %v", len(s), len(got), err)
+		}
+	}
+
+	var buf bytes.Buffer
+	WriteString(&buf, strings.Repeat("x", maxStringBytes+1))
+	if _, err := ReadString(&buf); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("over-long string: %v, want %v", err, ErrLengthTooLarge)
+	}
+	if _, err := ReadString(bytes.NewReader([]byte{0x05, 'a'})); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("string longer than the packet: %v, want %v", err, ErrLengthTooLarge)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	bodies := [][]byte{{}, []byte("status"), bytes.Repeat([]byte{0xAB}, minGatheredBody), bytes.Repeat([]byte{0xCD}, 100<<10)}
+	var stream bytes.Buffer
+	for i, body := range bodies {
+		if err := WritePacket(&stream, 0x25+i*100, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, reuse := range []bool{false, true} {
+		packets := NewPacketReader(bytes.NewReader(stream.Bytes()))
+		if reuse {
+			packets.ReuseBuffer()
+		}
+		for i, body := range bodies {
+			id, got, err := packets.ReadPacket()
+			if err != nil || id != 0x25+i*100 || !bytes.Equal(got, body) {
+				t.Errorf("reuse %v: packet %d read back as 0x%X with %d bytes, %v", reuse, i, id, len(got), err)
+			}
+		}
+		if _, _, err := packets.ReadPacket(); err != io.EOF {
+			t.Errorf("reuse %v: after the last packet: %v, want EOF", reuse, err)
+		}
+	}
+
+	packets := NewPacketReader(bytes.NewReader(stream.Bytes()))
+	packets.SetLimits(16, 0)
+	packets.ReadPacket()
+	packets.ReadPacket()
+	if _, _, err := packets.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("packet over the limit: %v, want %v", err, ErrPacketTooLarge)
+	}
+	if err := WritePacket(io.Discard, 0, make([]byte, MaxPacketSize)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("writing a packet over MaxPacketSize: %v, want %v", err, ErrPacketTooLarge)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	p := fuzzPacket{
+		Flag: true, Byte: -1, Short: -300, Port: 25565, Int: -5, Long: 1 << 40, Float: 1.5, Double: -2,
+		Count: -42, Seed: -7, Yaw: 90, Name: "Steve", ID: UUID{1, 2, 3}, Block: Position{X: 1, Y: -2, Z: 3},
+		Mask: BitSet{5, -1}, Tags: Compound{"a": int32(1), "b": []any{"x", "y"}}, Spawn: &Position{X: -8},
+		Names: []string{"a", "b"}, Data: []byte{1, 2, 3}, Rest: []byte("rest"),
+	}
+	data, err := Marshal(p, 773)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got fuzzPacket
+	if err := Unmarshal(data, &got, 773); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("read back as %+v, want %+v", got, p)
+	}
+
+	h := handshake{Protocol: 773, Host: "play.example.com", Port: 25565, NextState: 2}
+	data, _ = Marshal(h, 773)
+	var gotHandshake handshake
+	if err := Unmarshal(data, &gotHandshake, 773); err != nil || gotHandshake != h {
+		t.Errorf("handshake read back as %+v, %v, want %+v", gotHandshake, err, h)
+	}
+	if err := Unmarshal(append(data, 0), &gotHandshake, 773); err == nil {
+		t.Error("trailing byte accepted")
+	}
+}
+
+func TestStatusRoundTrip(t *testing.T) {
+	previews := false
+	status := StatusResponse{
+		Version:      Version{Name: "1.21.10", Protocol: 773},
+		Players:      Players{Max: 20, Online: 7, Sample: []interface{}{map[string]interface{}{"name": "Steve", "id": "00000000-0000-4000-8000-000000000000"}}},
+		Description:  Description{Text: "§bMinewire"},
+		Favicon:      "data:image/png;base64,AAAA",
+		PreviewsChat: &previews,
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	WritePacket(&buf, 0x00, append(AppendVarInt(nil, len(data)), data...))
+
+	id, body, err := NewPacketReader(&buf).ReadPacket()
+	if err != nil || id != 0x00 {
+		t.Fatalf("status packet read back as 0x%X, %v", id, err)
+	}
+	text, err := ReadString(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got StatusResponse
+	if err := json.Unmarshal([]byte(text), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, status) {
+		t.Errorf("read back as %+v, want %+v", got, status)
+	}
+	if empty, _ := json.Marshal(StatusResponse{}); strings.Contains(string(empty), "previewsChat") {
+		t.Errorf("previewsChat sent without being set: %s", empty)
+	}
+}
+
+func TestLegacyKickRoundTrip(t *testing.T) {
+	for _, format := range []int{0, 1} {
+		s := LegacyStatus(format, "1.21.10", "A Minecraft Server §", 7, 20)
+		var buf bytes.Buffer
+		if err := WriteLegacyKick(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadLegacyKick(&buf); err != nil || got != s {
+			t.Errorf("format %d: read back as %q, %v, want %q", format, got, err, s)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package mcproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"unicode/utf16"
+)
+
+// NBT tag types
+const (
+	TagEnd byte = iota
+	TagByte
+	TagShort
+	TagInt
+	TagLong
+	TagFloat
+	TagDouble
+	TagByteArray
+	TagString
+	TagList
+	TagCompound
+	TagIntArray
+	TagLongArray
+)
+
+// Compound is an NBT compound tag. Values are int8, int16, int32, int64, float32, float64,
+// []byte, string, []any (a list, all of one type), Compound, []int32 or []int64.
+type Compound map[string]any
+
+// Limits of decoded NBT, so crafted packets can't exhaust memory or the stack
+const (
+	maxNBTDepth    = 512
+	maxNBTElements = 1 << 20
+)
+
+// WriteNBT writes a compound as a named root tag, the form of NBT files and of packets before
+// protocol 764 (1.20.2).
+func WriteNBT(w io.Writer, name string, c Compound) error {
+	pw := NewPacketWriter(w)
+	pw.Byte(TagCompound)
+	pw.StringNBT(name)
+	if err := writeNBTPayload(pw, c, 0); err != nil {
+		return err
+	}
+	return pw.Err()
+}
+
+// WriteNetworkNBT writes a compound as a nameless root tag, the form of packets since 1.20.2.
+func WriteNetworkNBT(w io.Writer, c Compound) error {
+	pw := NewPacketWriter(w)
+	pw.Byte(TagCompound)
+	if err := writeNBTPayload(pw, c, 0); err != nil {
+		return err
+	}
+	return pw.Err()
+}
+
+// nbtType returns the tag type of a Go value.
+func nbtType(v any) (byte, error) {
+	switch v.(type) {
+	case int8:
+		return TagByte, nil
+	case int16:
+		return TagShort, nil
+	case int32:
+		return TagInt, nil
+	case int64:
+		return TagLong, nil
+	case float32:
+		return TagFloat, nil
+	case float64:
+		return TagDouble, nil
+	case []byte:
+		return TagByteArray, nil
+	case string:
+		return TagString, nil
+	case []any:
+		return TagList, nil
+	case Compound:
+		return TagCompound, nil
+	case []int32:
+		return TagIntArray, nil
+	case []int64:
+		return TagLongArray, nil
+	}
+	return 0, fmt.Errorf("nbt: unsupported type %T", v)
+}
+
+// writeNBTPayload writes the payload of a tag, without its type and name. It returns encoding
+// errors; write errors are latched in w.
+func writeNBTPayload(w *PacketWriter, v any, depth int) error {
+	if depth > maxNBTDepth {
+		return errors.New("nbt: nested too deeply")
+	}
+	switch v := v.(type) {
+	case int8:
+		w.Byte(byte(v))
+	case int16:
+		w.Short(v)
+	case int32:
+		w.Int(v)
+	case int64:
+		w.Long(v)
+	case float32:
+		w.Float(v)
+	case float64:
+		w.Double(v)
+	case []byte:
+		w.Int(int32(len(v)))
+		w.Raw(v)
+	case string:
+		w.StringNBT(v)
+	case []any:
+		elem := TagEnd // Type of an empty list
+		if len(v) > 0 {
+			var err error
+			if elem, err = nbtType(v[0]); err != nil {
+				return err
+			}
+		}
+		w.Byte(elem)
+		w.Int(int32(len(v)))
+		for _, e := range v {
+			if t, err := nbtType(e); err != nil || t != elem {
+				return errors.New("nbt: list elements must all have the same type")
+			}
+			if err := writeNBTPayload(w, e, depth+1); err != nil {
+				return err
+			}
+		}
+	case Compound:
+		// Sorted, so the same compound always encodes to the same bytes
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			t, err := nbtType(v[name])
+			if err != nil {
+				return err
+			}
+			w.Byte(t)
+			w.StringNBT(name)
+			if err := writeNBTPayload(w, v[name], depth+1); err != nil {
+				return err
+			}
+		}
+		w.Byte(TagEnd)
+	case []int32:
+		w.Int(int32(len(v)))
+		for _, e := range v {
+			w.Int(e)
+		}
+	case []int64:
+		w.Int(int32(len(v)))
+		for _, e := range v {
+			w.Long(e)
+		}
+	default:
+		return fmt.Errorf("nbt: unsupported type %T", v)
+	}
+	return nil
+}
+
+// ReadNBT reads a named root compound written by WriteNBT.
+func ReadNBT(r io.Reader) (string, Compound, error) {
+	if t, err := ReadByte(r); err != nil {
+		return "", nil, err
+	} else if t != TagCompound {
+		return "", nil, fmt.Errorf("nbt: root tag %d is not a compound", t)
+	}
+	name, err := ReadStringNBT(r)
+	if err != nil {
+		return "", nil, err
+	}
+	v, err := readNBTPayload(r, TagCompound, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, v.(Compound), nil
+}
+
+// ReadNetworkNBT reads a nameless root compound written by WriteNetworkNBT.
+func ReadNetworkNBT(r io.Reader) (Compound, error) {
+	if t, err := ReadByte(r); err != nil {
+		return nil, err
+	} else if t != TagCompound {
+		return nil, fmt.Errorf("nbt: root tag %d is not a compound", t)
+	}
+	v, err := readNBTPayload(r, TagCompound, 0)
+	if err != nil {
+		return nil, err
+	}
+	return v.(Compound), nil
+}
+
+// readNBTLength reads the Int length of an array or list of elements at least elemSize bytes
+// long, bounded by the bytes left in r when it knows them.
+func readNBTLength(r io.Reader, elemSize int) (int, error) {
+	n, err := ReadInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, ErrNegativeLength
+	}
+	if n > maxNBTElements {
+		return 0, ErrLengthTooLarge
+	}
+	if left, ok := remaining(r); ok && int(n)*elemSize > left {
+		return 0, ErrLengthTooLarge
+	}
+	return int(n), nil
+}
+
+// readNBTPayload reads the payload of a tag of type t.
+func readNBTPayload(r io.Reader, t byte, depth int) (any, error) {
+	if depth > maxNBTDepth {
+		return nil, errors.New("nbt: nested too deeply")
+	}
+	switch t {
+	case TagByte:
+		b, err := ReadByte(r)
+		return int8(b), err
+	case TagShort:
+		return ReadShort(r)
+	case TagInt:
+		return ReadInt(r)
+	case TagLong:
+		return ReadLong(r)
+	case TagFloat:
+		return ReadFloat(r)
+	case TagDouble:
+		return ReadDouble(r)
+	case TagByteArray:
+		n, err := readNBTLength(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	case TagString:
+		return ReadStringNBT(r)
+	case TagList:
+		elem, err := ReadByte(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readNBTLength(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, 0, min(n, 1024))
+		for range n {
+			e, err := readNBTPayload(r, elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+		}
+		return list, nil
+	case TagCompound:
+		c := make(Compound)
+		for {
+			t, err := ReadByte(r)
+			if err != nil {
+				return nil, err
+			}
+			if t == TagEnd {
+				return c, nil
+			}
+			name, err := ReadStringNBT(r)
+			if err != nil {
+				return nil, err
+			}
+			if c[name], err = readNBTPayload(r, t, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	case TagIntArray:
+		n, err := readNBTLength(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]int32, 0, min(n, 1024))
+		for range n {
+			v, err := ReadInt(r)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case TagLongArray:
+		n, err := readNBTLength(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]int64, 0, min(n, 1024))
+		for range n {
+			v, err := ReadLong(r)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("nbt: unknown tag type %d", t)
+}
+
+// WriteStringNBT writes an NBT string: [Short Length][Modified UTF-8 Bytes].
+// Modified UTF-8 encodes NUL as two bytes and supplementary characters as surrogate pairs.
+func WriteStringNBT(w io.Writer, s string) error {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == 0:
+			b = append(b, 0xC0, 0x80)
+		case r >= 0x10000:
+			hi, lo := utf16.EncodeRune(r)
+			b = appendModifiedUTF8(b, hi)
+			b = appendModifiedUTF8(b, lo)
+		default:
+			b = appendModifiedUTF8(b, r)
+		}
+	}
+	if len(b) > 0xFFFF {
+		return errors.New("nbt: string longer than 65535 bytes")
+	}
+	b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...) // Short Len
+	_, err := w.Write(b)
+	return err
+}
+
+// appendModifiedUTF8 encodes a single UTF-16 code unit
+func appendModifiedUTF8(b []byte, r rune) []byte {
+	switch {
+	case r < 0x80:
+		return append(b, byte(r))
+	case r < 0x800:
+		return append(b, 0xC0|byte(r>>6), 0x80|byte(r&0x3F))
+	default:
+		return append(b, 0xE0|byte(r>>12), 0x80|byte((r>>6)&0x3F), 0x80|byte(r&0x3F))
+	}
+}
+
+// ReadStringNBT reads an NBT string written by WriteStringNBT.
+func ReadStringNBT(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	units := make([]uint16, 0, len(b))
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			units = append(units, uint16(c))
+			i++
+		case c&0xE0 == 0xC0 && i+1 < len(b):
+			units = append(units, uint16(c&0x1F)<<6|uint16(b[i+1]&0x3F))
+			i += 2
+		case c&0xF0 == 0xE0 && i+2 < len(b):
+			units = append(units, uint16(c&0x0F)<<12|uint16(b[i+1]&0x3F)<<6|uint16(b[i+2]&0x3F))
+			i += 3
+		default:
+			return "", errors.New("nbt: invalid modified UTF-8")
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,365 @@
+package mcproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Packet is a declarative packet definition: a struct whose exported fields are encoded in
+// declaration order by Marshal.
+//
+// Fields are encoded by their Go type: bool, int8/uint8 (Byte), int16/uint16 (Short), int32
+// (Int), int64 (Long), float32, float64, int (VarInt), string, UUID, Position, BitSet, Compound
+// (network NBT), nested structs, and slices (a VarInt count followed by the elements; []byte is
+// a VarInt-prefixed byte array). An `mc` struct tag changes the encoding and limits the field to
+// a range of protocol versions:
+//
+//	Seed      int64   `mc:"varlong"`      // VarLong instead of Long
+//	Yaw       float32 `mc:"angle"`        // Angle byte instead of Float
+//	Death     *Loc    `mc:"optional"`     // Boolean, then the value if true
+//	Data      []byte  `mc:"rest"`         // The rest of the packet, without a length
+//	SeaLevel  int     `mc:",since=768"`   // Only in protocol 768 and later
+//	Flags     int8    `mc:",before=768"`  // Only before protocol 768
+type Packet interface {
+	PacketKind() PacketKind
+}
+
+// SendPacket marshals p for the protocol version and writes it with its ID in that version.
+func SendPacket(w io.Writer, proto Protocol, p Packet) error {
+	id := proto.ID(p.PacketKind())
+	if id < 0 {
+		return fmt.Errorf("mcproto: %T does not exist in protocol %d", p, proto.Version)
+	}
+	data, err := Marshal(p, proto.Version)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, id, data)
+}
+
+// Marshal encodes the fields of the struct v (or a pointer to it) for protocol version.
+func Marshal(v any, version int) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("mcproto: cannot marshal %T", v)
+	}
+	buf := new(bytes.Buffer)
+	if err := marshalStruct(buf, rv, version); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes data for protocol version into the struct pointed to by v. Data left over
+// after the last field is an error.
+func Unmarshal(data []byte, v any, version int) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("mcproto: cannot unmarshal into %T", v)
+	}
+	r := bytes.NewReader(data)
+	if err := unmarshalStruct(r, rv.Elem(), version); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("mcproto: %d bytes left after %s", r.Len(), rv.Elem().Type().Name())
+	}
+	return nil
+}
+
+// fieldTag is a parsed `mc` struct tag
+type fieldTag struct {
+	kind          string
+	since, before int // Version range, 0 = unbounded
+}
+
+func parseFieldTag(f reflect.StructField) (fieldTag, error) {
+	var t fieldTag
+	parts := strings.Split(f.Tag.Get("mc"), ",")
+	t.kind = parts[0]
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return t, fmt.Errorf("mcproto: field %s: bad tag option %q", f.Name, p)
+		}
+		switch k {
+		case "since":
+			t.since = n
+		case "before":
+			t.before = n
+		default:
+			return t, fmt.Errorf("mcproto: field %s: unknown tag option %q", f.Name, k)
+		}
+	}
+	return t, nil
+}
+
+// in reports whether a field with this tag is present in protocol version.
+func (t fieldTag) in(version int) bool {
+	return (t.since == 0 || version >= t.since) && (t.before == 0 || version < t.before)
+}
+
+var (
+	uuidType     = reflect.TypeFor[UUID]()
+	positionType = reflect.TypeFor[Position]()
+	bitSetType   = reflect.TypeFor[BitSet]()
+	compoundType = reflect.TypeFor[Compound]()
+)
+
+func marshalStruct(w *bytes.Buffer, v reflect.Value, version int) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag, err := parseFieldTag(f)
+		if err != nil {
+			return err
+		}
+		if !tag.in(version) {
+			continue
+		}
+		if err := marshalValue(w, v.Field(i), tag.kind, version); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func marshalValue(w *bytes.Buffer, v reflect.Value, kind string, version int) error {
+	switch kind {
+	case "varint":
+		return WriteVarInt(w, int(v.Int()))
+	case "varlong":
+		return WriteVarLong(w, v.Int())
+	case "angle":
+		return WriteAngle(w, float32(v.Float()))
+	case "optional":
+		if v.Kind() != reflect.Pointer {
+			return fmt.Errorf("optional field of type %s is not a pointer", v.Type())
+		}
+		if err := WriteBool(w, !v.IsNil()); err != nil || v.IsNil() {
+			return err
+		}
+		return marshalValue(w, v.Elem(), "", version)
+	case "rest":
+		_, err := w.Write(v.Bytes())
+		return err
+	case "":
+	default:
+		return fmt.Errorf("unknown encoding %q", kind)
+	}
+
+	switch v.Type() {
+	case uuidType:
+		return WriteUUID(w, v.Interface().(UUID))
+	case positionType:
+		return WritePosition(w, v.Interface().(Position))
+	case bitSetType:
+		return WriteBitSet(w, v.Interface().(BitSet))
+	case compoundType:
+		return WriteNetworkNBT(w, v.Interface().(Compound))
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return WriteBool(w, v.Bool())
+	case reflect.Int8:
+		return WriteByte(w, byte(v.Int()))
+	case reflect.Uint8:
+		return WriteByte(w, byte(v.Uint()))
+	case reflect.Int16:
+		return WriteShort(w, int16(v.Int()))
+	case reflect.Uint16:
+		return WriteShort(w, int16(v.Uint()))
+	case reflect.Int32:
+		return WriteInt(w, int32(v.Int()))
+	case reflect.Int64:
+		return WriteLong(w, v.Int())
+	case reflect.Int:
+		return WriteVarInt(w, int(v.Int()))
+	case reflect.Float32:
+		return WriteFloat(w, float32(v.Float()))
+	case reflect.Float64:
+		return WriteDouble(w, v.Float())
+	case reflect.String:
+		return WriteString(w, v.String())
+	case reflect.Struct:
+		return marshalStruct(w, v, version)
+	case reflect.Slice:
+		if err := WriteVarInt(w, v.Len()); err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			_, err := w.Write(v.Bytes())
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := marshalValue(w, v.Index(i), "", version); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func unmarshalStruct(r *bytes.Reader, v reflect.Value, version int) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag, err := parseFieldTag(f)
+		if err != nil {
+			return err
+		}
+		if !tag.in(version) {
+			continue
+		}
+		if err := unmarshalValue(r, v.Field(i), tag.kind, version); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// readCount reads a VarInt element count. Every element takes at least a byte, so a count
+// beyond the rest of the packet is malformed.
+func readCount(r *bytes.Reader) (int, error) {
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > r.Len() {
+		return 0, errors.New("length exceeds packet")
+	}
+	return n, nil
+}
+
+func unmarshalValue(r *bytes.Reader, v reflect.Value, kind string, version int) error {
+	switch kind {
+	case "varint":
+		n, err := ReadVarInt(r)
+		v.SetInt(int64(n))
+		return err
+	case "varlong":
+		n, err := ReadVarLong(r)
+		v.SetInt(n)
+		return err
+	case "angle":
+		a, err := ReadAngle(r)
+		v.SetFloat(float64(a))
+		return err
+	case "optional":
+		if v.Kind() != reflect.Pointer {
+			return fmt.Errorf("optional field of type %s is not a pointer", v.Type())
+		}
+		present, err := ReadBool(r)
+		if err != nil || !present {
+			return err
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return unmarshalValue(r, v.Elem(), "", version)
+	case "rest":
+		b, err := ReadBytes(r, r.Len())
+		v.SetBytes(b)
+		return err
+	case "":
+	default:
+		return fmt.Errorf("unknown encoding %q", kind)
+	}
+
+	var x any
+	var err error
+	switch v.Type() {
+	case uuidType:
+		x, err = ReadUUID(r)
+	case positionType:
+		x, err = ReadPosition(r)
+	case bitSetType:
+		x, err = ReadBitSet(r, r.Len()/8)
+	case compoundType:
+		x, err = ReadNetworkNBT(r)
+	}
+	if x != nil || err != nil {
+		if err == nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := ReadBool(r)
+		v.SetBool(b)
+		return err
+	case reflect.Int8:
+		b, err := ReadByte(r)
+		v.SetInt(int64(int8(b)))
+		return err
+	case reflect.Uint8:
+		b, err := ReadByte(r)
+		v.SetUint(uint64(b))
+		return err
+	case reflect.Int16:
+		n, err := ReadShort(r)
+		v.SetInt(int64(n))
+		return err
+	case reflect.Uint16:
+		n, err := ReadShort(r)
+		v.SetUint(uint64(uint16(n)))
+		return err
+	case reflect.Int32:
+		n, err := ReadInt(r)
+		v.SetInt(int64(n))
+		return err
+	case reflect.Int64:
+		n, err := ReadLong(r)
+		v.SetInt(n)
+		return err
+	case reflect.Int:
+		n, err := ReadVarInt(r)
+		v.SetInt(int64(n))
+		return err
+	case reflect.Float32:
+		f, err := ReadFloat(r)
+		v.SetFloat(float64(f))
+		return err
+	case reflect.Float64:
+		f, err := ReadDouble(r)
+		v.SetFloat(f)
+		return err
+	case reflect.String:
+		s, err := ReadString(r)
+		v.SetString(s)
+		return err
+	case reflect.Struct:
+		return unmarshalStruct(r, v, version)
+	case reflect.Slice:
+		n, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := ReadBytes(r, n)
+			v.SetBytes(b)
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := unmarshalValue(r, s.Index(i), "", version); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return fmt.Errorf("unsupported type %s", v.Type())
+}
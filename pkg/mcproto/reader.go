@@ -0,0 +1,173 @@
+package mcproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+// ErrEmptyPacket is a packet whose length doesn't even cover its ID
+var ErrEmptyPacket = errors.New("packet without an ID")
+
+// maxReusedPayload is the largest payload read into the buffer of ReuseBuffer. Larger packets
+// get their own, so a connection doesn't keep a burst's worth of memory afterwards.
+const maxReusedPayload = 64 << 10
+
+// PacketReader reads uncompressed packets from a connection. It owns the buffered reader, so
+// every packet of a connection should be read through the same PacketReader.
+type PacketReader struct {
+	r        *bufio.Reader
+	deadline interface{ SetReadDeadline(time.Time) error } // Nil if the reader has no deadlines
+	maxSize  int
+	timeout  time.Duration
+	reuse    bool
+	buf      []byte // Payload buffer of ReuseBuffer
+}
+
+// NewPacketReader returns a PacketReader reading from r, accepting packets up to MaxPacketSize
+// without a deadline. Read deadlines are applied when r is a net.Conn or similar.
+func NewPacketReader(r io.Reader) *PacketReader {
+	p := &PacketReader{maxSize: MaxPacketSize}
+	p.deadline, _ = r.(interface{ SetReadDeadline(time.Time) error })
+	if br, ok := r.(*bufio.Reader); ok {
+		p.r = br
+	} else {
+		p.r = bufio.NewReader(r)
+	}
+	return p
+}
+
+// SetLimits sets the largest packet ReadPacket accepts and how long each packet may take to
+// arrive, 0 for no deadline.
+func (p *PacketReader) SetLimits(maxSize int, timeout time.Duration) {
+	p.maxSize = maxSize
+	if p.timeout > 0 && timeout == 0 && p.deadline != nil {
+		p.deadline.SetReadDeadline(time.Time{})
+	}
+	p.timeout = timeout
+}
+
+// ReuseBuffer makes ReadPacket read payloads into a buffer it reuses, saving an allocation per
+// packet on busy connections: a payload is then only valid until the next ReadPacket.
+func (p *PacketReader) ReuseBuffer() {
+	p.reuse = true
+}
+
+// setDeadline starts the timeout of the next read.
+func (p *PacketReader) setDeadline() {
+	if p.timeout > 0 && p.deadline != nil {
+		p.deadline.SetReadDeadline(time.Now().Add(p.timeout))
+	}
+}
+
+// PeekByte waits for the next byte without consuming it, e.g. to tell a legacy ping from a
+// packet.
+func (p *PacketReader) PeekByte() (byte, error) {
+	p.setDeadline()
+	b, err := p.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Peek waits for the next n bytes without consuming them, e.g. to recognize the protocol of a
+// connection. It returns fewer bytes along with the error that ended the wait.
+func (p *PacketReader) Peek(n int) ([]byte, error) {
+	p.setDeadline()
+	return p.r.Peek(n)
+}
+
+// Buffered returns the bytes read from the connection but not consumed yet, e.g. to hand the
+// connection over to another server. They are only valid until the next read.
+func (p *PacketReader) Buffered() []byte {
+	b, _ := p.r.Peek(p.r.Buffered())
+	return b
+}
+
+// ReadLegacyPing consumes the server list ping of a client before 1.7, which starts with
+// LegacyPingMagic instead of a packet length. It returns the format of the request: 0 for
+// Beta 1.8-1.3 (the magic alone), 1 for 1.4-1.6 (0x01 after it, and a MC|PingHost plugin
+// message since 1.6).
+func (p *PacketReader) ReadLegacyPing() (int, error) {
+	if b, err := p.r.ReadByte(); err != nil {
+		return 0, err
+	} else if b != LegacyPingMagic {
+		return 0, errors.New("not a legacy ping")
+	}
+	// Old clients send the request in one write: a missing 0x01 is the oldest format
+	if p.r.Buffered() == 0 {
+		return 0, nil
+	}
+	if b, err := p.r.ReadByte(); err != nil || b != 0x01 {
+		return 0, err
+	}
+	if p.r.Buffered() == 0 {
+		return 1, nil
+	}
+	if b, err := p.r.ReadByte(); err != nil || b != 0xFA {
+		return 1, err
+	}
+	// MC|PingHost: the channel as a UTF-16 string, then the data with its length
+	var n uint16
+	if err := binary.Read(p.r, binary.BigEndian, &n); err != nil {
+		return 1, err
+	}
+	if _, err := p.r.Discard(int(n) * 2); err != nil {
+		return 1, err
+	}
+	if err := binary.Read(p.r, binary.BigEndian, &n); err != nil {
+		return 1, err
+	}
+	if int(n) > p.maxSize {
+		return 1, ErrPacketTooLarge
+	}
+	_, err := p.r.Discard(int(n))
+	return 1, err
+}
+
+// ReadPacket reads the next packet and returns its ID and payload. Packets beyond the size
+// limit fail with ErrPacketTooLarge before their payload is read.
+func (p *PacketReader) ReadPacket() (int, []byte, error) {
+	p.setDeadline()
+	length, err := ReadVarInt(p.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 1 {
+		return 0, nil, ErrEmptyPacket
+	}
+	if length > p.maxSize {
+		return 0, nil, ErrPacketTooLarge
+	}
+	id, err := ReadVarInt(p.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	n := length - VarIntSize(id) // Shortest encoding, ReadVarInt rejects others
+	if n < 0 {
+		return 0, nil, io.ErrUnexpectedEOF // The ID runs past the end of the packet
+	}
+
+	if p.reuse && n <= maxReusedPayload {
+		p.buf = slices.Grow(p.buf[:0], n)[:n]
+		if _, err := io.ReadFull(p.r, p.buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
+		return id, p.buf, nil
+	}
+	payload, err := ReadBytes(p.r, n)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
@@ -0,0 +1,86 @@
+package mcproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+// StatusResponse is the JSON document of a status response, as a vanilla server sends it.
+type StatusResponse struct {
+	Version     Version     `json:"version"`
+	Players     Players     `json:"players"`
+	Description Description `json:"description"`
+	Favicon     string      `json:"favicon,omitempty"`
+
+	EnforcesSecureChat bool  `json:"enforcesSecureChat"`
+	PreviewsChat       *bool `json:"previewsChat,omitempty"` // Only sent by 1.19-1.19.2 servers
+}
+
+// Version is the game version and protocol number a server reports.
+type Version struct {
+	Name     string `json:"name"`
+	Protocol int    `json:"protocol"`
+}
+
+// Players is the player count and sample a server reports.
+type Players struct {
+	Max    int           `json:"max"`
+	Online int           `json:"online"`
+	Sample []interface{} `json:"sample,omitempty"`
+}
+
+// Description is the MOTD of a server.
+type Description struct {
+	Text string `json:"text"`
+}
+
+// LegacyPingMagic is the first byte of the server list ping of clients before 1.7
+const LegacyPingMagic = 0xFE
+
+// legacyKickID is the Disconnect packet of the pre-1.7 protocol, which carries the response
+const legacyKickID = 0xFF
+
+// LegacyStatus returns the response to a legacy ping of the given format (see
+// PacketReader.ReadLegacyPing), exactly as vanilla servers answer it.
+func LegacyStatus(format int, version, motd string, online, max int) string {
+	if format == 0 {
+		return fmt.Sprintf("%s§%d§%d", motd, online, max)
+	}
+	return fmt.Sprintf("§1\x00%d\x00%s\x00%s\x00%d\x00%d", 127, version, motd, online, max)
+}
+
+// WriteLegacyKick writes a pre-1.7 Disconnect packet: the ID, the length in UTF-16 code units
+// and the UTF-16BE text.
+func WriteLegacyKick(w io.Writer, s string) error {
+	units := utf16.Encode([]rune(s))
+	if len(units) > 0xFFFF {
+		return fmt.Errorf("legacy kick of %d characters", len(units))
+	}
+	b := make([]byte, 3, 3+2*len(units))
+	b[0] = legacyKickID
+	binary.BigEndian.PutUint16(b[1:], uint16(len(units)))
+	for _, u := range units {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadLegacyKick reads a pre-1.7 Disconnect packet and returns its text.
+func ReadLegacyKick(r io.Reader) (string, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != legacyKickID {
+		return "", errors.New("not a legacy kick")
+	}
+	units := make([]uint16, binary.BigEndian.Uint16(head[1:]))
+	if err := binary.Read(r, binary.BigEndian, units); err != nil {
+		return "", err
+	}
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,193 @@
+package mcproto
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// ReadVarLong reads a variable-length 64-bit integer (1-10 bytes).
+func ReadVarLong(r io.ByteReader) (int64, error) {
+	v, err := readVarUint(r, 10)
+	return int64(v), err
+}
+
+// WriteVarLong writes a variable-length 64-bit integer.
+func WriteVarLong(w io.Writer, value int64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(appendVarUint(buf[:0], uint64(value)))
+	return err
+}
+
+// ReadVarLongZigZag reads a VarLong holding a zigzag-encoded signed integer.
+func ReadVarLongZigZag(r io.ByteReader) (int64, error) {
+	v, err := readVarUint(r, 10)
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+// WriteVarLongZigZag writes a zigzag-encoded signed integer as a VarLong.
+func WriteVarLongZigZag(w io.Writer, value int64) error {
+	return WriteVarLong(w, int64(uint64(value<<1)^uint64(value>>63)))
+}
+
+// ReadBool reads a boolean byte; any non-zero value is true.
+func ReadBool(r io.Reader) (bool, error) {
+	b, err := ReadByte(r)
+	return b != 0, err
+}
+
+// ReadByte reads a single byte.
+func ReadByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// WriteShort writes a big-endian 16-bit integer.
+func WriteShort(w io.Writer, v int16) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// ReadShort reads a big-endian 16-bit integer.
+func ReadShort(r io.Reader) (int16, error) {
+	var v int16
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+// ReadInt reads a big-endian 32-bit integer.
+func ReadInt(r io.Reader) (int32, error) {
+	var v int32
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+// ReadLong reads a big-endian 64-bit integer.
+func ReadLong(r io.Reader) (int64, error) {
+	var v int64
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+// ReadFloat reads a big-endian 32-bit float.
+func ReadFloat(r io.Reader) (float32, error) {
+	var v float32
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+// ReadDouble reads a big-endian 64-bit float.
+func ReadDouble(r io.Reader) (float64, error) {
+	var v float64
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+// UUID is a 128-bit UUID, sent as two big-endian longs.
+type UUID [16]byte
+
+// WriteUUID writes a UUID.
+func WriteUUID(w io.Writer, u UUID) error {
+	_, err := w.Write(u[:])
+	return err
+}
+
+// ReadUUID reads a UUID.
+func ReadUUID(r io.Reader) (UUID, error) {
+	var u UUID
+	_, err := io.ReadFull(r, u[:])
+	return u, err
+}
+
+// Position is a block position, packed into a long as x (26 bits), z (26 bits), y (12 bits).
+type Position struct {
+	X, Y, Z int
+}
+
+// Pack returns the long encoding of p.
+func (p Position) Pack() int64 {
+	return int64(p.X&0x3FFFFFF)<<38 | int64(p.Z&0x3FFFFFF)<<12 | int64(p.Y&0xFFF)
+}
+
+// UnpackPosition decodes a packed position, sign-extending each coordinate.
+func UnpackPosition(v int64) Position {
+	return Position{X: int(v >> 38), Y: int(v << 52 >> 52), Z: int(v << 26 >> 38)}
+}
+
+// WritePosition writes a packed block position.
+func WritePosition(w io.Writer, p Position) error {
+	return WriteLong(w, p.Pack())
+}
+
+// ReadPosition reads a packed block position.
+func ReadPosition(r io.Reader) (Position, error) {
+	v, err := ReadLong(r)
+	return UnpackPosition(v), err
+}
+
+// WriteAngle writes a rotation in degrees as a byte of 1/256 turns.
+func WriteAngle(w io.Writer, degrees float32) error {
+	turns := math.Mod(float64(degrees)/360, 1)
+	return WriteByte(w, byte(int(math.Round(turns*256))))
+}
+
+// ReadAngle reads a rotation of 1/256 turns and returns it in degrees, in [0, 360).
+func ReadAngle(r io.Reader) (float32, error) {
+	b, err := ReadByte(r)
+	return float32(b) * 360 / 256, err
+}
+
+// BitSet is a set of bits sent as a VarInt-prefixed array of longs, bit i in long i/64.
+type BitSet []int64
+
+// Set sets bit i, growing the set as needed.
+func (b *BitSet) Set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+// Has reports whether bit i is set.
+func (b BitSet) Has(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+// WriteBitSet writes a bit set.
+func WriteBitSet(w io.Writer, b BitSet) error {
+	if err := WriteVarInt(w, len(b)); err != nil {
+		return err
+	}
+	for _, l := range b {
+		if err := WriteLong(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadBitSet reads a bit set of at most maxLongs longs.
+func ReadBitSet(r io.Reader, maxLongs int) (BitSet, error) {
+	n, err := ReadLength(asByteReader(r), maxLongs)
+	if err != nil {
+		return nil, err
+	}
+	if left, ok := remaining(r); ok && n*8 > left {
+		return nil, ErrLengthTooLarge
+	}
+	b := make(BitSet, n)
+	for i := range b {
+		if b[i], err = ReadLong(r); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// asByteReader returns r as an io.ByteReader, wrapping it if it isn't one.
+func asByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return &byteReaderAdapter{r: r}
+}
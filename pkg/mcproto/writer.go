@@ -0,0 +1,139 @@
+package mcproto
+
+import (
+	"bytes"
+	"io"
+)
+
+// PacketWriter writes protocol values and latches the first error: once a write fails, later
+// writes do nothing, so a packet can be written with a run of calls and checked once with Err.
+type PacketWriter struct {
+	w   io.Writer
+	buf *bytes.Buffer // Set by NewPacketBuffer
+	err error
+}
+
+// NewPacketWriter returns a PacketWriter writing to w.
+func NewPacketWriter(w io.Writer) *PacketWriter {
+	return &PacketWriter{w: w}
+}
+
+// NewPacketBuffer returns a PacketWriter collecting a packet body in memory, returned by Body.
+func NewPacketBuffer() *PacketWriter {
+	buf := new(bytes.Buffer)
+	return &PacketWriter{w: buf, buf: buf}
+}
+
+// Err returns the first error a write returned.
+func (p *PacketWriter) Err() error {
+	return p.err
+}
+
+// Body returns the bytes written to a PacketWriter from NewPacketBuffer, and the first error.
+func (p *PacketWriter) Body() ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.buf.Bytes(), nil
+}
+
+// do runs a write unless an earlier one failed, and latches its error.
+func (p *PacketWriter) do(write func(io.Writer) error) {
+	if p.err == nil {
+		p.err = write(p.w)
+	}
+}
+
+// Write writes raw bytes, implementing io.Writer.
+func (p *PacketWriter) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.w.Write(b)
+	p.err = err
+	return n, err
+}
+
+// Raw writes bytes without a length.
+func (p *PacketWriter) Raw(b []byte) { p.Write(b) }
+
+// ByteArray writes a VarInt-prefixed byte array.
+func (p *PacketWriter) ByteArray(b []byte) {
+	p.VarInt(len(b))
+	p.Write(b)
+}
+
+func (p *PacketWriter) VarInt(v int) {
+	p.do(func(w io.Writer) error { return WriteVarInt(w, v) })
+}
+
+func (p *PacketWriter) VarLong(v int64) {
+	p.do(func(w io.Writer) error { return WriteVarLong(w, v) })
+}
+
+func (p *PacketWriter) String(s string) {
+	p.do(func(w io.Writer) error { return WriteString(w, s) })
+}
+
+func (p *PacketWriter) Bool(b bool) {
+	p.do(func(w io.Writer) error { return WriteBool(w, b) })
+}
+
+func (p *PacketWriter) Byte(b byte) {
+	p.do(func(w io.Writer) error { return WriteByte(w, b) })
+}
+
+func (p *PacketWriter) Short(v int16) {
+	p.do(func(w io.Writer) error { return WriteShort(w, v) })
+}
+
+func (p *PacketWriter) Int(v int32) {
+	p.do(func(w io.Writer) error { return WriteInt(w, v) })
+}
+
+func (p *PacketWriter) Long(v int64) {
+	p.do(func(w io.Writer) error { return WriteLong(w, v) })
+}
+
+func (p *PacketWriter) Float(v float32) {
+	p.do(func(w io.Writer) error { return WriteFloat(w, v) })
+}
+
+func (p *PacketWriter) Double(v float64) {
+	p.do(func(w io.Writer) error { return WriteDouble(w, v) })
+}
+
+func (p *PacketWriter) UUID(u UUID) {
+	p.do(func(w io.Writer) error { return WriteUUID(w, u) })
+}
+
+func (p *PacketWriter) Position(pos Position) {
+	p.do(func(w io.Writer) error { return WritePosition(w, pos) })
+}
+
+func (p *PacketWriter) Angle(degrees float32) {
+	p.do(func(w io.Writer) error { return WriteAngle(w, degrees) })
+}
+
+func (p *PacketWriter) BitSet(b BitSet) {
+	p.do(func(w io.Writer) error { return WriteBitSet(w, b) })
+}
+
+func (p *PacketWriter) StringNBT(s string) {
+	p.do(func(w io.Writer) error { return WriteStringNBT(w, s) })
+}
+
+// NetworkNBT writes a compound as nameless NBT.
+func (p *PacketWriter) NetworkNBT(c Compound) {
+	p.do(func(w io.Writer) error { return WriteNetworkNBT(w, c) })
+}
+
+// Packet writes a framed packet with the given ID and body.
+func (p *PacketWriter) Packet(packetID int, data []byte) {
+	p.do(func(w io.Writer) error { return WritePacket(w, packetID, data) })
+}
+
+// Send writes a packet marshaled for the protocol version, like SendPacket.
+func (p *PacketWriter) Send(proto Protocol, pk Packet) {
+	p.do(func(w io.Writer) error { return SendPacket(w, proto, pk) })
+}
@@ -0,0 +1,183 @@
+// Package mobile binds the Minewire client for Android and iOS apps with gomobile:
+//
+//	gomobile bind -target android -o minewire.aar ./pkg/mobile
+//	gomobile bind -target ios -o Minewire.xcframework ./pkg/mobile
+//
+// An app starts a Client with its server links and sends its traffic to the local SOCKS5
+// proxy, e.g. from a VpnService or a packet tunnel provider through a tun2socks library. The
+// exported API sticks to what gomobile can bind: strings, numbers, errors, interfaces and
+// pointers to structs of those.
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"minewire-server/internal/core"
+	"minewire-server/pkg/client"
+)
+
+// Options configure a Client. Get them from NewOptions, which fills in the defaults.
+type Options struct {
+	Links        string // mw:// links of the servers, one per line
+	Subscription string // Subscription URL, used when Links is empty
+
+	// Split tunneling rules as JSON, in the format of the "routing" object of a subscription;
+	// they override the subscription's. GeoIP is the path of the iptoasn.com TSV country rules need.
+	Rules string
+	GeoIP string
+
+	Framing   string // Server tunnel_framing: random or sequenced
+	PacketIDs string // Server packet_ids: legacy or version
+	Protocol  int    // Protocol version announced in the handshake
+
+	SocksPort     int // Port of the SOCKS5 proxy on 127.0.0.1, 0 picks a free one
+	StatsInterval int // Milliseconds between OnStats calls
+}
+
+// NewOptions returns Options with the defaults of a server with default settings.
+func NewOptions() *Options {
+	return &Options{
+		Framing:       core.FramingRandom,
+		PacketIDs:     core.PacketIDsLegacy,
+		Protocol:      773,
+		StatsInterval: 1000,
+	}
+}
+
+// StatsListener receives the traffic counters of a running Client. It is called from a
+// background goroutine.
+type StatsListener interface {
+	OnStats(stats *Stats)
+}
+
+// Stats are the traffic counters of a Client since it started
+type Stats struct {
+	BytesSent     int64
+	BytesReceived int64
+	OpenStreams   int64 // Proxy connections currently going through the tunnel
+	TotalStreams  int64
+}
+
+// Client is a running Minewire client serving a local SOCKS5 proxy.
+type Client struct {
+	d        *client.Dialer
+	ln       net.Listener
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start logs in to the best server of opts and starts the SOCKS5 proxy. It blocks until the
+// login succeeded or failed, so apps should call it off their main thread. listener may be nil.
+func Start(opts *Options, listener StatsListener) (*Client, error) {
+	if opts == nil {
+		return nil, errors.New("no options")
+	}
+	cfg := client.Config{
+		GeoIP:     opts.GeoIP,
+		Framing:   opts.Framing,
+		PacketIDs: opts.PacketIDs,
+		Protocol:  opts.Protocol,
+	}
+	switch {
+	case strings.TrimSpace(opts.Links) != "":
+		for _, link := range strings.Fields(opts.Links) {
+			ep, err := client.ParseLink(link)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Endpoints = append(cfg.Endpoints, ep)
+		}
+	case opts.Subscription != "":
+		sub, err := client.FetchSubscription(opts.Subscription)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the subscription: %w", err)
+		}
+		cfg.Endpoints, cfg.Routing = sub.Endpoints, sub.Routing
+	default:
+		return nil, errors.New("no links or subscription")
+	}
+	if opts.Rules != "" {
+		var policy client.Routing
+		if err := json.Unmarshal([]byte(opts.Rules), &policy); err != nil {
+			return nil, fmt.Errorf("routing rules: %w", err)
+		}
+		cfg.Routing = &policy
+	}
+
+	d, err := client.NewDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Connect(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(opts.SocksPort)))
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	c := &Client{d: d, ln: ln, stop: make(chan struct{})}
+	go d.ServeSOCKS(ln)
+	if listener != nil {
+		interval := time.Duration(opts.StatsInterval) * time.Millisecond
+		if interval <= 0 {
+			interval = time.Second
+		}
+		go c.reportStats(listener, interval)
+	}
+	return c, nil
+}
+
+// SocksPort returns the port of the SOCKS5 proxy on 127.0.0.1.
+func (c *Client) SocksPort() int {
+	return c.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Stats returns the current traffic counters.
+func (c *Client) Stats() *Stats {
+	s := c.d.Stats()
+	return &Stats{
+		BytesSent:     s.BytesSent,
+		BytesReceived: s.BytesReceived,
+		OpenStreams:   s.OpenStreams,
+		TotalStreams:  s.TotalStreams,
+	}
+}
+
+// Stop closes the SOCKS5 proxy and the tunnel, ending the connections still open. Calling it
+// again does nothing.
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.ln.Close()
+		c.d.Close()
+	})
+}
+
+// reportStats calls the listener every interval until the Client stops.
+func (c *Client) reportStats(listener StatsListener, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			listener.OnStats(c.Stats())
+		}
+	}
+}
+
+// CheckLink reports whether link is a valid mw:// link, for apps validating user input.
+func CheckLink(link string) error {
+	_, err := client.ParseLink(link)
+	return err
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Word lists used to build plausible player nicknames
+var (
+	namePrefixes = []string{
+		"Dark", "Shadow", "Pixel", "Craft", "Frost", "Nova", "Blaze", "Lucky", "Silent", "Red",
+		"Epic", "Mega", "Iron", "Golden", "Sneaky", "Crazy", "Super", "Ender", "Night", "Happy",
+	}
+	nameSuffixes = []string{
+		"Miner", "Wolf", "Fox", "Builder", "Knight", "Hunter", "Gamer", "Dragon", "Creeper", "Storm",
+		"Steve", "Ninja", "Pig", "Cat", "Panda", "Slayer", "Digger", "Boi", "Master", "Pro",
+	}
+)
+
+// Vanilla servers show at most 12 players in the status sample
+const maxStatusSample = 12
+
+// SimPlayer is a simulated player shown in the status sample, query responses and tab list
+type SimPlayer struct {
+	Name string
+	UUID [16]byte
+	Ping int
+}
+
+// rosterChange describes players joining or leaving the simulated server
+type rosterChange struct {
+	Joined []SimPlayer
+	Left   []SimPlayer
+}
+
+// rosterWatch follows the roster for one session. The simulator only marks it dirty, and the
+// session diffs the roster against the players it last sent, so changes coalesce instead of
+// queueing and a slow session can't miss one.
+type rosterWatch struct {
+	Dirty chan struct{}          // Holds a value while the roster differs from sent
+	sent  map[[16]byte]SimPlayer // Players last sent to the session, by UUID
+}
+
+// playerSim is the simulated population of one game server
+type playerSim struct {
+	server    string // Name of the game server, see serverConfig
+	lock      sync.Mutex
+	online    int
+	namePool  []SimPlayer // Every player that ever plays on the server
+	roster    []SimPlayer // Players currently online
+	listeners map[*rosterWatch]struct{}
+}
+
+// Simulated populations by game server name
+var (
+	playerSims     = make(map[string]*playerSim)
+	playerSimsLock sync.Mutex
+)
+
+// simFor returns the population of a game server, starting it at the average configured count.
+func simFor(server string) *playerSim {
+	playerSimsLock.Lock()
+	defer playerSimsLock.Unlock()
+	sim, ok := playerSims[server]
+	if !ok {
+		srv := serverConfig(server)
+		sim = &playerSim{server: server, listeners: make(map[*rosterWatch]struct{})}
+		sim.online = (srv.OnlineMin + srv.OnlineMax) / 2
+		sim.setRosterSize(sim.online)
+		playerSims[server] = sim
+	}
+	return sim
+}
+
+// generatePlayerName builds a random nickname like "FrostWolf42"
+func generatePlayerName() string {
+	name := namePrefixes[getSecureRandomInt(len(namePrefixes))] + nameSuffixes[getSecureRandomInt(len(nameSuffixes))]
+	switch getSecureRandomInt(3) {
+	case 0:
+		return name
+	case 1:
+		return fmt.Sprintf("%s%d", name, getSecureRandomInt(100))
+	default:
+		return fmt.Sprintf("%s_%d", name, 2000+getSecureRandomInt(25))
+	}
+}
+
+// newSimPlayer creates a player with a random version 4 UUID, like online-mode accounts
+func newSimPlayer(name string) SimPlayer {
+	p := SimPlayer{Name: name, Ping: 20 + getSecureRandomInt(150)}
+	rand.Read(p.UUID[:])
+	p.UUID[6] = (p.UUID[6] & 0x0F) | 0x40
+	p.UUID[8] = (p.UUID[8] & 0x3F) | 0x80
+	return p
+}
+
+// UUIDString formats the UUID in the hyphenated form used by status JSON
+func (p SimPlayer) UUIDString() string {
+	u := p.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// step applies a smooth random change (-3 to +3 players) within the configured range.
+func (sim *playerSim) step() {
+	srv := serverConfig(sim.server)
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	newVal := sim.online + getSecureRandomInt(7) - 3
+
+	// Clamp to configured min/max range
+	if newVal < srv.OnlineMin {
+		newVal = srv.OnlineMin
+	}
+	if newVal > srv.OnlineMax {
+		newVal = srv.OnlineMax
+	}
+
+	sim.online = newVal
+	sim.setRosterSize(sim.online)
+	log.Printf("Player count simulation: %d players online on %s", sim.online, sim.server)
+}
+
+// Online returns the simulated player count.
+func (sim *playerSim) Online() int {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.online
+}
+
+// setRosterSize brings the roster to the given size by letting random players join or leave,
+// and marks every subscribed session dirty. Must be called with sim.lock held.
+func (sim *playerSim) setRosterSize(n int) {
+	if sim.namePool == nil {
+		srv := serverConfig(sim.server)
+		seen := make(map[string]bool)
+		poolSize := srv.MaxPlayers
+		if srv.OnlineMax > poolSize {
+			poolSize = srv.OnlineMax
+		}
+		for len(sim.namePool) < poolSize {
+			name := generatePlayerName()
+			for try := 0; seen[name] && try < 8; try++ {
+				name = generatePlayerName()
+			}
+			// Past the ~50k distinct generated names, number the duplicates
+			for i, base := 2, name; seen[name]; i++ {
+				name = fmt.Sprintf("%s%d", base, i)
+			}
+			seen[name] = true
+			sim.namePool = append(sim.namePool, newSimPlayer(name))
+		}
+	}
+	if n > len(sim.namePool) {
+		n = len(sim.namePool)
+	}
+
+	if len(sim.roster) == n {
+		return
+	}
+	for len(sim.roster) > n {
+		i := getSecureRandomInt(len(sim.roster))
+		sim.roster = append(sim.roster[:i:i], sim.roster[i+1:]...)
+	}
+	if len(sim.roster) < n {
+		sim.roster = append(sim.roster, sim.offlinePlayers()[:n-len(sim.roster)]...)
+	}
+	for w := range sim.listeners {
+		select {
+		case w.Dirty <- struct{}{}:
+		default: // Already dirty, the next diff covers this change too
+		}
+	}
+}
+
+// offlinePlayers returns pool players not currently online, in random order
+func (sim *playerSim) offlinePlayers() []SimPlayer {
+	online := make(map[string]bool, len(sim.roster))
+	for _, p := range sim.roster {
+		online[p.Name] = true
+	}
+	var offline []SimPlayer
+	for _, p := range sim.namePool {
+		if !online[p.Name] {
+			offline = append(offline, p)
+		}
+	}
+	for i := len(offline) - 1; i > 0; i-- {
+		j := getSecureRandomInt(i + 1)
+		offline[i], offline[j] = offline[j], offline[i]
+	}
+	return offline
+}
+
+// Players returns a snapshot of the currently simulated online players.
+func (sim *playerSim) Players() []SimPlayer {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return append([]SimPlayer(nil), sim.roster...)
+}
+
+// PlayerNames returns the names of the currently simulated online players.
+func (sim *playerSim) PlayerNames() []string {
+	players := sim.Players()
+	names := make([]string, len(players))
+	for i, p := range players {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// statusSample returns up to 12 online players for the status response sample
+func (sim *playerSim) statusSample() []interface{} {
+	players := sim.Players()
+	if len(players) > maxStatusSample {
+		players = players[:maxStatusSample]
+	}
+	var sample []interface{}
+	for _, p := range players {
+		sample = append(sample, map[string]string{"name": p.Name, "id": p.UUIDString()})
+	}
+	return sample
+}
+
+// subscribe registers a session for roster changes and returns the current roster, which the
+// session is taken to have sent.
+func (sim *playerSim) subscribe() (*rosterWatch, []SimPlayer) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	w := &rosterWatch{Dirty: make(chan struct{}, 1), sent: make(map[[16]byte]SimPlayer, len(sim.roster))}
+	for _, p := range sim.roster {
+		w.sent[p.UUID] = p
+	}
+	sim.listeners[w] = struct{}{}
+	return w, append([]SimPlayer(nil), sim.roster...)
+}
+
+func (sim *playerSim) unsubscribe(w *rosterWatch) {
+	sim.lock.Lock()
+	delete(sim.listeners, w)
+	sim.lock.Unlock()
+}
+
+// changes returns the players who joined and left since the roster a session last sent, and
+// takes the current roster as sent.
+func (sim *playerSim) changes(w *rosterWatch) rosterChange {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	var change rosterChange
+	online := make(map[[16]byte]bool, len(sim.roster))
+	for _, p := range sim.roster {
+		online[p.UUID] = true
+		if _, ok := w.sent[p.UUID]; !ok {
+			change.Joined = append(change.Joined, p)
+			w.sent[p.UUID] = p
+		}
+	}
+	for id, p := range w.sent {
+		if !online[id] {
+			change.Left = append(change.Left, p)
+			delete(w.sent, id)
+		}
+	}
+	return change
+}
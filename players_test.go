@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestRosterWatch checks that a session that falls behind the simulator still ends up with the
+// current roster: changes coalesce into one diff instead of being dropped.
+func TestRosterWatch(t *testing.T) {
+	sim := &playerSim{listeners: make(map[*rosterWatch]struct{})}
+	for i := range 50 {
+		sim.namePool = append(sim.namePool, newSimPlayer(fmt.Sprintf("Player%d", i)))
+	}
+	sim.setRosterSize(10)
+	w, sent := sim.subscribe()
+
+	// Far more changes than any queue would hold, without the session reading them
+	for i := range 100 {
+		sim.setRosterSize(5 + i%30)
+	}
+	if len(w.Dirty) != 1 {
+		t.Fatalf("%d pending notifications, want 1", len(w.Dirty))
+	}
+	<-w.Dirty
+
+	tab := make(map[string]bool)
+	for _, p := range sent {
+		tab[p.Name] = true
+	}
+	change := sim.changes(w)
+	for _, p := range change.Left {
+		if !tab[p.Name] {
+			t.Errorf("%s left without being shown", p.Name)
+		}
+		delete(tab, p.Name)
+	}
+	for _, p := range change.Joined {
+		if tab[p.Name] {
+			t.Errorf("%s joined twice", p.Name)
+		}
+		tab[p.Name] = true
+	}
+	names := sim.PlayerNames()
+	if len(tab) != len(names) {
+		t.Errorf("tab list has %d players, the roster %d", len(tab), len(names))
+	}
+	for _, name := range names {
+		if !tab[name] {
+			t.Errorf("%s online but not in the tab list", name)
+		}
+	}
+	if change := sim.changes(w); len(change.Joined)+len(change.Left) != 0 {
+		t.Errorf("second diff without a roster change: %+v", change)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	probeHistoryHours = 48     // Hourly probe counts kept for the timeline
+	probeTopCount     = 20     // Entries in the top lists
+	maxProbeSources   = 100000 // Distinct source IPs remembered for the unique count
+)
+
+// probeCount is an entry of the top lists of status probe analytics
+type probeCount struct {
+	Key     string `json:"key"`
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+	Count   int64  `json:"count"`
+}
+
+// hourCount is an entry of the probe timeline
+type hourCount struct {
+	Hour  time.Time `json:"hour"`
+	Count int64     `json:"count"`
+}
+
+// statusProbeStats is the status probe section of /api/stats
+type statusProbeStats struct {
+	Total      int64            `json:"total"`
+	Pings      int64            `json:"pings"`
+	UniqueIPs  int              `json:"unique_ips"`
+	ByASN      []probeCount     `json:"by_asn,omitempty"` // Requires asn_database
+	ByCountry  map[string]int64 `json:"by_country,omitempty"`
+	ByProtocol map[string]int64 `json:"by_protocol"`
+	ByHost     []probeCount     `json:"by_host"` // Server address used in the handshake
+	Hourly     []hourCount      `json:"hourly"`
+}
+
+// Status probe analytics since process start
+var (
+	probeTotal    int64
+	probePings    int64
+	probeSources  = make(map[string]bool)
+	probeASNs     = make(map[uint32]*probeCount)
+	probeCountry  = make(map[string]int64)
+	probeProtocol = make(map[string]int64)
+	probeHosts    = make(map[string]int64)
+	probeHourly   []hourCount
+	probeLock     sync.Mutex
+)
+
+// recordStatusProbe counts a handshake asking for the server status.
+func recordStatusProbe(ip string, protocol int, host string) {
+	rng, known := asnDB.lookup(ip)
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	probeLock.Lock()
+	defer probeLock.Unlock()
+	probeTotal++
+	if len(probeSources) < maxProbeSources {
+		probeSources[ip] = true
+	}
+	probeProtocol[strconv.Itoa(protocol)]++
+
+	// Scanners usually connect by IP, players by domain name
+	if net.ParseIP(host) != nil {
+		host = "(ip address)"
+	}
+	if len(probeHosts) < maxProbeSources || probeHosts[host] > 0 {
+		probeHosts[host]++
+	}
+
+	if n := len(probeHourly); n == 0 || !probeHourly[n-1].Hour.Equal(hour) {
+		probeHourly = append(probeHourly, hourCount{Hour: hour})
+		if len(probeHourly) > probeHistoryHours {
+			probeHourly = probeHourly[1:]
+		}
+	}
+	probeHourly[len(probeHourly)-1].Count++
+
+	if known {
+		probeCountry[rng.country]++
+		entry, ok := probeASNs[rng.asn]
+		if !ok {
+			entry = &probeCount{Key: "AS" + strconv.FormatUint(uint64(rng.asn), 10), Name: rng.name, Country: rng.country}
+			probeASNs[rng.asn] = entry
+			log.Printf("Status probes from new network %s (%s, %s): %s", entry.Key, rng.name, rng.country, ip)
+		}
+		entry.Count++
+	}
+}
+
+// recordStatusPing counts a status ping request.
+func recordStatusPing() {
+	probeLock.Lock()
+	probePings++
+	probeLock.Unlock()
+}
+
+// collectProbeStats builds the status probe section of the stats document.
+func collectProbeStats() statusProbeStats {
+	probeLock.Lock()
+	defer probeLock.Unlock()
+
+	s := statusProbeStats{
+		Total:      probeTotal,
+		Pings:      probePings,
+		UniqueIPs:  len(probeSources),
+		ByProtocol: make(map[string]int64),
+		Hourly:     append([]hourCount{}, probeHourly...),
+	}
+	for k, v := range probeProtocol {
+		s.ByProtocol[k] = v
+	}
+	if asnDB != nil {
+		s.ByCountry = make(map[string]int64)
+		for k, v := range probeCountry {
+			s.ByCountry[k] = v
+		}
+		for _, c := range probeASNs {
+			s.ByASN = append(s.ByASN, *c)
+		}
+	}
+	for host, n := range probeHosts {
+		s.ByHost = append(s.ByHost, probeCount{Key: host, Count: n})
+	}
+
+	for _, list := range [][]probeCount{s.ByASN, s.ByHost} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Count > list[j].Count })
+	}
+	if len(s.ByASN) > probeTopCount {
+		s.ByASN = s.ByASN[:probeTopCount]
+	}
+	if len(s.ByHost) > probeTopCount {
+		s.ByHost = s.ByHost[:probeTopCount]
+	}
+	return s
+}
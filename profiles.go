@@ -0,0 +1,91 @@
+package main
+
+// DisguiseProfile bundles the settings that make the server look like a specific server software.
+// Values from a profile act as defaults, anything set explicitly in server.yaml takes precedence.
+type DisguiseProfile struct {
+	VersionName       string
+	ProtocolID        int
+	Brand             string
+	QueryPlugins      string
+	KeepAliveInterval int                    // Seconds between Keep Alive packets
+	Weather           bool                   // Whether the software simulates weather (all real ones do)
+	StatusExtras      map[string]interface{} // Additional top-level fields in the status JSON
+}
+
+// disguiseProfiles lists the built-in profiles selectable with the "profile" option
+var disguiseProfiles = map[string]DisguiseProfile{
+	"vanilla": {
+		VersionName:       "1.21.10",
+		ProtocolID:        773,
+		Brand:             "vanilla",
+		KeepAliveInterval: 15,
+		Weather:           true,
+	},
+	"paper": {
+		VersionName:       "1.21.10",
+		ProtocolID:        773,
+		Brand:             "Paper",
+		QueryPlugins:      "Paper on 1.21.10-R0.1-SNAPSHOT: LuckPerms 5.5.17; EssentialsX 2.21.2; Vault 1.7.3-b131",
+		KeepAliveInterval: 15,
+		Weather:           true,
+	},
+	"purpur": {
+		VersionName:       "1.21.10",
+		ProtocolID:        773,
+		Brand:             "Purpur",
+		QueryPlugins:      "Purpur on 1.21.10-R0.1-SNAPSHOT: LuckPerms 5.5.17; EssentialsX 2.21.2; CoreProtect 23.0",
+		KeepAliveInterval: 15,
+		Weather:           true,
+	},
+	// Modern Forge advertises its mod list in a "forgeData" block
+	"forge": {
+		VersionName:       "1.20.1",
+		ProtocolID:        763,
+		Brand:             "forge",
+		KeepAliveInterval: 15,
+		Weather:           true,
+		StatusExtras: map[string]interface{}{
+			"forgeData": map[string]interface{}{
+				"channels": []interface{}{},
+				"mods": []interface{}{
+					map[string]interface{}{"modId": "minecraft", "modmarker": "1.20.1"},
+					map[string]interface{}{"modId": "forge", "modmarker": "47.4.0"},
+					map[string]interface{}{"modId": "jei", "modmarker": "15.20.0.112"},
+				},
+				"fmlNetworkVersion": 3,
+				"truncated":         false,
+			},
+		},
+	},
+	// Legacy FML modpack server (1.12.2), advertises mods in a "modinfo" block
+	"modded": {
+		VersionName:       "1.12.2",
+		ProtocolID:        340,
+		Brand:             "fml,forge",
+		KeepAliveInterval: 15,
+		Weather:           true,
+		StatusExtras: map[string]interface{}{
+			"modinfo": map[string]interface{}{
+				"type": "FML",
+				"modList": []interface{}{
+					map[string]interface{}{"modid": "minecraft", "version": "1.12.2"},
+					map[string]interface{}{"modid": "mcp", "version": "9.42"},
+					map[string]interface{}{"modid": "FML", "version": "8.0.99.99"},
+					map[string]interface{}{"modid": "forge", "version": "14.23.5.2860"},
+					map[string]interface{}{"modid": "jei", "version": "4.16.1.302"},
+				},
+			},
+		},
+	},
+}
+
+// apply copies the profile settings into the config.
+func (p DisguiseProfile) apply(c *Config) {
+	c.VersionName = p.VersionName
+	c.ProtocolID = p.ProtocolID
+	c.Brand = p.Brand
+	c.QueryPlugins = p.QueryPlugins
+	c.KeepAliveInterval = p.KeepAliveInterval
+	c.Weather = p.Weather
+	c.StatusExtras = p.StatusExtras
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GS4 Query protocol constants
+const (
+	queryMagic         = 0xFEFD
+	queryTypeHandshake = 0x09
+	queryTypeStat      = 0x00
+
+	// Vanilla invalidates all challenge tokens every 30 seconds
+	queryChallengeLifetime = 30 * time.Second
+)
+
+// Challenge tokens issued to query clients, keyed by source address
+var (
+	queryChallenges = make(map[string]int32)
+	queryLock       sync.Mutex
+)
+
+// startQueryServer serves the UDP Query protocol (GS4) like a vanilla server with enable-query=true.
+func startQueryServer() {
+	cfg := currentConfig()
+	pc, err := listenUDP("query", ":"+cfg.QueryPort)
+	if err != nil {
+		log.Printf("Query Server Error: %v", err)
+		return
+	}
+	listenersLock.Lock()
+	queryConn = pc
+	listenersLock.Unlock()
+	serveQuery(pc)
+}
+
+// serveQuery answers query requests on pc until it is closed.
+func serveQuery(pc net.PacketConn) {
+	cfg := currentConfig()
+	log.Printf("Starting Query Server on port %s", cfg.QueryPort)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(queryChallengeLifetime)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				queryLock.Lock()
+				queryChallenges = make(map[string]int32)
+				queryLock.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1460)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if resp := handleQueryPacket(buf[:n], addr); resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+// handleQueryPacket parses a single query request and returns the response, or nil to stay silent.
+func handleQueryPacket(p []byte, addr net.Addr) []byte {
+	if len(p) < 7 || binary.BigEndian.Uint16(p) != queryMagic {
+		return nil
+	}
+	packetType := p[2]
+	sessionID := int32(binary.BigEndian.Uint32(p[3:7])) & 0x0F0F0F0F
+	host := addrHost(addr)
+
+	resp := new(bytes.Buffer)
+	resp.WriteByte(packetType)
+	binary.Write(resp, binary.BigEndian, sessionID)
+
+	switch packetType {
+	case queryTypeHandshake:
+		token := int32(getSecureRandomInt(256))<<16 | int32(getSecureRandomInt(256))<<8 | int32(getSecureRandomInt(256))
+		queryLock.Lock()
+		queryChallenges[host] = token
+		queryLock.Unlock()
+		resp.WriteString(strconv.Itoa(int(token)))
+		resp.WriteByte(0)
+		return resp.Bytes()
+
+	case queryTypeStat:
+		if len(p) < 11 {
+			return nil
+		}
+		queryLock.Lock()
+		token, ok := queryChallenges[host]
+		queryLock.Unlock()
+		if !ok || token != int32(binary.BigEndian.Uint32(p[7:11])) {
+			return nil
+		}
+		// Full stat requests are padded with 4 extra bytes
+		if len(p) >= 15 {
+			writeFullStat(resp)
+		} else {
+			writeBasicStat(resp)
+		}
+		return resp.Bytes()
+	}
+	return nil
+}
+
+// queryPlayerNames returns the players reported by query, consistent with the status mode
+func queryPlayerNames() []string {
+	cfg := currentConfig()
+	if cfg.StatusMode == StatusModeWhitelist || cfg.StatusMode == StatusModeMaintenance {
+		return nil
+	}
+	return simFor(cfg.Name).PlayerNames()
+}
+
+func writeBasicStat(w *bytes.Buffer) {
+	cfg := currentConfig()
+	players := queryPlayerNames()
+	writeQueryString(w, queryMotd())
+	writeQueryString(w, "SMP")
+	writeQueryString(w, "world")
+	writeQueryString(w, strconv.Itoa(len(players)))
+	writeQueryString(w, strconv.Itoa(cfg.MaxPlayers))
+	port, _ := strconv.Atoi(cfg.ListenPort)
+	binary.Write(w, binary.LittleEndian, uint16(port))
+	writeQueryString(w, "0.0.0.0")
+}
+
+func writeFullStat(w *bytes.Buffer) {
+	cfg := currentConfig()
+	players := queryPlayerNames()
+	w.WriteString("splitnum\x00\x80\x00")
+	kv := [][2]string{
+		{"hostname", queryMotd()},
+		{"gametype", "SMP"},
+		{"game_id", "MINECRAFT"},
+		{"version", cfg.VersionName},
+		{"plugins", cfg.QueryPlugins},
+		{"map", "world"},
+		{"numplayers", strconv.Itoa(len(players))},
+		{"maxplayers", strconv.Itoa(cfg.MaxPlayers)},
+		{"hostport", cfg.ListenPort},
+		{"hostip", "0.0.0.0"},
+	}
+	for _, pair := range kv {
+		writeQueryString(w, pair[0])
+		writeQueryString(w, pair[1])
+	}
+	w.WriteByte(0)
+
+	w.WriteString("\x01player_\x00\x00")
+	for _, name := range players {
+		writeQueryString(w, name)
+	}
+	w.WriteByte(0)
+}
+
+// queryMotd returns the first MOTD line, query clients don't render line breaks
+func queryMotd() string {
+	cfg := currentConfig()
+	motd := strings.ReplaceAll(cfg.Motd, `\n`, "\n")
+	return strings.SplitN(motd, "\n", 2)[0]
+}
+
+// writeQueryString writes a null-terminated string
+func writeQueryString(w *bytes.Buffer, s string) {
+	w.WriteString(s)
+	w.WriteByte(0)
+}
+
+// addrHost returns the IP part of a network address
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings used only at startup (open files, exporters, the game port). A reload keeps their
+// running values and reports them as requiring a restart.
+var restartKeys = map[string]bool{
+	"listen_port": true, "listen_address": true, "admin_listen": true, "name": true,
+	"log_output": true, "syslog_address": true, "syslog_tag": true,
+	"access_log": true, "access_log_max_size": true, "access_log_max_backups": true,
+	"access_log_rotate_hours": true, "access_log_max_age": true,
+	"event_log": true, "event_log_max_size": true, "event_log_max_backups": true,
+	"event_log_rotate_hours": true, "event_log_max_age": true,
+	"tracing_endpoint": true, "tracing_service_name": true, "tracing_headers": true,
+	"capture_template": true, "capture_server_port": true,
+	"asn_database": true, "destination_stats_salt": true,
+	"anomaly_scoring": true, "firewall_backend": true, "watchdog_interval": true,
+	"max_connections": true, "max_streams_total": true, "memory_limit": true, "tunnel_crypto_workers": true,
+	"tun_network": true, "tun_name": true, "tun_mtu": true, "tcp_max_segment": true,
+	"acme_domains": true, "acme_email": true, "acme_directory": true, "acme_cache_dir": true,
+	"acme_challenge": true, "acme_http_port": true, "acme_dns_hook": true,
+	"subs_access_log": true, "subs_tls_cert": true, "subs_tls_key": true, "subs_client_ca": true,
+}
+
+// Listeners that can be replaced by a reload
+var (
+	queryConn     net.PacketConn
+	subsListener  net.Listener
+	listenersLock sync.Mutex
+	reloadLock    sync.Mutex
+)
+
+// reloadReport describes what a configuration reload changed
+type reloadReport struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+	KickedSessions  int      `json:"kicked_sessions"` // Sessions of removed users
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+// reloadConfig validates a new config document and applies it. New listeners are bound before
+// anything is changed, so a failure leaves the running configuration untouched.
+func reloadConfig(data []byte) (*reloadReport, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	sdNotifyReloading()
+	defer sdNotify("READY=1")
+
+	keyErrors, err := checkUnknownKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	next, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	report := &reloadReport{Applied: []string{}, RequiresRestart: []string{}}
+	problems := keyErrors
+	for _, p := range validateConfig(&next) {
+		if strings.HasPrefix(p, "ERROR ") {
+			problems = append(problems, strings.TrimPrefix(p, "ERROR "))
+		} else {
+			report.Warnings = append(report.Warnings, strings.TrimPrefix(p, "WARNING "))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+
+	// Compare every setting with the running configuration
+	old := currentConfig()
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(&next).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		key := strings.Split(nv.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" {
+			continue // Not a setting
+		}
+		if sameSetting(ov.Field(i), nv.Field(i)) {
+			continue
+		}
+		// Users and disguise of servers entries reload, adding or moving a server needs a restart
+		if restartKeys[key] || (key == "servers" && !sameServerListeners(old.Servers, next.Servers)) {
+			nv.Field(i).Set(ov.Field(i))
+			report.RequiresRestart = append(report.RequiresRestart, key)
+		} else {
+			report.Applied = append(report.Applied, key)
+		}
+	}
+
+	// Bind new listeners first: this is the only step that can fail
+	queryChanged := old.QueryEnabled != next.QueryEnabled || (next.QueryEnabled && old.QueryPort != next.QueryPort)
+	subsChanged := subsAddr(old) != subsAddr(&next)
+	var newQuery net.PacketConn
+	var newSubs net.Listener
+	if queryChanged && next.QueryEnabled {
+		if newQuery, err = net.ListenPacket("udp", ":"+next.QueryPort); err != nil {
+			return nil, err
+		}
+	}
+	if subsChanged && next.SubsListenPort != "" {
+		if newSubs, err = net.Listen("tcp", subsAddr(&next)); err != nil {
+			if newQuery != nil {
+				newQuery.Close()
+			}
+			return nil, err
+		}
+	}
+
+	// Commit
+	publishConfig(&next)
+	initAuthMap()
+	initListenerACL()
+	initEgress()
+	go refreshEgressLists()
+	listenersLock.Lock()
+	if queryChanged {
+		if queryConn != nil {
+			queryConn.Close()
+		}
+		queryConn = newQuery
+		if newQuery != nil {
+			go serveQuery(newQuery)
+		}
+	}
+	if subsChanged {
+		if subsListener != nil {
+			subsListener.Close()
+		}
+		subsListener = newSubs
+		if newSubs != nil {
+			go serveSubscriptions(newSubs)
+		}
+	}
+	listenersLock.Unlock()
+	for _, s := range sessions.Live() {
+		if _, _, ok := lookupUser(s.Username); !ok {
+			s.Kick()
+			report.KickedSessions++
+		}
+	}
+
+	log.Printf("Configuration reloaded: %d setting(s) applied, %d require a restart (%s)",
+		len(report.Applied), len(report.RequiresRestart), strings.Join(report.RequiresRestart, ", "))
+	return report, nil
+}
+
+// sameSetting compares two config values, treating empty and missing lists or maps as equal.
+func sameSetting(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Map, reflect.Slice:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	if servers, ok := a.Interface().([]Config); ok {
+		return reflect.DeepEqual(withoutRoots(servers), withoutRoots(b.Interface().([]Config)))
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// withoutRoots returns a copy of servers entries without the link to their top-level config,
+// which differs between any two configs.
+func withoutRoots(servers []Config) []Config {
+	servers = slices.Clone(servers)
+	for i := range servers {
+		servers[i].root = nil
+	}
+	return servers
+}
+
+// sameServerListeners reports whether two servers lists have the same names, ports and
+// listener options.
+func sameServerListeners(a, b []Config) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].ListenPort != b[i].ListenPort || a[i].ListenAddress != b[i].ListenAddress ||
+			a[i].TCPMaxSegment != b[i].TCPMaxSegment {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadConfigFile reloads the config file from disk.
+func reloadConfigFile() (*reloadReport, error) {
+	data, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return reloadConfig(data)
+}
+
+// handleSignals reloads the config file on SIGHUP, starts a binary upgrade on SIGUSR2 and
+// reports shutdown to systemd on SIGTERM/SIGINT.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	if upgradeSignal != nil {
+		signal.Notify(c, upgradeSignal)
+	}
+	for sig := range c {
+		if sig == upgradeSignal {
+			go upgradeBinary()
+			continue
+		}
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down", sig)
+			sdNotify("STOPPING=1")
+			os.Exit(0)
+		}
+		if _, err := reloadConfigFile(); err != nil {
+			log.Printf("Configuration reload failed, keeping the running configuration: %v", err)
+		}
+	}
+}
+
+// handleAdminGetConfig returns the running configuration as YAML, with its secrets redacted.
+func handleAdminGetConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	data, err := yaml.Marshal(cfg)
+	if err == nil {
+		data, err = redactSecrets(data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+// handleAdminPutConfig applies the config document in the request body: YAML, or JSON/TOML with
+// a matching Content-Type. With ?save=1 the document also replaces the config file, so the
+// change survives restarts.
+func handleAdminPutConfig(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := formatYAML
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.Contains(ct, "json"):
+		format = formatJSON
+	case strings.Contains(ct, "toml"):
+		format = formatTOML
+	}
+	data, err := toYAML(format, raw)
+	restored := false
+	if err == nil {
+		data, restored, err = restoreSecrets(data, currentConfig())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := reloadConfig(data)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.URL.Query().Get("save") == "1" {
+		var err error
+		switch {
+		case format != configFormat(configPath):
+			err = fmt.Errorf("the document is %s but %s is %s", format, configPath, configFormat(configPath))
+		case restored && format != formatYAML:
+			err = errors.New("redacted secrets are only restored in YAML documents")
+		default:
+			if restored {
+				raw = data // The file gets the running secrets, not the placeholders
+			}
+			tmp := configPath + ".tmp"
+			if err = os.WriteFile(tmp, raw, 0640); err == nil {
+				err = os.Rename(tmp, configPath)
+			}
+		}
+		if err != nil {
+			report.Warnings = append(report.Warnings, "applied but not saved: "+err.Error())
+		}
+	}
+	log.Printf("Admin reloaded configuration")
+	writeJSON(w, report)
+}
+
+// redactedSecret stands for a secret in GET /api/config. PUT keeps the running value of a
+// secret left redacted, so a fetched document can be edited and sent back.
+const redactedSecret = "REDACTED"
+
+// Config keys holding secrets, and those of a passwords entry. Every tracing_headers value is
+// a secret too.
+var (
+	secretKeys = []string{
+		"admin_token", "subs_token", "subs_secret", "telegram_bot_token", "smtp_password",
+		"check_password", "destination_stats_salt",
+	}
+	userSecretKeys = []string{"password", "key"}
+)
+
+// walkSecrets calls f with the path and node of every secret in a config document. List
+// entries are named by their id or name in paths, so they still match after a reorder.
+func walkSecrets(node *yaml.Node, path, parent string, f func(path string, value *yaml.Node)) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			walkSecrets(n, path, parent, f)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if value.Kind == yaml.ScalarNode && (slices.Contains(secretKeys, key) || parent == "tracing_headers" ||
+				(parent == "passwords" && slices.Contains(userSecretKeys, key))) {
+				f(path+"."+key, value)
+			} else {
+				walkSecrets(value, path+"."+key, key, f)
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			name := strconv.Itoa(i)
+			for _, field := range []string{"id", "name"} {
+				if v := mappingValue(item, field); v != "" {
+					name = field + "=" + v
+					break
+				}
+			}
+			walkSecrets(item, path+"["+name+"]", parent, f)
+		}
+	}
+}
+
+// mappingValue returns the scalar value of key in a mapping node, "" if absent.
+func mappingValue(node *yaml.Node, key string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.ScalarNode {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// redactSecrets replaces every set secret of a YAML config document with redactedSecret.
+func redactSecrets(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	walkSecrets(&doc, "", "", func(_ string, value *yaml.Node) {
+		if value.Value != "" {
+			value.SetString(redactedSecret)
+		}
+	})
+	return yaml.Marshal(&doc)
+}
+
+// restoreSecrets replaces the redacted secrets of a YAML config document with their values in
+// running, and reports whether there were any.
+func restoreSecrets(data []byte, running *Config) ([]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	redacted := make(map[string]*yaml.Node)
+	walkSecrets(&doc, "", "", func(path string, value *yaml.Node) {
+		if value.Value == redactedSecret {
+			redacted[path] = value
+		}
+	})
+	if len(redacted) == 0 {
+		return data, false, nil
+	}
+
+	current, err := yaml.Marshal(running)
+	if err != nil {
+		return nil, false, err
+	}
+	var currentDoc yaml.Node
+	if err := yaml.Unmarshal(current, &currentDoc); err != nil {
+		return nil, false, err
+	}
+	walkSecrets(&currentDoc, "", "", func(path string, value *yaml.Node) {
+		if node := redacted[path]; node != nil && value.Value != "" {
+			node.SetString(value.Value)
+			delete(redacted, path)
+		}
+	})
+	for path := range redacted {
+		return nil, false, fmt.Errorf("%s is %s but has no running value", strings.TrimPrefix(path, "."), redactedSecret)
+	}
+	data, err = yaml.Marshal(&doc)
+	return data, true, err
+}
+
+// handleAdminReloadConfig reloads the config file from disk, like SIGHUP.
+func handleAdminReloadConfig(w http.ResponseWriter, r *http.Request) {
+	report, err := reloadConfigFile()
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestRedactSecrets checks that GET /api/config shows no secret and that PUT of the document
+// restores them.
+func TestRedactSecrets(t *testing.T) {
+	running, err := parseConfig([]byte(`
+admin_token: admin-secret
+subs_secret: subs-secret
+tracing_headers: {Authorization: Bearer trace-secret}
+passwords:
+  - {name: Alice, password: alice-secret}
+  - {id: bob, key: ` + strings.Repeat("ab", 32) + `}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := yaml.Marshal(&running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted, err := redactSecrets(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"admin-secret", "subs-secret", "trace-secret", "alice-secret", "abab"} {
+		if strings.Contains(string(redacted), secret) {
+			t.Errorf("%s in the redacted config", secret)
+		}
+	}
+
+	restored, ok, err := restoreSecrets(redacted, &running)
+	if err != nil || !ok {
+		t.Fatalf("restoring: %v, %v", ok, err)
+	}
+	got, err := parseConfig(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AdminToken != "admin-secret" || got.SubsSecret != "subs-secret" || got.TracingHeaders["Authorization"] != "Bearer trace-secret" ||
+		got.Passwords[0].Password != "alice-secret" || got.Passwords[1].Key != running.Passwords[1].Key {
+		t.Errorf("secrets not restored: %s", restored)
+	}
+
+	// A redacted secret of a user that isn't running has nothing to restore
+	renamed := strings.Replace(string(redacted), "Alice", "Carol", 1)
+	if _, _, err := restoreSecrets([]byte(renamed), &running); err == nil {
+		t.Error("redacted password of a new user accepted")
+	}
+}
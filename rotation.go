@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Subscription keys replaced by a rotation -> end of their notice period, kept in memory
+var (
+	rotatedSubs     = make(map[string]time.Time)
+	rotatedSubsLock sync.Mutex
+)
+
+// rotationResult is the response of the rotate API
+type rotationResult struct {
+	Username     string   `json:"username"` // New generated username
+	ID           string   `json:"id,omitempty"`
+	Password     string   `json:"password"`
+	Subscription string   `json:"subscription,omitempty"` // Path of the new subscription
+	Kicked       int      `json:"kicked_sessions"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// rotateUser gives the user with a generated username a new password and, if it has one, a new
+// id, so both its old mw:// links and its old subscription path stop working. Sessions of the
+// old password are closed.
+func rotateUser(username string, save bool) (*rotationResult, error) {
+	cfg := currentConfig()
+	res := &rotationResult{Password: randomHex(16), Warnings: []string{}}
+	var oldKey, newKey string
+	entryName := username // Username the config file entry resolves to
+	err := editUser(username, func(u *UserConfig) error {
+		if u.Key != "" {
+			return errors.New("the user is configured by key, set a new key in the config file instead")
+		}
+		if u.PasswordFile != "" {
+			// The file is where the password lives, it is updated even without saving
+			if err := os.WriteFile(u.PasswordFile, []byte(res.Password+"\n"), 0600); err != nil {
+				return err
+			}
+			entryName = usernameFor(res.Password)
+		}
+		oldKey = u.SubsKey()
+		u.Password = res.Password
+		if u.ID != "" {
+			u.ID = randomHex(8)
+		}
+		res.Username, res.ID = u.Username(), u.ID
+		if newKey = u.SubsKey(); newKey != "" {
+			res.Subscription = cfg.SubsPath + newKey
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if save {
+		err := saveUserEntry(entryName, func(entry *yaml.Node) {
+			var u UserConfig
+			entry.Decode(&u)
+			if u.PasswordFile == "" {
+				setEntryField(entry, "password", res.Password)
+			}
+			if res.ID != "" {
+				setEntryField(entry, "id", res.ID)
+			}
+		})
+		if err != nil {
+			res.Warnings = append(res.Warnings, "applied but not saved: "+err.Error())
+		}
+	}
+
+	// The old subscription path answers with a notice instead of a 404 for a while
+	if oldKey != "" && oldKey != newKey && cfg.SubsRotationNotice > 0 {
+		rotatedSubsLock.Lock()
+		rotatedSubs[oldKey] = time.Now().Add(time.Duration(cfg.SubsRotationNotice) * time.Hour)
+		rotatedSubsLock.Unlock()
+	}
+	if isUserDisabled(username) {
+		setUserDisabled(res.Username, true)
+	}
+	res.Kicked = sessions.KickUser(username)
+	return res, nil
+}
+
+// rotatedSubscription reports whether key named a subscription replaced by a rotation within
+// subs_rotation_notice hours.
+func rotatedSubscription(key string) bool {
+	rotatedSubsLock.Lock()
+	defer rotatedSubsLock.Unlock()
+	until, ok := rotatedSubs[key]
+	if ok && time.Now().After(until) {
+		delete(rotatedSubs, key)
+		return false
+	}
+	return ok
+}
+
+// handleAdminRotateUser rotates the password (and subscription id) of a user. With ?save=1 the
+// config file is updated too.
+func handleAdminRotateUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	label := logUser(username) // The old username is unknown once rotated
+	res, err := rotateUser(username, r.URL.Query().Get("save") == "1")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin rotated the password of %s, now %s (%d session(s) closed)", label, logUser(res.Username), res.Kicked)
+	writeJSON(w, res)
+}
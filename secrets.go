@@ -0,0 +1,37 @@
+package main
+
+// keyArena holds the tunnel keys of the users in memory of their own: locked against swapping
+// and left out of core dumps where the platform allows, and wiped when a configuration reload
+// replaces them. Keys a session derives its ciphers from are copied out and cleared after use.
+type keyArena struct {
+	buf  []byte
+	used int
+	free func() // Releases buf, nil for heap memory
+}
+
+// newKeyArena returns an arena with room for n keys.
+func newKeyArena(n int) *keyArena {
+	a := &keyArena{}
+	if n > 0 {
+		a.buf, a.free = allocSecret(n * 32)
+	}
+	return a
+}
+
+// add copies key into the arena and clears it. The arena must have room for it.
+func (a *keyArena) add(key *[32]byte) *[32]byte {
+	p := (*[32]byte)(a.buf[a.used : a.used+32])
+	a.used += 32
+	*p = *key
+	clear(key[:])
+	return p
+}
+
+// wipe clears the keys and releases their memory. The arena must no longer be used.
+func (a *keyArena) wipe() {
+	clear(a.buf)
+	if a.free != nil {
+		a.free()
+	}
+	a.buf, a.used = nil, 0
+}
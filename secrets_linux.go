@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Logs the failure to lock key memory once, not on every reload
+var lockWarning sync.Once
+
+// allocSecret maps size bytes outside the Go heap, locked in RAM and excluded from core dumps.
+// Without the memory lock limit (RLIMIT_MEMLOCK) for it, the memory is only excluded from dumps.
+func allocSecret(size int) ([]byte, func()) {
+	buf, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, size), nil
+	}
+	unix.Madvise(buf, unix.MADV_DONTDUMP)
+	locked := unix.Mlock(buf) == nil
+	if !locked {
+		lockWarning.Do(func() {
+			log.Printf("Could not lock the tunnel keys in memory: raise LimitMEMLOCK / ulimit -l to keep them out of swap")
+		})
+	}
+	return buf, func() {
+		if locked {
+			unix.Munlock(buf)
+		}
+		unix.Munmap(buf)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// allocSecret returns heap memory: locking it is only implemented on Linux.
+func allocSecret(size int) ([]byte, func()) {
+	return make([]byte, size), nil
+}
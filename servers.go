@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+)
+
+// allServers returns the game servers run by this process: the top-level config first, then
+// the entries of servers.
+func allServers() []*Config {
+	cfg := currentConfig()
+	list := []*Config{cfg}
+	for i := range cfg.Servers {
+		list = append(list, &cfg.Servers[i])
+	}
+	return list
+}
+
+// serverConfig returns the running config of the named game server, or the top-level config.
+func serverConfig(name string) *Config {
+	cfg := currentConfig()
+	for i := range cfg.Servers {
+		if cfg.Servers[i].Name == name {
+			return &cfg.Servers[i]
+		}
+	}
+	return cfg
+}
+
+// socketName is the socket activation and upgrade handoff name of a game server's listener.
+// The top-level server keeps "game" so existing socket units work unchanged.
+func socketName(srv *Config) string {
+	if srv == srv.root {
+		return "game"
+	}
+	return "game-" + srv.Name
+}
+
+// gameAddr is the address the game port of a server binds: listen_address, or all interfaces
+// (IPv4 and IPv6 where the system has both).
+func gameAddr(srv *Config) string {
+	return net.JoinHostPort(srv.ListenAddress, srv.ListenPort)
+}
+
+// listenGame binds the game port of a server and registers it for binary upgrades.
+func listenGame(srv *Config) (net.Listener, error) {
+	ln, err := listenTCP(socketName(srv), gameAddr(srv))
+	if err != nil {
+		return nil, err
+	}
+	if err := setListenerOptions(ln, srv); err != nil {
+		log.Printf("Could not set tcp_max_segment on %s: %v", gameAddr(srv), err)
+	}
+	listenersLock.Lock()
+	gameListeners[socketName(srv)] = ln
+	listenersLock.Unlock()
+	return ln, nil
+}
+
+// serveGame accepts game connections for the named server until the listener is closed.
+func serveGame(ln net.Listener, name string) {
+	for {
+		acquireConnSlot()
+		conn, err := ln.Accept()
+		if err != nil {
+			releaseConnSlot()
+			if errors.Is(err, net.ErrClosed) {
+				return // Handed over to an upgraded process
+			}
+			continue
+		}
+		if !admitConnection(name, remoteIP(conn)) {
+			releaseConnSlot()
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer releaseConnSlot()
+			handleConnection(conn, serverConfig(name))
+		}()
+	}
+}
+
+// startExtraServers starts the game servers of the servers list.
+func startExtraServers() {
+	for _, srv := range allServers()[1:] {
+		ln, err := listenGame(srv)
+		if err != nil {
+			log.Fatalf("Server %s: %v", srv.Name, err)
+		}
+		log.Printf("Server %s started (version: %s, protocol: %d, port: %s, %d user(s))",
+			srv.Name, srv.VersionName, srv.ProtocolID, srv.ListenPort, len(srv.Passwords))
+		go serveGame(ln, srv.Name)
+	}
+}
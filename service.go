@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Service identity in the platform's service manager
+const (
+	serviceName        = "minewire-server"
+	serviceDisplayName = "Minewire Proxy Server"
+	serviceDescription = "Minewire tunnel server disguised as a Minecraft server"
+)
+
+// runServiceCommand implements "service install|uninstall|start|stop", registering the server
+// with systemd (Linux), launchd (macOS) or the Windows service manager.
+func runServiceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: minewire-server service install|uninstall|start|stop [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+	if env := os.Getenv("MINEWIRE_CONFIG"); env != "" {
+		configPath = env
+	}
+	fs.StringVar(&configPath, "config", configPath, "config file the service runs with (env MINEWIRE_CONFIG)")
+	printOnly := fs.Bool("print", false, "install: print the generated service definition instead of installing it")
+	fs.Parse(args[1:])
+
+	var err error
+	switch args[0] {
+	case "install":
+		var exe, conf string
+		if exe, conf, err = servicePaths(); err != nil {
+			break
+		}
+		if *printOnly {
+			err = printService(exe, conf)
+			break
+		}
+		if err = installService(exe, conf); err == nil {
+			fmt.Printf("Installed service %s (%s --config %s)\n", serviceName, exe, conf)
+		}
+	case "uninstall":
+		if err = uninstallService(); err == nil {
+			fmt.Printf("Removed service %s\n", serviceName)
+		}
+	case "start":
+		err = startService()
+	case "stop":
+		err = stopService()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service command: %s\n", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// servicePaths returns the absolute paths of this executable and of the config file, since
+// service managers start programs from an unrelated working directory.
+func servicePaths() (string, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", "", err
+	}
+	conf, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(conf); err != nil {
+		return "", "", err
+	}
+	return exe, conf, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	launchdLabel     = "com.minewire.server"
+	launchdPlistPath = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+	launchdLogPath   = "/var/log/" + serviceName + ".log"
+)
+
+// launchdPlist returns a launch daemon definition that keeps the server running.
+func launchdPlist(exe, conf string) string {
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>--config</string>
+		<string>%s</string>
+	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel, esc(exe), esc(conf), esc(filepath.Dir(conf)), launchdLogPath, launchdLogPath)
+}
+
+func printService(exe, conf string) error {
+	fmt.Print(launchdPlist(exe, conf))
+	return nil
+}
+
+// installService writes the launch daemon. It starts at boot; "service start" loads it now.
+func installService(exe, conf string) error {
+	return os.WriteFile(launchdPlistPath, []byte(launchdPlist(exe, conf)), 0644)
+}
+
+func uninstallService() error {
+	launchctl("bootout", "system/"+launchdLabel)
+	return os.Remove(launchdPlistPath)
+}
+
+func startService() error { return launchctl("bootstrap", "system", launchdPlistPath) }
+func stopService() error  { return launchctl("bootout", "system/"+launchdLabel) }
+
+// launchctl runs launchctl with its output passed through.
+func launchctl(args ...string) error {
+	cmd := exec.Command("launchctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed minewire-server.service
+var systemdUnit string
+
+const systemdUnitPath = "/etc/systemd/system/" + serviceName + ".service"
+
+// systemdUnitFor returns the bundled unit pointed at the given executable and config file.
+// The User/Group lines are dropped if the minewire account (created by setup.sh) doesn't exist.
+func systemdUnitFor(exe, conf string) string {
+	_, userErr := user.Lookup("minewire")
+	var lines []string
+	for _, line := range strings.Split(systemdUnit, "\n") {
+		switch {
+		case strings.HasPrefix(line, "ExecStart="):
+			line = fmt.Sprintf("ExecStart=%q --config %q", exe, conf)
+		case strings.HasPrefix(line, "WorkingDirectory="):
+			line = "WorkingDirectory=" + filepath.Dir(conf)
+		case strings.HasPrefix(line, "ReadWritePaths="):
+			line = "ReadWritePaths=" + filepath.Dir(conf)
+		case strings.HasPrefix(line, "User="), strings.HasPrefix(line, "Group="):
+			if userErr != nil {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func printService(exe, conf string) error {
+	fmt.Print(systemdUnitFor(exe, conf))
+	return nil
+}
+
+func installService(exe, conf string) error {
+	if err := os.WriteFile(systemdUnitPath, []byte(systemdUnitFor(exe, conf)), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", serviceName)
+}
+
+func uninstallService() error {
+	systemctl("disable", "--now", serviceName)
+	if err := os.Remove(systemdUnitPath); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func startService() error { return systemctl("start", serviceName) }
+func stopService() error  { return systemctl("stop", serviceName) }
+
+// systemctl runs systemctl with its output passed through.
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runAsService reports whether the process was started by a service manager that needs a
+// control loop. systemd and launchd just run the server, so this is Windows only.
+func runAsService(run func()) bool {
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+var errNoServiceManager = errors.New("no supported service manager on this platform")
+
+func printService(exe, conf string) error   { return errNoServiceManager }
+func installService(exe, conf string) error { return errNoServiceManager }
+func uninstallService() error               { return errNoServiceManager }
+func startService() error                   { return errNoServiceManager }
+func stopService() error                    { return errNoServiceManager }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runAsService runs the server under the Windows service manager, logging to the Windows
+// event log. It returns false when started from a console.
+func runAsService(run func()) bool {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return false
+	}
+	if el, err := eventlog.Open(serviceName); err == nil {
+		log.SetOutput(eventLogWriter{el})
+	}
+	// Relative paths in the config (icon, logs) are relative to the config file
+	os.Chdir(filepath.Dir(configPath))
+	if err := svc.Run(serviceName, windowsService{run}); err != nil {
+		log.Printf("Service failed: %v", err)
+	}
+	return true
+}
+
+// windowsService answers service control requests while the server runs.
+type windowsService struct {
+	run func()
+}
+
+func (s windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go s.run()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Printf("Service stopping")
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// eventLogWriter sends log lines to the Windows event log with a matching event type.
+type eventLogWriter struct {
+	el *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	switch logSeverity(msg) {
+	case sevCrit, sevErr:
+		w.el.Error(1, msg)
+	case sevWarning:
+		w.el.Warning(1, msg)
+	default:
+		w.el.Info(1, msg)
+	}
+	return len(p), nil
+}
+
+func printService(exe, conf string) error {
+	fmt.Printf("sc.exe create %s binPath= \"\\\"%s\\\" --config \\\"%s\\\"\" start= auto DisplayName= \"%s\"\n",
+		serviceName, exe, conf, serviceDisplayName)
+	return nil
+}
+
+// installService registers an automatically started service that restarts after crashes.
+func installService(exe, conf string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service already installed")
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "--config", conf)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 10 * time.Second}}, 86400)
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService() error {
+	return withService(func(s *mgr.Service) error {
+		s.Control(svc.Stop)
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		eventlog.Remove(serviceName)
+		return nil
+	})
+}
+
+func startService() error {
+	return withService(func(s *mgr.Service) error { return s.Start() })
+}
+
+// stopService asks the service to stop and waits up to 10 seconds for it.
+func stopService() error {
+	return withService(func(s *mgr.Service) error {
+		st, err := s.Control(svc.Stop)
+		for i := 0; err == nil && st.State != svc.Stopped; i++ {
+			if i == 100 {
+				return errors.New("timed out waiting for the service to stop")
+			}
+			time.Sleep(100 * time.Millisecond)
+			st, err = s.Query()
+		}
+		return err
+	})
+}
+
+// withService calls f with the installed service.
+func withService(f func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return f(s)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Session is a live authenticated tunnel session
+type Session struct {
+	ID       uint64
+	Username string
+	Server   string // Game server the session logged in on
+	Remote   string
+	Start    time.Time
+
+	BytesUp   atomic.Int64 // Client -> server tunnel payload
+	BytesDown atomic.Int64 // Server -> client tunnel payload
+	Streams   atomic.Int64 // Currently open streams
+	RTT       atomic.Int64 // Smoothed Keep Alive round trip in nanoseconds, 0 until the client answers one
+	lastPing  atomic.Int64 // Unix nanoseconds of the last tunnel ping answered (stream_keepalive)
+
+	Goroutines atomic.Int64 // Goroutines started for this session that are still running
+	Conns      atomic.Int64 // Open destination connections
+
+	conn    net.Conn
+	span    *Span              // Tunnel stage span, parent of the stream spans
+	streams map[uint32]*Stream // Streams with a destination, guarded by the manager lock
+}
+
+// Kick terminates the session by closing its connection.
+func (s *Session) Kick() {
+	s.conn.Close()
+}
+
+// spawn runs f in a goroutine accounted to the session, for the leak watchdog. A panic in f
+// ends only this session.
+func (s *Session) spawn(f func()) {
+	s.Goroutines.Add(1)
+	go func() {
+		defer s.Goroutines.Add(-1)
+		scope := &panicScope{stage: "tunnel", remote: s.Remote, close: s.Kick}
+		defer scope.recoverPanic()
+		f()
+	}()
+}
+
+// pingTunnel checks that the client still answers on the tunnel, for streams idle for interval.
+// An answer is shared by all the session's streams for an interval, so idle streams don't
+// each send a ping.
+func (s *Session) pingTunnel(tunnel *yamux.Session, interval time.Duration) error {
+	if time.Since(time.Unix(0, s.lastPing.Load())) < interval {
+		return nil
+	}
+	if _, err := tunnel.Ping(); err != nil {
+		return err
+	}
+	s.lastPing.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Stream is a live stream of a session, from its destination request until it closes
+type Stream struct {
+	ID      uint32
+	Session *Session
+	Dest    string
+	Start   time.Time
+
+	BytesUp   atomic.Int64 // Client -> destination
+	BytesDown atomic.Int64 // Destination -> client
+}
+
+// Session event kinds
+const (
+	SessionOpened = "session_opened"
+	SessionClosed = "session_closed"
+	StreamOpened  = "stream_opened"
+	StreamClosed  = "stream_closed"
+)
+
+// SessionEvent is a change of the session registry passed to subscribers. Stream is nil for
+// session events.
+type SessionEvent struct {
+	Kind    string
+	Session *Session
+	Stream  *Stream
+}
+
+// SessionManager tracks every live session and stream. Subscribers are called after each
+// change, in the goroutine making it, so they must not block.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[uint64]*Session
+	nextID   atomic.Uint64
+	hooks    []*func(SessionEvent)
+}
+
+// Registry of live sessions
+var sessions = &SessionManager{sessions: make(map[uint64]*Session)}
+
+// Subscribe calls fn on every session and stream event until the returned function is called.
+func (m *SessionManager) Subscribe(fn func(SessionEvent)) (cancel func()) {
+	hook := &fn
+	m.mu.Lock()
+	m.hooks = append(slices.Clip(m.hooks), hook)
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.hooks = slices.DeleteFunc(slices.Clone(m.hooks), func(h *func(SessionEvent)) bool { return h == hook })
+		m.mu.Unlock()
+	}
+}
+
+// notify passes an event to the subscribers. The hooks slice is never modified in place, so a
+// copy taken under the lock can be iterated without it.
+func (m *SessionManager) notify(hooks []*func(SessionEvent), ev SessionEvent) {
+	for _, h := range hooks {
+		(*h)(ev)
+	}
+}
+
+// Register adds a new live session to the registry.
+func (m *SessionManager) Register(username, server string, conn net.Conn) *Session {
+	s := &Session{
+		ID:       m.nextID.Add(1),
+		Username: username,
+		Server:   server,
+		Remote:   conn.RemoteAddr().String(),
+		Start:    time.Now(),
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+	}
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	hooks := m.hooks
+	m.mu.Unlock()
+	m.notify(hooks, SessionEvent{Kind: SessionOpened, Session: s})
+	return s
+}
+
+// Unregister removes a finished session from the registry.
+func (m *SessionManager) Unregister(s *Session) {
+	m.mu.Lock()
+	delete(m.sessions, s.ID)
+	hooks := m.hooks
+	m.mu.Unlock()
+	m.notify(hooks, SessionEvent{Kind: SessionClosed, Session: s})
+}
+
+// OpenStream adds a stream that requested dest to its session.
+func (m *SessionManager) OpenStream(s *Session, id uint32, dest string) *Stream {
+	st := &Stream{ID: id, Session: s, Dest: dest, Start: time.Now()}
+	m.mu.Lock()
+	s.streams[id] = st
+	hooks := m.hooks
+	m.mu.Unlock()
+	m.notify(hooks, SessionEvent{Kind: StreamOpened, Session: s, Stream: st})
+	return st
+}
+
+// CloseStream removes a finished stream from its session.
+func (m *SessionManager) CloseStream(st *Stream) {
+	m.mu.Lock()
+	delete(st.Session.streams, st.ID)
+	hooks := m.hooks
+	m.mu.Unlock()
+	m.notify(hooks, SessionEvent{Kind: StreamClosed, Session: st.Session, Stream: st})
+}
+
+// Count returns the number of live sessions.
+func (m *SessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// Live returns a snapshot of all live sessions, oldest first.
+func (m *SessionManager) Live() []*Session {
+	m.mu.Lock()
+	list := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Streams returns a snapshot of the live streams of a session, oldest first.
+func (m *SessionManager) Streams(s *Session) []*Stream {
+	m.mu.Lock()
+	list := make([]*Stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		list = append(list, st)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// UserCount returns the number of live sessions of a user.
+func (m *SessionManager) UserCount(username string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, s := range m.sessions {
+		if s.Username == username {
+			n++
+		}
+	}
+	return n
+}
+
+// Find returns the live session with the given ID.
+func (m *SessionManager) Find(id uint64) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// KickUser closes the live sessions of a user and returns how many there were.
+func (m *SessionManager) KickUser(username string) int {
+	n := 0
+	for _, s := range m.Live() {
+		if s.Username == username {
+			s.Kick()
+			n++
+		}
+	}
+	return n
+}
+
+// countingReader adds the bytes read through it to a counter.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// loginEvent is an entry of the recent logins list
+type loginEvent struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Remote   string    `json:"remote"`
+	Accepted bool      `json:"accepted"`
+}
+
+const maxRecentLogins = 100
+
+// Recent logins and disabled users
+var (
+	loginsLock   sync.Mutex
+	recentLogins []loginEvent
+	disabledUser = make(map[string]bool) // Usernames refused at login until re-enabled
+)
+
+// recordLogin appends a login attempt to the recent logins list.
+func recordLogin(username string, conn net.Conn, accepted bool) {
+	loginsLock.Lock()
+	defer loginsLock.Unlock()
+	recentLogins = append(recentLogins, loginEvent{
+		Time:     time.Now(),
+		Username: username,
+		Remote:   conn.RemoteAddr().String(),
+		Accepted: accepted,
+	})
+	if len(recentLogins) > maxRecentLogins {
+		recentLogins = recentLogins[len(recentLogins)-maxRecentLogins:]
+	}
+}
+
+// isUserDisabled reports whether logins for the username are currently refused.
+func isUserDisabled(username string) bool {
+	loginsLock.Lock()
+	defer loginsLock.Unlock()
+	return disabledUser[username]
+}
+
+// setUserDisabled enables or disables a user, kicking its live sessions when disabling.
+func setUserDisabled(username string, disabled bool) {
+	loginsLock.Lock()
+	if disabled {
+		disabledUser[username] = true
+	} else {
+		delete(disabledUser, username)
+	}
+	loginsLock.Unlock()
+
+	if disabled {
+		sessions.KickUser(username)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Number of destinations reported in the stats API
+const topDestinationsCount = 20
+
+// trafficTotals holds counters accumulated from finished sessions
+type trafficTotals struct {
+	BytesUp       int64 `json:"bytes_up"`
+	BytesDown     int64 `json:"bytes_down"`
+	Sessions      int64 `json:"sessions"` // Currently live
+	Streams       int64 `json:"streams"`  // Currently open
+	SessionsTotal int64 `json:"sessions_total"`
+	StreamsTotal  int64 `json:"streams_total"`
+
+	// Average Keep Alive round trip of the live sessions whose client answers them
+	RTTMillis float64 `json:"rtt_ms,omitempty"`
+	rttSum    int64
+	rttCount  int64
+}
+
+// destinationCount is an entry of the top destinations list
+type destinationCount struct {
+	Dest    string `json:"dest"`
+	Streams int64  `json:"streams"`
+}
+
+// statsResponse is the document served by /api/stats
+type statsResponse struct {
+	Started         time.Time                 `json:"started"`
+	UptimeSeconds   int64                     `json:"uptime_seconds"`
+	Total           trafficTotals             `json:"total"`
+	Users           map[string]*trafficTotals `json:"users"`
+	TopDestinations []destinationCount        `json:"top_destinations"`
+	StatusProbes    statusProbeStats          `json:"status_probes"`
+	Goroutines      int                       `json:"goroutines"` // Whole process
+	OpenFDs         int                       `json:"open_fds"`   // Whole process, -1 if unknown
+	Panics          map[string]int64          `json:"panics"`     // Recovered panics by session stage
+	Upstreams       []upstreamHealth          `json:"upstreams"`  // Exits of upstream egress rules
+}
+
+// Traffic statistics since process start
+var (
+	startTime = time.Now()
+
+	finishedTotals = make(map[string]*trafficTotals) // Per username, from finished sessions and streams
+	statsLock      sync.Mutex
+)
+
+// userTotals returns the totals entry for a user. Must be called with statsLock held.
+func userTotals(m map[string]*trafficTotals, username string) *trafficTotals {
+	t, ok := m[username]
+	if !ok {
+		t = &trafficTotals{}
+		m[username] = t
+	}
+	return t
+}
+
+// initSessionStats keeps the per-user totals up to date from session registry events.
+func initSessionStats() {
+	sessions.Subscribe(func(ev SessionEvent) {
+		switch ev.Kind {
+		case SessionOpened:
+			recordSessionStart(ev.Session.Username)
+		case SessionClosed:
+			recordSessionEnd(ev.Session)
+		case StreamOpened:
+			recordStreamOpen(ev.Session.Username)
+		}
+	})
+}
+
+// recordSessionStart counts a new session for the user.
+func recordSessionStart(username string) {
+	statsLock.Lock()
+	userTotals(finishedTotals, username).SessionsTotal++
+	statsLock.Unlock()
+}
+
+// recordSessionEnd folds the traffic of a finished session into the user's totals.
+func recordSessionEnd(s *Session) {
+	statsLock.Lock()
+	t := userTotals(finishedTotals, s.Username)
+	t.BytesUp += s.BytesUp.Load()
+	t.BytesDown += s.BytesDown.Load()
+	statsLock.Unlock()
+}
+
+// userTraffic returns the bytes a user transferred since the server started.
+func userTraffic(username string) (up, down int64) {
+	statsLock.Lock()
+	if t, ok := finishedTotals[username]; ok {
+		up, down = t.BytesUp, t.BytesDown
+	}
+	statsLock.Unlock()
+	for _, s := range sessions.Live() {
+		if s.Username == username {
+			up += s.BytesUp.Load()
+			down += s.BytesDown.Load()
+		}
+	}
+	return up, down
+}
+
+// recordStreamOpen counts a new stream for the user.
+func recordStreamOpen(username string) {
+	statsLock.Lock()
+	userTotals(finishedTotals, username).StreamsTotal++
+	statsLock.Unlock()
+}
+
+// collectStats builds the stats document from finished totals plus live sessions.
+func collectStats() statsResponse {
+	resp := statsResponse{
+		Started:       startTime,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Users:         make(map[string]*trafficTotals),
+		StatusProbes:  collectProbeStats(),
+		Goroutines:    runtime.NumGoroutine(),
+		OpenFDs:       openFDs(),
+		Panics:        panicStats(),
+		Upstreams:     collectUpstreamHealth(),
+	}
+
+	statsLock.Lock()
+	for user, t := range finishedTotals {
+		copied := *t
+		resp.Users[user] = &copied
+	}
+	statsLock.Unlock()
+
+	// Destinations follow the destination_stats privacy mode and retention
+	_, top := topDestinations(topDestinationsCount)
+	for _, u := range top {
+		resp.TopDestinations = append(resp.TopDestinations, destinationCount{Dest: u.Host, Streams: u.Streams})
+	}
+
+	for _, s := range sessions.Live() {
+		t := userTotals(resp.Users, s.Username)
+		t.BytesUp += s.BytesUp.Load()
+		t.BytesDown += s.BytesDown.Load()
+		t.Sessions++
+		t.Streams += s.Streams.Load()
+		if rtt := s.RTT.Load(); rtt != 0 {
+			t.rttSum += rtt
+			t.rttCount++
+		}
+	}
+	for _, t := range resp.Users {
+		if t.rttCount > 0 {
+			t.RTTMillis = rttMillis(t.rttSum / t.rttCount)
+		}
+		resp.Total.rttSum += t.rttSum
+		resp.Total.rttCount += t.rttCount
+		resp.Total.BytesUp += t.BytesUp
+		resp.Total.BytesDown += t.BytesDown
+		resp.Total.Sessions += t.Sessions
+		resp.Total.Streams += t.Streams
+		resp.Total.SessionsTotal += t.SessionsTotal
+		resp.Total.StreamsTotal += t.StreamsTotal
+	}
+	if resp.Total.rttCount > 0 {
+		resp.Total.RTTMillis = rttMillis(resp.Total.rttSum / resp.Total.rttCount)
+	}
+	return resp
+}
+
+// rttMillis converts a round trip in nanoseconds to milliseconds with microsecond precision.
+func rttMillis(ns int64) float64 {
+	return float64(ns/1000) / 1000
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, collectStats())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subsAccessRecord is one subscription access log entry
+type subsAccessRecord struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"` // Subscription nicknames and tokens are not logged
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	User      string    `json:"user,omitempty"` // Nickname whose subscription was served
+	Format    string    `json:"format,omitempty"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// subsResponseWriter records the status and size of a response for the access log
+type subsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	user   string
+}
+
+func (w *subsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *subsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// subsBucket is the request budget of one source IP, refilled at subs_rate_limit per minute
+type subsBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var (
+	subsAccessLog *RotatingFile
+	subsBuckets   = make(map[string]*subsBucket)
+	subsPruned    time.Time
+	subsRateLock  sync.Mutex
+)
+
+// initSubsAccessLog opens the subscription access log, if configured. It rotates like access_log.
+func initSubsAccessLog() {
+	cfg := currentConfig()
+	if cfg.SubsAccessLog == "" {
+		return
+	}
+	f, err := OpenRotatingFile(cfg.SubsAccessLog, cfg.AccessLogMaxSize, cfg.AccessLogMaxBackups,
+		cfg.AccessLogRotateHours, cfg.AccessLogMaxAge)
+	if err != nil {
+		log.Fatalf("Could not open subscription access log %s: %v", cfg.SubsAccessLog, err)
+	}
+	subsAccessLog = f
+}
+
+// allowSubsRequest takes a request from the budget of ip, allowing bursts of subs_rate_limit.
+func allowSubsRequest(ip string) bool {
+	cfg := currentConfig()
+	if cfg.SubsRateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	limit := float64(cfg.SubsRateLimit)
+
+	subsRateLock.Lock()
+	defer subsRateLock.Unlock()
+	// Buckets idle for a minute are full again and can be dropped
+	if now.Sub(subsPruned) > time.Minute {
+		for k, b := range subsBuckets {
+			if now.Sub(b.updated) > time.Minute {
+				delete(subsBuckets, k)
+			}
+		}
+		subsPruned = now
+	}
+	b, ok := subsBuckets[ip]
+	if !ok {
+		b = &subsBucket{tokens: limit, updated: now}
+		subsBuckets[ip] = b
+	}
+	b.tokens = min(limit, b.tokens+now.Sub(b.updated).Minutes()*limit)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// subsAccess rate limits requests for subscriptions per source IP and writes every request to
+// the subscription access log.
+func subsAccess(next http.Handler) http.Handler {
+	cfg := currentConfig()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &subsResponseWriter{ResponseWriter: w}
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		// Only subscription paths are limited, browsing the decoy website is not
+		path := r.URL.Path
+		if strings.HasPrefix(path, cfg.SubsPath) && path != cfg.SubsPath {
+			path = cfg.SubsPath + "..."
+			if !allowSubsRequest(ip) {
+				recordEvent(EventLimit, ip, "", "subs_rate_limit")
+				sw.Header().Set("Retry-After", "60")
+				http.Error(sw, "Too Many Requests", http.StatusTooManyRequests)
+			}
+		}
+		if sw.status == 0 {
+			next.ServeHTTP(sw, r)
+		}
+
+		if subsAccessLog == nil {
+			return
+		}
+		rec := subsAccessRecord{
+			Time: start.UTC(), Remote: ip, Method: r.Method, Path: path, Status: sw.status,
+			Bytes: sw.bytes, User: sw.user, UserAgent: r.UserAgent(),
+		}
+		if sw.user != "" {
+			rec.Format = r.URL.Query().Get("format")
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		if line, err := json.Marshal(rec); err == nil {
+			subsAccessLog.Write(append(line, '\n'))
+		}
+	})
+}
+
+// setSubsUser notes the user whose subscription is served for the access log.
+func setSubsUser(w http.ResponseWriter, name string) {
+	if sw, ok := w.(*subsResponseWriter); ok {
+		sw.user = name
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Clash, sing-box and Xray have no Minecraft transport, so their snippets chain through the
+// local SOCKS5 port of the Minewire client (subs_local_proxy), which connects to the endpoints.
+
+// clashProxy is an entry of the proxies list of a Clash (Mihomo) config
+type clashProxy struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Server string `yaml:"server"`
+	Port   int    `yaml:"port"`
+	UDP    bool   `yaml:"udp"`
+}
+
+// localProxy splits subs_local_proxy into host and port.
+func localProxy() (string, int) {
+	cfg := currentConfig()
+	host, p, _ := net.SplitHostPort(cfg.SubsLocalProxy)
+	port, _ := strconv.Atoi(p)
+	return host, port
+}
+
+// writeClashSubscription writes a Clash proxies list with the mw:// links to run the client with
+// as comments.
+func writeClashSubscription(w http.ResponseWriter, user UserConfig, hosts []string) {
+	cfg := currentConfig()
+	h, port := localProxy()
+	data, err := yaml.Marshal(map[string][]clashProxy{
+		"proxies": {{Name: user.Name, Type: "socks5", Server: h, Port: port}},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	fmt.Fprintf(w, "# Run the Minewire client on %s with one of these links, by priority:\n", cfg.SubsLocalProxy)
+	for _, link := range subscriptionLinks(user, hosts) {
+		fmt.Fprintf(w, "# %s\n", link)
+	}
+	w.Write(data)
+}
+
+// singBoxOutbound is a socks outbound of a sing-box config
+type singBoxOutbound struct {
+	Type       string `json:"type"`
+	Tag        string `json:"tag"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Version    string `json:"version"`
+}
+
+// xrayOutbound is a socks outbound of an Xray config
+type xrayOutbound struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+	Settings struct {
+		Servers []xraySocksServer `json:"servers"`
+	} `json:"settings"`
+}
+
+type xraySocksServer struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// writeSingBoxSubscription writes a sing-box outbounds list. sing-box rejects unknown keys, so
+// the client gets its endpoints from the json format.
+func writeSingBoxSubscription(w http.ResponseWriter, user UserConfig) {
+	h, port := localProxy()
+	writeJSON(w, map[string]interface{}{
+		"outbounds": []singBoxOutbound{{Type: "socks", Tag: user.Name, Server: h, ServerPort: port, Version: "5"}},
+	})
+}
+
+// writeXraySubscription writes an Xray outbounds list, without the endpoints like sing-box.
+func writeXraySubscription(w http.ResponseWriter, user UserConfig) {
+	h, port := localProxy()
+	out := xrayOutbound{Tag: user.Name, Protocol: "socks"}
+	out.Settings.Servers = []xraySocksServer{{Address: h, Port: port}}
+	writeJSON(w, map[string]interface{}{
+		"outbounds": []xrayOutbound{out},
+	})
+}
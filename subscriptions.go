@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"minewire-server/internal/core"
+)
+
+// subsAddr returns the listen address of the subscription server of c.
+func subsAddr(c *Config) string {
+	return net.JoinHostPort(c.SubsListenAddress, c.SubsListenPort)
+}
+
+// startSubscriptionServer listens on subs_listen_address:subs_listen_port and serves subscription links.
+func startSubscriptionServer() {
+	cfg := currentConfig()
+	ln, err := listenTCP("subs", subsAddr(cfg))
+	if err != nil {
+		log.Printf("Subscription Server Error: %v", err)
+		return
+	}
+	listenersLock.Lock()
+	subsListener = ln
+	listenersLock.Unlock()
+	serveSubscriptions(ln)
+}
+
+// SubsEndpoint is an address listed in subscriptions, e.g. another domain, port or a fallback server
+type SubsEndpoint struct {
+	Name     string `yaml:"name"`     // Appended to the link name, e.g. "Phone (backup)"
+	Host     string `yaml:"host"`     // Defaults to the host the subscription was requested from
+	Port     string `yaml:"port"`     // Defaults to the port of the user's server
+	Priority int    `yaml:"priority"` // Lower is tried first
+	Server   string `yaml:"server"`   // Only for users of this game server (default: all)
+}
+
+// Subscription address selections (subs_address_selection)
+const (
+	SubsAddressesAll          = "all"           // Every public address
+	SubsAddressesClientFamily = "client_family" // Public addresses of the client's IP family, and domains
+)
+
+// subscriptionEndpoint is an address of a user's subscription with its resolved host and port
+type subscriptionEndpoint struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Priority int    `json:"priority"`
+	Link     string `json:"link"`
+}
+
+// subscriptionEndpoints returns the addresses of a user from every subs_endpoints entry that
+// applies, by priority, or the address of its server when no endpoints are configured. Entries
+// without a host are repeated for each of hosts, labelled with the host when there are several.
+func subscriptionEndpoints(user UserConfig, hosts []string) []subscriptionEndpoint {
+	cfg := currentConfig()
+	server := userServer(user.Username())
+	var endpoints []SubsEndpoint
+	for _, e := range cfg.SubsEndpoints {
+		if e.Server == "" || e.Server == server {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = []SubsEndpoint{{}}
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool { return endpoints[i].Priority < endpoints[j].Priority })
+
+	var list []subscriptionEndpoint
+	add := func(e SubsEndpoint, host, label string) {
+		ep := subscriptionEndpoint{Name: user.Name, Host: host, Port: e.Port, Priority: e.Priority}
+		if ep.Port == "" {
+			ep.Port = serverConfig(server).ListenPort
+		}
+		if label != "" {
+			ep.Name += " (" + label + ")"
+		}
+		ep.Link = fmt.Sprintf("mw://%s@%s#%s", user.Password, net.JoinHostPort(ep.Host, ep.Port), (&url.URL{Fragment: ep.Name}).EscapedFragment())
+		list = append(list, ep)
+	}
+	for _, e := range endpoints {
+		if e.Host != "" {
+			add(e, e.Host, e.Name)
+			continue
+		}
+		for _, host := range hosts {
+			label := e.Name
+			if len(hosts) > 1 {
+				label = strings.TrimPrefix(label+", "+host, ", ")
+			}
+			add(e, host, label)
+		}
+	}
+	return list
+}
+
+// subscriptionLinks returns the mw:// links of a user's subscription, by priority.
+func subscriptionLinks(user UserConfig, hosts []string) []string {
+	var links []string
+	for _, e := range subscriptionEndpoints(user, hosts) {
+		links = append(links, e.Link)
+	}
+	return links
+}
+
+// subscriptionDocument is the ?format=json subscription: everything a client needs to connect
+// without parsing links.
+type subscriptionDocument struct {
+	Version   int                    `json:"version"`
+	Name      string                 `json:"name"`
+	Server    string                 `json:"server"`
+	Username  string                 `json:"username"` // Minecraft name the client logs in with
+	Password  string                 `json:"password"`
+	Cipher    string                 `json:"cipher"` // Tunnel cipher, keyed by the SHA-256 of the password
+	Endpoints []subscriptionEndpoint `json:"endpoints"`
+	Limits    UserLimits             `json:"limits"`
+	Usage     subscriptionUsage      `json:"usage"`
+	Expires   *time.Time             `json:"expires,omitempty"` // Account or signed path expiry, whichever is first
+	Routing   *core.Routing          `json:"routing,omitempty"` // Split tunneling rules (subs_routing)
+}
+
+// subscriptionUsage is the traffic of a user since the server started
+type subscriptionUsage struct {
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	Remaining *int64 `json:"remaining,omitempty"` // Bytes left of quota_mb
+}
+
+// newSubscriptionDocument returns the structured subscription of a user.
+func newSubscriptionDocument(user UserConfig, hosts []string, expires *time.Time) subscriptionDocument {
+	cfg := currentConfig()
+	var usage subscriptionUsage
+	usage.BytesUp, usage.BytesDown = userTraffic(user.Username())
+	if q := user.Limits.QuotaMB << 20; q > 0 {
+		remaining := max(q-usage.BytesUp-usage.BytesDown, 0)
+		usage.Remaining = &remaining
+	}
+	doc := subscriptionDocument{
+		Version:   1,
+		Name:      user.Name,
+		Server:    serverConfig(userServer(user.Username())).Name,
+		Username:  user.Username(),
+		Password:  user.Password,
+		Cipher:    "aes-256-gcm",
+		Endpoints: subscriptionEndpoints(user, hosts),
+		Limits:    user.Limits,
+		Usage:     usage,
+		Expires:   expires,
+	}
+	if routing := cfg.SubsRouting; !routing.Empty() {
+		doc.Routing = &routing
+	}
+	return doc
+}
+
+// writeSubscription writes a subscription in the requested ?format=: plain (one mw:// link per
+// line, the default), base64 (the plain list encoded, as many converters expect), json, or a
+// snippet for clash, sing-box or xray.
+func writeSubscription(w http.ResponseWriter, r *http.Request, user UserConfig, hosts []string, expires *time.Time) {
+	if end, ok := user.Limits.ExpiresAt(); ok && (expires == nil || end.Before(*expires)) {
+		expires = &end
+	}
+	w.Header().Set("Subscription-Userinfo", subscriptionUserinfo(user, expires))
+	plain := strings.Join(subscriptionLinks(user, hosts), "\n")
+	switch r.URL.Query().Get("format") {
+	case "", "plain":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(plain))
+	case "base64":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(plain))))
+	case "json":
+		writeJSON(w, newSubscriptionDocument(user, hosts, expires))
+	case "clash":
+		writeClashSubscription(w, user, hosts)
+	case "sing-box":
+		writeSingBoxSubscription(w, user)
+	case "xray":
+		writeXraySubscription(w, user)
+	default:
+		http.Error(w, "Unknown format (expected plain, base64, json, clash, sing-box or xray)", http.StatusBadRequest)
+	}
+}
+
+// subscriptionUserinfo returns the Subscription-Userinfo header clients such as Clash and V2Ray
+// apps show: the traffic since the server started, the quota and the expiry.
+func subscriptionUserinfo(user UserConfig, expires *time.Time) string {
+	up, down := userTraffic(user.Username())
+	info := fmt.Sprintf("upload=%d; download=%d", up, down)
+	if user.Limits.QuotaMB > 0 {
+		info += fmt.Sprintf("; total=%d", user.Limits.QuotaMB<<20)
+	}
+	if expires != nil {
+		info += fmt.Sprintf("; expire=%d", expires.Unix())
+	}
+	return info
+}
+
+// serveSubscriptions serves subscription links on ln until it is closed.
+func serveSubscriptions(ln net.Listener) {
+	cfg := currentConfig()
+	tlsConfig, err := subsTLSConfig()
+	if err != nil {
+		log.Printf("Subscription Server Error: %v", err)
+		ln.Close()
+		return
+	}
+	switch {
+	case tlsConfig == nil:
+		log.Printf("Starting Subscription Server on %s", subsAddr(cfg))
+	case tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert:
+		ln = tls.NewListener(ln, tlsConfig)
+		log.Printf("Starting Subscription Server on %s (HTTPS, client certificates required)", subsAddr(cfg))
+	default:
+		ln = tls.NewListener(ln, tlsConfig)
+		log.Printf("Starting Subscription Server on %s (HTTPS)", subsAddr(cfg))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleSubsRequest)
+	server := &http.Server{
+		Handler:           subsAccess(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       time.Minute,
+		MaxHeaderBytes:    16 << 10,
+	}
+	err = server.Serve(ln)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Subscription Server Error: %v", err)
+	}
+}
+
+// handleSubsRequest serves subscriptions under subs_path and the decoy website everywhere else.
+func handleSubsRequest(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if id, ok := strings.CutPrefix(r.URL.Path, cfg.SubsPath); ok && id != "" {
+		subsAuth(http.HandlerFunc(handleSubscription)).ServeHTTP(w, r)
+		return
+	}
+	serveSubsDecoy(w, r)
+}
+
+// handleSubscription serves the subscription named by the path: a user id (or the nickname of
+// users without one), or a signed token with subs_secret.
+func handleSubscription(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	key := strings.TrimPrefix(r.URL.Path, cfg.SubsPath)
+
+	// One-time links work with and without subs_secret
+	var expires *time.Time
+	if name, exp, ok := takeOneTimeLink(key); ok {
+		key, expires = name, &exp
+	} else if cfg.SubsSecret != "" {
+		// With subs_secret the path is a signed token, ids and nicknames alone are not accepted
+		name, exp, err := verifySubscriptionToken(key)
+		if errors.Is(err, errTokenExpired) {
+			http.Error(w, "Subscription expired", http.StatusGone)
+			return
+		}
+		if err != nil {
+			subsNotFound(w, r)
+			return
+		}
+		key, expires = name, &exp
+	}
+
+	user, ok := lookupSubscription(key)
+	if !ok && rotatedSubscription(key) {
+		http.Error(w, "This subscription was replaced, ask for the new link", http.StatusGone)
+		return
+	}
+	if !ok || user.Password == "" { // Users configured by key have no password to hand out
+		subsNotFound(w, r)
+		return
+	}
+
+	setSubsUser(w, key)
+	writeSubscription(w, r, user, subscriptionHosts(r), expires)
+}
+
+// subscriptionHosts returns the hosts links point at: public_addresses if configured, only those
+// of the client's address family with subs_address_selection: client_family, or else the host
+// the subscription was requested from.
+func subscriptionHosts(r *http.Request) []string {
+	cfg := currentConfig()
+	if len(cfg.PublicAddresses) == 0 {
+		return []string{subscriptionHost(r)}
+	}
+	if cfg.SubsAddressSelection != SubsAddressesClientFamily {
+		return cfg.PublicAddresses
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	clientV4 := isIPv4(ip)
+	var hosts []string
+	for _, h := range cfg.PublicAddresses {
+		// Domain names may resolve to either family and are always kept
+		if net.ParseIP(h) == nil || isIPv4(h) == clientV4 {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return cfg.PublicAddresses
+	}
+	return hosts
+}
+
+// isIPv4 reports whether s is an IPv4 address, including IPv4-mapped IPv6 addresses.
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// subscriptionHost returns the host links point at: the request's Host header if it is one of
+// subs_hosts (or acme_domains), otherwise the first of them. Without either list the Host
+// header is used as is.
+func subscriptionHost(r *http.Request) string {
+	cfg := currentConfig()
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	allowed := cfg.SubsHosts
+	if len(allowed) == 0 {
+		allowed = cfg.ACMEDomains
+	}
+	if len(allowed) == 0 {
+		return host
+	}
+	for _, h := range allowed {
+		if strings.EqualFold(h, host) {
+			return h
+		}
+	}
+	return allowed[0]
+}
+
+// serveSubsDecoy serves the static website in subs_decoy_dir, so the subscription port looks
+// like an ordinary web server to scanners.
+func serveSubsDecoy(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.SubsDecoyDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.FileServer(http.Dir(cfg.SubsDecoyDir)).ServeHTTP(w, r)
+}
+
+// subsNotFound answers a path that is not a subscription like any other missing page.
+func subsNotFound(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.SubsDecoyDir != "" {
+		serveSubsDecoy(w, r)
+		return
+	}
+	http.Error(w, "Subscription not found", http.StatusNotFound)
+}
+
+var errTokenExpired = errors.New("subscription token expired")
+
+// signSubscriptionToken returns a subscription token for the named user, valid until expires:
+// the expiry and name, base64url encoded, and their HMAC-SHA256 under subs_secret.
+func signSubscriptionToken(name string, expires time.Time) string {
+	cfg := currentConfig()
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	payload = append(payload, name...)
+	mac := hmac.New(sha256.New, []byte(cfg.SubsSecret))
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// verifySubscriptionToken checks the signature and expiry of a token and returns the user name
+// and the expiry.
+func verifySubscriptionToken(token string) (string, time.Time, error) {
+	cfg := currentConfig()
+	enc := base64.RawURLEncoding
+	p, s, ok := strings.Cut(token, ".")
+	payload, err1 := enc.DecodeString(p)
+	sig, err2 := enc.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil || len(payload) <= 8 {
+		return "", time.Time{}, errors.New("malformed subscription token")
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.SubsSecret))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", time.Time{}, errors.New("invalid subscription token signature")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if time.Now().After(expires) {
+		return "", time.Time{}, errTokenExpired
+	}
+	return string(payload[8:]), expires, nil
+}
+
+// subscriptionToken is the response of the token API and CLI
+type subscriptionToken struct {
+	Name    string    `json:"name"`
+	Token   string    `json:"token"`
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+}
+
+// newSubscriptionToken signs a token for the user with the subscription key name (id or
+// nickname), valid for ttl (subs_token_ttl hours if zero).
+func newSubscriptionToken(name string, ttl time.Duration) (subscriptionToken, error) {
+	cfg := currentConfig()
+	if cfg.SubsSecret == "" {
+		return subscriptionToken{}, errors.New("subs_secret is not set")
+	}
+	if user, ok := lookupSubscription(name); !ok || user.Password == "" {
+		return subscriptionToken{}, fmt.Errorf("no user %q with a password", name)
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(cfg.SubsTokenTTL) * time.Hour
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token := signSubscriptionToken(name, expires)
+	return subscriptionToken{Name: name, Token: token, Path: cfg.SubsPath + token, Expires: expires}, nil
+}
+
+// handleAdminSubsToken issues a subscription token for a user, valid for ?ttl= (e.g. 24h).
+func handleAdminSubsToken(w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := newSubscriptionToken(r.PathValue("name"), ttl)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin issued a subscription token for %s, valid until %s", t.Name, t.Expires.Format(time.RFC3339))
+	writeJSON(w, t)
+}
+
+// runSubsCommand handles "subs token" (prints a subscription token) and "subs once" (mints a
+// one-time link on the running server). Returns the process exit code.
+func runSubsCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "token" && args[0] != "once") {
+		fmt.Fprintln(os.Stderr, "usage: minewire-server subs token --user ID [--ttl 720h] [--config server.yaml]")
+		fmt.Fprintln(os.Stderr, "       minewire-server subs once --user ID [--ttl 15m] [--config server.yaml]")
+		return 2
+	}
+	var name string
+	var ttl time.Duration
+	parseFlags("subs "+args[0], args[1:], func(fs *flag.FlagSet) {
+		fs.StringVar(&name, "user", "", "id of the user (nickname for users without one)")
+		fs.DurationVar(&ttl, "ttl", 0, "validity (default subs_token_ttl for tokens, 15m for one-time links)")
+	})
+	loadConfig()
+	var t subscriptionToken
+	var err error
+	if args[0] == "once" {
+		t, err = requestOneTimeLink(name, ttl)
+	} else {
+		initAuthMap()
+		t, err = newSubscriptionToken(name, ttl)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\nexpires %s\n", t.Path, t.Expires.Format(time.RFC3339))
+	return 0
+}
+
+// subsTLSConfig returns the TLS settings of the subscription server: the certificate from
+// subs_tls_cert or ACME, and client certificate verification against subs_client_ca. It
+// returns nil when subscriptions are served over plain HTTP.
+func subsTLSConfig() (*tls.Config, error) {
+	cfg := currentConfig()
+	var tc *tls.Config
+	switch {
+	case cfg.SubsTLSCert != "":
+		cert, err := tls.LoadX509KeyPair(cfg.SubsTLSCert, cfg.SubsTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tc = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	case acmeEnabled():
+		tc = acmeTLSConfig()
+	default:
+		return nil, nil
+	}
+	if cfg.SubsClientCA != "" {
+		data, err := os.ReadFile(cfg.SubsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates", cfg.SubsClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// subsAuth requires subs_token, if set, as a bearer token or a ?token= parameter (for clients
+// that can only import a URL).
+func subsAuth(next http.Handler) http.Handler {
+	cfg := currentConfig()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.SubsToken != "" {
+			token := r.URL.Query().Get("token")
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SubsToken)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
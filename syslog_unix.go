@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter forwards each log line to syslog with the severity guessed from its wording.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var err error
+	switch logSeverity(msg) {
+	case sevCrit:
+		err = s.w.Crit(msg)
+	case sevErr:
+		err = s.w.Err(msg)
+	case sevWarning:
+		err = s.w.Warning(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// openSyslog connects to the local syslog daemon, or to a remote one given as
+// "udp://host:514" or "tcp://host:514".
+func openSyslog(address, tag string) (io.Writer, error) {
+	network, raddr := "", ""
+	if address != "" {
+		network, raddr = "udp", address
+		if i := strings.Index(address, "://"); i >= 0 {
+			network, raddr = address[:i], address[i+3:]
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w: w}, nil
+}
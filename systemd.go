@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File descriptor of the first socket passed by systemd (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// Sockets passed by systemd socket activation, by FileDescriptorName
+// ("game", "query", "subs", "admin", "acme"). Unnamed sockets default to "game".
+var activatedFiles = make(map[string]*os.File)
+
+// initSocketActivation collects the sockets passed by systemd, if any.
+func initSocketActivation() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	// A binary upgrade passes sockets the same way, but cannot know the new pid in advance
+	upgrade := os.Getenv("MINEWIRE_UPGRADE_FD") != ""
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() && !upgrade {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := "game"
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		activatedFiles[name] = os.NewFile(uintptr(listenFdsStart+i), name)
+	}
+	if upgrade {
+		log.Printf("Received %d socket(s) from the previous process", n)
+	} else if n > 0 {
+		log.Printf("Received %d socket(s) from systemd", n)
+	}
+}
+
+// listenTCP returns the socket passed by systemd under name, or listens on addr.
+func listenTCP(name, addr string) (net.Listener, error) {
+	if f, ok := activatedFiles[name]; ok {
+		delete(activatedFiles, name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUDP returns the datagram socket passed by systemd under name, or listens on addr.
+func listenUDP(name, addr string) (net.PacketConn, error) {
+	if f, ok := activatedFiles[name]; ok {
+		delete(activatedFiles, name)
+		defer f.Close()
+		return net.FilePacketConn(f)
+	}
+	return net.ListenPacket("udp", addr)
+}
+
+// sdNotify sends a state notification (READY=1, RELOADING=1, STOPPING=1...) to the service
+// manager. It does nothing when not started by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if strings.HasPrefix(socket, "@") {
+		addr.Name = "\x00" + socket[1:] // Abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// sdNotifyReloading tells systemd a reload started. RELOADING=1 requires the monotonic timestamp.
+func sdNotifyReloading() {
+	sdNotify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(monotonicUsec(), 10))
+}
+
+// startSystemdWatchdog pings the systemd watchdog at half the configured WatchdogSec interval.
+func startSystemdWatchdog() {
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if pid := os.Getenv("WATCHDOG_PID"); usec <= 0 || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		sdNotify("WATCHDOG=1")
+	}
+}
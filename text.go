@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"minewire-server/pkg/mcproto"
+)
+
+// NBT tag types used in text components
+const (
+	nbtTagEnd      = 0x00
+	nbtTagByte     = 0x01
+	nbtTagString   = 0x08
+	nbtTagList     = 0x09
+	nbtTagCompound = 0x0A
+)
+
+// TextComponent is a Minecraft chat component, used for disconnect reasons, chat and prompts.
+// It marshals to the JSON format used in the login state and can be written as NBT for play packets.
+type TextComponent struct {
+	Text          string          `json:"text"`
+	Color         string          `json:"color,omitempty"`
+	Bold          bool            `json:"bold,omitempty"`
+	Italic        bool            `json:"italic,omitempty"`
+	Underlined    bool            `json:"underlined,omitempty"`
+	Strikethrough bool            `json:"strikethrough,omitempty"`
+	Obfuscated    bool            `json:"obfuscated,omitempty"`
+	Extra         []TextComponent `json:"extra,omitempty"`
+}
+
+// legacyColors maps legacy § color codes to component color names
+var legacyColors = map[rune]string{
+	'0': "black", '1': "dark_blue", '2': "dark_green", '3': "dark_aqua",
+	'4': "dark_red", '5': "dark_purple", '6': "gold", '7': "gray",
+	'8': "dark_gray", '9': "blue", 'a': "green", 'b': "aqua",
+	'c': "red", 'd': "light_purple", 'e': "yellow", 'f': "white",
+}
+
+// ParseLegacyText converts a string with legacy § formatting codes into a text component.
+// Color codes reset formatting, like in the vanilla client. Literal "\n" sequences become line breaks.
+func ParseLegacyText(s string) TextComponent {
+	s = strings.ReplaceAll(s, `\n`, "\n")
+
+	var parts []TextComponent
+	var cur TextComponent
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			cur.Text = text.String()
+			parts = append(parts, cur)
+			text.Reset()
+		}
+	}
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '§' || i+1 >= len(runes) {
+			text.WriteRune(runes[i])
+			continue
+		}
+		code := runes[i+1]
+		if code >= 'A' && code <= 'Z' {
+			code += 'a' - 'A'
+		}
+		i++
+
+		flush()
+		if color, ok := legacyColors[code]; ok {
+			cur = TextComponent{Color: color}
+			continue
+		}
+		switch code {
+		case 'k':
+			cur.Obfuscated = true
+		case 'l':
+			cur.Bold = true
+		case 'm':
+			cur.Strikethrough = true
+		case 'n':
+			cur.Underlined = true
+		case 'o':
+			cur.Italic = true
+		case 'r':
+			cur = TextComponent{}
+		default:
+			// Unknown code: keep it as literal text
+			text.WriteRune('§')
+			text.WriteRune(runes[i])
+		}
+	}
+	flush()
+
+	switch len(parts) {
+	case 0:
+		return TextComponent{}
+	case 1:
+		return parts[0]
+	default:
+		return TextComponent{Extra: parts}
+	}
+}
+
+// JSON returns the component as a JSON string, as sent in login disconnect and status packets.
+func (c TextComponent) JSON() string {
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// WriteNBT writes the component as nameless NBT, the text component format of play packets since 1.20.3.
+func (c TextComponent) WriteNBT(w io.Writer) error {
+	pw := mcproto.NewPacketWriter(w)
+	pw.Byte(nbtTagCompound)
+	c.writeNBTPayload(pw)
+	return pw.Err()
+}
+
+func (c TextComponent) writeNBTPayload(w *mcproto.PacketWriter) {
+	writeNBTString(w, "text", c.Text)
+	if c.Color != "" {
+		writeNBTString(w, "color", c.Color)
+	}
+	flags := []struct {
+		name string
+		set  bool
+	}{
+		{"bold", c.Bold}, {"italic", c.Italic}, {"underlined", c.Underlined},
+		{"strikethrough", c.Strikethrough}, {"obfuscated", c.Obfuscated},
+	}
+	for _, f := range flags {
+		if f.set {
+			w.Byte(nbtTagByte)
+			w.StringNBT(f.name)
+			w.Byte(1)
+		}
+	}
+	if len(c.Extra) > 0 {
+		w.Byte(nbtTagList)
+		w.StringNBT("extra")
+		w.Byte(nbtTagCompound)
+		w.Int(int32(len(c.Extra)))
+		for _, e := range c.Extra {
+			e.writeNBTPayload(w)
+		}
+	}
+	w.Byte(nbtTagEnd)
+}
+
+func writeNBTString(w *mcproto.PacketWriter, name, value string) {
+	w.Byte(nbtTagString)
+	w.StringNBT(name)
+	w.StringNBT(value)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	traceQueueSize     = 2048 // Finished spans waiting for export; more are dropped
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+)
+
+// Span is one traced stage of a session. A nil *Span is valid and records nothing,
+// so callers don't need to check whether tracing is enabled.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+
+	mu     sync.Mutex
+	attrs  map[string]interface{}
+	failed string // Error status message
+}
+
+var traceQueue chan *Span
+
+// startSpan starts a span as a child of parent, or as the root of a new trace when parent is nil.
+func startSpan(parent *Span, name string) *Span {
+	if traceQueue == nil {
+		return nil
+	}
+	s := &Span{name: name, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttr sets a string, integer or boolean attribute.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// Fail marks the span as failed with the given reason.
+func (s *Span) Fail(reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = reason
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case traceQueue <- s:
+	default: // Collector too slow or unreachable, drop rather than block sessions
+	}
+}
+
+// sessionTrace follows a connection through its stages (handshake, status/login, join, tunnel),
+// each stage being a child span of the connection span.
+type sessionTrace struct {
+	root  *Span
+	stage *Span
+	name  string // Current stage, also known when tracing is disabled
+}
+
+func newSessionTrace(remote string) *sessionTrace {
+	root := startSpan(nil, "connection")
+	root.SetAttr("net.peer.ip", remote)
+	return &sessionTrace{root: root, stage: startSpan(root, "handshake"), name: "handshake"}
+}
+
+// next ends the current stage and starts the named one.
+func (t *sessionTrace) next(name string) *Span {
+	t.stage.End()
+	t.stage = startSpan(t.root, name)
+	t.name = name
+	return t.stage
+}
+
+// fail marks the current stage and the connection as failed.
+func (t *sessionTrace) fail(reason string) {
+	t.stage.Fail(reason)
+	t.root.Fail(reason)
+}
+
+func (t *sessionTrace) end() {
+	t.stage.End()
+	t.root.End()
+}
+
+// OTLP/HTTP JSON encoding (opentelemetry-proto, trace/v1)
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"` // 2 = server
+	Start        string                 `json:"startTimeUnixNano"`
+	End          string                 `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue         `json:"attributes,omitempty"`
+	Status       map[string]interface{} `json:"status,omitempty"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint32:
+		return map[string]interface{}{"intValue": strconv.FormatUint(uint64(v), 10)}
+	}
+	return map[string]interface{}{"stringValue": "?"}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    2,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	if s.failed != "" {
+		o.Status = map[string]interface{}{"code": 2, "message": s.failed}
+	}
+	return o
+}
+
+// exportSpans posts a batch of spans to the OTLP/HTTP traces endpoint.
+func exportSpans(client *http.Client, batch []*Span) error {
+	cfg := currentConfig()
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpKeyValue{
+				{Key: "service.name", Value: otlpValue(cfg.TracingServiceName)},
+				{Key: "service.version", Value: otlpValue(ServerVersion)},
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "minewire-server"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.TracingEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.TracingHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// startTraceExporter batches finished spans and sends them to the collector.
+func startTraceExporter() {
+	cfg := currentConfig()
+	log.Printf("Exporting traces to %s", cfg.TracingEndpoint)
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	lastErr := ""
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := exportSpans(client, batch)
+		batch = batch[:0]
+		// Log collector errors once instead of every flush
+		if err != nil && err.Error() != lastErr {
+			log.Printf("Trace export failed: %v", err)
+		}
+		lastErr = ""
+		if err != nil {
+			lastErr = err.Error()
+		}
+	}
+	for {
+		select {
+		case s := <-traceQueue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// initTracing enables span recording if a collector endpoint is configured.
+func initTracing() {
+	cfg := currentConfig()
+	if cfg.TracingEndpoint == "" {
+		return
+	}
+	traceQueue = make(chan *Span, traceQueueSize)
+	go startTraceExporter()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net/netip"
+	"sync"
+
+	"minewire-server/internal/core"
+	"minewire-server/internal/tun"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Outgoing packets queued per client in TUN mode; more are dropped, like a full router queue
+const packetQueueSize = 256
+
+// packetRouter carries the IP packet streams of clients in TUN mode through the server's TUN
+// interface: packets from a client are handed to the kernel, which routes (and NATs) them like
+// those of any other interface, and packets it routes back to a client's address are sent
+// down that client's stream.
+type packetRouter struct {
+	dev     *tun.Device
+	network netip.Prefix
+	mtu     int
+
+	mu      sync.Mutex
+	clients map[netip.Addr]chan []byte // Outgoing packets by client address
+}
+
+var tunRouter *packetRouter // nil unless tun_network is set
+
+// initTunRouter creates the TUN interface of tun_network. The server takes the network's first
+// address, clients get the following ones.
+func initTunRouter() {
+	cfg := currentConfig()
+	if cfg.TunNetwork == "" {
+		return
+	}
+	network := netip.MustParsePrefix(cfg.TunNetwork).Masked()
+	dev, err := tun.Open(cfg.TunName)
+	if err != nil {
+		log.Fatalf("Could not create the TUN interface %s: %v", cfg.TunName, err)
+	}
+	if err := dev.Configure(netip.PrefixFrom(network.Addr().Next(), network.Bits()), cfg.TunMTU); err != nil {
+		log.Fatalf("Could not configure the TUN interface %s: %v", dev.Name(), err)
+	}
+	tunRouter = &packetRouter{dev: dev, network: network, mtu: cfg.TunMTU, clients: make(map[netip.Addr]chan []byte)}
+	log.Printf("TUN mode on %s (%s, MTU %d)", dev.Name(), network, cfg.TunMTU)
+	go tunRouter.readLoop()
+}
+
+// readLoop hands the packets the kernel routes to the interface to the clients they're addressed to.
+func (r *packetRouter) readLoop() {
+	buf := make([]byte, core.MaxPacket)
+	for {
+		n, err := r.dev.Read(buf)
+		if err != nil {
+			log.Printf("TUN interface %s: %v", r.dev.Name(), err)
+			return
+		}
+		dst, ok := core.PacketDestination(buf[:n])
+		if !ok {
+			continue
+		}
+		r.mu.Lock()
+		out := r.clients[dst]
+		r.mu.Unlock()
+		if out == nil {
+			continue
+		}
+		select {
+		case out <- bytes.Clone(buf[:n]):
+		default:
+		}
+	}
+}
+
+// attach gives a client the first free address of the network, with the queue of its packets.
+func (r *packetRouter) attach() (netip.Addr, chan []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The network address and the server's are skipped, and so is the broadcast address
+	for addr := r.network.Addr().Next().Next(); r.network.Contains(addr.Next()); addr = addr.Next() {
+		if _, used := r.clients[addr]; !used {
+			out := make(chan []byte, packetQueueSize)
+			r.clients[addr] = out
+			return addr, out, true
+		}
+	}
+	return netip.Addr{}, nil, false
+}
+
+// detach frees the address of a client whose packet stream ended.
+func (r *packetRouter) detach(addr netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, addr)
+}
+
+// servePacketStream relays an IP packet stream (core.PacketStream) between the client and the
+// TUN interface until either side closes it, and returns the close reason.
+func servePacketStream(stream *yamux.Stream, br *bufio.Reader, sess *Session, st *Stream) string {
+	if tunRouter == nil {
+		return "TUN mode disabled"
+	}
+	addr, out, ok := tunRouter.attach()
+	if !ok {
+		log.Printf("No free address in tun_network %s for %s", tunRouter.network, logUser(sess.Username))
+		return "TUN network full"
+	}
+	defer tunRouter.detach(addr)
+	if err := core.WritePacketAssignment(stream, netip.PrefixFrom(addr, tunRouter.network.Bits()), tunRouter.mtu); err != nil {
+		return "client closed"
+	}
+
+	weight := userBandwidthWeight(sess.Username)
+	done, written := make(chan struct{}), make(chan struct{})
+	sess.spawn(func() {
+		defer close(written)
+		for {
+			select {
+			case packet := <-out:
+				bandwidth.wait(sess.Username, weight, len(packet))
+				if err := core.WriteIPPacket(stream, packet); err != nil {
+					stream.Close()
+					return
+				}
+				st.BytesDown.Add(int64(len(packet)))
+			case <-done:
+				return
+			}
+		}
+	})
+
+	buf := make([]byte, core.MaxPacket)
+	for {
+		packet, err := core.ReadIPPacket(br, buf)
+		if err != nil {
+			break
+		}
+		// Only the client's own address may be used, so clients can't spoof each other
+		if src, ok := core.PacketSource(packet); !ok || src != addr {
+			continue
+		}
+		bandwidth.wait(sess.Username, weight, len(packet))
+		if _, err := tunRouter.dev.Write(packet); err != nil {
+			continue // e.g. a malformed packet the kernel refuses
+		}
+		st.BytesUp.Add(int64(len(packet)))
+	}
+	close(done)
+	<-written
+	return "client closed"
+}
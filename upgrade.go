@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long the new process may take to start serving before the upgrade is abandoned
+const upgradeStartTimeout = 30 * time.Second
+
+// Listeners handed over to the new process on a binary upgrade (see also reload.go)
+var (
+	gameListeners = make(map[string]net.Listener) // By socket name, see socketName
+	adminListener net.Listener
+
+	upgrading atomic.Bool
+)
+
+// fileListener is implemented by the TCP listeners and UDP connections that can be handed over
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// upgradeBinary starts the current executable again with all listening sockets, waits until it
+// serves, then stops accepting and drains the live sessions before exiting. If the new process
+// fails to start, this one keeps running as before.
+func upgradeBinary() {
+	if !upgrading.CompareAndSwap(false, true) {
+		log.Printf("Upgrade already in progress")
+		return
+	}
+	pid, err := startUpgradedProcess()
+	if err != nil {
+		log.Printf("Upgrade failed, keeping the running process: %v", err)
+		upgrading.Store(false)
+		return
+	}
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", pid))
+
+	// The new process owns the sockets now
+	listenersLock.Lock()
+	for _, l := range gameListeners {
+		l.Close()
+	}
+	for _, l := range []net.Listener{adminListener, subsListener, acmeListener} {
+		if l != nil {
+			l.Close()
+		}
+	}
+	if queryConn != nil {
+		queryConn.Close()
+	}
+	queryConn, subsListener = nil, nil
+	listenersLock.Unlock()
+
+	drainSessions()
+	log.Printf("Upgrade complete, old process exiting")
+	os.Exit(0)
+}
+
+// startUpgradedProcess execs the binary with the listening sockets, like systemd socket
+// activation, and returns its pid once it reports being ready.
+func startUpgradedProcess() (int, error) {
+	// Started by the name it was invoked with, so a binary replaced on disk is picked up
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listenersLock.Lock()
+	sockets := []struct {
+		name string
+		l    interface{}
+	}{{"query", queryConn}, {"subs", subsListener}, {"admin", adminListener}, {"acme", acmeListener}}
+	for name, l := range gameListeners {
+		sockets = append(sockets, struct {
+			name string
+			l    interface{}
+		}{name, l})
+	}
+	for _, s := range sockets {
+		fl, ok := s.l.(fileListener)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			listenersLock.Unlock()
+			return 0, fmt.Errorf("%s socket: %w", s.name, err)
+		}
+		names = append(names, s.name)
+		files = append(files, f)
+	}
+	listenersLock.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = upgradeEnv(names, listenFdsStart+len(files))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	log.Printf("Upgrade: started %s (pid %d) with %d socket(s)", exe, cmd.Process.Pid, len(files))
+
+	// The new process writes to the pipe once serving; it closes without data if it dies
+	ready.SetReadDeadline(time.Now().Add(upgradeStartTimeout))
+	buf := make([]byte, 1)
+	if n, err := ready.Read(buf); n == 0 {
+		cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, errors.New("new process did not become ready in time")
+		}
+		return 0, fmt.Errorf("new process exited: %v", <-exited)
+	}
+	return cmd.Process.Pid, nil
+}
+
+// upgradeEnv returns the environment of the new process: the socket activation variables, the
+// readiness pipe, and no stale systemd pids.
+func upgradeEnv(names []string, readyFd int) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", "MINEWIRE_UPGRADE_FD":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"MINEWIRE_UPGRADE_FD="+strconv.Itoa(readyFd))
+}
+
+// signalUpgradeReady tells the previous process that this one is serving, when started by an upgrade.
+func signalUpgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv("MINEWIRE_UPGRADE_FD"))
+	os.Unsetenv("MINEWIRE_UPGRADE_FD")
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// drainSessions waits for live sessions to end, closing the rest after upgrade_drain_timeout.
+func drainSessions() {
+	cfg := currentConfig()
+	var deadline <-chan time.Time
+	if cfg.UpgradeDrainTimeout > 0 {
+		deadline = time.After(time.Duration(cfg.UpgradeDrainTimeout) * time.Second)
+	}
+	log.Printf("Upgrade: draining %d session(s)", len(sessions.Live()))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for len(sessions.Live()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			left := sessions.Live()
+			log.Printf("Upgrade: drain timeout, closing %d remaining session(s)", len(left))
+			for _, s := range left {
+				s.Kick()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// Binary upgrades need inherited sockets, which these platforms don't support
+var upgradeSignal os.Signal
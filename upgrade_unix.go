@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal that starts a zero-downtime binary upgrade
+var upgradeSignal os.Signal = syscall.SIGUSR2
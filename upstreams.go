@@ -0,0 +1,413 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Strategies picking the exit of an upstream rule. Whatever the strategy, exits that just
+// failed are tried last, so every strategy fails over to the others.
+const (
+	StrategyRoundRobin   = "round_robin"   // Each stream takes the next exit
+	StrategyLeastLatency = "least_latency" // The exit with the fastest recent connects
+	StrategyHash         = "hash"          // The same destination host always takes the same exit
+	StrategyFailover     = "failover"      // The first exit, the next ones only when it fails
+)
+
+// An exit that failed is skipped for upstreamBackoff, doubling with every consecutive failure
+// up to maxUpstreamBackoff
+const (
+	upstreamBackoff    = 30 * time.Second
+	maxUpstreamBackoff = 5 * time.Minute
+)
+
+// upstreamState is what the server learned about an exit from the streams it carried and its
+// health checks
+type upstreamState struct {
+	latency   time.Duration // Moving average of successful connects, 0 until the first
+	failures  int           // Consecutive failed connects
+	downUntil time.Time
+
+	dead      bool // Failed its last health check
+	checked   time.Time
+	checkTime time.Duration
+	checkErr  string
+}
+
+// errUpstreamRefused is returned when a working exit could not connect to the destination
+var errUpstreamRefused = errors.New("connect failed")
+
+var (
+	upstreamStates = make(map[string]*upstreamState) // By upstreamName
+	upstreamLock   sync.Mutex
+)
+
+// parseUpstream checks an exit of an upstream rule: socks5://[user:pass@]host:port,
+// http://[user:pass@]host:port, or direct:// with an optional local address to connect from.
+func parseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+		if u.Hostname() == "" || u.Port() == "" {
+			return nil, fmt.Errorf("upstream %q must be a socks5://host:port or http://host:port URL", s)
+		}
+	case "direct":
+		if u.Host == "" {
+			break
+		}
+		if _, err := netip.ParseAddr(u.Hostname()); err != nil || u.Port() != "" || u.User != nil {
+			return nil, fmt.Errorf("upstream %q must be direct:// or direct://<local address>", s)
+		}
+	default:
+		return nil, fmt.Errorf("upstream %q must be a socks5://, http:// or direct:// URL", s)
+	}
+	return u, nil
+}
+
+// upstreamName names an exit in logs and statistics, without its credentials.
+func upstreamName(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// upstreamOrder returns the exits of a rule in the order a stream to dest tries them.
+func upstreamOrder(r *egressRule, dest string) []*url.URL {
+	exits := slices.Clone(r.upstreams)
+	n := len(exits)
+	switch r.Strategy {
+	case StrategyHash:
+		host, _, _ := net.SplitHostPort(dest)
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		start := int(h.Sum32() % uint32(n))
+		exits = append(exits[start:], exits[:start]...)
+	case StrategyFailover:
+	case StrategyLeastLatency:
+		upstreamLock.Lock()
+		latency := make(map[*url.URL]time.Duration, n)
+		for _, u := range exits {
+			if s := upstreamStates[upstreamName(u)]; s != nil {
+				latency[u] = s.latency
+			}
+		}
+		upstreamLock.Unlock()
+		// Exits not measured yet come first, to measure them
+		slices.SortStableFunc(exits, func(a, b *url.URL) int { return cmp.Compare(latency[a], latency[b]) })
+	default:
+		start := int((r.next.Add(1) - 1) % uint64(n))
+		exits = append(exits[start:], exits[:start]...)
+	}
+
+	now := time.Now()
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	slices.SortStableFunc(exits, func(a, b *url.URL) int {
+		downA, downB := isUpstreamDown(a, now), isUpstreamDown(b, now)
+		switch {
+		case downA == downB:
+			return 0
+		case downA:
+			return 1
+		}
+		return -1
+	})
+	return exits
+}
+
+// isUpstreamDown reports whether an exit failed recently or failed its health check. Must be called with upstreamLock held.
+func isUpstreamDown(u *url.URL, now time.Time) bool {
+	s := upstreamStates[upstreamName(u)]
+	return s != nil && (s.dead || now.Before(s.downUntil))
+}
+
+// upstreamStateOf returns the state of an exit, created on first use. Must be called with
+// upstreamLock held.
+func upstreamStateOf(name string) *upstreamState {
+	s := upstreamStates[name]
+	if s == nil {
+		s = &upstreamState{}
+		upstreamStates[name] = s
+	}
+	return s
+}
+
+// recordUpstream updates the state of an exit after a connect through it. Failures to reach the
+// destination say nothing about the exit.
+func recordUpstream(u *url.URL, connectTime time.Duration, err error) {
+	if errors.Is(err, errUpstreamRefused) {
+		return
+	}
+	name := upstreamName(u)
+	upstreamLock.Lock()
+	s := upstreamStateOf(name)
+	if err == nil {
+		recovered := s.failures > 0 || s.dead
+		s.failures, s.downUntil, s.dead = 0, time.Time{}, false
+		if s.latency == 0 {
+			s.latency = connectTime
+		} else {
+			s.latency = (s.latency*7 + connectTime) / 8
+		}
+		upstreamLock.Unlock()
+		if recovered {
+			log.Printf("Upstream %s works again", name)
+		}
+		return
+	}
+	s.failures++
+	backoff := min(upstreamBackoff<<min(s.failures-1, 10), maxUpstreamBackoff)
+	s.downUntil = time.Now().Add(backoff)
+	first := s.failures == 1
+	upstreamLock.Unlock()
+	if first {
+		log.Printf("Upstream %s failed, trying other exits first for %v: %v", name, backoff, err)
+	}
+}
+
+// dialUpstreams connects to dest through the exits of an upstream rule in upstreamOrder, until
+// one succeeds. Each attempt gets an equal share of the time left.
+func dialUpstreams(ctx context.Context, r *egressRule, dest string) (net.Conn, error) {
+	exits := upstreamOrder(r, dest)
+	start := time.Now()
+	var err error
+	for i, u := range exits {
+		deadline, _ := ctx.Deadline()
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(exits)-i))
+		attemptStart := time.Now()
+		var conn net.Conn
+		conn, err = dialUpstream(attemptCtx, u, dest)
+		cancel()
+		recordUpstream(u, time.Since(attemptStart), err)
+		if err == nil {
+			recordDial(dest, 0, time.Since(start), false, false)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	recordDial(dest, 0, time.Since(start), false, true)
+	return nil, err
+}
+
+// dialUpstream connects to dest through one exit: a SOCKS5 or HTTP CONNECT proxy, which
+// resolves hostnames itself and receives the credentials of the URL, or directly from a local
+// address.
+func dialUpstream(ctx context.Context, u *url.URL, dest string) (net.Conn, error) {
+	dialer := destinationDialer()
+	if u.Scheme == "direct" {
+		network := "tcp"
+		if local, err := netip.ParseAddr(u.Hostname()); err == nil {
+			// Only destination addresses of the local address's family are reachable from it
+			local = local.Unmap()
+			dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(local, 0))
+			network = "tcp4"
+			if local.Is6() {
+				network = "tcp6"
+			}
+		}
+		conn, err := dialer.DialContext(ctx, network, dest)
+		if errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, fmt.Errorf("upstream %s: %w", upstreamName(u), err)
+		} else if err != nil {
+			// Only a local address gone is a failure of the exit itself
+			return nil, fmt.Errorf("upstream %s: %w: %w", upstreamName(u), errUpstreamRefused, err)
+		}
+		return conn, nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", u.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "socks5" {
+		err = socks5Connect(conn, u.User, dest)
+	} else {
+		err = httpConnect(conn, u.User, dest)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s: %w", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// upstreamHealth is the state of an exit in /api/stats and /api/upstreams
+type upstreamHealth struct {
+	Name       string    `json:"name"` // Without credentials
+	Healthy    bool      `json:"healthy"`
+	LatencyMs  float64   `json:"latency_ms,omitempty"` // Moving average of the streams' connects
+	Failures   int       `json:"failures"`             // Consecutive failed connects of streams
+	LastCheck  time.Time `json:"last_check"`
+	CheckMs    float64   `json:"check_ms,omitempty"`
+	CheckError string    `json:"check_error,omitempty"`
+}
+
+// configuredUpstreams returns the exits of the upstream rules of all egress policies, once each.
+func configuredUpstreams() []*url.URL {
+	egressLock.RLock()
+	defer egressLock.RUnlock()
+	sets := []*egressRuleSet{egressGlobal}
+	for _, set := range egressGroups {
+		sets = append(sets, set)
+	}
+	seen := make(map[string]bool)
+	var exits []*url.URL
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		for _, r := range set.rules {
+			for _, u := range r.upstreams {
+				if !seen[upstreamName(u)] {
+					seen[upstreamName(u)] = true
+					exits = append(exits, u)
+				}
+			}
+		}
+	}
+	return exits
+}
+
+// collectUpstreamHealth reports the state of the configured exits, sorted by name.
+func collectUpstreamHealth() []upstreamHealth {
+	now := time.Now()
+	health := []upstreamHealth{}
+	exits := configuredUpstreams()
+	upstreamLock.Lock()
+	for _, u := range exits {
+		h := upstreamHealth{Name: upstreamName(u), Healthy: !isUpstreamDown(u, now)}
+		if s := upstreamStates[h.Name]; s != nil {
+			h.LatencyMs = rttMillis(s.latency.Nanoseconds())
+			h.Failures = s.failures
+			h.LastCheck = s.checked
+			h.CheckMs = rttMillis(s.checkTime.Nanoseconds())
+			h.CheckError = s.checkErr
+		}
+		health = append(health, h)
+	}
+	upstreamLock.Unlock()
+	slices.SortFunc(health, func(a, b upstreamHealth) int { return cmp.Compare(a.Name, b.Name) })
+	return health
+}
+
+func handleAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, collectUpstreamHealth())
+}
+
+// startUpstreamChecks checks the exits of the upstream rules every upstream_check_interval
+// seconds, so streams skip dead exits instead of finding out themselves.
+func startUpstreamChecks() {
+	go func() {
+		for {
+			interval := currentConfig().UpstreamCheckInterval
+			if interval <= 0 {
+				time.Sleep(time.Minute) // Disabled, until a reload enables checks
+				continue
+			}
+			checkUpstreams()
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
+}
+
+// checkUpstreams checks all configured exits at once and forgets the state of the others.
+func checkUpstreams() {
+	exits := configuredUpstreams()
+	var wg sync.WaitGroup
+	for _, u := range exits {
+		wg.Go(func() {
+			start := time.Now()
+			err := probeUpstream(u)
+			recordUpstreamCheck(u, time.Since(start), err)
+		})
+	}
+	wg.Wait()
+
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	for name := range upstreamStates {
+		if !slices.ContainsFunc(exits, func(u *url.URL) bool { return upstreamName(u) == name }) {
+			delete(upstreamStates, name)
+		}
+	}
+}
+
+// probeUpstream checks an exit. With upstream_check_target it connects to the target through
+// the exit, so a proxy whose next hop is down fails too; without, it only connects to proxies
+// (and authenticates with SOCKS5 ones) and checks that direct exits' addresses are still local.
+func probeUpstream(u *url.URL) error {
+	cfg := currentConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout())
+	defer cancel()
+	if cfg.UpstreamCheckTarget != "" {
+		conn, err := dialUpstream(ctx, u, cfg.UpstreamCheckTarget)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if u.Scheme == "direct" {
+		if u.Host == "" {
+			return nil
+		}
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(u.Hostname(), "0"))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if u.Scheme == "socks5" {
+		deadline, _ := ctx.Deadline()
+		conn.SetDeadline(deadline)
+		return socks5Handshake(conn, u.User)
+	}
+	return nil
+}
+
+// recordUpstreamCheck updates the state of an exit after a health check, logging changes.
+func recordUpstreamCheck(u *url.URL, checkTime time.Duration, err error) {
+	name := upstreamName(u)
+	upstreamLock.Lock()
+	s := upstreamStateOf(name)
+	wasDead := s.dead
+	s.checked, s.checkTime, s.checkErr = time.Now(), checkTime, ""
+	if err != nil {
+		s.checkErr = err.Error()
+	}
+	s.dead = err != nil
+	if err == nil {
+		s.failures, s.downUntil = 0, time.Time{}
+	}
+	upstreamLock.Unlock()
+	switch {
+	case err != nil && !wasDead:
+		log.Printf("Upstream %s failed its health check, streams try other exits first: %v", name, err)
+	case err == nil && wasDead:
+		log.Printf("Upstream %s passed its health check again", name)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"minewire-server/internal/core"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UserLimits restricts the resources of a single user. Zero means unlimited.
+type UserLimits struct {
+	MaxSessions     int    `yaml:"max_sessions" json:"max_sessions"`           // Concurrent tunnel sessions
+	MaxStreams      int    `yaml:"max_streams" json:"max_streams"`             // Concurrent streams per session
+	QuotaMB         int64  `yaml:"quota_mb" json:"quota_mb"`                   // Traffic (up + down) since the server started
+	StreamRate      int    `yaml:"stream_rate" json:"stream_rate"`             // New streams per second, 0 = user_stream_rate, -1 = unlimited
+	MaxDials        int    `yaml:"max_dials" json:"max_dials"`                 // Dials in progress, 0 = user_max_dials, -1 = unlimited
+	DialTimeout     int    `yaml:"dial_timeout" json:"dial_timeout"`           // Seconds to connect to a destination, 0 = dial_timeout
+	BandwidthWeight int    `yaml:"bandwidth_weight" json:"bandwidth_weight"`   // Share of bandwidth_limit under contention, 0 = 1
+	Expires         string `yaml:"expires,omitempty" json:"expires,omitempty"` // Last day of access, YYYY-MM-DD
+}
+
+// ExpiresAt returns the end of the last day of access (UTC), or false without an expiry.
+func (l UserLimits) ExpiresAt() (time.Time, bool) {
+	day, err := time.Parse(time.DateOnly, l.Expires)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day.AddDate(0, 0, 1), true
+}
+
+// accessEnded returns why a user may not start new sessions (expired or over quota), or "".
+func accessEnded(username string, l UserLimits) string {
+	if end, ok := l.ExpiresAt(); ok && !time.Now().Before(end) {
+		return "expired " + l.Expires
+	}
+	if up, down := userTraffic(username); l.QuotaMB > 0 && up+down >= l.QuotaMB<<20 {
+		return fmt.Sprintf("quota of %d MB used", l.QuotaMB)
+	}
+	return ""
+}
+
+// UserConfig is one entry of the passwords list. Three forms are accepted:
+//
+//   - "PASSWORD"
+//   - "PASSWORD": "Nickname"
+//   - id: "u7f3a"
+//     name: "Nickname"
+//     password: "PASSWORD"
+//     limits: {max_sessions: 2, max_streams: 64, quota_mb: 10240, expires: "2026-12-31"}
+//
+// The structured form can keep the secret out of the config file with password_file (read
+// at load) or key, the tunnel key derived from the password (see "config key"). The id names
+// the user's subscription, so renaming the user keeps the link and the credential it serves.
+type UserConfig struct {
+	ID           string     `yaml:"id,omitempty"`
+	Name         string     `yaml:"name"`
+	Password     string     `yaml:"password,omitempty"`
+	PasswordFile string     `yaml:"password_file,omitempty"`
+	Key          string     `yaml:"key,omitempty"`   // Hex SHA-256 of the password
+	Group        string     `yaml:"group,omitempty"` // Name in egress_groups
+	Limits       UserLimits `yaml:"limits"`
+}
+
+// userFields are the keys of a structured user entry. A single-key entry with one of them is
+// structured, not the "PASSWORD": "Nickname" shorthand.
+var userFields = []string{"id", "name", "password", "password_file", "key", "group", "limits"}
+
+// UnmarshalYAML decodes any of the accepted forms, reporting errors with the offending line.
+func (u *UserConfig) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		u.Password = node.Value
+	case yaml.MappingNode:
+		if len(node.Content) == 2 && !slices.Contains(userFields, node.Content[0].Value) {
+			// Shorthand "PASSWORD": "Nickname"
+			if node.Content[1].Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: nickname of a password must be a string", node.Content[1].Line)
+			}
+			u.Password, u.Name = node.Content[0].Value, node.Content[1].Value
+			break
+		}
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; !slices.Contains(userFields, key.Value) {
+				return fmt.Errorf("line %d: unknown user field %q (expected %s)", key.Line, key.Value, strings.Join(userFields, ", "))
+			}
+		}
+		type plain UserConfig // Without the UnmarshalYAML method
+		if err := node.Decode((*plain)(u)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: expected a password or a user entry", node.Line)
+	}
+
+	secrets := 0
+	for _, s := range []string{u.Password, u.PasswordFile, u.Key} {
+		if s != "" {
+			secrets++
+		}
+	}
+	if secrets != 1 {
+		return fmt.Errorf("line %d: exactly one of password, password_file or key is required", node.Line)
+	}
+	if u.PasswordFile != "" {
+		data, err := os.ReadFile(u.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.Line, err)
+		}
+		u.Password = strings.TrimSpace(string(data))
+		clear(data) // The string is a copy
+		if u.Password == "" {
+			return fmt.Errorf("line %d: %s is empty", node.Line, u.PasswordFile)
+		}
+	}
+	if b, err := hex.DecodeString(u.Key); u.Key != "" && (err != nil || len(b) != sha256.Size) {
+		return fmt.Errorf("line %d: key must be 64 hex characters", node.Line)
+	}
+	if u.ID != "" && !validUserID(u.ID) {
+		return fmt.Errorf("line %d: id may only contain letters, digits, - and _ (up to 64)", node.Line)
+	}
+	if u.Limits.MaxSessions < 0 || u.Limits.MaxStreams < 0 || u.Limits.QuotaMB < 0 ||
+		u.Limits.StreamRate < -1 || u.Limits.MaxDials < -1 || u.Limits.DialTimeout < 0 || u.Limits.BandwidthWeight < 0 {
+		return fmt.Errorf("line %d: limits must not be negative (-1 for unlimited stream_rate and max_dials)", node.Line)
+	}
+	if _, err := time.Parse(time.DateOnly, u.Limits.Expires); u.Limits.Expires != "" && err != nil {
+		return fmt.Errorf("line %d: expires must be a date like 2026-12-31", node.Line)
+	}
+	return nil
+}
+
+// MarshalYAML writes the structured form, without a password read from password_file.
+func (u UserConfig) MarshalYAML() (interface{}, error) {
+	type plain UserConfig // Without the MarshalYAML method
+	p := plain(u)
+	if p.PasswordFile != "" {
+		p.Password = ""
+	}
+	return p, nil
+}
+
+// validUserID reports whether id can be used in subscription paths.
+func validUserID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// SubsKey returns the name of the user's subscription: the id, or the nickname of users
+// without one. Users with neither have no subscription.
+func (u UserConfig) SubsKey() string {
+	if u.ID != "" {
+		return u.ID
+	}
+	return u.Name
+}
+
+// TunnelKey returns the AES key of the user's tunnel, the SHA-256 of the password.
+func (u UserConfig) TunnelKey() [32]byte {
+	if u.Key == "" {
+		return core.TunnelKey(u.Password)
+	}
+	var key [32]byte
+	hex.Decode(key[:], []byte(u.Key))
+	return key
+}
+
+// Username returns the in-game name the client derives from the password.
+func (u UserConfig) Username() string {
+	return core.Username(u.TunnelKey())
+}
+
+// usernameFor returns the username a client logs in with for a password.
+func usernameFor(password string) string {
+	return core.Username(core.TunnelKey(password))
+}
+
+// editUser applies edit to the entry of the user with a generated username in a copy of the
+// running config and makes the copy current.
+func editUser(username string, edit func(u *UserConfig) error) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next := cloneUsers(currentConfig())
+	lists := [][]UserConfig{next.Passwords}
+	for _, s := range next.Servers {
+		lists = append(lists, s.Passwords)
+	}
+	for _, list := range lists {
+		for i := range list {
+			if list[i].Username() != username {
+				continue
+			}
+			if err := edit(&list[i]); err != nil {
+				return err
+			}
+			publishUsers(&next)
+			return nil
+		}
+	}
+	return fmt.Errorf("no user %s", username)
+}
+
+// cloneUsers returns a copy of a published config whose passwords lists can be changed. The
+// caller holds reloadLock from loading cur until the copy is published, so no reload or other
+// edit is lost in between.
+func cloneUsers(cur *Config) Config {
+	next := *cur
+	next.Passwords = slices.Clone(cur.Passwords)
+	next.Servers = slices.Clone(cur.Servers)
+	for i := range next.Servers {
+		next.Servers[i].Passwords = slices.Clone(cur.Servers[i].Passwords)
+	}
+	return next
+}
+
+// publishUsers makes a copy made by cloneUsers the running config and rebuilds the user
+// lookups from it. Must be called with reloadLock held.
+func publishUsers(next *Config) {
+	publishConfig(next)
+	initAuthMap()
+}
+
+// addUser adds a user to the game server named server in the running config.
+func addUser(server string, u UserConfig) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	for _, key := range []string{u.Name, u.ID} {
+		if key != "" && subsKeyTaken(key, "") {
+			return fmt.Errorf("%q is already used by another user", key)
+		}
+	}
+	next := cloneUsers(currentConfig())
+	list := &next.Passwords
+	if server != "" && server != next.Name {
+		list = nil
+		for i := range next.Servers {
+			if next.Servers[i].Name == server {
+				list = &next.Servers[i].Passwords
+			}
+		}
+		if list == nil {
+			return fmt.Errorf("no server %q", server)
+		}
+	}
+	*list = append(*list, u)
+	publishUsers(&next)
+	return nil
+}
+
+// saveNewUser appends a user to the passwords list of the game server named server in the
+// YAML config file, keeping its comments and layout.
+func saveNewUser(server string, u UserConfig) error {
+	cfg := currentConfig()
+	return editConfigFile(func(root *yaml.Node) error {
+		config := root
+		if server != "" && server != cfg.Name {
+			config = nil
+			for i := 0; i+1 < len(root.Content); i += 2 {
+				if root.Content[i].Value != "servers" {
+					continue
+				}
+				for _, s := range root.Content[i+1].Content {
+					var named struct {
+						Name string `yaml:"name"`
+					}
+					if s.Decode(&named) == nil && named.Name == server {
+						config = s
+					}
+				}
+			}
+			if config == nil {
+				return fmt.Errorf("%s has no server %q", configPath, server)
+			}
+		}
+
+		str := func(s string) *yaml.Node { return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s} }
+		entry := yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, f := range [][2]string{{"id", u.ID}, {"name", u.Name}, {"password", u.Password}} {
+			if f[1] != "" {
+				entry.Content = append(entry.Content, str(f[0]), str(f[1]))
+			}
+		}
+		if u.Limits != (UserLimits{}) {
+			var limits yaml.Node
+			if err := limits.Encode(u.Limits); err != nil {
+				return err
+			}
+			limits.Style = yaml.FlowStyle
+			entry.Content = append(entry.Content, str("limits"), &limits)
+		}
+		for i := 0; i+1 < len(config.Content); i += 2 {
+			if config.Content[i].Value == "passwords" {
+				config.Content[i+1].Content = append(config.Content[i+1].Content, &entry)
+				return nil
+			}
+		}
+		list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{&entry}}
+		config.Content = append(config.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "passwords"}, list)
+		return nil
+	})
+}
+
+// subsKeyTaken reports whether a user other than username has the nickname or id key.
+func subsKeyTaken(key, username string) bool {
+	for _, srv := range allServers() {
+		for _, u := range srv.Passwords {
+			if u.Username() != username && (u.Name == key || u.ID == key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renameUser sets the nickname of the user with a generated username in the running config.
+// The subscription of a user with an id keeps working under the new nickname.
+func renameUser(username, name string) error {
+	cfg := currentConfig()
+	return editUser(username, func(u *UserConfig) error {
+		if name != "" && subsKeyTaken(name, username) {
+			return fmt.Errorf("%q is already used by another user", name)
+		}
+		if u.ID == "" && u.Name != "" && cfg.SubsListenPort != "" {
+			log.Printf("Renaming %s, which has no id: its subscription moves from %s to %s", logUser(username), u.Name, name)
+		}
+		u.Name = name
+		return nil
+	})
+}
+
+// saveUserEntry applies edit to the passwords entry of the user with a generated username in
+// the YAML config file, keeping its comments and layout.
+func saveUserEntry(username string, edit func(entry *yaml.Node)) error {
+	return editConfigFile(func(root *yaml.Node) error {
+		entry := findUserNode(root, username)
+		if entry == nil {
+			return fmt.Errorf("%s has no entry for %s", configPath, username)
+		}
+		edit(entry)
+		return nil
+	})
+}
+
+// editConfigFile applies edit to the top-level mapping of the YAML config file and writes it
+// back, keeping comments and layout.
+func editConfigFile(edit func(root *yaml.Node) error) error {
+	if f := configFormat(configPath); f != formatYAML {
+		return fmt.Errorf("%s is %s, only YAML config files can be edited", configPath, f)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", configPath)
+	}
+	if err := edit(doc.Content[0]); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configPath)
+}
+
+// findUserNode returns the passwords entry of username in a config mapping or its servers.
+func findUserNode(config *yaml.Node, username string) *yaml.Node {
+	if config.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(config.Content); i += 2 {
+		key, value := config.Content[i].Value, config.Content[i+1]
+		if value.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, item := range value.Content {
+			switch key {
+			case "servers":
+				if entry := findUserNode(item, username); entry != nil {
+					return entry
+				}
+			case "passwords":
+				var u UserConfig
+				if item.Decode(&u) == nil && u.Username() == username {
+					return item
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setEntryField sets a field of one passwords entry node. The short forms are rewritten into
+// the structured one, except for a new nickname of a "PASSWORD": "Nickname" entry.
+func setEntryField(entry *yaml.Node, field, value string) {
+	str := func(s string) *yaml.Node { return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s} }
+	switch {
+	case entry.Kind == yaml.ScalarNode:
+		// "PASSWORD" becomes {password: "PASSWORD"}, keeping a comment on the password line
+		password := *entry
+		password.HeadComment, password.FootComment = "", ""
+		*entry = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: entry.HeadComment,
+			FootComment: entry.FootComment, Content: []*yaml.Node{str("password"), &password}}
+	case len(entry.Content) == 2 && entry.Content[0].Value != "password" && entry.Content[0].Value != "name" &&
+		entry.Content[0].Value != "id":
+		// "PASSWORD": "Nickname"
+		if field == "name" {
+			entry.Content[1].Value = value
+			return
+		}
+		entry.Content = []*yaml.Node{str("name"), entry.Content[1], str("password"), entry.Content[0]}
+	}
+
+	at := 0
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		switch entry.Content[i].Value {
+		case field:
+			entry.Content[i+1].Value = value
+			return
+		case "id", "name":
+			at = i + 2 // Fields follow the id and name
+		}
+	}
+	if field == "id" {
+		at = 0
+	}
+	entry.Content = slices.Insert(entry.Content, at, str(field), str(value))
+}
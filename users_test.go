@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestUserConfigSingleKey checks that entries with a single user field decode as that field,
+// not as the "PASSWORD": "Nickname" shorthand.
+func TestUserConfigSingleKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alice")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		entry string
+		want  UserConfig
+	}{
+		{"password: secret", UserConfig{Password: "secret"}},
+		{"password_file: " + file, UserConfig{Password: "from-file", PasswordFile: file}},
+		{"key: " + key, UserConfig{Key: key}},
+		{"secret: Alice", UserConfig{Password: "secret", Name: "Alice"}},
+	}
+	for _, tt := range tests {
+		var u UserConfig
+		if err := yaml.Unmarshal([]byte(tt.entry), &u); err != nil {
+			t.Errorf("%s: %v", tt.entry, err)
+			continue
+		}
+		if u != tt.want {
+			t.Errorf("%s: decoded as %+v, want %+v", tt.entry, u, tt.want)
+		}
+	}
+
+	// Fields other than a secret are structured too, so they are missing one
+	for _, field := range []string{"id: alice", "name: Alice", "group: eu", "limits: {max_sessions: 2}"} {
+		var u UserConfig
+		if err := yaml.Unmarshal([]byte(field), &u); err == nil {
+			t.Errorf("%s: decoded as %+v, want an error", field, u)
+		}
+	}
+}
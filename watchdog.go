@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Consecutive watchdog checks with growing goroutine counts before a session is reported
+const watchdogGrowthChecks = 10
+
+// sessionUsage is the watchdog's memory of a session between checks
+type sessionUsage struct {
+	goroutines int64
+	growing    int  // Consecutive checks the goroutine count increased
+	reported   bool // Growth already logged
+}
+
+// openFDs returns the number of open file descriptors of the process, or -1 if unknown.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// startWatchdog periodically checks the goroutines and connections held by each session.
+// Sessions whose goroutine count keeps growing are logged, sessions over the limits are closed.
+func startWatchdog() {
+	cfg := currentConfig()
+	ticker := time.NewTicker(time.Duration(cfg.WatchdogInterval) * time.Second)
+	defer ticker.Stop()
+	usage := make(map[uint64]*sessionUsage)
+
+	for range ticker.C {
+		cfg := currentConfig()
+		seen := make(map[uint64]bool)
+		for _, s := range sessions.Live() {
+			seen[s.ID] = true
+			goroutines, conns := s.Goroutines.Load(), s.Conns.Load()
+
+			if (cfg.SessionMaxGoroutines > 0 && goroutines > int64(cfg.SessionMaxGoroutines)) ||
+				(cfg.SessionMaxConns > 0 && conns > int64(cfg.SessionMaxConns)) {
+				log.Printf("Watchdog closed session %d (%s): %d goroutines, %d connections over limit",
+					s.ID, logUser(s.Username), goroutines, conns)
+				recordEvent(EventLimit, addrHost(s.conn.RemoteAddr()), s.Username,
+					fmt.Sprintf("%d goroutines, %d connections", goroutines, conns))
+				s.Kick()
+				continue
+			}
+
+			u, ok := usage[s.ID]
+			if !ok {
+				u = &sessionUsage{}
+				usage[s.ID] = u
+			}
+			if goroutines > u.goroutines {
+				u.growing++
+			} else {
+				u.growing, u.reported = 0, false
+			}
+			u.goroutines = goroutines
+			if u.growing >= watchdogGrowthChecks && !u.reported {
+				u.reported = true
+				log.Printf("Watchdog: session %d (%s) keeps growing: %d goroutines, %d connections, %d streams (process: %d goroutines, %d fds)",
+					s.ID, logUser(s.Username), goroutines, conns, s.Streams.Load(), runtime.NumGoroutine(), openFDs())
+			}
+		}
+		for id := range usage {
+			if !seen[id] {
+				delete(usage, id)
+			}
+		}
+	}
+}
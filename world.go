@@ -0,0 +1,57 @@
+package main
+
+const (
+	// Vanilla world timing constants (in ticks, 20 ticks per second)
+	ticksPerSecond = 20
+	ticksPerDay    = 24000
+
+	// Vanilla weather durations (in ticks)
+	minClearTicks = 12000
+	maxClearTicks = 180000
+	minRainTicks  = 12000
+	maxRainTicks  = 24000
+)
+
+// WorldClock simulates the world age, day/night cycle and weather of a session
+type WorldClock struct {
+	Age       int64 // Total ticks since world creation
+	TimeOfDay int64 // Ticks into the current day (0..23999)
+	Raining   bool
+
+	weatherTicks int64 // Ticks until the next weather change
+}
+
+func NewWorldClock() *WorldClock {
+	// Start at a random point of a long-running world, like joining an established server
+	age := int64(getSecureRandomInt(200))*ticksPerDay + int64(getRandomFloat()*ticksPerDay)
+	return &WorldClock{
+		Age:          age,
+		TimeOfDay:    age % ticksPerDay,
+		weatherTicks: randomTicks(minClearTicks, maxClearTicks),
+	}
+}
+
+// Advance moves the clock forward by the given number of ticks.
+// Returns true if the weather changed during this step.
+func (w *WorldClock) Advance(ticks int64) bool {
+	w.Age += ticks
+	w.TimeOfDay = (w.TimeOfDay + ticks) % ticksPerDay
+
+	w.weatherTicks -= ticks
+	if w.weatherTicks > 0 {
+		return false
+	}
+
+	w.Raining = !w.Raining
+	if w.Raining {
+		w.weatherTicks = randomTicks(minRainTicks, maxRainTicks)
+	} else {
+		w.weatherTicks = randomTicks(minClearTicks, maxClearTicks)
+	}
+	return true
+}
+
+// randomTicks returns a random duration between min and max ticks
+func randomTicks(min, max int64) int64 {
+	return min + int64(getRandomFloat()*float64(max-min))
+}